@@ -0,0 +1,147 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// addressField is the column added by -address.
+const addressField = "Address"
+
+// directionals are the USPS abbreviations of street directions.
+var directionals = map[string]string{
+	"NORTH": "N", "SOUTH": "S", "EAST": "E", "WEST": "W",
+	"NORTHEAST": "NE", "NORTHWEST": "NW", "SOUTHEAST": "SE", "SOUTHWEST": "SW",
+	"NO": "N", "SO": "S",
+}
+
+// streetSuffixes maps street types, spelled out or commonly abbreviated, to
+// their USPS standard abbreviations (Publication 28, appendix C1).
+var streetSuffixes = map[string]string{
+	"ALLEY":      "ALY",
+	"ALLY":       "ALY",
+	"AVENUE":     "AVE",
+	"AV":         "AVE",
+	"AVEN":       "AVE",
+	"AVN":        "AVE",
+	"BEND":       "BND",
+	"BLUFF":      "BLF",
+	"BOULEVARD":  "BLVD",
+	"BLV":        "BLVD",
+	"BOUL":       "BLVD",
+	"BRANCH":     "BR",
+	"BROOK":      "BRK",
+	"BYPASS":     "BYP",
+	"CIRCLE":     "CIR",
+	"CIRC":       "CIR",
+	"CRCL":       "CIR",
+	"COMMON":     "CMN",
+	"COURT":      "CT",
+	"CRT":        "CT",
+	"COVE":       "CV",
+	"CREEK":      "CRK",
+	"CROSSING":   "XING",
+	"CRSSNG":     "XING",
+	"DRIVE":      "DR",
+	"DRV":        "DR",
+	"ESTATES":    "ESTS",
+	"EXPRESSWAY": "EXPY",
+	"EXPWY":      "EXPY",
+	"EXTENSION":  "EXT",
+	"FORK":       "FRK",
+	"GARDENS":    "GDNS",
+	"GLEN":       "GLN",
+	"GREEN":      "GRN",
+	"GROVE":      "GRV",
+	"HARBOR":     "HBR",
+	"HEIGHTS":    "HTS",
+	"HT":         "HTS",
+	"HIGHWAY":    "HWY",
+	"HIWAY":      "HWY",
+	"HILL":       "HL",
+	"HILLS":      "HLS",
+	"HOLLOW":     "HOLW",
+	"ISLAND":     "IS",
+	"JUNCTION":   "JCT",
+	"KNOLL":      "KNL",
+	"LAKE":       "LK",
+	"LANDING":    "LNDG",
+	"LANE":       "LN",
+	"MANOR":      "MNR",
+	"MEADOW":     "MDW",
+	"MEADOWS":    "MDWS",
+	"MILL":       "ML",
+	"ORCHARD":    "ORCH",
+	"PARKWAY":    "PKWY",
+	"PKY":        "PKWY",
+	"PARKWY":     "PKWY",
+	"PINES":      "PNES",
+	"PLACE":      "PL",
+	"PLAZA":      "PLZ",
+	"POINT":      "PT",
+	"RIDGE":      "RDG",
+	"ROAD":       "RD",
+	"SHORE":      "SHR",
+	"SPRINGS":    "SPGS",
+	"SQUARE":     "SQ",
+	"STATION":    "STA",
+	"STREET":     "ST",
+	"STR":        "ST",
+	"STRT":       "ST",
+	"SUMMIT":     "SMT",
+	"TERRACE":    "TER",
+	"TERR":       "TER",
+	"TRACE":      "TRCE",
+	"TRAIL":      "TRL",
+	"TURNPIKE":   "TPKE",
+	"VALLEY":     "VLY",
+	"VIEW":       "VW",
+	"VILLAGE":    "VLG",
+	"VISTA":      "VIS",
+	"WOODS":      "WDS",
+}
+
+// normalizeAddress assembles a record's address fields (addressFields)
+// into one standardized string, following USPS conventions: upper case,
+// no punctuation, and standard abbreviations for directions and street
+// types, e.g. "123 N Main Street" becomes "123 N MAIN ST". It returns nil
+// when the record has no address.
+func normalizeAddress(record map[string]interface{}) interface{} {
+	var parts []string
+	for _, field := range addressFields {
+		s := addressPart(record[field])
+		switch field {
+		case "Dir", "Post_Dir":
+			if abbr, ok := directionals[s]; ok {
+				s = abbr
+			}
+		case "St_Type":
+			if abbr, ok := streetSuffixes[s]; ok {
+				s = abbr
+			}
+		}
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	if len(parts) == 0 {
+		return nil
+	}
+	return strings.Join(parts, " ")
+}
+
+// addressPart cleans one address field: upper case, with periods and
+// commas dropped and runs of spaces collapsed.
+func addressPart(value interface{}) string {
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return ""
+	}
+	s = strings.NewReplacer(".", "", ",", " ").Replace(strings.ToUpper(s))
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// ageChunkSize is the plaintext size of each age payload chunk.
+const ageChunkSize = 64 << 10
+
+// ageRecipient is an age X25519 public key, from an age1... recipient.
+type ageRecipient struct {
+	key *ecdh.PublicKey
+}
+
+// parseAgeRecipient decodes a Bech32 age1... recipient.
+func parseAgeRecipient(s string) (*ageRecipient, error) {
+	hrp, data, err := bech32Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("age recipient %q: %w", s, err)
+	}
+	if hrp != "age" || len(data) != 32 {
+		return nil, fmt.Errorf("age recipient %q: not an X25519 public key", s)
+	}
+	key, err := ecdh.X25519().NewPublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("age recipient %q: %w", s, err)
+	}
+	return &ageRecipient{key: key}, nil
+}
+
+// encryptAge writes src as an age v1 file (https://age-encryption.org/v1)
+// for the recipients.
+func encryptAge(w io.Writer, src io.Reader, recipients []*ageRecipient) error {
+	fileKey := make([]byte, 16)
+	rand.Read(fileKey)
+
+	var header strings.Builder
+	header.WriteString("age-encryption.org/v1\n")
+	for _, r := range recipients {
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		shared, err := ephemeral.ECDH(r.key)
+		if err != nil {
+			return err
+		}
+		share := ephemeral.PublicKey().Bytes()
+		salt := append(append([]byte(nil), share...), r.key.Bytes()...)
+		wrapKey, err := hkdf.Key(sha256.New, shared, salt, "age-encryption.org/v1/X25519", chacha20poly1305.KeySize)
+		if err != nil {
+			return err
+		}
+		wrap, err := chacha20poly1305.New(wrapKey)
+		if err != nil {
+			return err
+		}
+		body := wrap.Seal(nil, make([]byte, chacha20poly1305.NonceSize), fileKey, nil)
+		// The wrapped key is 43 characters, so it fits on one line.
+		fmt.Fprintf(&header, "-> X25519 %s\n%s\n", base64.RawStdEncoding.EncodeToString(share), base64.RawStdEncoding.EncodeToString(body))
+	}
+	header.WriteString("---")
+	macKey, err := hkdf.Key(sha256.New, fileKey, nil, "header", 32)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write([]byte(header.String()))
+	fmt.Fprintf(&header, " %s\n", base64.RawStdEncoding.EncodeToString(mac.Sum(nil)))
+	if _, err := io.WriteString(w, header.String()); err != nil {
+		return err
+	}
+
+	// The payload is the STREAM construction: chunks sealed with a counter
+	// nonce, the last one flagged so truncation is detected.
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	if _, err := w.Write(nonce); err != nil {
+		return err
+	}
+	payloadKey, err := hkdf.Key(sha256.New, fileKey, nonce, "payload", chacha20poly1305.KeySize)
+	if err != nil {
+		return err
+	}
+	aead, err := chacha20poly1305.New(payloadKey)
+	if err != nil {
+		return err
+	}
+	chunk := make([]byte, ageChunkSize)
+	next := make([]byte, ageChunkSize)
+	n, err := io.ReadFull(src, chunk)
+	for counter := uint64(0); ; counter++ {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		// A full chunk is the last one only if nothing follows it.
+		var m int
+		last := err != nil
+		if !last {
+			m, err = io.ReadFull(src, next)
+			last = m == 0 && err == io.EOF
+		}
+		chunkNonce := make([]byte, chacha20poly1305.NonceSize)
+		binary.BigEndian.PutUint64(chunkNonce[3:11], counter)
+		if last {
+			chunkNonce[11] = 1
+		}
+		if _, werr := w.Write(aead.Seal(nil, chunkNonce, chunk[:n], nil)); werr != nil {
+			return werr
+		}
+		if last {
+			return nil
+		}
+		chunk, next, n = next, chunk, m
+	}
+}
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// bech32Decode decodes a Bech32 string (BIP 173) into its human-readable
+// part and data bytes.
+func bech32Decode(s string) (string, []byte, error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, errors.New("mixed case")
+	}
+	s = strings.ToLower(s)
+	sep := strings.LastIndexByte(s, '1')
+	if sep < 1 || sep+7 > len(s) {
+		return "", nil, errors.New("not a Bech32 string")
+	}
+	hrp := s[:sep]
+	var values []byte
+	for _, c := range s[sep+1:] {
+		v := strings.IndexRune(bech32Charset, c)
+		if v < 0 {
+			return "", nil, fmt.Errorf("invalid character %q", c)
+		}
+		values = append(values, byte(v))
+	}
+
+	// The checksum is valid if the polymod of the expanded HRP and the
+	// values, checksum included, is 1.
+	var expanded []byte
+	for _, c := range []byte(hrp) {
+		expanded = append(expanded, c>>5)
+	}
+	expanded = append(expanded, 0)
+	for _, c := range []byte(hrp) {
+		expanded = append(expanded, c&31)
+	}
+	generator := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range append(expanded, values...) {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := range 5 {
+			if (top>>i)&1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+	}
+	if chk != 1 {
+		return "", nil, errors.New("invalid checksum")
+	}
+
+	// Regroup the 5-bit values, without the checksum, into bytes.
+	var data []byte
+	acc, n := uint32(0), 0
+	for _, v := range values[:len(values)-6] {
+		acc = acc<<5 | uint32(v)
+		n += 5
+		if n >= 8 {
+			n -= 8
+			data = append(data, byte(acc>>n))
+		}
+	}
+	if n >= 5 || acc&(1<<n-1) != 0 {
+		return "", nil, errors.New("invalid padding")
+	}
+	return hrp, data, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// The valid and invalid Bech32 strings of BIP 173.
+func TestBech32Decode(t *testing.T) {
+	valid := []string{
+		"A12UEL5L",
+		"a12uel5l",
+		"an83characterlonghumanreadablepartthatcontainsthenumber1andtheexcludedcharactersbio1tt5tgs",
+		"abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw",
+		"11qqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqc8247j",
+		"split1checkupstagehandshakeupstreamerranterredcaperred2y9e3w",
+		"?1ezyfcl",
+	}
+	for _, s := range valid {
+		if _, _, err := bech32Decode(s); err != nil {
+			t.Errorf("%s: %v", s, err)
+		}
+	}
+	invalid := []string{
+		"pzry9x0s0muk",  // no separator
+		"1pzry9x0s0muk", // empty human-readable part
+		"x1b4n0q5v",     // invalid data character
+		"li1dgmt3",      // checksum too short
+		"A1G7SGD8",      // checksum calculated with uppercase form of the human-readable part
+		"10a06t8",       // empty human-readable part
+		"1qzzfhee",      // empty human-readable part
+		"a12UEL5L",      // mixed case
+	}
+	for _, s := range invalid {
+		if _, _, err := bech32Decode(s); err == nil {
+			t.Errorf("%s: decoded", s)
+		}
+	}
+}
+
+// Files of every size around the 64 KiB chunks decrypt to what was
+// encrypted, following the age v1 spec independently of encryptAge.
+func TestEncryptAgeRoundTrip(t *testing.T) {
+	identity, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient, err := parseAgeRecipient(bech32Encode("age", identity.PublicKey().Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, ageChunkSize - 1, ageChunkSize, ageChunkSize + 1, 3*ageChunkSize + 7} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			plaintext := make([]byte, size)
+			rand.Read(plaintext)
+			var file bytes.Buffer
+			if err := encryptAge(&file, bytes.NewReader(plaintext), []*ageRecipient{recipient}); err != nil {
+				t.Fatal(err)
+			}
+			got, err := decryptAge(file.Bytes(), identity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Errorf("decrypted %d bytes, not the %d encrypted", len(got), len(plaintext))
+			}
+		})
+	}
+}
+
+// A run with -encrypt-to leaves only the encrypted output, which decrypts
+// to what -keep-plaintext keeps.
+func TestEncryptToRemovesPlaintext(t *testing.T) {
+	_, server := newFixtureServer(t)
+	identity, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient := bech32Encode("age", identity.PublicKey().Bytes())
+	fetch := func(extra ...string) string {
+		out := filepath.Join(t.TempDir(), "out.csv")
+		args := append([]string{
+			"-url", server.URL + "/FeatureServer/0", "-out", out, "-encrypt-to", recipient,
+			"-report", "", "-lock", "", "-provenance=false", "-progress", "off",
+		}, extra...)
+		if code := runFixtureFetch(t, args); code != exitOK {
+			t.Fatalf("fetch exited with %d", code)
+		}
+		return out
+	}
+
+	out := fetch()
+	if _, err := os.Stat(out); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("plaintext output left behind: %v", err)
+	}
+	file, err := os.ReadFile(out + ".age")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decryptAge(file, identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kept := fetch("-keep-plaintext")
+	want, err := os.ReadFile(kept)
+	if err != nil {
+		t.Fatalf("-keep-plaintext: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("the encrypted output decrypts to %d bytes, not the %d of the plaintext", len(got), len(want))
+	}
+}
+
+// decryptAge decrypts an age v1 file with one X25519 stanza.
+func decryptAge(file []byte, identity *ecdh.PrivateKey) ([]byte, error) {
+	headerEnd := bytes.Index(file, []byte("\n---"))
+	if headerEnd < 0 {
+		return nil, fmt.Errorf("no header")
+	}
+	macLine, payload, ok := bytes.Cut(file[headerEnd+1:], []byte("\n"))
+	if !ok {
+		return nil, fmt.Errorf("no payload")
+	}
+	lines := strings.Split(string(file[:headerEnd]), "\n")
+	if len(lines) != 3 || lines[0] != "age-encryption.org/v1" || !strings.HasPrefix(lines[1], "-> X25519 ") {
+		return nil, fmt.Errorf("unexpected header %q", lines)
+	}
+	share, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(lines[1], "-> X25519 "))
+	if err != nil {
+		return nil, err
+	}
+	body, err := base64.RawStdEncoding.DecodeString(lines[2])
+	if err != nil {
+		return nil, err
+	}
+	sharePub, err := ecdh.X25519().NewPublicKey(share)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := identity.ECDH(sharePub)
+	if err != nil {
+		return nil, err
+	}
+	salt := append(append([]byte(nil), share...), identity.PublicKey().Bytes()...)
+	wrapKey, err := hkdf.Key(sha256.New, shared, salt, "age-encryption.org/v1/X25519", chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	wrap, _ := chacha20poly1305.New(wrapKey)
+	fileKey, err := wrap.Open(nil, make([]byte, chacha20poly1305.NonceSize), body, nil)
+	if err != nil {
+		return nil, fmt.Errorf("file key: %w", err)
+	}
+
+	macKey, _ := hkdf.Key(sha256.New, fileKey, nil, "header", 32)
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(file[:headerEnd+4]) // up to and including "---"
+	want, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(string(macLine), "--- "))
+	if err != nil || !hmac.Equal(mac.Sum(nil), want) {
+		return nil, fmt.Errorf("header MAC does not verify")
+	}
+
+	if len(payload) < 16 {
+		return nil, fmt.Errorf("no payload nonce")
+	}
+	payloadKey, _ := hkdf.Key(sha256.New, fileKey, payload[:16], "payload", chacha20poly1305.KeySize)
+	aead, _ := chacha20poly1305.New(payloadKey)
+	payload = payload[16:]
+	var plaintext []byte
+	for counter := uint64(0); ; counter++ {
+		n := min(len(payload), ageChunkSize+aead.Overhead())
+		nonce := make([]byte, chacha20poly1305.NonceSize)
+		binary.BigEndian.PutUint64(nonce[3:11], counter)
+		last := n == len(payload)
+		if last {
+			nonce[11] = 1
+		}
+		chunk, err := aead.Open(nil, nonce, payload[:n], nil)
+		if err != nil {
+			return nil, fmt.Errorf("chunk %d: %w", counter, err)
+		}
+		plaintext = append(plaintext, chunk...)
+		payload = payload[n:]
+		if last {
+			return plaintext, nil
+		}
+	}
+}
+
+// bech32Encode encodes data as a Bech32 string (BIP 173).
+func bech32Encode(hrp string, data []byte) string {
+	var values []byte
+	acc, n := uint32(0), 0
+	for _, b := range data {
+		acc = acc<<8 | uint32(b)
+		n += 8
+		for n >= 5 {
+			n -= 5
+			values = append(values, byte(acc>>n)&31)
+		}
+	}
+	if n > 0 {
+		values = append(values, byte(acc<<(5-n))&31)
+	}
+	var expanded []byte
+	for _, c := range []byte(hrp) {
+		expanded = append(expanded, c>>5)
+	}
+	expanded = append(expanded, 0)
+	for _, c := range []byte(hrp) {
+		expanded = append(expanded, c&31)
+	}
+	generator := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range append(append(expanded, values...), 0, 0, 0, 0, 0, 0) {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := range 5 {
+			if (top>>i)&1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+	}
+	chk ^= 1
+	s := hrp + "1"
+	for _, v := range values {
+		s += string(bech32Charset[v])
+	}
+	for i := range 6 {
+		s += string(bech32Charset[(chk>>(5*(5-i)))&31])
+	}
+	return s
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxAlertRecords is how many matching records an alert carries in the run
+// report; the count covers them all.
+const maxAlertRecords = 50
+
+// An alertRule is an -alert condition, checked against each new record of
+// a run. Conditions use a small part of SQL:
+//
+//	Zip = 40203 OR Neighborhood = 'Shawnee'
+//	Sale_Price >= 100000 AND Purchaser LIKE '%bank%'
+//	Zip IN (40203, 40211) AND NOT Case_Style IS NULL
+//
+// The operators can also be written as in CEL or C, for -filter:
+//
+//	Sale_Price > 50000 && Neighborhood == "Portland"
+//
+// Text compares case-insensitively, values that are both numbers compare
+// as numbers, and date fields compare by their date (YYYY-MM-DD) in -tz.
+// Conditions see -hash-fields and -redact-fields unmasked.
+type alertRule struct {
+	text string
+	cond alertExpr
+}
+
+// AlertMatch is an -alert rule that new records of the run matched.
+type AlertMatch struct {
+	Rule    string              `json:"rule"`
+	Count   int                 `json:"count"`
+	Records []map[string]string `json:"records"` // the first maxAlertRecords, as written to the CSV
+}
+
+// parseAlertRules parses the -alert conditions. Field names are matched
+// case-insensitively against the output columns.
+func parseAlertRules(texts []string, columns []string) ([]*alertRule, error) {
+	var rules []*alertRule
+	for _, text := range texts {
+		cond, err := parseCondition(text, columns)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, &alertRule{text: strings.TrimSpace(text), cond: cond})
+	}
+	return rules, nil
+}
+
+// parseCondition parses an -alert or -filter condition.
+func parseCondition(text string, columns []string) (alertExpr, error) {
+	tokens, err := alertLexer.lex(text)
+	if err == nil && len(tokens) == 0 {
+		err = errors.New("empty condition")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", text, err)
+	}
+	p := &alertParser{columns: columns, tokenStream: tokenStream{tokens: tokens, end: len(text)}}
+	cond, err := p.or()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", text, err)
+	}
+	return cond, nil
+}
+
+// alerter collects the new records that match the -alert rules.
+type alerter struct {
+	rules     []*alertRule
+	headers   []string
+	formatter *Formatter
+	matches   []AlertMatch // one per rule
+}
+
+// newAlerter starts from the matches of a resumed run, if any.
+func newAlerter(rules []*alertRule, headers []string, f *Formatter, resumed []AlertMatch) *alerter {
+	a := &alerter{rules: rules, headers: headers, formatter: f, matches: make([]AlertMatch, len(rules))}
+	for i, rule := range rules {
+		a.matches[i].Rule = rule.text
+		for _, m := range resumed {
+			if m.Rule == rule.text {
+				a.matches[i] = m
+			}
+		}
+	}
+	return a
+}
+
+// observe checks a new record against the rules.
+func (a *alerter) observe(record map[string]interface{}) {
+	for i, rule := range a.rules {
+		if !rule.cond.eval(record, a.formatter) {
+			continue
+		}
+		m := &a.matches[i]
+		m.Count++
+		if len(m.Records) < maxAlertRecords {
+			row := make(map[string]string, len(a.headers))
+			for _, h := range a.headers {
+				row[h] = a.formatter.formatValue(h, record[h])
+			}
+			m.Records = append(m.Records, row)
+		}
+	}
+}
+
+// results returns the rules that matched at least one record.
+func (a *alerter) results() []AlertMatch {
+	var out []AlertMatch
+	for _, m := range a.matches {
+		if m.Count > 0 {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+type alertExpr interface {
+	eval(record map[string]interface{}, f *Formatter) bool
+}
+
+type andExpr struct{ left, right alertExpr }
+type orExpr struct{ left, right alertExpr }
+type notExpr struct{ expr alertExpr }
+
+func (e andExpr) eval(r map[string]interface{}, f *Formatter) bool {
+	return e.left.eval(r, f) && e.right.eval(r, f)
+}
+
+func (e orExpr) eval(r map[string]interface{}, f *Formatter) bool {
+	return e.left.eval(r, f) || e.right.eval(r, f)
+}
+
+func (e notExpr) eval(r map[string]interface{}, f *Formatter) bool { return !e.expr.eval(r, f) }
+
+// compareExpr compares a field with one or more literals: =, !=, <, <=, >,
+// >= and IN. A null field matches nothing.
+type compareExpr struct {
+	field  string
+	op     string
+	values []string
+}
+
+func (e compareExpr) eval(r map[string]interface{}, f *Formatter) bool {
+	raw := r[e.field]
+	if raw == nil {
+		return false
+	}
+	value := f.formatPlain(e.field, raw)
+	if dateFields[e.field] {
+		ms, ok := raw.(float64)
+		if !ok || ms == 0 {
+			return false
+		}
+		value = time.UnixMilli(int64(ms)).In(f.Location).Format("2006-01-02")
+	}
+	if e.op == "IN" {
+		for _, v := range e.values {
+			if compareValues(value, v, dateFields[e.field]) == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	c := compareValues(value, e.values[0], dateFields[e.field])
+	switch e.op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default: // >=
+		return c >= 0
+	}
+}
+
+// compareValues compares numerically when both values are numbers and as
+// case-insensitive text otherwise. Dates arrive as YYYY-MM-DD, which sorts
+// as text.
+func compareValues(a, b string, date bool) int {
+	if !date {
+		x, errX := strconv.ParseFloat(strings.TrimSpace(a), 64)
+		y, errY := strconv.ParseFloat(strings.TrimSpace(b), 64)
+		if errX == nil && errY == nil {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+}
+
+// likeExpr matches a field against a LIKE pattern, where % is any run of
+// characters and _ is any one character.
+type likeExpr struct {
+	field   string
+	pattern *regexp.Regexp
+}
+
+func (e likeExpr) eval(r map[string]interface{}, f *Formatter) bool {
+	raw := r[e.field]
+	return raw != nil && e.pattern.MatchString(f.formatPlain(e.field, raw))
+}
+
+// nullExpr is IS NULL; empty text counts as null too.
+type nullExpr struct{ field string }
+
+func (e nullExpr) eval(r map[string]interface{}, f *Formatter) bool {
+	raw := r[e.field]
+	return raw == nil || raw == ""
+}
+
+// alertOperators are the comparisons; <> is the same as !=.
+var alertOperators = map[string]bool{"=": true, "==": true, "!=": true, "<>": true, "<": true, "<=": true, ">": true, ">=": true}
+
+// cOperators are the keywords that can be written as in CEL or C.
+var cOperators = map[string]string{"&&": "AND", "||": "OR"}
+
+// alertParser is a recursive-descent parser for -alert conditions.
+type alertParser struct {
+	tokenStream
+	columns []string
+}
+
+func (p *alertParser) or() (alertExpr, error) {
+	left, err := p.and()
+	for err == nil && p.keyword("OR") {
+		var right alertExpr
+		if right, err = p.and(); err == nil {
+			left = orExpr{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *alertParser) and() (alertExpr, error) {
+	left, err := p.not()
+	for err == nil && p.keyword("AND") {
+		var right alertExpr
+		if right, err = p.not(); err == nil {
+			left = andExpr{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *alertParser) not() (alertExpr, error) {
+	if p.keyword("NOT") {
+		e, err := p.not()
+		return notExpr{e}, err
+	}
+	if p.punct("(") {
+		e, err := p.or()
+		if err == nil && !p.punct(")") {
+			err = errors.New("missing )")
+		}
+		return e, err
+	}
+	return p.predicate()
+}
+
+// predicate parses a field followed by a comparison, IN, LIKE or IS NULL.
+func (p *alertParser) predicate() (alertExpr, error) {
+	t := p.peek()
+	if t.kind != 'i' {
+		if t.text == "" {
+			return nil, errors.New("condition ends early")
+		}
+		return nil, fmt.Errorf("expected a field name, found %q", t.text)
+	}
+	p.pos++
+	field, err := p.column(t.text)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.keyword("IS") {
+		negate := p.keyword("NOT")
+		if !p.keyword("NULL") {
+			return nil, errors.New("expected NULL after IS")
+		}
+		var e alertExpr = nullExpr{field}
+		if negate {
+			e = notExpr{e}
+		}
+		return e, nil
+	}
+
+	negate := p.keyword("NOT")
+	var e alertExpr
+	switch {
+	case p.keyword("IN"):
+		if !p.punct("(") {
+			return nil, errors.New("expected ( after IN")
+		}
+		var values []string
+		for {
+			v, err := p.literal(field)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+			if p.punct(")") {
+				break
+			}
+			if !p.punct(",") {
+				return nil, errors.New("expected , or ) in IN list")
+			}
+		}
+		e = compareExpr{field: field, op: "IN", values: values}
+	case p.keyword("LIKE"):
+		pattern, err := p.literal("")
+		if err != nil {
+			return nil, err
+		}
+		e = likeExpr{field: field, pattern: likePattern(pattern)}
+	case negate:
+		return nil, errors.New("expected IN or LIKE after NOT")
+	default:
+		op := p.peek()
+		if op.kind != 'o' || !alertOperators[op.text] {
+			return nil, fmt.Errorf("expected an operator after %s", field)
+		}
+		p.pos++
+		v, err := p.literal(field)
+		if err != nil {
+			return nil, err
+		}
+		e = compareExpr{field: field, op: op.text, values: []string{v}}
+	}
+	if negate {
+		e = notExpr{e}
+	}
+	return e, nil
+}
+
+// literal parses a string or number. Literals compared with a date field
+// have to be dates.
+func (p *alertParser) literal(field string) (string, error) {
+	t := p.peek()
+	if t.kind != 's' && t.kind != 'n' {
+		return "", errors.New("expected a value")
+	}
+	p.pos++
+	if dateFields[field] {
+		if _, err := time.Parse("2006-01-02", t.text); err != nil {
+			return "", fmt.Errorf("%s: want a date as 'YYYY-MM-DD', not %q", field, t.text)
+		}
+	}
+	return t.text, nil
+}
+
+// column resolves a field name against the output columns.
+func (p *alertParser) column(name string) (string, error) {
+	for _, c := range p.columns {
+		if strings.EqualFold(c, name) {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("unknown field %q", name)
+}
+
+// likePattern compiles a LIKE pattern to a case-insensitive regexp.
+func likePattern(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("(?is)^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			b.WriteString(".*")
+		case '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+func isAlpha(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
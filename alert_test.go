@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCondition(t *testing.T) {
+	columns := []string{"Zip", "Neighborhood", "Sale_Price", "Sale_Date", "Purchaser", "Case_Style"}
+	record := map[string]interface{}{
+		"Zip":          float64(40203),
+		"Neighborhood": "Shawnee",
+		"Sale_Price":   float64(125000),
+		"Sale_Date":    float64(time.Date(2024, 6, 3, 4, 0, 0, 0, time.UTC).UnixMilli()),
+		"Purchaser":    "First Bank of KY",
+		"Case_Style":   nil,
+	}
+	f, err := newFormatter(&Options{DateFormat: "default"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		cond string
+		want bool
+	}{
+		{`Zip = 40203`, true},
+		{`zip = '40203.0'`, true},
+		{`Zip = 40203 AND Neighborhood = 'Portland'`, false},
+		{`Zip = 1 OR Neighborhood = 'shawnee'`, true},
+		{`Zip <> 40203`, false},
+		{`Zip IN (40211, 40203)`, true},
+		{`Zip NOT IN (40211, 40203)`, false},
+		{`Sale_Price >= 100000 AND Purchaser LIKE '%bank%'`, true},
+		{`Purchaser NOT LIKE 'First _ank%'`, false},
+		{`Case_Style IS NULL`, true},
+		{`NOT Case_Style IS NULL`, false},
+		{`Purchaser IS NOT NULL`, true},
+		{`Sale_Date >= '2024-06-01' AND Sale_Date < '2024-07-01'`, true},
+		{`NOT (Zip = 40203 OR Zip = 40211)`, false},
+		{`Sale_Price > 50000 && Neighborhood == "Shawnee"`, true},
+		{`!(Sale_Price > 50000) || Zip != 40203`, false},
+		{`Sale_Price > -1`, true},
+	}
+	for _, tt := range tests {
+		cond, err := parseCondition(tt.cond, columns)
+		if err != nil {
+			t.Errorf("%s: %v", tt.cond, err)
+			continue
+		}
+		if got := cond.eval(record, f); got != tt.want {
+			t.Errorf("%s = %t, want %t", tt.cond, got, tt.want)
+		}
+	}
+
+	errs := []struct {
+		cond string
+		want string
+	}{
+		{``, "empty condition"},
+		{`Zip =`, "expected a value"},
+		{`Zip = 1 AND`, "condition ends early"},
+		{`Owner = 'x'`, `unknown field "Owner"`},
+		{`Zip ~ 1`, `unexpected "~"`},
+		{`Zip 1`, "expected an operator after Zip"},
+		{`Zip IN (1, 2`, "expected , or ) in IN list"},
+		{`Zip NOT = 1`, "expected IN or LIKE after NOT"},
+		{`Case_Style IS 1`, "expected NULL after IS"},
+		{`(Zip = 1`, "missing )"},
+		{`Zip = 1 Zip`, `unexpected "Zip"`},
+		{`Sale_Date > '06/01/2024'`, "want a date as 'YYYY-MM-DD'"},
+		{`Purchaser = 'open`, "unterminated string"},
+	}
+	for _, tt := range errs {
+		_, err := parseCondition(tt.cond, columns)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want %q", tt.cond, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Client talks to an ArcGIS REST service. It wraps the HTTP client with
+// the settings every request needs, such as authentication.
+type Client struct {
+	HTTP    *http.Client
+	Tokens  TokenSource // nil for public services
+	DumpDir string      // -debug-http-dir: where responses that fail are saved; "" not to
+
+	received atomic.Int64 // response body bytes read by getJSON
+	dumps    atomic.Int64 // responses saved to DumpDir
+}
+
+// newClient builds a Client from the connection and authentication flags.
+func newClient(opts *Options) (*Client, error) {
+	headers, err := parseHeaders(opts.Headers)
+	if err != nil {
+		return nil, err
+	}
+	apiKey := opts.APIKey
+	if apiKey == "" {
+		apiKey = os.Getenv("ARCGIS_API_KEY")
+	}
+	if apiKey != "" {
+		headers.Set("X-Esri-Authorization", "Bearer "+apiKey)
+	}
+
+	base, err := newTransport(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var transport http.RoundTripper = base
+	if len(headers) > 0 {
+		transport = &headerTransport{base: transport, headers: headers}
+	}
+	if opts.Rate > 0 {
+		transport = &rateLimitTransport{base: transport, limiter: newRateLimiter(opts.Rate, 1)}
+	}
+	if opts.CacheDir != "" {
+		transport = &cachingTransport{base: transport, dir: opts.CacheDir}
+	}
+	if opts.DebugHTTP {
+		// Outermost, so it also logs the responses served from -cache-dir.
+		transport = &debugTransport{base: transport}
+	}
+
+	c := &Client{HTTP: &http.Client{Transport: transport, Timeout: opts.Timeout}, DumpDir: opts.DebugHTTPDir}
+
+	tokens, err := newTokenSource(opts, c.HTTP)
+	if err != nil {
+		return nil, err
+	}
+	c.Tokens = tokens
+	return c, nil
+}
+
+// HTTPStatusError reports a response with a status other than 200 OK.
+type HTTPStatusError struct {
+	Code int
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("status code %d", e.Code)
+}
+
+// ArcGISError is the error object the REST API returns, often with an
+// HTTP 200 status, in place of a normal response.
+type ArcGISError struct {
+	Code    int      `json:"code"`
+	Message string   `json:"message"`
+	Details []string `json:"details"`
+}
+
+func (e *ArcGISError) Error() string {
+	msg := fmt.Sprintf("arcgis error %d: %s", e.Code, e.Message)
+	if len(e.Details) > 0 {
+		msg += " (" + strings.Join(e.Details, "; ") + ")"
+	}
+	return msg
+}
+
+// UnmarshalJSON accepts the variations servers send: a code as a string
+// ("500"), details as a single string, and a description in place of a
+// missing message.
+func (e *ArcGISError) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Code        json.Number     `json:"code"`
+		Message     string          `json:"message"`
+		Description string          `json:"description"`
+		Details     json.RawMessage `json:"details"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("invalid error object: %w", err)
+	}
+	code, _ := strconv.Atoi(raw.Code.String())
+	*e = ArcGISError{Code: code, Message: cmp.Or(raw.Message, raw.Description)}
+	if json.Unmarshal(raw.Details, &e.Details) != nil {
+		var detail string
+		if json.Unmarshal(raw.Details, &detail) == nil && detail != "" {
+			e.Details = []string{detail}
+		}
+	}
+	return nil
+}
+
+// invalidToken reports whether the server rejected the request's token
+// (498) or wanted one that was not sent (499).
+func (e *ArcGISError) invalidToken() bool {
+	return e.Code == 498 || e.Code == 499
+}
+
+// retryable reports whether the request might succeed if made again:
+// server errors, which ArcGIS also reports for a query that timed out or
+// ran out of memory, and throttling. An error without a code is taken to
+// be one of them. Any other code, such as 400 for an invalid where clause,
+// or 403 and 404, fails the same way every time.
+func (e *ArcGISError) retryable() bool {
+	return e.Code == 0 || e.Code >= 500 || e.Code == http.StatusTooManyRequests
+}
+
+// rejected reports whether err is an error object that no retry or
+// smaller page will get past, so every page of the query would fail.
+// A rejected token is not: the client refreshes it.
+func rejected(err error) bool {
+	var apiErr *ArcGISError
+	return errors.As(err, &apiErr) && !apiErr.retryable() && !apiErr.invalidToken()
+}
+
+// getJSON issues a GET request against an ArcGIS REST endpoint and decodes
+// the JSON response into v. If the server rejects the token, the token is
+// refreshed and the request retried once. Cancelling ctx aborts the request.
+func (c *Client) getJSON(ctx context.Context, endpoint string, params url.Values, v interface{}) error {
+	return c.get(ctx, endpoint, params, decodeJSONInto(v))
+}
+
+// postJSON is getJSON with the parameters, and the token, in a form body:
+// for operations such as createReplica that change state on the server,
+// and that the REST API only accepts as POST.
+func (c *Client) postJSON(ctx context.Context, endpoint string, params url.Values, v interface{}) error {
+	return c.send(ctx, http.MethodPost, endpoint, params, decodeJSONInto(v))
+}
+
+// decodeJSONInto returns a decode function for get that decodes the
+// response into v.
+func decodeJSONInto(v interface{}) func(io.Reader) error {
+	return func(r io.Reader) error {
+		body, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return decodeResponse(body, v)
+	}
+}
+
+// get requests endpoint and hands the response body to decode, retrying
+// once with a fresh token if the server rejects the current one. decode
+// may be called twice, so it must reset anything it accumulates.
+func (c *Client) get(ctx context.Context, endpoint string, params url.Values, decode func(io.Reader) error) error {
+	return c.send(ctx, http.MethodGet, endpoint, params, decode)
+}
+
+// send is get with the request method: GET puts the parameters in the
+// URL, POST in a form body.
+func (c *Client) send(ctx context.Context, method, endpoint string, params url.Values, decode func(io.Reader) error) error {
+	err := c.sendOnce(ctx, method, endpoint, params, decode)
+
+	var apiErr *ArcGISError
+	if c.Tokens != nil && errors.As(err, &apiErr) && apiErr.invalidToken() {
+		if refreshErr := c.Tokens.Refresh(ctx); refreshErr != nil {
+			return fmt.Errorf("%w; token refresh failed: %v", err, refreshErr)
+		}
+		err = c.sendOnce(ctx, method, endpoint, params, decode)
+	}
+	return err
+}
+
+func (c *Client) sendOnce(ctx context.Context, method, endpoint string, params url.Values, decode func(io.Reader) error) error {
+	if c.Tokens != nil {
+		token, err := c.Tokens.Token(ctx)
+		if err != nil {
+			return fmt.Errorf("getting token: %w", err)
+		}
+		params = cloneValues(params)
+		params.Set("token", token)
+	}
+	var form io.Reader
+	if method == http.MethodPost {
+		form = strings.NewReader(params.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, form)
+	if err != nil {
+		return err
+	}
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req.URL.RawQuery = params.Encode()
+	}
+
+	slog.Debug("request", "method", method, "url", cacheURL(req))
+
+	_, sp := startSpan(ctx, "HTTP "+method, "http.method", method, "url.full", cacheURL(req))
+	defer sp.finish()
+	if sp != nil {
+		sp.kind = 3 // client
+		req.Header.Set("traceparent", sp.traceparent())
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		// The error carries the URL, and with it the token, into the logs,
+		// the run report and the notifications.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = cacheURL(req)
+		}
+		sp.fail(err)
+		return err
+	}
+	defer resp.Body.Close()
+	sp.set("http.status_code", resp.StatusCode)
+
+	if resp.StatusCode != http.StatusOK {
+		err := &HTTPStatusError{Code: resp.StatusCode}
+		if c.DumpDir != "" {
+			data, _ := io.ReadAll(resp.Body)
+			c.dumpResponse(req, resp, data, err)
+		}
+		sp.fail(err)
+		return err
+	}
+
+	body := &countingReader{r: resp.Body}
+	// With -debug-http-dir the body is kept, to be saved if it turns out
+	// to hold an error object or cannot be decoded.
+	var kept bytes.Buffer
+	if c.DumpDir != "" {
+		body.r = io.TeeReader(resp.Body, &kept)
+	}
+	err = decode(body)
+	c.received.Add(body.n)
+	sp.set("http.response.body.size", body.n)
+	sp.fail(err)
+	if err != nil && c.DumpDir != "" && ctx.Err() == nil {
+		// The decoder stops at the first error; save the rest too.
+		io.Copy(io.Discard, body.r)
+		c.dumpResponse(req, resp, kept.Bytes(), err)
+	}
+	return err
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// BytesReceived reports how many bytes of response bodies the client has
+// read, after decompression.
+func (c *Client) BytesReceived() int64 {
+	return c.received.Load()
+}
+
+// decodeBody reads the whole response body and decodes it with decodeResponse.
+func decodeBody(resp *http.Response, v interface{}) error {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(body, v)
+}
+
+// decodeResponse decodes a JSON response body, returning the ArcGIS error
+// object as an error if the server sent one instead of a result.
+func decodeResponse(body []byte, v interface{}) error {
+	var envelope struct {
+		Error *ArcGISError `json:"error"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return err
+	}
+	if envelope.Error != nil {
+		return envelope.Error
+	}
+	return json.Unmarshal(body, v)
+}
+
+func cloneValues(v url.Values) url.Values {
+	out := make(url.Values, len(v))
+	for key, values := range v {
+		out[key] = append([]string(nil), values...)
+	}
+	return out
+}
+
+// LayerInfo is the subset of a feature layer's metadata (the layer
+// endpoint with f=json) that the fetcher uses.
+type LayerInfo struct {
+	Name                  string         `json:"name"`
+	Type                  string         `json:"type"`
+	MaxRecordCount        int            `json:"maxRecordCount"`
+	SupportedQueryFormats string         `json:"supportedQueryFormats"`
+	GeometryType          string         `json:"geometryType"`
+	Capabilities          string         `json:"capabilities"`
+	ObjectIDField         string         `json:"objectIdField"`
+	HasAttachments        bool           `json:"hasAttachments"`
+	Relationships         []Relationship `json:"relationships"`
+	Fields                []FieldInfo    `json:"fields"`
+
+	EditingInfo struct {
+		LastEditDate int64 `json:"lastEditDate"` // epoch milliseconds
+	} `json:"editingInfo"`
+}
+
+// supportsFormat reports whether the layer lists a format among its
+// supportedQueryFormats, e.g. "JSON, geoJSON, PBF".
+func (l *LayerInfo) supportsFormat(format string) bool {
+	for _, f := range strings.Split(l.SupportedQueryFormats, ",") {
+		if strings.EqualFold(strings.TrimSpace(f), format) {
+			return true
+		}
+	}
+	return false
+}
+
+// FieldInfo describes one attribute field of a layer.
+type FieldInfo struct {
+	Name     string       `json:"name"`
+	Type     string       `json:"type"`
+	Alias    string       `json:"alias"`
+	Length   int          `json:"length"`
+	Nullable *bool        `json:"nullable"`
+	Domain   *FieldDomain `json:"domain"`
+}
+
+// FieldDomain restricts the values of a field: a list of codes with
+// descriptions (codedValue), or a numeric range.
+type FieldDomain struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	CodedValues []struct {
+		Name string      `json:"name"`
+		Code interface{} `json:"code"`
+	} `json:"codedValues"`
+	Range []float64 `json:"range"`
+}
+
+// layerURL returns the layer endpoint for a query URL.
+func layerURL(queryURL string) string {
+	return strings.TrimSuffix(queryURL, "/query")
+}
+
+// queryURL normalizes a -url value, which may name either the layer or its
+// query endpoint, to the query endpoint.
+func queryURL(u string) string {
+	u = strings.TrimRight(strings.TrimSpace(u), "/")
+	if strings.HasSuffix(u, "/query") {
+		return u
+	}
+	return u + "/query"
+}
+
+// fetchLayerInfo reads the layer metadata.
+func fetchLayerInfo(ctx context.Context, client *Client, endpoint string) (*LayerInfo, error) {
+	var info LayerInfo
+	if err := client.getJSON(ctx, layerURL(endpoint), url.Values{"f": {"json"}}, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// fetchCount asks the server how many features match the query.
+func fetchCount(ctx context.Context, client *Client, query *Query) (int, error) {
+	params := query.params()
+	params.Del("orderByFields")
+	params.Set("returnCountOnly", "true")
+
+	var result struct {
+		Count *int `json:"count"`
+	}
+	if err := client.getJSON(ctx, query.URL, params, &result); err != nil {
+		return 0, err
+	}
+	if result.Count == nil {
+		return 0, fmt.Errorf("count response is missing the count")
+	}
+	return *result.Count, nil
+}
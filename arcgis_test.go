@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetErrorOmitsToken(t *testing.T) {
+	const token = "s3cr3t-t0ken"
+	c := &Client{
+		HTTP:   &http.Client{Timeout: 5 * time.Second},
+		Tokens: staticToken(token),
+	}
+	// Nothing listens on port 1, so the request fails before any response.
+	err := c.getJSON(context.Background(), "http://127.0.0.1:1/arcgis/rest/services/x/FeatureServer/0/query",
+		url.Values{"where": {"1=1"}, "f": {"json"}}, new(QueryResult))
+	if err == nil {
+		t.Fatal("request to 127.0.0.1:1 succeeded")
+	}
+	if strings.Contains(err.Error(), token) {
+		t.Errorf("error contains the token: %v", err)
+	}
+	if !strings.Contains(err.Error(), "where=1%3D1") {
+		t.Errorf("error lost the rest of the URL: %v", err)
+	}
+}
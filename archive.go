@@ -0,0 +1,180 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// dictionaryFiles are the names the schema subcommand is documented to
+// write its dictionary to; archive picks up whichever exist.
+var dictionaryFiles = []string{"dictionary.md", "dictionary.csv", "dictionary.json"}
+
+// runArchive implements the archive subcommand, which bundles the latest
+// run into one dated zip for delivery: the outputs, -related and -delta
+// files from the run report, their provenance and CSVW sidecars, the
+// report itself, and the checksums, data package and data dictionary if
+// they were written:
+//
+//	go run . archive -out data/foreclosures_2025-06-01.zip
+func runArchive(args []string) int {
+	fs := flag.NewFlagSet("archive", flag.ExitOnError)
+	var opts Options
+	opts.registerLogging(fs)
+	reportPath := fs.String("report", filepath.Join(outputDir, defaultReportFile), "run report listing the files of the run")
+	out := fs.String("out", "", "zip file to write (default <output>_<date of the run>.zip in "+outputDir+")")
+	var include listFlag
+	fs.Var(&include, "include", "also add this file to the archive; repeatable")
+	fs.Parse(args)
+	if err := setupLogging(&opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFatal
+	}
+
+	files, finished, err := archiveFiles(*reportPath)
+	if err != nil {
+		slog.Error("cannot read run report", "path", *reportPath, "err", err)
+		return exitFatal
+	}
+	for _, path := range include {
+		if _, err := os.Stat(path); err != nil {
+			slog.Error("cannot add file", "err", err)
+			return exitFatal
+		}
+		if !slices.Contains(files, path) {
+			files = append(files, path)
+		}
+	}
+
+	if *out == "" {
+		name := strings.TrimSuffix(outputFile, filepath.Ext(outputFile))
+		*out = filepath.Join(outputDir, name+"_"+finished.Local().Format(time.DateOnly)+".zip")
+	}
+	if err := writeArchive(*out, files); err != nil {
+		slog.Error("cannot write archive", "path", *out, "err", err)
+		return exitFatal
+	}
+	slog.Info("archive saved", "path", *out, "files", len(files))
+	return exitOK
+}
+
+// archiveFiles lists the files of the run in the report and when it
+// finished. The outputs have to exist; the sidecars are added if they do.
+func archiveFiles(reportPath string) ([]string, time.Time, error) {
+	raw, err := os.ReadFile(reportPath)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var report RunReport
+	if err := json.Unmarshal(raw, &report); err != nil {
+		return nil, time.Time{}, err
+	}
+	if len(report.Outputs) == 0 {
+		return nil, time.Time{}, errors.New("the run wrote no outputs")
+	}
+
+	var files []string
+	add := func(path string, required bool) error {
+		if _, err := os.Stat(path); err != nil {
+			if required || !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			return nil
+		}
+		if !slices.Contains(files, path) {
+			files = append(files, path)
+		}
+		return nil
+	}
+	for _, output := range report.Outputs {
+		if err := add(output.Path, true); err != nil {
+			return nil, time.Time{}, err
+		}
+		add(output.Path+provenanceSuffix, false)
+		add(output.Path+csvwSuffix, false)
+	}
+	for _, related := range report.Related {
+		add(related.Path, false)
+	}
+	if report.Delta != nil {
+		add(report.Delta.Path, false)
+	}
+	if report.Quarantine != nil {
+		add(report.Quarantine.Path, false)
+	}
+	add(reportPath, true)
+	add(filepath.Join(outputDir, checksumFile), false)
+	add(filepath.Join(outputDir, dataPackageFile), false)
+	for _, name := range dictionaryFiles {
+		add(filepath.Join(outputDir, name), false)
+	}
+	return files, report.FinishedAt, nil
+}
+
+// writeArchive zips the files via a temporary file. Files in the output
+// directory keep their path relative to it, so the manifests inside still
+// name them correctly once unpacked; others are stored by base name.
+func writeArchive(path string, files []string) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(file)
+	for _, name := range files {
+		if err = addToArchive(zw, name); err != nil {
+			break
+		}
+	}
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func addToArchive(zw *zip.Writer, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.Base(path)
+	if rel, err := filepath.Rel(outputDir, path); err == nil && !strings.HasPrefix(rel, "..") {
+		header.Name = filepath.ToSlash(rel)
+	}
+	header.Method = zip.Deflate
+	w, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, src)
+	return err
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"cmp"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// areaFields are the groupings of -area-summary: the neighborhood and the
+// Metro Council district.
+var areaFields = []string{neighborhoodField, "CD"}
+
+// writeAreaSummary writes, for each neighborhood and each council
+// district of the outputs, the number of records and sales, the median
+// sale price and the first and last filing date. It reads the outputs
+// back, so the file covers a resumed or -merge run's whole output.
+func (j *fetchJob) writeAreaSummary(path string, outputs []string) error {
+	ds, column, err := j.loadOutputs(outputs)
+	if err != nil {
+		return err
+	}
+	f := j.formatter
+	filed := ds.dates[ds.dateColumn]
+	sold := ds.dates[column(saleDateField)]
+	price := column(salePriceField)
+
+	first, last := "first_filed", "last_filed"
+	if ds.dateColumn != "" {
+		first, last = "first_"+ds.dateColumn, "last_"+ds.dateColumn
+	}
+	rows := [][]string{{"area", "value", "records", "sales", "median_sale_price", first, last}}
+	for _, field := range areaFields {
+		area := column(field)
+		if area == "" {
+			continue
+		}
+		type group struct {
+			records, sales int
+			prices         []float64
+			first, last    time.Time
+		}
+		groups := make(map[string]*group)
+		for i, rec := range ds.records {
+			g := groups[rec[area]]
+			if g == nil {
+				g = &group{}
+				groups[rec[area]] = g
+			}
+			g.records++
+			if sold != nil && !sold[i].IsZero() {
+				g.sales++
+			}
+			// $0 and missing prices are not sales for the median.
+			if n, ok := f.parseNumber(rec[price]); ok && price != "" && n > 0 {
+				g.prices = append(g.prices, n)
+			}
+			if filed != nil && !filed[i].IsZero() {
+				if g.first.IsZero() || filed[i].Before(g.first) {
+					g.first = filed[i]
+				}
+				if filed[i].After(g.last) {
+					g.last = filed[i]
+				}
+			}
+		}
+
+		values := slices.Collect(maps.Keys(groups))
+		slices.SortFunc(values, compareAreas)
+		for _, value := range values {
+			g := groups[value]
+			row := []string{area, value, strconv.Itoa(g.records), strconv.Itoa(g.sales), "", "", ""}
+			if len(g.prices) > 0 {
+				row[4] = strconv.FormatFloat(median(g.prices), 'f', -1, 64)
+			}
+			if !g.first.IsZero() {
+				row[5] = g.first.In(f.Location).Format(time.DateOnly)
+				row[6] = g.last.In(f.Location).Format(time.DateOnly)
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	file, err := openPartial(path, false)
+	if err != nil {
+		return err
+	}
+	w := newCSVWriter(file, j.dialect)
+	for _, row := range rows {
+		w.Write(row, nil)
+	}
+	err = w.Flush()
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return commitPartials([]string{path})
+}
+
+// compareAreas orders district numbers numerically and names
+// alphabetically, with the records without one last.
+func compareAreas(a, b string) int {
+	if (a == "") != (b == "") {
+		if a == "" {
+			return 1
+		}
+		return -1
+	}
+	na, errA := strconv.Atoi(a)
+	nb, errB := strconv.Atoi(b)
+	if errA == nil && errB == nil {
+		return cmp.Compare(na, nb)
+	}
+	return cmp.Compare(a, b)
+}
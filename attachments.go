@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// attachmentManifest is the CSV that -attachments writes next to the
+// downloaded files, listing every attachment with its feature.
+const attachmentManifest = "attachments.csv"
+
+// attachmentBatch is how many ObjectIds each queryAttachments request
+// asks about.
+const attachmentBatch = 100
+
+// AttachmentInfo is one attachment of a feature, as listed by the
+// queryAttachments and attachments endpoints.
+type AttachmentInfo struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+	Keywords    string `json:"keywords"`
+}
+
+// attachmentFetcher downloads the attachments (photos, scanned documents)
+// of the features a run wrote into dir/<ObjectId>/, for -attachments.
+// Files already there with the listed size are kept, so a scheduled run
+// only downloads new attachments.
+type attachmentFetcher struct {
+	client  *Client
+	layer   string // layer endpoint
+	dir     string
+	workers int
+}
+
+// AttachmentSummary counts what a fetch of the attachments did.
+type AttachmentSummary struct {
+	Features    int // features with at least one attachment
+	Attachments int
+	Downloaded  int
+	Failed      int
+}
+
+// fetch lists and downloads the attachments of the features with the
+// given ObjectIds and writes the manifest. Attachments that cannot be
+// downloaded are logged, counted and left out of the manifest.
+func (a *attachmentFetcher) fetch(ctx context.Context, ids []int64) (*AttachmentSummary, error) {
+	infos, err := a.list(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	type download struct {
+		oid  int64
+		info AttachmentInfo
+		path string
+		sum  string
+		err  error
+	}
+	var downloads []*download
+	for _, oid := range ids {
+		for _, info := range infos[oid] {
+			downloads = append(downloads, &download{oid: oid, info: info, path: a.path(oid, info)})
+		}
+	}
+
+	var mu sync.Mutex
+	summary := &AttachmentSummary{Features: len(infos), Attachments: len(downloads)}
+	work := make(chan *download)
+	var wg sync.WaitGroup
+	for range max(a.workers, 1) {
+		wg.Go(func() {
+			for d := range work {
+				fetched, err := a.download(ctx, d.oid, d.info, d.path)
+				if err == nil {
+					d.sum, err = fileSHA256(d.path)
+				}
+				d.err = err
+				mu.Lock()
+				if fetched {
+					summary.Downloaded++
+				}
+				if err != nil {
+					summary.Failed++
+				}
+				mu.Unlock()
+			}
+		})
+	}
+	for _, d := range downloads {
+		work <- d
+	}
+	close(work)
+	wg.Wait()
+
+	rows := [][]string{{"ObjectId", "AttachmentId", "Name", "ContentType", "Size", "Keywords", "Path", "SHA256"}}
+	for _, d := range downloads {
+		if d.err != nil {
+			slog.Warn("cannot download attachment", "objectId", d.oid, "attachment", d.info.ID, "err", d.err)
+			continue
+		}
+		rel, _ := filepath.Rel(a.dir, d.path)
+		rows = append(rows, []string{
+			strconv.FormatInt(d.oid, 10), strconv.FormatInt(d.info.ID, 10), d.info.Name, d.info.ContentType,
+			strconv.FormatInt(d.info.Size, 10), d.info.Keywords, filepath.ToSlash(rel), d.sum,
+		})
+	}
+	return summary, writeCSVFile(filepath.Join(a.dir, attachmentManifest), rows)
+}
+
+// list returns the attachments of each feature that has any. It asks
+// queryAttachments about many features at once, and falls back to one
+// request per feature on servers older than 10.8 that lack it.
+func (a *attachmentFetcher) list(ctx context.Context, ids []int64) (map[int64][]AttachmentInfo, error) {
+	infos := make(map[int64][]AttachmentInfo)
+	for batch := range slices.Chunk(ids, attachmentBatch) {
+		oids := make([]string, len(batch))
+		for i, id := range batch {
+			oids[i] = strconv.FormatInt(id, 10)
+		}
+		var result struct {
+			AttachmentGroups []struct {
+				ParentObjectID  int64            `json:"parentObjectId"`
+				AttachmentInfos []AttachmentInfo `json:"attachmentInfos"`
+			} `json:"attachmentGroups"`
+		}
+		params := url.Values{"f": {"json"}, "objectIds": {strings.Join(oids, ",")}}
+		err := a.client.getJSON(ctx, a.layer+"/queryAttachments", params, &result)
+		var apiErr *ArcGISError
+		var statusErr *HTTPStatusError
+		if len(infos) == 0 && (errors.As(err, &apiErr) || errors.As(err, &statusErr)) {
+			slog.Info("queryAttachments is not supported; listing attachments one feature at a time", "err", err)
+			return a.listEach(ctx, ids)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range result.AttachmentGroups {
+			if len(group.AttachmentInfos) > 0 {
+				infos[group.ParentObjectID] = append(infos[group.ParentObjectID], group.AttachmentInfos...)
+			}
+		}
+	}
+	return infos, nil
+}
+
+// listEach lists the attachments with the per-feature endpoint.
+func (a *attachmentFetcher) listEach(ctx context.Context, ids []int64) (map[int64][]AttachmentInfo, error) {
+	infos := make(map[int64][]AttachmentInfo)
+	for _, oid := range ids {
+		var result struct {
+			AttachmentInfos []AttachmentInfo `json:"attachmentInfos"`
+		}
+		endpoint := fmt.Sprintf("%s/%d/attachments", a.layer, oid)
+		if err := a.client.getJSON(ctx, endpoint, url.Values{"f": {"json"}}, &result); err != nil {
+			return nil, fmt.Errorf("ObjectId %d: %w", oid, err)
+		}
+		if len(result.AttachmentInfos) > 0 {
+			infos[oid] = result.AttachmentInfos
+		}
+	}
+	return infos, nil
+}
+
+// path is where an attachment is saved: dir/<ObjectId>/<id>_<name>. The
+// attachment id keeps two files of the same name apart.
+func (a *attachmentFetcher) path(oid int64, info AttachmentInfo) string {
+	name := strings.Map(func(r rune) rune {
+		if r < ' ' || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, info.Name)
+	if name == "" || name == "." || name == ".." {
+		name = "attachment"
+	}
+	return filepath.Join(a.dir, strconv.FormatInt(oid, 10), fmt.Sprintf("%d_%s", info.ID, name))
+}
+
+// download saves one attachment via a temporary file, unless a file of
+// the listed size is already there. It reports whether it downloaded.
+func (a *attachmentFetcher) download(ctx context.Context, oid int64, info AttachmentInfo, path string) (bool, error) {
+	if st, err := os.Stat(path); err == nil && info.Size > 0 && st.Size() == info.Size {
+		return false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return false, err
+	}
+
+	tmp := path + ".tmp"
+	endpoint := fmt.Sprintf("%s/%d/attachments/%d", a.layer, oid, info.ID)
+	err := a.client.get(ctx, endpoint, url.Values{}, func(r io.Reader) error {
+		file, err := os.Create(tmp)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, r)
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	})
+	if err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	return true, os.Rename(tmp, path)
+}
+
+// objectIDs reads the ObjectIds of the outputs, from the named column.
+func objectIDs(paths []string, comma rune, name string) ([]int64, error) {
+	var ids []int64
+	for _, path := range paths {
+		column, err := readColumn(path, comma, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, value := range column {
+			id, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s %q is not an integer", path, idField, value)
+			}
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// writeCSVFile writes rows to a CSV file via a temporary file.
+func writeCSVFile(path string, rows [][]string) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(file)
+	w.WriteAll(rows)
+	err = w.Error()
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultTokenURL is the ArcGIS Online token endpoint. Enterprise portals
+// use <portal>/sharing/rest/generateToken instead.
+const defaultTokenURL = "https://www.arcgis.com/sharing/rest/generateToken"
+
+// defaultOAuthURL is the ArcGIS Online OAuth2 token endpoint used for
+// app logins (client credentials).
+const defaultOAuthURL = "https://www.arcgis.com/sharing/rest/oauth2/token"
+
+// TokenSource supplies the token appended to each request.
+type TokenSource interface {
+	// Token returns the current token, obtaining one if needed.
+	Token(ctx context.Context) (string, error)
+	// Refresh discards the current token after the server rejected it.
+	Refresh(ctx context.Context) error
+}
+
+// newTokenSource picks the token source from the flags: an OAuth2 app
+// login from -client-id and ARCGIS_CLIENT_SECRET, a token generated from
+// -username and ARCGIS_PASSWORD, or a fixed -token. The first two are
+// renewed when they expire. It returns nil for anonymous access.
+func newTokenSource(opts *Options, client *http.Client) (TokenSource, error) {
+	clientID := opts.ClientID
+	if clientID == "" {
+		clientID = os.Getenv("ARCGIS_CLIENT_ID")
+	}
+	if clientID != "" {
+		secret := os.Getenv("ARCGIS_CLIENT_SECRET")
+		if secret == "" {
+			return nil, fmt.Errorf("-client-id requires the ARCGIS_CLIENT_SECRET environment variable")
+		}
+		return &oauthToken{
+			client:   client,
+			tokenURL: opts.OAuthURL,
+			clientID: clientID,
+			secret:   secret,
+		}, nil
+	}
+
+	token := opts.Token
+	if token == "" {
+		token = os.Getenv("ARCGIS_TOKEN")
+	}
+
+	username := opts.Username
+	if username == "" {
+		username = os.Getenv("ARCGIS_USERNAME")
+	}
+
+	if username != "" {
+		password := os.Getenv("ARCGIS_PASSWORD")
+		if password == "" {
+			return nil, fmt.Errorf("-username requires the ARCGIS_PASSWORD environment variable")
+		}
+		return &generatedToken{
+			client:   client,
+			tokenURL: opts.TokenURL,
+			username: username,
+			password: password,
+			token:    token,
+		}, nil
+	}
+
+	if token != "" {
+		return staticToken(token), nil
+	}
+	return nil, nil
+}
+
+// staticToken is a token passed on the command line. It cannot be renewed.
+type staticToken string
+
+func (t staticToken) Token(ctx context.Context) (string, error) { return string(t), nil }
+
+func (t staticToken) Refresh(ctx context.Context) error {
+	return fmt.Errorf("the token was rejected; pass a new -token or use -username to generate one")
+}
+
+// generatedToken obtains short-lived tokens from a generateToken endpoint.
+type generatedToken struct {
+	client   *http.Client
+	tokenURL string
+	username string
+	password string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// tokenLifetime is the expiration requested from generateToken, in minutes.
+const tokenLifetime = 60
+
+func (g *generatedToken) Token(ctx context.Context) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// Renew a minute early so a token does not expire mid-request.
+	if g.token != "" && (g.expires.IsZero() || time.Now().Before(g.expires.Add(-time.Minute))) {
+		return g.token, nil
+	}
+	if err := g.generate(ctx); err != nil {
+		return "", err
+	}
+	return g.token, nil
+}
+
+func (g *generatedToken) Refresh(ctx context.Context) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.generate(ctx)
+}
+
+// generate requests a new token. The caller must hold g.mu.
+func (g *generatedToken) generate(ctx context.Context) error {
+	form := url.Values{
+		"username":   {g.username},
+		"password":   {g.password},
+		"client":     {"requestip"},
+		"expiration": {fmt.Sprint(tokenLifetime)},
+		"f":          {"json"},
+	}
+
+	resp, err := postForm(ctx, g.client, g.tokenURL, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("generateToken: status code %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Token   string `json:"token"`
+		Expires int64  `json:"expires"` // epoch milliseconds
+	}
+	if err := decodeBody(resp, &result); err != nil {
+		return fmt.Errorf("generateToken: %w", err)
+	}
+	if result.Token == "" {
+		return fmt.Errorf("generateToken: no token in response")
+	}
+
+	g.token = result.Token
+	g.expires = time.UnixMilli(result.Expires)
+	return nil
+}
+
+// oauthToken obtains application tokens with the OAuth2 client credentials
+// grant, so the tool can authenticate as a registered app.
+type oauthToken struct {
+	client   *http.Client
+	tokenURL string
+	clientID string
+	secret   string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (o *oauthToken) Token(ctx context.Context) (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.token != "" && time.Now().Before(o.expires.Add(-time.Minute)) {
+		return o.token, nil
+	}
+	if err := o.request(ctx); err != nil {
+		return "", err
+	}
+	return o.token, nil
+}
+
+func (o *oauthToken) Refresh(ctx context.Context) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.request(ctx)
+}
+
+// request exchanges the client credentials for a token. The caller must
+// hold o.mu.
+func (o *oauthToken) request(ctx context.Context) error {
+	form := url.Values{
+		"client_id":     {o.clientID},
+		"client_secret": {o.secret},
+		"grant_type":    {"client_credentials"},
+		"expiration":    {fmt.Sprint(tokenLifetime)},
+		"f":             {"json"},
+	}
+
+	resp, err := postForm(ctx, o.client, o.tokenURL, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oauth2 token: status code %d", resp.StatusCode)
+	}
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"` // seconds
+	}
+	if err := decodeBody(resp, &result); err != nil {
+		return fmt.Errorf("oauth2 token: %w", err)
+	}
+	if result.AccessToken == "" {
+		return fmt.Errorf("oauth2 token: no access_token in response")
+	}
+
+	o.token = result.AccessToken
+	o.expires = time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)
+	return nil
+}
+
+// postForm sends a URL-encoded form, as the token endpoints expect.
+func postForm(ctx context.Context, client *http.Client, endpoint string, form url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return client.Do(req)
+}
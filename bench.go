@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// benchResult is the outcome of one -workers and -batch-sizes combination.
+type benchResult struct {
+	Workers       int     `json:"workers"`
+	BatchSize     int     `json:"batchSize"`
+	Pages         int     `json:"pages"`
+	Records       int     `json:"records"`
+	Errors        int     `json:"errors"`
+	Seconds       float64 `json:"seconds"` // the median of the rounds
+	RecordsPerSec float64 `json:"recordsPerSec"`
+	MiBPerSec     float64 `json:"mibPerSec"`
+}
+
+// runBench implements the bench subcommand, which fetches the same records
+// with each combination of worker count and batch size and reports the
+// throughput, so -workers and -batch-size can be chosen by measurement:
+//
+//	go run . bench -workers 1,5,10 -batch-sizes 500,1000,2000 -records 10000
+//
+// Pages go through the same client as a fetch run, with its -rate limit,
+// but are decoded and dropped rather than written, and a failed page is
+// counted rather than retried. Point -url at a local server to measure the
+// program rather than the network.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	var opts Options
+	opts.registerClient(fs)
+	opts.registerQuery(fs)
+	opts.registerLogging(fs)
+	workerList := fs.String("workers", "1,2,5,10", "comma-separated worker counts to try")
+	batchList := fs.String("batch-sizes", "500,1000,2000", "comma-separated batch sizes to try")
+	records := fs.Int("records", 5000, "records fetched by each combination (fewer if the query matches fewer)")
+	rounds := fs.Int("rounds", 1, "times each combination is run; the median time counts")
+	fs.StringVar(&opts.QueryFormat, "query-format", "json", "format pages are requested in: auto, json, pbf or geojson")
+	asJSON := fs.Bool("json", false, "print the results as JSON")
+	fs.Parse(args)
+	if err := setupLogging(&opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFatal
+	}
+
+	workers, err := parseCounts(*workerList)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bench: -workers:", err)
+		return exitFatal
+	}
+	batches, err := parseCounts(*batchList)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bench: -batch-sizes:", err)
+		return exitFatal
+	}
+	if !slices.Contains([]string{"auto", "json", "pbf", "geojson"}, opts.QueryFormat) {
+		fmt.Fprintln(os.Stderr, "bench: -query-format must be auto, json, pbf or geojson")
+		return exitFatal
+	}
+	if *records <= 0 || *rounds <= 0 {
+		fmt.Fprintln(os.Stderr, "bench: -records and -rounds must be positive")
+		return exitFatal
+	}
+	if opts.CacheDir != "" {
+		slog.Warn("-cache-dir serves repeated pages from disk, which measures the cache rather than the service")
+	}
+
+	query, err := newQuery(&opts)
+	if err != nil {
+		slog.Error("invalid query options", "err", err)
+		return exitFatal
+	}
+	client, err := newClient(&opts)
+	if err != nil {
+		slog.Error("invalid connection options", "err", err)
+		return exitFatal
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	count, err := fetchCount(ctx, client, query)
+	if err != nil {
+		slog.Error("cannot count records", "err", err)
+		return exitFatal
+	}
+	total := min(*records, count)
+	if total == 0 {
+		slog.Error("the query matches no records")
+		return exitFatal
+	}
+	if info, err := fetchLayerInfo(ctx, client, query.URL); err == nil {
+		want := opts.QueryFormat
+		if want == "auto" {
+			want = "pbf"
+		}
+		if want != "json" && info.supportsFormat(want) {
+			query.Format = want
+		}
+		if info.MaxRecordCount > 0 && slices.Max(batches) > info.MaxRecordCount {
+			slog.Warn("batch sizes above the server page limit return short pages and are retried smaller",
+				"maxRecordCount", info.MaxRecordCount)
+		}
+	}
+	format := query.Format
+	if format == "" {
+		format = "json"
+	}
+	slog.Info("benchmarking", "records", total, "combinations", len(workers)*len(batches), "rounds", *rounds, "format", format)
+
+	var results []benchResult
+	for _, w := range workers {
+		for _, b := range batches {
+			r := benchResult{Workers: w, BatchSize: b}
+			var times []float64
+			for range *rounds {
+				start, received := time.Now(), client.BytesReceived()
+				pages, got, errs := benchFetch(ctx, client, query, total, w, b)
+				if ctx.Err() != nil {
+					slog.Warn("benchmark interrupted")
+					return exitFatal
+				}
+				times = append(times, time.Since(start).Seconds())
+				r.Pages, r.Records, r.Errors = pages, got, r.Errors+errs
+				r.MiBPerSec += float64(client.BytesReceived()-received) / (1 << 20)
+			}
+			r.Seconds = median(times)
+			r.RecordsPerSec = float64(r.Records) / r.Seconds
+			// The bytes of all rounds over their total time.
+			sum := 0.0
+			for _, t := range times {
+				sum += t
+			}
+			r.MiBPerSec /= sum
+			slog.Debug("combination done", "workers", w, "batchSize", b, "seconds", r.Seconds)
+			results = append(results, r)
+		}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(results)
+		return exitOK
+	}
+	best := 0
+	for i, r := range results {
+		if r.Errors == 0 && (results[best].Errors > 0 || r.RecordsPerSec > results[best].RecordsPerSec) {
+			best = i
+		}
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "workers\tbatch size\tpages\trecords\terrors\tseconds\trecords/s\tMiB/s\t\t")
+	for i, r := range results {
+		mark := ""
+		if i == best {
+			mark = "fastest"
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%d\t%.2f\t%.0f\t%.2f\t%s\t\n",
+			r.Workers, r.BatchSize, r.Pages, r.Records, r.Errors, r.Seconds, r.RecordsPerSec, r.MiBPerSec, mark)
+	}
+	tw.Flush()
+	return exitOK
+}
+
+// benchFetch fetches the first total records in pages of size with the
+// given number of workers, and returns the pages and records fetched and
+// the pages that failed.
+func benchFetch(ctx context.Context, client *Client, query *Query, total, workers, size int) (pages, records, errs int) {
+	offsets := make(chan int)
+	go func() {
+		defer close(offsets)
+		for offset := 0; offset < total; offset += size {
+			select {
+			case offsets <- offset:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for offset := range offsets {
+				got, err := fetchBatch(ctx, offset, min(size, total-offset), client, query, nil)
+				mu.Lock()
+				pages++
+				if err != nil {
+					errs++
+					slog.Debug("page failed", "offset", offset, "err", err)
+				}
+				records += len(got)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return pages, records, errs
+}
+
+// parseCounts parses a comma-separated list of positive integers.
+func parseCounts(s string) ([]int, error) {
+	var counts []int
+	for _, part := range splitList(s) {
+		n, err := strconv.Atoi(part)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("%q is not a positive number", part)
+		}
+		counts = append(counts, n)
+	}
+	if len(counts) == 0 {
+		return nil, fmt.Errorf("no values in %q", s)
+	}
+	return counts, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// cachingTransport keeps an on-disk copy of GET responses that carry an
+// ETag or Last-Modified header. Later requests for the same URL are sent as
+// conditional requests, and a 304 Not Modified answer is served from the
+// cache instead of re-transferring the page.
+type cachingTransport struct {
+	base http.RoundTripper
+	dir  string
+}
+
+// cacheEntry is the metadata stored next to each cached body.
+type cacheEntry struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	ContentType  string `json:"contentType,omitempty"`
+}
+
+// cacheURL returns the request URL without its token, which changes
+// between runs but does not change the response.
+func cacheURL(req *http.Request) string {
+	u := *req.URL
+	q := u.Query()
+	q.Del("token")
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func cacheKey(u string) string {
+	sum := sha256.Sum256([]byte(u))
+	return hex.EncodeToString(sum[:])
+}
+
+func (t *cachingTransport) paths(key string) (meta, body string) {
+	return filepath.Join(t.dir, key+".json"), filepath.Join(t.dir, key+".body")
+}
+
+func (t *cachingTransport) load(key string) (*cacheEntry, []byte) {
+	metaPath, bodyPath := t.paths(key)
+
+	data, err := os.ReadFile(metaPath)
+	if err != nil {
+		return nil, nil
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, nil
+	}
+	body, err := os.ReadFile(bodyPath)
+	if err != nil {
+		return nil, nil
+	}
+	return &entry, body
+}
+
+func (t *cachingTransport) store(key string, entry *cacheEntry, body []byte) error {
+	if err := os.MkdirAll(t.dir, os.ModePerm); err != nil {
+		return err
+	}
+	metaPath, bodyPath := t.paths(key)
+
+	// Write the body first so a metadata file never points at a missing body.
+	if err := os.WriteFile(bodyPath, body, 0o644); err != nil {
+		return err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(metaPath, data, 0o644)
+}
+
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return t.base.RoundTrip(req)
+	}
+
+	u := cacheURL(req)
+	key := cacheKey(u)
+	entry, cached := t.load(key)
+
+	if entry != nil {
+		req = req.Clone(req.Context())
+		if entry.ETag != "" {
+			req.Header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified && entry != nil {
+		resp.Body.Close()
+		return cachedResponse(req, entry, cached), nil
+	}
+
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if resp.StatusCode != http.StatusOK || (etag == "" && lastModified == "") {
+		return resp, nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	// A failed cache write only costs a re-download next time.
+	_ = t.store(key, &cacheEntry{
+		URL:          u,
+		ETag:         etag,
+		LastModified: lastModified,
+		ContentType:  resp.Header.Get("Content-Type"),
+	}, body)
+
+	return resp, nil
+}
+
+// cachedResponse builds a 200 response from a cache entry.
+func cachedResponse(req *http.Request, entry *cacheEntry, body []byte) *http.Response {
+	header := make(http.Header)
+	if entry.ContentType != "" {
+		header.Set("Content-Type", entry.ContentType)
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	header.Set("X-From-Cache", "1")
+
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
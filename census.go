@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultCensusCache keeps the ACS tables between runs, relative to the
+// output directory.
+const defaultCensusCache = ".census_cache.json"
+
+// censusAPI is the ACS 5-year endpoint, with the year filled in.
+var censusAPI = "https://api.census.gov/data/%d/acs/acs5"
+
+// tractField holds the census tract code the ACS data is joined on.
+const tractField = "Census_Tract"
+
+// A censusVariable is a column added by -census: an ACS estimate, or the
+// share of one estimate in another, as a percentage.
+type censusVariable struct {
+	Column      string
+	Code        string
+	Denominator string // for rates; empty for plain estimates
+}
+
+// censusPresets are the -census names for common variables. Other ACS
+// variable codes, such as B25077_001E, are added under their own names.
+var censusPresets = map[string]censusVariable{
+	"median_income":     {Column: "Median_Household_Income", Code: "B19013_001E"},
+	"poverty_rate":      {Column: "Poverty_Rate", Code: "B17001_002E", Denominator: "B17001_001E"},
+	"median_home_value": {Column: "Median_Home_Value", Code: "B25077_001E"},
+	"median_rent":       {Column: "Median_Gross_Rent", Code: "B25064_001E"},
+	"population":        {Column: "Population", Code: "B01003_001E"},
+	"owner_occupied":    {Column: "Owner_Occupied_Rate", Code: "B25003_002E", Denominator: "B25003_001E"},
+}
+
+// censusEnricher joins American Community Survey estimates to records by
+// census tract. The whole county is one request, so a run makes at most
+// one; the table is cached in a file and only fetched again for another
+// year, county or set of variables.
+type censusEnricher struct {
+	year      int
+	state     string // FIPS codes of the county the tract codes are in
+	county    string
+	variables []censusVariable
+	apiKey    string
+	client    *http.Client
+	cachePath string
+
+	tracts map[string][]interface{} // tract code → values in variables order
+}
+
+// newCensusEnricher builds the enricher for -census, or returns nil if it
+// is off.
+func newCensusEnricher(opts *Options) (*censusEnricher, error) {
+	names := splitList(opts.Census)
+	if len(names) == 0 {
+		return nil, nil
+	}
+	fips := strings.TrimSpace(opts.CensusCounty)
+	if len(fips) != 5 || strings.Trim(fips, "0123456789") != "" {
+		return nil, fmt.Errorf("-census-county %q: want the five-digit state and county FIPS code, e.g. 21111", opts.CensusCounty)
+	}
+	if opts.CensusYear < 2009 {
+		return nil, fmt.Errorf("-census-year %d: ACS 5-year estimates start in 2009", opts.CensusYear)
+	}
+	var variables []censusVariable
+	for _, name := range names {
+		v, ok := censusPresets[strings.ToLower(name)]
+		if !ok {
+			code := strings.ToUpper(name)
+			if !strings.Contains(code, "_") || strings.Trim(code, "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_") != "" {
+				return nil, fmt.Errorf("-census %q: want one of %s, or an ACS variable code such as B25077_001E", name, presetNames())
+			}
+			v = censusVariable{Column: code, Code: code}
+		}
+		variables = append(variables, v)
+	}
+
+	transport, err := newTransport(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &censusEnricher{
+		year:      opts.CensusYear,
+		state:     fips[:2],
+		county:    fips[2:],
+		variables: variables,
+		apiKey:    os.Getenv("CENSUS_API_KEY"),
+		client:    &http.Client{Transport: transport, Timeout: opts.Timeout},
+		cachePath: opts.CensusCache,
+	}, nil
+}
+
+func presetNames() string {
+	var names []string
+	for name := range censusPresets {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, ", ")
+}
+
+// columns are the output columns added, in -census order.
+func (c *censusEnricher) columns() []string {
+	columns := make([]string, len(c.variables))
+	for i, v := range c.variables {
+		columns[i] = v.Column
+	}
+	return columns
+}
+
+// codes are the ACS variables to request.
+func (c *censusEnricher) codes() []string {
+	var codes []string
+	for _, v := range c.variables {
+		for _, code := range []string{v.Code, v.Denominator} {
+			if code != "" && !slices.Contains(codes, code) {
+				codes = append(codes, code)
+			}
+		}
+	}
+	return codes
+}
+
+// cacheKey identifies a table in the cache file.
+func (c *censusEnricher) cacheKey() string {
+	return fmt.Sprintf("%d/%s%s/%s", c.year, c.state, c.county, strings.Join(c.codes(), ","))
+}
+
+// load reads the table for the run from the cache or the Census API. If
+// that fails, the run goes on with the columns left empty.
+func (c *censusEnricher) load(ctx context.Context) {
+	if c.tracts != nil {
+		return
+	}
+	cache := map[string]map[string][]interface{}{}
+	if c.cachePath != "" {
+		if data, err := os.ReadFile(c.cachePath); err == nil {
+			if err := json.Unmarshal(data, &cache); err != nil {
+				slog.Warn("ignoring unreadable Census cache", "path", c.cachePath, "err", err)
+				cache = map[string]map[string][]interface{}{}
+			}
+		}
+	}
+	key := c.cacheKey()
+	if tracts, ok := cache[key]; ok {
+		c.tracts = tracts
+		slog.Debug("Census data loaded from cache", "tracts", len(tracts))
+		return
+	}
+
+	start := time.Now()
+	tracts, err := c.fetch(ctx)
+	if err != nil {
+		slog.Warn("cannot load Census data; its columns are left empty", "err", err)
+		c.tracts = map[string][]interface{}{}
+		return
+	}
+	c.tracts = tracts
+	slog.Info("Census data loaded", "year", c.year, "tracts", len(tracts), "elapsed", time.Since(start).Round(time.Millisecond))
+
+	if c.cachePath == "" {
+		return
+	}
+	cache[key] = tracts
+	data, err := json.Marshal(cache)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(c.cachePath), os.ModePerm)
+	}
+	if err == nil {
+		tmp := c.cachePath + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o644); err == nil {
+			err = os.Rename(tmp, c.cachePath)
+		}
+	}
+	if err != nil {
+		slog.Warn("could not save Census cache", "path", c.cachePath, "err", err)
+	}
+}
+
+// fetch requests every tract of the county. The API answers with rows of
+// strings, the first of them the column names.
+func (c *censusEnricher) fetch(ctx context.Context) (map[string][]interface{}, error) {
+	codes := c.codes()
+	params := url.Values{
+		"get": {strings.Join(codes, ",")},
+		"for": {"tract:*"},
+		"in":  {"state:" + c.state + " county:" + c.county},
+	}
+	if c.apiKey != "" {
+		params.Set("key", c.apiKey)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf(censusAPI, c.year)+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err // the URL holds the API key
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// The API explains bad variables and keys in a plain-text body.
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(snippet))
+	}
+	var rows [][]string
+	if err := json.NewDecoder(resp.Body).Decode(&rows); err != nil {
+		return nil, fmt.Errorf("unexpected response: %w", err)
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("empty response")
+	}
+
+	index := make(map[string]int)
+	for i, name := range rows[0] {
+		index[name] = i
+	}
+	tractIdx, ok := index["tract"]
+	if !ok {
+		return nil, errors.New("response has no tract column")
+	}
+	tracts := make(map[string][]interface{}, len(rows)-1)
+	for _, row := range rows[1:] {
+		if len(row) != len(rows[0]) {
+			continue
+		}
+		estimate := func(code string) (float64, bool) {
+			n, err := strconv.ParseFloat(row[index[code]], 64)
+			// Large negative values are the API's annotations for
+			// estimates that are not available.
+			return n, err == nil && n >= 0
+		}
+		values := make([]interface{}, len(c.variables))
+		for i, v := range c.variables {
+			n, ok := estimate(v.Code)
+			if !ok {
+				continue
+			}
+			if v.Denominator != "" {
+				d, ok := estimate(v.Denominator)
+				if !ok || d == 0 {
+					continue
+				}
+				n = math.Round(n/d*1000) / 10 // percent, one decimal
+			}
+			values[i] = n
+		}
+		tracts[row[tractIdx]] = values
+	}
+	return tracts, nil
+}
+
+// enrich adds the ACS columns for a record's tract.
+func (c *censusEnricher) enrich(record map[string]interface{}) {
+	values := c.tracts[tractCode(record[tractField])]
+	for i, v := range c.variables {
+		if i < len(values) {
+			record[v.Column] = values[i]
+		}
+	}
+}
+
+// tractCode turns a tract as the layer stores it (002401, 24.01, or the
+// full 11-digit GEOID) into the six-digit code the API uses.
+func tractCode(value interface{}) string {
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = strings.TrimSpace(v)
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return ""
+	}
+	if whole, frac, ok := strings.Cut(s, "."); ok && len(whole) <= 4 && len(frac) <= 2 {
+		s = strings.Repeat("0", 4-len(whole)) + whole + frac + strings.Repeat("0", 2-len(frac))
+	}
+	if len(s) == 11 {
+		s = s[5:]
+	}
+	if s == "" || len(s) > 6 || strings.Trim(s, "0123456789") != "" {
+		return ""
+	}
+	return strings.Repeat("0", 6-len(s)) + s
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runMessage is the human-readable summary of a run that chat and email
+// notifications send: a headline and a few detail lines.
+type runMessage struct {
+	Headline string
+	Lines    []string
+	Failed   bool // the run did not fetch everything; highlighted in chat
+}
+
+func newRunMessage(report *RunReport) *runMessage {
+	m := &runMessage{}
+	layer := layerLabel(report.URL)
+
+	fetched := "Fetched " + formatCount(report.Records) + " rows"
+	if report.NewRecords >= 0 {
+		fetched += ", " + formatCount(report.NewRecords) + " new records"
+	}
+	fetched += fmt.Sprintf(" in %s, %s downloaded.",
+		(time.Duration(report.WallTimeSeconds * float64(time.Second))).Round(time.Second), formatBytes(report.BytesDownloaded))
+
+	switch report.Status {
+	case statusOK:
+		m.Headline = "✅ " + layer + ": fetch succeeded"
+		m.Lines = append(m.Lines, fetched)
+	case statusUnchanged:
+		m.Headline = "ℹ️ " + layer + ": layer unchanged since the last run"
+		m.Lines = append(m.Lines, "The existing output was kept.")
+	default:
+		m.Failed = true
+		switch report.Status {
+		case statusPartial:
+			pages := "pages"
+			if len(report.Failures) == 1 {
+				pages = "page"
+			}
+			m.Headline = fmt.Sprintf("⚠️ %s: fetch incomplete, %d %s failed", layer, len(report.Failures), pages)
+		case statusInterrupted:
+			m.Headline = "⚠️ " + layer + ": fetch interrupted"
+		case statusCancelled:
+			m.Headline = "⚠️ " + layer + ": fetch stopped early"
+		default:
+			m.Headline = "❌ " + layer + ": fetch failed"
+		}
+		m.Lines = append(m.Lines, fetched)
+		if report.Error != "" {
+			m.Lines = append(m.Lines, "Error: "+report.Error)
+		} else if len(report.Failures) > 0 {
+			m.Lines = append(m.Lines, "First failure: "+report.Failures[0].Error)
+		}
+		if report.Checkpoint != "" {
+			m.Lines = append(m.Lines, "A checkpoint was saved; rerun with -resume to fetch the rest.")
+		}
+	}
+	m.Lines = append(m.Lines, alertLines(report.Alerts)...)
+	if len(report.Alerts) > 0 && !m.Failed {
+		alerts := "alerts"
+		if len(report.Alerts) == 1 {
+			alerts = "alert"
+		}
+		m.Headline = fmt.Sprintf("🔔 %s: new records match %d %s", layer, len(report.Alerts), alerts)
+	}
+	for _, out := range report.Outputs {
+		m.Lines = append(m.Lines, fmt.Sprintf("Output: %s (%s)", out.Path, formatBytes(out.Size)))
+	}
+	return m
+}
+
+// alertLines describes the -alert matches: the rule, then its first few
+// records by ObjectId and address.
+func alertLines(alerts []AlertMatch) []string {
+	const shown = 5
+	var lines []string
+	for _, a := range alerts {
+		records := "records"
+		if a.Count == 1 {
+			records = "record"
+		}
+		lines = append(lines, fmt.Sprintf("Alert %s: %s new %s", a.Rule, formatCount(a.Count), records))
+		for i, rec := range a.Records {
+			if i == shown {
+				lines = append(lines, fmt.Sprintf("  … and %s more", formatCount(a.Count-shown)))
+				break
+			}
+			lines = append(lines, "  • "+recordLabel(rec))
+		}
+	}
+	return lines
+}
+
+// recordLabel names a record by its ObjectId, address and neighborhood,
+// whichever of them it has.
+func recordLabel(rec map[string]string) string {
+	var address []string
+	for _, field := range addressFields {
+		if v := strings.TrimSpace(rec[field]); v != "" {
+			address = append(address, v)
+		}
+	}
+	label := idField + " " + rec[idField]
+	if len(address) > 0 {
+		label += ": " + strings.Join(address, " ")
+	}
+	if n := rec[neighborhoodField]; n != "" {
+		label += " (" + n + ")"
+	}
+	return label
+}
+
+// layerLabel names a feature layer by its service, e.g.
+// Louisville_Metro_KY_Property_Foreclosures.
+func layerLabel(url string) string {
+	if _, rest, ok := strings.Cut(url, "/services/"); ok {
+		if name, _, _ := strings.Cut(rest, "/"); name != "" {
+			return name
+		}
+	}
+	return "fetch"
+}
+
+// formatCount formats a count with thousands separators, e.g. 212,431.
+func formatCount(n int) string {
+	s := strconv.Itoa(n)
+	if n < 0 {
+		return s
+	}
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+// slackNotifier posts the run message to a Slack incoming webhook.
+type slackNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (s *slackNotifier) name() string { return "slack" }
+
+func (s *slackNotifier) notify(ctx context.Context, report *RunReport) error {
+	m := newRunMessage(report)
+	text := "*" + slackEscape(m.Headline) + "*"
+	for i, line := range m.Lines {
+		line = slackEscape(line)
+		// The failure itself is the line to notice.
+		if m.Failed && i == 1 {
+			line = "*" + line + "*"
+		}
+		text += "\n" + line
+	}
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	return postWithRetry(ctx, s.client, s.url, "application/json", body)
+}
+
+// slackEscape escapes the characters Slack reserves for links and mentions.
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// teamsNotifier posts the run message as an Adaptive Card, the format
+// accepted by both Teams workflow webhooks and the older connectors.
+type teamsNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (t *teamsNotifier) name() string { return "teams" }
+
+func (t *teamsNotifier) notify(ctx context.Context, report *RunReport) error {
+	m := newRunMessage(report)
+	color := "Good"
+	if m.Failed {
+		color = "Attention"
+	}
+	blocks := []map[string]interface{}{{
+		"type": "TextBlock", "text": m.Headline, "weight": "Bolder", "size": "Medium", "color": color, "wrap": true,
+	}}
+	for _, line := range m.Lines {
+		blocks = append(blocks, map[string]interface{}{"type": "TextBlock", "text": line, "wrap": true, "spacing": "Small"})
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"type": "message",
+		"attachments": []map[string]interface{}{{
+			"contentType": "application/vnd.microsoft.card.adaptive",
+			"content": map[string]interface{}{
+				"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+				"type":    "AdaptiveCard",
+				"version": "1.4",
+				"body":    blocks,
+			},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	return postWithRetry(ctx, t.client, t.url, "application/json", body)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// checkpointFile is written next to the output when a run stops before
+// every page was fetched, so that -resume can pick up where it left off.
+const checkpointFile = ".fetch_checkpoint.json"
+
+// Checkpoint records the pages an unfinished run already wrote.
+type Checkpoint struct {
+	Query      string                  `json:"query"` // Query.key() of the run
+	BatchSize  int                     `json:"batchSize"`
+	File       string                  `json:"file,omitempty"`       // output path before partitioning, kept by -versioned runs
+	RawArchive string                  `json:"rawArchive,omitempty"` // -raw-dir directory of the run, which a resumed run adds to
+	Completed  []int                   `json:"completed"`            // offsets of pages written to the output
+	Outputs    []string                `json:"outputs"`
+	Records    int                     `json:"records"`
+	NewRecords int                     `json:"newRecords"` // of Records, those not in the output before the run; -1 if unknown
+	Alerts     []AlertMatch            `json:"alerts,omitempty"`
+	Periods    map[string]*periodCount `json:"periods,omitempty"` // -timeseries counts by month
+	SavedAt    time.Time               `json:"savedAt"`
+}
+
+// loadCheckpoint reads a checkpoint. A missing file returns nil.
+func loadCheckpoint(path string) (*Checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c Checkpoint
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// matches reports whether the checkpoint was written by a run of the same
+// query with the same page size, so its offsets mean the same pages.
+func (c *Checkpoint) matches(query *Query, batchSize int) bool {
+	return c.Query == query.key() && c.BatchSize == batchSize
+}
+
+// done returns the completed offsets as a set.
+func (c *Checkpoint) done() map[int]bool {
+	done := make(map[int]bool, len(c.Completed))
+	for _, offset := range c.Completed {
+		done[offset] = true
+	}
+	return done
+}
+
+// save writes the checkpoint via a temporary file, like State.save.
+func (c *Checkpoint) save(path string) error {
+	c.SavedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
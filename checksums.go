@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// checksumFile is the manifest written to the output directory by
+// -checksums, in the format of sha256sum, so that
+// "cd data && sha256sum -c SHA256SUMS" checks it as well as "go run . verify".
+const checksumFile = "SHA256SUMS"
+
+// writeChecksums writes the manifest of a run's files. Paths in it are
+// relative to the manifest.
+func writeChecksums(path string, files []string) error {
+	var b strings.Builder
+	dir := filepath.Dir(path)
+	for _, file := range files {
+		sum, err := fileSHA256(file)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, file)
+		if err != nil {
+			name = file
+		}
+		fmt.Fprintf(&b, "%s  %s\n", sum, filepath.ToSlash(name))
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readChecksums reads a manifest into a map from file path, relative to
+// the working directory, to checksum.
+func readChecksums(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		// "sum  name", or "sum *name" for sha256sum's binary mode.
+		sum, name, ok := strings.Cut(text, " ")
+		name = strings.TrimPrefix(strings.TrimPrefix(name, " "), "*")
+		if !ok || len(sum) != 64 || name == "" {
+			return nil, fmt.Errorf("%s:%d: want a SHA-256 checksum and a file name", path, line)
+		}
+		sums[filepath.Join(filepath.Dir(path), filepath.FromSlash(name))] = strings.ToLower(sum)
+	}
+	return sums, scanner.Err()
+}
+
+// verifyChecksums checks files against the manifest in their directory.
+// A file the manifest does not list fails too, since it was not produced
+// by the run the manifest describes.
+func verifyChecksums(files []string) error {
+	manifests := make(map[string]map[string]string)
+	var errs []error
+	for _, file := range files {
+		manifest := filepath.Join(filepath.Dir(file), checksumFile)
+		sums, ok := manifests[manifest]
+		if !ok {
+			var err error
+			if sums, err = readChecksums(manifest); err != nil {
+				return fmt.Errorf("cannot read checksums: %w", err)
+			}
+			manifests[manifest] = sums
+		}
+		want, ok := sums[filepath.Clean(file)]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s is not listed in %s", file, manifest))
+			continue
+		}
+		if got, err := fileSHA256(file); err != nil {
+			errs = append(errs, err)
+		} else if got != want {
+			errs = append(errs, fmt.Errorf("%s: checksum mismatch", file))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// runVerify implements the verify subcommand, which checks every file in
+// a manifest written by -checksums, for archival checks:
+//
+//	go run . verify -manifest data/SHA256SUMS
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	var opts Options
+	opts.registerLogging(fs)
+	manifest := fs.String("manifest", filepath.Join(outputDir, checksumFile), "checksum manifest to verify")
+	fs.Parse(args)
+	if err := setupLogging(&opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFatal
+	}
+
+	sums, err := readChecksums(*manifest)
+	if err != nil {
+		slog.Error("cannot read checksums", "err", err)
+		return exitFatal
+	}
+	var files []string
+	for file := range sums {
+		files = append(files, file)
+	}
+	slices.Sort(files)
+	failed := 0
+	for _, file := range files {
+		got, err := fileSHA256(file)
+		switch {
+		case err != nil:
+			slog.Error("cannot read file", "path", file, "err", err)
+		case got != sums[file]:
+			slog.Error("checksum mismatch", "path", file)
+		default:
+			slog.Info("checksum OK", "path", file)
+			continue
+		}
+		failed++
+	}
+	if failed > 0 {
+		slog.Error("verification failed", "files", len(files), "failed", failed)
+		return exitFatal
+	}
+	slog.Info("all files verified", "files", len(files))
+	return exitOK
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// quarantineReasonField is the column the quarantine file adds to the
+// output columns: why the record was kept out of the output.
+const quarantineReasonField = "Quarantine_Reason"
+
+// defaultQuarantineFile is the -quarantine file name in the output directory.
+const defaultQuarantineFile = "quarantine.csv"
+
+// coercion is a -coerce rule: the type a field is always written as.
+type coercion struct {
+	Type  string // int, float, string or date
+	Width int    // float: decimal places; string: zero-padded length; -1 if not given
+}
+
+// parseCoercions parses -coerce, a comma-separated list of field=type
+// rules such as "Zip=string(5),Sale_Price=float(2),Case_=int".
+func parseCoercions(spec string) (map[string]coercion, error) {
+	rules := make(map[string]coercion)
+	for _, rule := range splitList(spec) {
+		field, typ, ok := strings.Cut(rule, "=")
+		field, typ = strings.TrimSpace(field), strings.ToLower(strings.TrimSpace(typ))
+		if !ok || field == "" {
+			return nil, fmt.Errorf("%q: want field=type", rule)
+		}
+		c := coercion{Type: typ, Width: -1}
+		if open := strings.IndexByte(typ, '('); open >= 0 {
+			if !strings.HasSuffix(typ, ")") {
+				return nil, fmt.Errorf("%q: unbalanced parentheses", rule)
+			}
+			n, err := strconv.Atoi(typ[open+1 : len(typ)-1])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("%q: the width must be a non-negative integer", rule)
+			}
+			c.Type, c.Width = typ[:open], n
+		}
+		switch c.Type {
+		case "float", "string":
+		case "int", "date":
+			if c.Width >= 0 {
+				return nil, fmt.Errorf("%q: %s takes no width", rule, c.Type)
+			}
+		default:
+			return nil, fmt.Errorf("%q: unknown type %q (use int, float, string or date)", rule, c.Type)
+		}
+		rules[field] = c
+	}
+	return rules, nil
+}
+
+// apply converts a value to the rule's type and formats it.
+func (c coercion) apply(f *Formatter, key string, value interface{}) (string, error) {
+	switch c.Type {
+	case "int":
+		n, ok := f.parseNumber(value)
+		if !ok || n != math.Trunc(n) || math.Abs(n) > 1<<53 {
+			return "", fmt.Errorf("%v is not an integer", value)
+		}
+		return strconv.FormatInt(int64(n), 10), nil
+	case "float":
+		n, ok := f.parseNumber(value)
+		if !ok {
+			return "", fmt.Errorf("%v is not a number", value)
+		}
+		return strconv.FormatFloat(n, 'f', c.Width, 64), nil
+	case "date":
+		switch v := value.(type) {
+		case float64:
+			return f.formatDate(key, v), nil
+		case string:
+			for _, layout := range []string{time.RFC3339, time.DateTime, time.DateOnly} {
+				if t, err := time.Parse(layout, strings.TrimSpace(v)); err == nil {
+					return f.formatDate(key, float64(t.UnixMilli())), nil
+				}
+			}
+		}
+		return "", fmt.Errorf("%v is not a date", value)
+	}
+
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		s = fmt.Sprint(v)
+	}
+	if c.Width < 0 {
+		return s, nil
+	}
+	if len(s) < c.Width && strings.Trim(s, "0123456789") == "" {
+		s = strings.Repeat("0", c.Width-len(s)) + s
+	}
+	if len(s) != c.Width {
+		return "", fmt.Errorf("%q is not %d characters", s, c.Width)
+	}
+	return s, nil
+}
+
+// checkCoercions reports the first field, in name order, of a record that
+// breaks its -coerce rule. Nulls and empty strings are left as they are.
+func (f *Formatter) checkCoercions(record map[string]interface{}) error {
+	for _, field := range slices.Sorted(maps.Keys(f.Coerce)) {
+		value, ok := record[field]
+		if !ok || value == nil || value == "" {
+			continue
+		}
+		if _, err := f.Coerce[field].apply(f, field, value); err != nil {
+			return fmt.Errorf("%s: %w", field, err)
+		}
+	}
+	return nil
+}
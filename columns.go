@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// outputColumns applies -rename and -columns to the output columns. It
+// returns the fields to write, in output order, and the name each one is
+// written under in the header. -rename is a comma-separated list of
+// field=name pairs, e.g. "Case_=case_number"; -columns lists the output
+// order by either name, and leaves out the columns it does not list.
+func outputColumns(headers []string, rename, order string) (fields, names []string, err error) {
+	renamed := make(map[string]string)
+	for _, pair := range splitList(rename) {
+		field, name, ok := strings.Cut(pair, "=")
+		field, name = strings.TrimSpace(field), strings.TrimSpace(name)
+		if !ok || field == "" || name == "" {
+			return nil, nil, fmt.Errorf("%q: want field=name", pair)
+		}
+		if !slices.Contains(headers, field) {
+			return nil, nil, fmt.Errorf("%s is not an output column", field)
+		}
+		renamed[field] = name
+	}
+	nameOf := func(field string) string {
+		if name, ok := renamed[field]; ok {
+			return name
+		}
+		return field
+	}
+
+	fields = headers
+	if order != "" {
+		fields = nil
+		for _, column := range splitList(order) {
+			i := slices.IndexFunc(headers, func(h string) bool { return nameOf(h) == column })
+			if i < 0 {
+				i = slices.Index(headers, column)
+			}
+			if i < 0 {
+				return nil, nil, fmt.Errorf("%s is not an output column", column)
+			}
+			if slices.Contains(fields, headers[i]) {
+				return nil, nil, fmt.Errorf("%s is listed twice", column)
+			}
+			fields = append(fields, headers[i])
+		}
+	}
+
+	for _, field := range fields {
+		name := nameOf(field)
+		if slices.Contains(names, name) {
+			return nil, nil, fmt.Errorf("two columns would be named %s", name)
+		}
+		names = append(names, name)
+	}
+	return fields, names, nil
+}
+
+// column returns the name a field is written under in the output.
+func (j *fetchJob) column(field string) string {
+	if i := slices.Index(j.headers, field); i >= 0 && j.columns != nil {
+		return j.columns[i]
+	}
+	return field
+}
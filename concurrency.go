@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// aimdLimiter adapts the number of requests in flight with additive
+// increase / multiplicative decrease, like TCP congestion control. While
+// requests succeed about as fast as the fastest one seen so far, the limit
+// grows by roughly one per round of requests; a timeout or a throttling
+// response halves it.
+type aimdLimiter struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	limit    float64
+	min, max float64
+	inFlight int
+
+	fastest time.Duration
+}
+
+func newAIMDLimiter(initial, max int) *aimdLimiter {
+	if max < initial {
+		max = initial
+	}
+	l := &aimdLimiter{limit: float64(initial), min: 1, max: float64(max)}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// Acquire blocks until another request may start, or until ctx is done.
+func (l *aimdLimiter) Acquire(ctx context.Context) error {
+	// Wake the waiters when ctx is done so they can give up.
+	stop := context.AfterFunc(ctx, func() {
+		l.mu.Lock()
+		l.cond.Broadcast()
+		l.mu.Unlock()
+	})
+	defer stop()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.inFlight >= int(l.limit) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		l.cond.Wait()
+	}
+	l.inFlight++
+	return nil
+}
+
+// Release records the outcome of a request started with Acquire.
+func (l *aimdLimiter) Release(latency time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+
+	switch {
+	case isOverload(err):
+		l.limit /= 2
+		if l.limit < l.min {
+			l.limit = l.min
+		}
+	case err == nil:
+		if l.fastest == 0 || latency < l.fastest {
+			l.fastest = latency
+		}
+		// Only grow while latency stays near the best case; slower
+		// responses mean the server is already busy.
+		if latency <= 2*l.fastest {
+			l.limit += 1 / l.limit
+			if l.limit > l.max {
+				l.limit = l.max
+			}
+		}
+	}
+	l.cond.Broadcast()
+}
+
+// Limit returns the current concurrency limit.
+func (l *aimdLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+// isOverload reports whether an error means the server is overloaded or
+// throttling us: timeouts, 429 Too Many Requests, and 503/504.
+func isOverload(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	code := 0
+	var statusErr *HTTPStatusError
+	var apiErr *ArcGISError
+	switch {
+	case errors.As(err, &statusErr):
+		code = statusErr.Code
+	case errors.As(err, &apiErr):
+		code = apiErr.Code
+	}
+	return code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// shrinkable reports whether a failed page might succeed if requested in
+// smaller pieces. Client errors such as an invalid where clause or a
+// rejected token fail the same way at any page size.
+func shrinkable(err error) bool {
+	if isOverload(err) {
+		return true
+	}
+
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code >= 500
+	}
+	var apiErr *ArcGISError
+	if errors.As(err, &apiErr) {
+		return apiErr.retryable()
+	}
+	// Network and decoding errors (e.g. a response cut off mid-page).
+	return true
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAIMDLimiter(t *testing.T) {
+	fast := 100 * time.Millisecond
+	tests := []struct {
+		name     string
+		initial  int
+		max      int
+		outcomes []error         // released in order, each after one Acquire
+		latency  []time.Duration // per outcome; fast if missing
+		want     int
+	}{
+		{
+			name:     "grows by about one per round of fast successes",
+			initial:  4,
+			max:      10,
+			outcomes: make([]error, 5),
+			want:     5,
+		},
+		{
+			name:     "stops at max",
+			initial:  4,
+			max:      5,
+			outcomes: make([]error, 40),
+			want:     5,
+		},
+		{
+			name:     "halves on 429",
+			initial:  8,
+			max:      10,
+			outcomes: []error{&HTTPStatusError{Code: http.StatusTooManyRequests}},
+			want:     4,
+		},
+		{
+			name:     "halves on ArcGIS 503",
+			initial:  8,
+			max:      10,
+			outcomes: []error{&ArcGISError{Code: http.StatusServiceUnavailable}},
+			want:     4,
+		},
+		{
+			name:     "halves on timeout",
+			initial:  8,
+			max:      10,
+			outcomes: []error{fmt.Errorf("page 3: %w", context.DeadlineExceeded)},
+			want:     4,
+		},
+		{
+			name:     "never below one",
+			initial:  2,
+			max:      10,
+			outcomes: []error{context.DeadlineExceeded, context.DeadlineExceeded, context.DeadlineExceeded},
+			want:     1,
+		},
+		{
+			name:     "other errors leave it alone",
+			initial:  4,
+			max:      10,
+			outcomes: []error{&HTTPStatusError{Code: http.StatusBadRequest}, errors.New("unexpected EOF")},
+			want:     4,
+		},
+		{
+			name:     "slow successes do not grow it",
+			initial:  4,
+			max:      10,
+			outcomes: make([]error, 5),
+			latency:  []time.Duration{fast, 3 * fast, 3 * fast, 3 * fast, 3 * fast},
+			want:     4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newAIMDLimiter(tt.initial, tt.max)
+			for i, err := range tt.outcomes {
+				if err := l.Acquire(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+				latency := fast
+				if i < len(tt.latency) {
+					latency = tt.latency[i]
+				}
+				l.Release(latency, err)
+			}
+			if got := l.Limit(); got != tt.want {
+				t.Errorf("Limit() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAIMDLimiterBlocksAtLimit(t *testing.T) {
+	l := newAIMDLimiter(2, 2)
+	for range 2 {
+		if err := l.Acquire(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Acquire over the limit = %v, want it to wait until ctx is done", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- l.Acquire(context.Background()) }()
+	l.Release(time.Millisecond, nil)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Acquire still blocked after a Release")
+	}
+}
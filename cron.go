@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a standard five-field cron expression: minute, hour,
+// day of month, month and day of week. Fields accept *, numbers, ranges
+// (1-5), steps (*/15, 0-30/10), comma lists, and month and weekday names
+// (JAN, MON). As in Vixie cron, when both the day of month and the day
+// of week are restricted, a day matching either one fires. A leading
+// CRON_TZ=Zone (or TZ=Zone) evaluates the schedule in that IANA zone
+// instead of the local one.
+type cronSchedule struct {
+	spec   string
+	minute uint64 // bit n set: fires when the field is n
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	domAny bool // the day of month field was *
+	dowAny bool
+	loc    *time.Location
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronMonths = []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+var cronWeekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseCron parses a schedule such as "0 6 * * *" or
+// "CRON_TZ=America/Kentucky/Louisville 30 5 * * MON-FRI".
+func parseCron(spec string) (*cronSchedule, error) {
+	c := &cronSchedule{spec: spec, loc: time.Local}
+
+	fields := strings.Fields(spec)
+	if len(fields) > 0 {
+		if name, ok := strings.CutPrefix(fields[0], "CRON_TZ="); ok {
+			fields[0] = "TZ=" + name
+		}
+		if name, ok := strings.CutPrefix(fields[0], "TZ="); ok {
+			loc, err := time.LoadLocation(name)
+			if err != nil {
+				return nil, fmt.Errorf("unknown time zone %q", name)
+			}
+			c.loc = loc
+			fields = fields[1:]
+		}
+	}
+	if len(fields) == 1 && strings.HasPrefix(fields[0], "@") {
+		expanded, ok := cronMacros[strings.ToLower(fields[0])]
+		if !ok {
+			return nil, fmt.Errorf("unknown schedule %q", fields[0])
+		}
+		fields = strings.Fields(expanded)
+	}
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%q: want 5 fields (minute hour day month weekday), got %d", spec, len(fields))
+	}
+
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	// 7 is accepted for Sunday, like most crons.
+	if c.dow, err = parseCronField(fields[4], 0, 7, cronWeekdays); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domAny = strings.HasPrefix(fields[2], "*")
+	c.dowAny = strings.HasPrefix(fields[4], "*")
+
+	if c.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("%q never fires", spec)
+	}
+	return c, nil
+}
+
+// parseCronField returns the bit set for one comma-separated field.
+// names, if given, are the lowercase names of the values from 0.
+func parseCronField(field string, lo, hi int, names []string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		expr, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", part)
+			}
+			step = n
+		}
+
+		start, end := lo, hi
+		switch from, to, isRange := strings.Cut(expr, "-"); {
+		case expr == "*":
+		case isRange:
+			var err error
+			if start, err = cronValue(from, lo, hi, names); err != nil {
+				return 0, err
+			}
+			if end, err = cronValue(to, lo, hi, names); err != nil {
+				return 0, err
+			}
+			if start > end {
+				return 0, fmt.Errorf("invalid range %q", expr)
+			}
+		default:
+			n, err := cronValue(expr, lo, hi, names)
+			if err != nil {
+				return 0, err
+			}
+			// "5/15" means from 5 to the end in steps of 15.
+			start = n
+			if !hasStep {
+				end = n
+			}
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func cronValue(s string, lo, hi int, names []string) (int, error) {
+	for i, name := range names {
+		if name != "" && strings.EqualFold(s, name) {
+			return i, nil
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	if n < lo || n > hi {
+		return 0, fmt.Errorf("%d is out of range %d-%d", n, lo, hi)
+	}
+	return n, nil
+}
+
+// next returns the first time after t that the schedule fires, or the
+// zero time if it fires on no date in the next five years (0 0 30 2 *).
+// Times are wall-clock times in the schedule's zone: a time skipped by a
+// daylight saving change does not fire that day, and a repeated hour
+// fires once.
+func (c *cronSchedule) next(t time.Time) time.Time {
+	// The search runs on wall-clock times carried in UTC, where no
+	// daylight saving change can send it backwards; each match is then
+	// placed in the schedule's zone.
+	w := t.In(c.loc)
+	wall := time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute()+1, 0, 0, time.UTC)
+	limit := wall.AddDate(5, 0, 0)
+
+	for wall.Before(limit) {
+		switch {
+		case c.month&(1<<uint(wall.Month())) == 0:
+			wall = time.Date(wall.Year(), wall.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.dayMatches(wall):
+			wall = time.Date(wall.Year(), wall.Month(), wall.Day()+1, 0, 0, 0, 0, time.UTC)
+		case c.hour&(1<<uint(wall.Hour())) == 0:
+			wall = wall.Truncate(time.Hour).Add(time.Hour)
+		case c.minute&(1<<uint(wall.Minute())) == 0:
+			wall = wall.Add(time.Minute)
+		default:
+			at := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), 0, 0, c.loc)
+			if at.Hour() == wall.Hour() && at.Minute() == wall.Minute() && at.After(t) {
+				return at
+			}
+			wall = wall.Add(time.Minute)
+		}
+	}
+	return time.Time{}
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+func (c *cronSchedule) String() string {
+	return c.spec
+}
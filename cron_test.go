@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	from := time.Date(2025, 1, 15, 10, 7, 0, 0, time.UTC) // a Wednesday
+	tests := []struct {
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"TZ=UTC 0 6 * * *", from, time.Date(2025, 1, 16, 6, 0, 0, 0, time.UTC)},
+		{"TZ=UTC */15 * * * *", from, time.Date(2025, 1, 15, 10, 15, 0, 0, time.UTC)},
+		{"TZ=UTC 5/20 10 * * *", from, time.Date(2025, 1, 15, 10, 25, 0, 0, time.UTC)},
+		{"TZ=UTC 30 5 * * MON-FRI", from, time.Date(2025, 1, 16, 5, 30, 0, 0, time.UTC)},
+		{"TZ=UTC 0 12 * * 7", from, time.Date(2025, 1, 19, 12, 0, 0, 0, time.UTC)},
+		{"TZ=UTC 0 0 1 jan,JUL *", from, time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{"TZ=UTC @monthly", from, time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"TZ=UTC 0 0 29 2 *", from, time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Day of month and day of week both restricted: either fires.
+		{"TZ=UTC 0 0 13 * FRI", from, time.Date(2025, 1, 17, 0, 0, 0, 0, time.UTC)},
+		{"TZ=UTC 0 9 1-7 * MON", from, time.Date(2025, 1, 20, 9, 0, 0, 0, time.UTC)},
+		// 02:30 does not exist on the day clocks spring forward.
+		{"CRON_TZ=America/New_York 30 2 * * *", time.Date(2025, 3, 8, 12, 0, 0, 0, time.UTC), time.Date(2025, 3, 10, 6, 30, 0, 0, time.UTC)},
+		// 01:30 happens twice on the day they fall back, and fires once.
+		{"CRON_TZ=America/New_York 30 1 * * *", time.Date(2025, 11, 2, 4, 0, 0, 0, time.UTC), time.Date(2025, 11, 2, 5, 30, 0, 0, time.UTC)},
+		{"CRON_TZ=America/New_York 30 1 * * *", time.Date(2025, 11, 2, 5, 30, 0, 0, time.UTC), time.Date(2025, 11, 3, 6, 30, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.spec)
+		if err != nil {
+			t.Errorf("%s: %v", tt.spec, err)
+			continue
+		}
+		if got := c.next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%s: next after %s = %s, want %s", tt.spec, tt.from.UTC(), got.UTC(), tt.want.UTC())
+		}
+	}
+
+	errs := []struct {
+		spec string
+		want string
+	}{
+		{"0 6 * *", "want 5 fields"},
+		{"60 * * * *", "minute: 60 is out of range 0-59"},
+		{"0 0 0 * *", "day of month: 0 is out of range 1-31"},
+		{"*/0 * * * *", `invalid step "*/0"`},
+		{"5-1 * * * *", `invalid range "5-1"`},
+		{"0 0 * * FUNDAY", `day of week: invalid value "FUNDAY"`},
+		{"@fortnightly", `unknown schedule "@fortnightly"`},
+		{"TZ=Nowhere/City 0 0 * * *", `unknown time zone "Nowhere/City"`},
+		{"0 0 30 2 *", "never fires"},
+	}
+	for _, tt := range errs {
+		_, err := parseCron(tt.spec)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want %q", tt.spec, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// csvwSuffix names the CSVW metadata file of an output: the W3C default
+// location for data.csv is data.csv-metadata.json.
+const csvwSuffix = "-metadata.json"
+
+// CSVWTable is W3C CSV on the Web metadata for one output file
+// (https://www.w3.org/TR/tabular-metadata/).
+type CSVWTable struct {
+	Context     []interface{} `json:"@context"`
+	URL         string        `json:"url"` // relative to the metadata file
+	Title       string        `json:"dc:title,omitempty"`
+	Source      string        `json:"dc:source"`
+	Created     string        `json:"dc:created"`
+	Dialect     *CSVWDialect  `json:"dialect,omitempty"`
+	TableSchema CSVWSchema    `json:"tableSchema"`
+}
+
+type CSVWDialect struct {
+	Delimiter string `json:"delimiter"`
+}
+
+type CSVWSchema struct {
+	Columns    []CSVWColumn `json:"columns"`
+	PrimaryKey string       `json:"primaryKey,omitempty"`
+}
+
+type CSVWColumn struct {
+	Name        string      `json:"name"`
+	Titles      []string    `json:"titles"` // the header, then the layer alias
+	Description string      `json:"dc:description,omitempty"`
+	Datatype    interface{} `json:"datatype"` // a type name, or a CSVWDatatype with a format
+	Null        []string    `json:"null"`
+	Required    bool        `json:"required,omitempty"`
+}
+
+type CSVWDatatype struct {
+	Base   string `json:"base"`
+	Format string `json:"format"`
+}
+
+// writeCSVW writes CSVW metadata next to each output and returns the
+// paths of the metadata files. The columns have
+// the same types as in the data package; date fields also get the format
+// they are written in, so validators can parse them.
+func (j *fetchJob) writeCSVW(layer *LayerInfo, outputs []string) ([]string, error) {
+	schema := j.tableSchema(layer)
+	columns := make([]CSVWColumn, len(schema.Fields))
+	for i, field := range schema.Fields {
+		col := CSVWColumn{
+			Name:        field.Name,
+			Titles:      []string{field.Name},
+			Description: field.Description,
+			Datatype:    csvwTypes[field.Type],
+			Null:        schema.MissingValues,
+			Required:    field.Constraints != nil && field.Constraints.Required,
+		}
+		if field.Title != "" {
+			col.Titles = append(col.Titles, field.Title)
+		}
+		// The schema has a field per header, under its output name.
+		name := j.headers[i]
+		if (dateFields[name] || j.formatter.Coerce[name].Type == "date") && (field.Type == "date" || field.Type == "datetime" || field.Type == "string") &&
+			!j.formatter.RedactFields[name] && !j.formatter.HashFields[name] {
+			if base, pattern, ok := datePattern(j.formatter.DateLayout); ok {
+				col.Datatype = CSVWDatatype{Base: base, Format: pattern}
+				col.Description = "time zone " + j.formatter.Location.String()
+			}
+		}
+		columns[i] = col
+	}
+
+	table := CSVWTable{
+		Context: []interface{}{"http://www.w3.org/ns/csvw", map[string]string{"@language": "en"}},
+		Title:   layer.Name,
+		Source:  layerURL(j.query.URL),
+		Created: time.Now().UTC().Format(time.RFC3339),
+		TableSchema: CSVWSchema{
+			Columns: columns,
+		},
+	}
+	if len(schema.PrimaryKey) > 0 {
+		table.TableSchema.PrimaryKey = schema.PrimaryKey[0]
+	}
+	if j.dialect.Comma != ',' {
+		table.Dialect = &CSVWDialect{Delimiter: string(j.dialect.Comma)}
+	}
+	var written []string
+	for _, path := range outputs {
+		table.URL = filepath.Base(path)
+		data, err := json.MarshalIndent(table, "", "  ")
+		if err != nil {
+			return written, err
+		}
+		meta := path + csvwSuffix
+		if err := os.WriteFile(meta, data, 0o644); err != nil {
+			return written, err
+		}
+		slog.Info("CSVW metadata saved", "path", meta)
+		written = append(written, meta)
+	}
+	return written, nil
+}
+
+// csvwTypes maps Table Schema types to CSVW datatypes. Dates that are
+// written with a layout are handled by datePattern.
+var csvwTypes = map[string]interface{}{
+	"integer":  "integer",
+	"number":   "number",
+	"string":   "string",
+	"any":      "string",
+	"date":     CSVWDatatype{Base: "date", Format: "yyyy-MM-dd"},
+	"datetime": "datetime",
+}
+
+// goLayoutTokens are the elements of a Go time layout and their Unicode
+// (UAX #35) date pattern equivalents, longest first where one is a
+// prefix of another. An empty pattern has no equivalent.
+var goLayoutTokens = []struct{ layout, pattern string }{
+	{"January", "MMMM"}, {"Jan", "MMM"}, {"Monday", "EEEE"}, {"Mon", "EEE"}, {"MST", ""},
+	{"2006", "yyyy"}, {"002", "DDD"}, {"01", "MM"}, {"02", "dd"}, {"03", "hh"}, {"04", "mm"},
+	{"05", "ss"}, {"06", "yy"}, {"_2", ""}, {"15", "HH"}, {"1", "M"}, {"2", "d"}, {"3", "h"},
+	{"4", "m"}, {"5", "s"}, {"PM", "a"}, {"pm", ""},
+	{"-07:00:00", ""}, {"-07:00", "xxx"}, {"-0700", "xx"}, {"-07", "x"},
+	{"Z07:00:00", ""}, {"Z07:00", "XXX"}, {"Z0700", "XX"}, {"Z07", "X"},
+}
+
+// datePattern translates a Go time layout into a date pattern for CSVW,
+// with base "date", "datetime" or "time". ok is false for layouts with
+// elements that have no equivalent, such as zone abbreviations.
+func datePattern(layout string) (base, pattern string, ok bool) {
+	var b strings.Builder
+	hasDate, hasTime := false, false
+	literal := func(s string) {
+		// Letters are pattern characters and have to be quoted, except
+		// the T between date and time that CSVW formats use as is.
+		for _, r := range s {
+			if r != 'T' && (r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+				b.WriteString("'" + string(r) + "'")
+			} else if r == '\'' {
+				b.WriteString("''")
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+next:
+	for len(layout) > 0 {
+		// Fractional seconds: .000 or ,000; .999 trims zeros, which the
+		// patterns cannot express.
+		// As in Go, the run of zeros must not be followed by another digit.
+		if c := layout[0]; (c == '.' || c == ',') && len(layout) > 1 && layout[1] == '0' {
+			n := 1 + len(layout[1:]) - len(strings.TrimLeft(layout[1:], "0"))
+			if n == len(layout) || layout[n] < '0' || layout[n] > '9' {
+				b.WriteString(string(c) + strings.Repeat("S", n-1))
+				layout = layout[n:]
+				hasTime = true
+				continue
+			}
+		}
+		for _, t := range goLayoutTokens {
+			if !strings.HasPrefix(layout, t.layout) {
+				continue
+			}
+			if t.pattern == "" {
+				return "", "", false
+			}
+			b.WriteString(t.pattern)
+			switch t.pattern[0] {
+			case 'y', 'M', 'd', 'D', 'E':
+				hasDate = true
+			case 'H', 'h', 'm', 's', 'a':
+				hasTime = true
+			}
+			layout = layout[len(t.layout):]
+			continue next
+		}
+		_, size := utf8.DecodeRuneInString(layout)
+		literal(layout[:size])
+		layout = layout[size:]
+	}
+	switch {
+	case hasDate && hasTime:
+		return "datetime", b.String(), true
+	case hasDate:
+		return "date", b.String(), true
+	case hasTime:
+		return "time", b.String(), true
+	}
+	return "", "", false
+}
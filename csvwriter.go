@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// csvWriter is a small replacement for encoding/csv.Writer. The standard
+// writer only quotes fields when it has to, while some consumers require
+// every field to be quoted, so quoting behaviour is configurable here.
+type csvWriter struct {
+	w       *bufio.Writer
+	dialect CSVDialect
+}
+
+func newCSVWriter(w io.Writer, dialect CSVDialect) *csvWriter {
+	if dialect.Comma == 0 {
+		dialect.Comma = ','
+	}
+	return &csvWriter{w: bufio.NewWriter(w), dialect: dialect}
+}
+
+// checkControl reports the first control character in a record. RFC 4180
+// only permits CR and LF (inside quoted fields) besides printable text.
+func checkControl(record []string) error {
+	for i, field := range record {
+		for _, r := range field {
+			if r == '\r' || r == '\n' {
+				continue
+			}
+			if r < 0x20 || r == 0x7f {
+				return fmt.Errorf("field %d contains control character %U", i+1, r)
+			}
+		}
+	}
+	return nil
+}
+
+// Write writes a single record. null, if not nil, marks the fields that
+// hold the null token: they are never quoted, even with QuoteAll, since a
+// quoted token is a string to readers such as Postgres COPY, not a null.
+// With RejectControl set, records containing control characters are
+// rejected before anything is written.
+func (cw *csvWriter) Write(record []string, null []bool) error {
+	if cw.dialect.RejectControl {
+		if err := checkControl(record); err != nil {
+			return err
+		}
+	}
+
+	for i, field := range record {
+		if i > 0 {
+			if _, err := cw.w.WriteRune(cw.dialect.Comma); err != nil {
+				return err
+			}
+		}
+
+		bare := null != nil && null[i]
+		if bare || !cw.dialect.QuoteAll && !cw.fieldNeedsQuotes(field) {
+			if _, err := cw.w.WriteString(field); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := cw.w.WriteByte('"'); err != nil {
+			return err
+		}
+		for len(field) > 0 {
+			// Copy everything up to the next character that needs escaping.
+			n := strings.IndexAny(field, "\"\r\n")
+			if n < 0 {
+				n = len(field)
+			}
+			if _, err := cw.w.WriteString(field[:n]); err != nil {
+				return err
+			}
+			field = field[n:]
+			if len(field) == 0 {
+				break
+			}
+
+			var err error
+			switch field[0] {
+			case '"':
+				_, err = cw.w.WriteString(`""`)
+			case '\r':
+				if !cw.dialect.UseCRLF {
+					err = cw.w.WriteByte('\r')
+				}
+			case '\n':
+				if cw.dialect.UseCRLF {
+					_, err = cw.w.WriteString("\r\n")
+				} else {
+					err = cw.w.WriteByte('\n')
+				}
+			}
+			field = field[1:]
+			if err != nil {
+				return err
+			}
+		}
+		if err := cw.w.WriteByte('"'); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if cw.dialect.UseCRLF {
+		_, err = cw.w.WriteString("\r\n")
+	} else {
+		err = cw.w.WriteByte('\n')
+	}
+	return err
+}
+
+// nullFields marks the fields of a record read back from a CSV that hold
+// the null token. Without one, nulls cannot be told from empty strings.
+func nullFields(record []string, token string) []bool {
+	if token == "" {
+		return nil
+	}
+	null := make([]bool, len(record))
+	for i, field := range record {
+		null[i] = field == token
+	}
+	return null
+}
+
+// fieldNeedsQuotes mirrors encoding/csv: quote fields containing the
+// delimiter, quotes, line breaks, or a leading space.
+func (cw *csvWriter) fieldNeedsQuotes(field string) bool {
+	if field == "" {
+		return false
+	}
+	if field == `\.` {
+		return true
+	}
+
+	comma := cw.dialect.Comma
+	if comma < utf8.RuneSelf {
+		for i := 0; i < len(field); i++ {
+			c := field[i]
+			if c == '\n' || c == '\r' || c == '"' || c == byte(comma) {
+				return true
+			}
+		}
+	} else if strings.ContainsRune(field, comma) || strings.ContainsAny(field, "\"\r\n") {
+		return true
+	}
+
+	r, _ := utf8.DecodeRuneInString(field)
+	return unicode.IsSpace(r)
+}
+
+// Flush writes any buffered data to the underlying io.Writer.
+func (cw *csvWriter) Flush() error {
+	return cw.w.Flush()
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCSVWriterNullsUnquoted(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect CSVDialect
+		record  []string
+		null    []bool
+		want    string
+	}{
+		{"plain", CSVDialect{}, []string{"a", `\N`, ""}, []bool{false, true, true}, "a,\\N,\n"},
+		{"quote all", CSVDialect{QuoteAll: true}, []string{"a", `\N`, ""}, []bool{false, true, false}, "\"a\",\\N,\"\"\n"},
+		{"quote all empty null", CSVDialect{QuoteAll: true}, []string{"a", ""}, []bool{false, true}, "\"a\",\n"},
+		{"rfc4180", CSVDialect{QuoteAll: true, UseCRLF: true}, []string{`\N`, "x"}, []bool{true, false}, "\\N,\"x\"\r\n"},
+		{"no mask", CSVDialect{QuoteAll: true}, []string{`\N`}, nil, "\"\\N\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			w := newCSVWriter(&b, tt.dialect)
+			if err := w.Write(tt.record, tt.null); err != nil {
+				t.Fatal(err)
+			}
+			w.Flush()
+			if b.String() != tt.want {
+				t.Errorf("got %q, want %q", b.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Columns the dashboard charts. Sections whose columns are not in the
+// extract (-fields) are left out.
+const (
+	neighborhoodField = "Neighborhood"
+	saleDateField     = "Sale_Date"
+	salePriceField    = "Sale_Price"
+)
+
+// Sizes of the dashboard sections.
+const (
+	dashboardMonths        = 36 // filings per month: the most recent months shown
+	dashboardNeighborhoods = 15
+	dashboardSales         = 20
+)
+
+// addressFields are joined to form the address shown for a sale.
+var addressFields = []string{"House_Nr", "Dir", "Street_Name", "St_Type", "Post_Dir"}
+
+// chartBar is one bar of a dashboard chart; Percent is its length relative
+// to the largest bar.
+type chartBar struct {
+	Label   string
+	Count   int
+	Percent float64
+	Query   template.URL // dashboard query string that filters on this bar, already encoded
+}
+
+// saleRow is one line of the recent sales table.
+type saleRow struct {
+	ID           string
+	Date         string
+	Address      string
+	Neighborhood string
+	Price        string
+	Purchaser    string
+}
+
+// dashboardData is what the dashboard template renders.
+type dashboardData struct {
+	Records       int
+	Total         int
+	Filtered      bool
+	Files         []string
+	UpdatedAt     string
+	DateField     string
+	Since, Until  string
+	Neighborhood  string
+	Zip           string
+	Choices       []string // neighborhoods for the filter form
+	Months        []chartBar
+	FirstMonth    string
+	LastMonth     string
+	Neighborhoods []chartBar
+	Sales         []saleRow
+	Error         string
+}
+
+// serveDashboard renders a one-page overview of the extract: filings per
+// month, the neighborhoods with the most records and the most recent
+// sales. It takes the same filters as /records, so a chart can be narrowed
+// to one zip code or period.
+func serveDashboard(store *extractStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ds, ok := loadDataset(w, store)
+		if !ok {
+			return
+		}
+		query := r.URL.Query()
+		data := dashboardData{
+			Total:        len(ds.records),
+			Files:        ds.paths,
+			DateField:    ds.dateColumn,
+			Since:        firstParam(query, "since"),
+			Until:        firstParam(query, "until"),
+			Neighborhood: firstParam(query, neighborhoodField),
+			Zip:          firstParam(query, "zip"),
+		}
+		var updated time.Time
+		for _, t := range ds.modTimes {
+			if t.After(updated) {
+				updated = t
+			}
+		}
+		data.UpdatedAt = updated.In(store.formatter.Location).Format("2006-01-02 15:04 MST")
+		if column, ok := ds.column(neighborhoodField); ok {
+			for _, g := range countValues(ds, column, allRecords(ds)) {
+				if g.Value != "" {
+					data.Choices = append(data.Choices, g.Value)
+				}
+			}
+			sort.Strings(data.Choices)
+		}
+
+		// Empty form fields arrive as zip=&since=; they mean "any".
+		for key, values := range query {
+			if len(values) == 1 && values[0] == "" {
+				delete(query, key)
+			}
+		}
+		filter, err := parseRecordFilter(ds, store.formatter, query)
+		if err != nil {
+			data.Error = err.Error()
+			filter = &recordFilter{}
+		}
+		matched := filter.match(ds)
+		data.Records = len(matched)
+		data.Filtered = len(query) > 0
+
+		data.Months = filingsPerMonth(ds, matched, store.formatter.Location)
+		if len(data.Months) > 0 {
+			data.FirstMonth, data.LastMonth = data.Months[0].Label, data.Months[len(data.Months)-1].Label
+		}
+		if column, ok := ds.column(neighborhoodField); ok {
+			data.Neighborhoods = topValues(ds, column, matched, query)
+		}
+		data.Sales = recentSales(ds, matched, store.formatter)
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := dashboardPage.Execute(w, data); err != nil {
+			slog.Debug("dashboard not written", "err", err)
+		}
+	}
+}
+
+func allRecords(ds *dataset) []int {
+	all := make([]int, len(ds.records))
+	for i := range all {
+		all[i] = i
+	}
+	return all
+}
+
+// filingsPerMonth counts the records per month of the date field over the
+// most recent dashboardMonths months that have any, including the empty
+// months in between.
+func filingsPerMonth(ds *dataset, matched []int, loc *time.Location) []chartBar {
+	dates := ds.dates[ds.dateColumn]
+	if dates == nil {
+		return nil
+	}
+	counts := make(map[time.Time]int)
+	var last time.Time
+	for _, idx := range matched {
+		if dates[idx].IsZero() {
+			continue
+		}
+		t := dates[idx].In(loc)
+		month := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		counts[month]++
+		if month.After(last) {
+			last = month
+		}
+	}
+	if len(counts) == 0 {
+		return nil
+	}
+
+	first := last.AddDate(0, 1-dashboardMonths, 0)
+	for month := range counts {
+		if month.Before(first) {
+			delete(counts, month)
+		}
+	}
+	earliest := last
+	for month := range counts {
+		if month.Before(earliest) {
+			earliest = month
+		}
+	}
+
+	var bars []chartBar
+	for month := earliest; !month.After(last); month = month.AddDate(0, 1, 0) {
+		bars = append(bars, chartBar{Label: month.Format("Jan 2006"), Count: counts[month]})
+	}
+	scaleBars(bars)
+	return bars
+}
+
+// topValues returns the most frequent values of a column, each linked to
+// the dashboard filtered on it.
+func topValues(ds *dataset, column string, matched []int, query map[string][]string) []chartBar {
+	var bars []chartBar
+	for _, g := range countValues(ds, column, matched) {
+		if g.Value == "" {
+			continue
+		}
+		if len(bars) == dashboardNeighborhoods {
+			break
+		}
+		q := make(map[string][]string, len(query)+1)
+		for key, values := range query {
+			if !strings.EqualFold(key, column) {
+				q[key] = values
+			}
+		}
+		q[column] = []string{g.Value}
+		bars = append(bars, chartBar{Label: g.Value, Count: g.Count, Query: template.URL(url.Values(q).Encode())})
+	}
+	scaleBars(bars)
+	return bars
+}
+
+func scaleBars(bars []chartBar) {
+	largest := 0
+	for _, b := range bars {
+		largest = max(largest, b.Count)
+	}
+	for i := range bars {
+		if largest > 0 {
+			bars[i].Percent = 100 * float64(bars[i].Count) / float64(largest)
+		}
+	}
+}
+
+// recentSales returns the matched records with the latest sale dates.
+func recentSales(ds *dataset, matched []int, f *Formatter) []saleRow {
+	column, ok := ds.column(saleDateField)
+	if !ok || ds.dates[column] == nil {
+		return nil
+	}
+	dates := ds.dates[column]
+	var sold []int
+	for _, idx := range matched {
+		if !dates[idx].IsZero() {
+			sold = append(sold, idx)
+		}
+	}
+	sort.SliceStable(sold, func(i, j int) bool { return dates[sold[i]].After(dates[sold[j]]) })
+
+	rows := make([]saleRow, 0, min(len(sold), dashboardSales))
+	for _, idx := range sold[:min(len(sold), dashboardSales)] {
+		rec := ds.records[idx]
+		var address []string
+		for _, field := range addressFields {
+			if column, ok := ds.column(field); ok && rec[column] != "" && rec[column] != f.NullToken {
+				address = append(address, rec[column])
+			}
+		}
+		rows = append(rows, saleRow{
+			ID:           rec[idField],
+			Date:         dates[idx].In(f.Location).Format("2006-01-02"),
+			Address:      strings.Join(address, " "),
+			Neighborhood: rec[neighborhoodField],
+			Price:        rec[salePriceField],
+			Purchaser:    rec["Purchaser"],
+		})
+	}
+	return rows
+}
+
+var dashboardPage = template.Must(template.New("dashboard").Parse(dashboardTemplate))
+
+const dashboardTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Foreclosures Dashboard</title>
+<style>
+body { font: 14px/1.4 system-ui, sans-serif; margin: 0 auto; max-width: 1100px; padding: 1em 2em; color: #222; }
+h1 { font-size: 1.6em; margin-bottom: 0.2em; }
+h2 { font-size: 1.15em; margin-top: 2em; border-bottom: 1px solid #ddd; padding-bottom: 0.3em; }
+.muted { color: #777; }
+.error { color: #b00; }
+form { margin: 1em 0; display: flex; gap: 1em; flex-wrap: wrap; align-items: end; }
+form label { display: flex; flex-direction: column; font-size: 0.85em; color: #555; }
+.months { display: flex; align-items: flex-end; gap: 2px; height: 220px; border-bottom: 1px solid #999; }
+.months div { flex: 1; background: #3a78b5; min-width: 4px; }
+.months div:hover { background: #1d4f80; }
+.month-labels { display: flex; justify-content: space-between; font-size: 0.8em; color: #777; }
+.bars { display: grid; grid-template-columns: 12em 1fr 4em; gap: 4px 8px; align-items: center; }
+.bars .bar { background: #e0873a; height: 1.1em; }
+.bars .count { text-align: right; font-variant-numeric: tabular-nums; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 4px 8px; border-bottom: 1px solid #eee; }
+td.price { text-align: right; font-variant-numeric: tabular-nums; }
+a { color: #1d4f80; }
+</style>
+</head>
+<body>
+<h1>Foreclosures Dashboard</h1>
+<p class="muted">
+{{if .Filtered}}{{.Records}} of {{end}}{{.Total}} records, data updated {{.UpdatedAt}}.
+JSON: <a href="records?limit=10">/records</a>, <a href="stats/Neighborhood">/stats/Neighborhood</a>.
+</p>
+
+<form method="get">
+{{if .Choices}}<label>Neighborhood
+<select name="Neighborhood">
+<option value="">All</option>
+{{range .Choices}}<option{{if eq . $.Neighborhood}} selected{{end}}>{{.}}</option>
+{{end}}</select></label>{{end}}
+<label>Zip <input name="zip" value="{{.Zip}}" size="6"></label>
+{{if .DateField}}<label>{{.DateField}} since <input type="date" name="since" value="{{.Since}}"></label>
+<label>until <input type="date" name="until" value="{{.Until}}"></label>{{end}}
+<button type="submit">Filter</button>
+{{if .Filtered}}<a href="?">Clear</a>{{end}}
+</form>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+
+<h2>Filings per month{{if .DateField}} <span class="muted">({{.DateField}})</span>{{end}}</h2>
+{{if .Months}}
+<div class="months">
+{{range .Months}}<div style="height: {{.Percent}}%" title="{{.Label}}: {{.Count}}"></div>
+{{end}}</div>
+<div class="month-labels"><span>{{.FirstMonth}}</span><span>{{.LastMonth}}</span></div>
+{{else}}<p class="muted">No dated records.</p>{{end}}
+
+<h2>Top neighborhoods</h2>
+{{if .Neighborhoods}}
+<div class="bars">
+{{range .Neighborhoods}}<a href="?{{.Query}}">{{.Label}}</a><div><div class="bar" style="width: {{.Percent}}%"></div></div><span class="count">{{.Count}}</span>
+{{end}}</div>
+{{else}}<p class="muted">No neighborhoods.</p>{{end}}
+
+<h2>Recent sales</h2>
+{{if .Sales}}
+<table>
+<tr><th>Sale date</th><th>Address</th><th>Neighborhood</th><th>Price</th><th>Purchaser</th></tr>
+{{range .Sales}}<tr><td>{{if .ID}}<a href="records/{{.ID}}">{{.Date}}</a>{{else}}{{.Date}}{{end}}</td><td>{{.Address}}</td><td>{{.Neighborhood}}</td><td class="price">{{.Price}}</td><td>{{.Purchaser}}</td></tr>
+{{end}}</table>
+{{else}}<p class="muted">No sales.</p>{{end}}
+
+<p class="muted">Files: {{range $i, $f := .Files}}{{if $i}}, {{end}}{{$f}}{{end}}</p>
+</body>
+</html>
+`
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dataPackageFile is the Frictionless Data Package descriptor written to
+// the output directory by -datapackage.
+const dataPackageFile = "datapackage.json"
+
+// DataPackage is a Frictionless Data Package descriptor
+// (https://specs.frictionlessdata.io/data-package/) for the CSV output.
+type DataPackage struct {
+	Profile   string         `json:"profile"`
+	Name      string         `json:"name"`
+	Title     string         `json:"title,omitempty"`
+	Created   time.Time      `json:"created"`
+	Sources   []DataSource   `json:"sources"`
+	Resources []DataResource `json:"resources"`
+}
+
+type DataSource struct {
+	Title string `json:"title"`
+	Path  string `json:"path"`
+}
+
+// DataResource is one CSV file of the package. A partitioned output has
+// one resource per file, all with the same schema.
+type DataResource struct {
+	Profile   string       `json:"profile"`
+	Name      string       `json:"name"`
+	Path      string       `json:"path"` // relative to the descriptor
+	Format    string       `json:"format"`
+	MediaType string       `json:"mediatype"`
+	Encoding  string       `json:"encoding"`
+	Bytes     int64        `json:"bytes"`
+	Hash      string       `json:"hash"`
+	Dialect   *DataDialect `json:"dialect,omitempty"`
+	Schema    *TableSchema `json:"schema"`
+}
+
+// DataDialect describes a CSV that differs from the default dialect.
+type DataDialect struct {
+	Delimiter      string `json:"delimiter,omitempty"`
+	LineTerminator string `json:"lineTerminator,omitempty"`
+}
+
+// TableSchema is a Frictionless Table Schema.
+type TableSchema struct {
+	Fields        []SchemaField `json:"fields"`
+	PrimaryKey    []string      `json:"primaryKey,omitempty"`
+	MissingValues []string      `json:"missingValues"`
+}
+
+type SchemaField struct {
+	Name        string            `json:"name"`
+	Title       string            `json:"title,omitempty"`
+	Type        string            `json:"type"`
+	Description string            `json:"description,omitempty"`
+	Constraints *FieldConstraints `json:"constraints,omitempty"`
+}
+
+type FieldConstraints struct {
+	Required bool     `json:"required,omitempty"`
+	Unique   bool     `json:"unique,omitempty"`
+	Enum     []string `json:"enum,omitempty"`
+}
+
+// writeDataPackage describes the outputs of a run in datapackage.json in
+// dir, next to them, and returns its path. Without layer metadata (an
+// empty layer), the columns that come from the layer have type "any".
+func (j *fetchJob) writeDataPackage(layer *LayerInfo, dir string, outputs []string) (string, error) {
+	pkg := &DataPackage{
+		Profile: "tabular-data-package",
+		Name:    packageName(firstNonEmpty(layer.Name, layerLabel(j.query.URL))),
+		Title:   layer.Name,
+		Created: time.Now().UTC().Truncate(time.Second),
+		Sources: []DataSource{{Title: "ArcGIS feature layer", Path: layerURL(j.query.URL)}},
+	}
+
+	schema := j.tableSchema(layer)
+	var dialect *DataDialect
+	if j.dialect.Comma != ',' || j.dialect.UseCRLF {
+		dialect = &DataDialect{}
+		if j.dialect.Comma != ',' {
+			dialect.Delimiter = string(j.dialect.Comma)
+		}
+		if j.dialect.UseCRLF {
+			dialect.LineTerminator = "\r\n"
+		}
+	}
+	for _, file := range statOutputs(outputs) {
+		rel, err := filepath.Rel(dir, file.Path)
+		if err != nil {
+			return "", err
+		}
+		sum, err := fileSHA256(file.Path)
+		if err != nil {
+			return "", err
+		}
+		pkg.Resources = append(pkg.Resources, DataResource{
+			Profile:   "tabular-data-resource",
+			Name:      packageName(strings.TrimSuffix(filepath.Base(file.Path), filepath.Ext(file.Path))),
+			Path:      filepath.ToSlash(rel),
+			Format:    "csv",
+			MediaType: "text/csv",
+			Encoding:  "utf-8",
+			Bytes:     file.Size,
+			Hash:      "sha256:" + sum,
+			Dialect:   dialect,
+			Schema:    schema,
+		})
+	}
+
+	path := filepath.Join(dir, dataPackageFile)
+	data, err := json.MarshalIndent(pkg, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return "", err
+	}
+	return path, os.Rename(tmp, path)
+}
+
+// tableSchema describes the output columns, with their types as the
+// formatting flags write them.
+func (j *fetchJob) tableSchema(layer *LayerInfo) *TableSchema {
+	fields := make(map[string]FieldInfo)
+	for _, field := range layer.Fields {
+		fields[field.Name] = field
+	}
+	schema := &TableSchema{MissingValues: []string{""}}
+	if token := j.formatter.NullToken; token != "" {
+		schema.MissingValues = append(schema.MissingValues, token)
+	}
+	for _, name := range j.headers {
+		field := SchemaField{Name: j.column(name), Type: "any"}
+		info, known := fields[name]
+		if known && info.Alias != name {
+			field.Title = info.Alias
+		}
+		switch {
+		case j.formatter.RedactFields[name]:
+			field.Type, field.Description = "string", "redacted"
+		case j.formatter.HashFields[name]:
+			field.Type, field.Description = "string", "HMAC-SHA256 of the value, hex-encoded"
+		case j.formatter.Coerce[name].Type == "date":
+			field.Type, field.Description = j.dateType(name)
+		case j.formatter.Coerce[name].Type != "":
+			field.Type = coercedSchemaTypes[j.formatter.Coerce[name].Type]
+		case dateFields[name]:
+			field.Type, field.Description = j.dateType(name)
+		case j.formatter.NumberFields[name] || slices.Contains(geometryFields, name) ||
+			name == latitudeField || name == longitudeField || (j.census != nil && slices.Contains(j.census.columns(), name)):
+			field.Type = "number"
+		case name == addressField:
+			field.Type = "string"
+		case known:
+			field.Type = esriSchemaTypes[info.Type]
+			if field.Type == "" {
+				field.Type = "any"
+			}
+			if info.Domain != nil && len(info.Domain.CodedValues) > 0 {
+				field.Constraints = &FieldConstraints{}
+				for _, cv := range info.Domain.CodedValues {
+					field.Constraints.Enum = append(field.Constraints.Enum, j.formatter.formatPlain(name, cv.Code))
+				}
+			}
+		}
+		if name == idField || (known && info.Type == "esriFieldTypeOID") {
+			field.Constraints = &FieldConstraints{Required: true, Unique: true}
+			schema.PrimaryKey = []string{field.Name}
+		}
+		schema.Fields = append(schema.Fields, field)
+	}
+	return schema
+}
+
+// dateType is the Table Schema type of a date field under -date-format
+// and -raw-dates. Go layouts other than the presets have no Table Schema
+// equivalent and are described as strings.
+func (j *fetchJob) dateType(name string) (typ, description string) {
+	f := j.formatter
+	switch {
+	case f.RawDates["*"] || f.RawDates[name]:
+		return "integer", "milliseconds since 1970-01-01 UTC"
+	case f.EpochDates:
+		return "integer", "seconds since 1970-01-01 UTC"
+	case f.DateLayout == datePresets["date-only"]:
+		return "date", "calendar date in " + f.Location.String()
+	case f.DateLayout == datePresets["iso8601"]:
+		return "datetime", ""
+	}
+	return "string", "date written with the Go layout " + strconv.Quote(f.DateLayout) + " in " + f.Location.String()
+}
+
+// esriSchemaTypes maps ArcGIS field types to Table Schema types. Other
+// esri date fields are written as the API returns them, in milliseconds.
+var esriSchemaTypes = map[string]string{
+	"esriFieldTypeOID":          "integer",
+	"esriFieldTypeSmallInteger": "integer",
+	"esriFieldTypeInteger":      "integer",
+	"esriFieldTypeBigInteger":   "integer",
+	"esriFieldTypeSingle":       "number",
+	"esriFieldTypeDouble":       "number",
+	"esriFieldTypeString":       "string",
+	"esriFieldTypeGUID":         "string",
+	"esriFieldTypeGlobalID":     "string",
+	"esriFieldTypeDate":         "integer",
+	"esriFieldTypeDateOnly":     "date",
+}
+
+// coercedSchemaTypes maps the -coerce types to Table Schema types.
+var coercedSchemaTypes = map[string]string{
+	"int":    "integer",
+	"float":  "number",
+	"string": "string",
+}
+
+var packageNameInvalid = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// packageName turns a layer or file name into a Data Package name, which
+// may only hold lowercase letters, digits, "-", "_" and ".".
+func packageName(s string) string {
+	name := strings.Trim(packageNameInvalid.ReplaceAllString(strings.ToLower(s), "-"), "-")
+	if name == "" {
+		return "fetch"
+	}
+	return name
+}
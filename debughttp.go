@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// debugTransport logs every request for -debug-http: the URL without its
+// token, the status, the time to the response headers, and once the body
+// has been read and closed, its size and the time of the whole exchange.
+type debugTransport struct {
+	base http.RoundTripper
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	log := slog.With("method", req.Method, "url", cacheURL(req))
+	if err != nil {
+		log.Warn("http request failed", "duration", time.Since(start), "err", err)
+		return nil, err
+	}
+	headers := time.Since(start)
+	resp.Body = &debugBody{ReadCloser: resp.Body, done: func(n int64) {
+		log.Info("http request", "status", resp.StatusCode, "proto", resp.Proto,
+			"contentType", resp.Header.Get("Content-Type"), "bytes", n,
+			"headers", headers, "duration", time.Since(start))
+	}}
+	return resp, nil
+}
+
+// debugBody counts the bytes read from a response body and reports them
+// once when it is closed.
+type debugBody struct {
+	io.ReadCloser
+	n    int64
+	once sync.Once
+	done func(n int64)
+}
+
+func (b *debugBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *debugBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.done(b.n) })
+	return err
+}
+
+// dumpResponse saves a response that failed, for -debug-http-dir: the
+// request URL without its token, the error, the status and headers, and
+// the body as the server sent it (decompressed). Token requests never
+// get here, so no token or password is written.
+func (c *Client) dumpResponse(req *http.Request, resp *http.Response, body []byte, failure error) {
+	n := c.dumps.Add(1)
+	path := filepath.Join(c.DumpDir, fmt.Sprintf("%s_%04d.txt", time.Now().Format("20060102T150405"), n))
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s\n", req.Method, cacheURL(req))
+	fmt.Fprintf(&buf, "Error: %v\n\n", failure)
+	fmt.Fprintf(&buf, "%s %s\n", resp.Proto, resp.Status)
+	for _, name := range slices.Sorted(maps.Keys(resp.Header)) {
+		for _, value := range resp.Header[name] {
+			fmt.Fprintf(&buf, "%s: %s\n", name, value)
+		}
+	}
+	buf.WriteString("\n")
+	buf.Write(body)
+
+	if err := os.MkdirAll(c.DumpDir, os.ModePerm); err != nil {
+		slog.Warn("cannot save response", "dir", c.DumpDir, "err", err)
+		return
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		slog.Warn("cannot save response", "path", path, "err", err)
+		return
+	}
+	slog.Warn("failed response saved", "path", path, "url", cacheURL(req))
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// decodeFunc decodes a query response, calling visit for each feature. It
+// reports whether the server set exceededTransferLimit: the page was cut
+// short of the records the query asked for, or more records follow it.
+type decodeFunc func(r io.Reader, visit func(attrs map[string]interface{}, geometry *Geometry)) (exceeded bool, err error)
+
+// featureDecoder returns the decoder of query responses in format, the
+// f= of the request: esri JSON by default, pbf or geojson.
+func featureDecoder(format string) decodeFunc {
+	switch format {
+	case "pbf":
+		return decodePBF
+	case "geojson":
+		return decodeGeoJSON
+	}
+	return decodeFeatures
+}
+
+// decodeFeatures streams a query response, calling visit for each feature
+// as soon as it has been read, instead of unmarshalling the whole page
+// (twice, with the error probe) into a []Feature first. The attributes of
+// a feature are parsed by attributeDecoder; an error object in place of
+// the result is returned as an *ArcGISError.
+func decodeFeatures(r io.Reader, visit func(attrs map[string]interface{}, geometry *Geometry)) (bool, error) {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return false, err
+	}
+
+	attrs := newAttributeDecoder()
+	var exceeded bool
+	var feature struct {
+		Attributes json.RawMessage `json:"attributes"`
+		Geometry   *Geometry       `json:"geometry"`
+	}
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return false, err
+		}
+		switch tok {
+		case "error":
+			var apiErr ArcGISError
+			if err := dec.Decode(&apiErr); err != nil {
+				return false, err
+			}
+			return false, &apiErr
+		case "features":
+			if err := expectDelim(dec, '['); err != nil {
+				return false, err
+			}
+			for dec.More() {
+				// Decode reuses the RawMessage buffer from the previous feature.
+				feature.Attributes, feature.Geometry = feature.Attributes[:0], nil
+				if err := dec.Decode(&feature); err != nil {
+					return false, err
+				}
+				m, err := attrs.decode(feature.Attributes)
+				if err != nil {
+					return false, err
+				}
+				visit(m, feature.Geometry)
+			}
+			if err := expectDelim(dec, ']'); err != nil {
+				return false, err
+			}
+		case "exceededTransferLimit":
+			if err := dec.Decode(&exceeded); err != nil {
+				return false, err
+			}
+		default:
+			// fields, spatialReference, ...
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return false, err
+			}
+		}
+	}
+	return exceeded, expectDelim(dec, '}')
+}
+
+// decodeGeoJSON streams a f=geojson query response like decodeFeatures.
+// The properties are the attributes; a Point's coordinates become the
+// geometry, in WGS84 longitude/latitude unless -out-sr asked otherwise.
+func decodeGeoJSON(r io.Reader, visit func(attrs map[string]interface{}, geometry *Geometry)) (bool, error) {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return false, err
+	}
+
+	attrs := newAttributeDecoder()
+	var exceeded bool
+	var feature struct {
+		Properties json.RawMessage `json:"properties"`
+		Geometry   *struct {
+			Type        string          `json:"type"`
+			Coordinates json.RawMessage `json:"coordinates"`
+		} `json:"geometry"`
+	}
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return false, err
+		}
+		switch tok {
+		case "error":
+			var apiErr ArcGISError
+			if err := dec.Decode(&apiErr); err != nil {
+				return false, err
+			}
+			return false, &apiErr
+		case "features":
+			if err := expectDelim(dec, '['); err != nil {
+				return false, err
+			}
+			for dec.More() {
+				feature.Properties, feature.Geometry = feature.Properties[:0], nil
+				if err := dec.Decode(&feature); err != nil {
+					return false, err
+				}
+				m, err := attrs.decode(feature.Properties)
+				if err != nil {
+					return false, err
+				}
+				// Only points have X and Y columns; the coordinates of
+				// lines and polygons are left undecoded.
+				var g *Geometry
+				if p := feature.Geometry; p != nil && p.Type == "Point" {
+					var xy []float64
+					if err := json.Unmarshal(p.Coordinates, &xy); err == nil && len(xy) >= 2 {
+						g = &Geometry{X: &xy[0], Y: &xy[1]}
+					}
+				}
+				visit(m, g)
+			}
+			if err := expectDelim(dec, ']'); err != nil {
+				return false, err
+			}
+		case "properties":
+			// The collection's properties hold exceededTransferLimit.
+			var props struct {
+				ExceededTransferLimit bool `json:"exceededTransferLimit"`
+			}
+			if err := dec.Decode(&props); err != nil {
+				return false, err
+			}
+			exceeded = props.ExceededTransferLimit
+		default:
+			// type, crs, ...
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return false, err
+			}
+		}
+	}
+	return exceeded, expectDelim(dec, '}')
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != want {
+		return fmt.Errorf("invalid query response: expected %v, found %v", want, tok)
+	}
+	return nil
+}
+
+// attributeDecoder parses feature attribute objects. Attributes are flat
+// objects of strings, numbers, booleans and nulls, so a small hand-written
+// parser handles them far faster than encoding/json does for a
+// map[string]interface{}. It also cuts the garbage per page: field names
+// are allocated once per page rather than once per feature, maps are
+// sized for the field count up front, and short string values that repeat
+// (zip codes, street types) share one boxed value. Anything unexpected is
+// handed to encoding/json.
+type attributeDecoder struct {
+	keys   map[string]string
+	values map[string]interface{}
+	fields int // largest attribute count seen, used to size new maps
+}
+
+const (
+	maxCachedValueLen = 32   // longer strings are rarely repeated
+	maxCachedValues   = 4096 // bounds the cache on pages of unique values
+)
+
+var errUnexpectedAttribute = errors.New("unexpected attribute syntax")
+
+func newAttributeDecoder() *attributeDecoder {
+	return &attributeDecoder{
+		keys:   make(map[string]string),
+		values: make(map[string]interface{}),
+	}
+}
+
+// decode parses one attributes object. Empty input and null give a nil map.
+func (d *attributeDecoder) decode(data []byte) (map[string]interface{}, error) {
+	m, err := d.parse(data)
+	if errors.Is(err, errUnexpectedAttribute) {
+		m = nil
+		err = json.Unmarshal(data, &m)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(m) > d.fields {
+		d.fields = len(m)
+	}
+	return m, nil
+}
+
+func (d *attributeDecoder) parse(b []byte) (map[string]interface{}, error) {
+	i := skipSpace(b, 0)
+	if i == len(b) || hasLiteral(b, i, "null") {
+		return nil, nil
+	}
+	if b[i] != '{' {
+		return nil, errUnexpectedAttribute
+	}
+
+	m := make(map[string]interface{}, d.fields)
+	i = skipSpace(b, i+1)
+	if i < len(b) && b[i] == '}' {
+		return m, nil
+	}
+	for {
+		if i == len(b) || b[i] != '"' {
+			return nil, errUnexpectedAttribute
+		}
+		end, escaped, err := scanString(b, i)
+		if err != nil {
+			return nil, err
+		}
+		var key string
+		if escaped {
+			if err := json.Unmarshal(b[i:end], &key); err != nil {
+				return nil, err
+			}
+			key = d.key([]byte(key))
+		} else {
+			key = d.key(b[i+1 : end-1])
+		}
+
+		i = skipSpace(b, end)
+		if i == len(b) || b[i] != ':' {
+			return nil, errUnexpectedAttribute
+		}
+		i = skipSpace(b, i+1)
+		if i == len(b) {
+			return nil, errUnexpectedAttribute
+		}
+
+		var value interface{}
+		switch c := b[i]; {
+		case c == '"':
+			end, escaped, err := scanString(b, i)
+			if err != nil {
+				return nil, err
+			}
+			if escaped {
+				var s string
+				if err := json.Unmarshal(b[i:end], &s); err != nil {
+					return nil, err
+				}
+				value = s
+			} else {
+				value = d.value(b[i+1 : end-1])
+			}
+			i = end
+		case hasLiteral(b, i, "null"):
+			value, i = nil, i+4
+		case hasLiteral(b, i, "true"):
+			value, i = true, i+4
+		case hasLiteral(b, i, "false"):
+			value, i = false, i+5
+		case c == '-' || (c >= '0' && c <= '9'):
+			j := i + 1
+			for j < len(b) && isNumberByte(b[j]) {
+				j++
+			}
+			n, err := strconv.ParseFloat(string(b[i:j]), 64)
+			if err != nil {
+				return nil, errUnexpectedAttribute
+			}
+			value, i = n, j
+		default:
+			// Nested objects or arrays: leave them to encoding/json.
+			return nil, errUnexpectedAttribute
+		}
+		m[key] = value
+
+		i = skipSpace(b, i)
+		if i < len(b) && b[i] == ',' {
+			i = skipSpace(b, i+1)
+			continue
+		}
+		if i < len(b) && b[i] == '}' {
+			return m, nil
+		}
+		return nil, errUnexpectedAttribute
+	}
+}
+
+// key returns the shared copy of a field name.
+func (d *attributeDecoder) key(b []byte) string {
+	if k, ok := d.keys[string(b)]; ok {
+		return k
+	}
+	k := string(b)
+	d.keys[k] = k
+	return k
+}
+
+// value boxes a string value, reusing the box for short repeated values.
+func (d *attributeDecoder) value(b []byte) interface{} {
+	if len(b) > maxCachedValueLen {
+		return string(b)
+	}
+	if v, ok := d.values[string(b)]; ok {
+		return v
+	}
+	var v interface{} = string(b)
+	if len(d.values) < maxCachedValues {
+		d.values[string(b)] = v
+	}
+	return v
+}
+
+// scanString finds the end of the JSON string starting at b[i], returning
+// the index after the closing quote and whether it contains escapes.
+func scanString(b []byte, i int) (end int, escaped bool, err error) {
+	for j := i + 1; j < len(b); j++ {
+		switch b[j] {
+		case '\\':
+			escaped = true
+			j++
+		case '"':
+			return j + 1, escaped, nil
+		}
+	}
+	return 0, false, errUnexpectedAttribute
+}
+
+func skipSpace(b []byte, i int) int {
+	for i < len(b) && (b[i] == ' ' || b[i] == '\t' || b[i] == '\n' || b[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+func hasLiteral(b []byte, i int, lit string) bool {
+	return len(b)-i >= len(lit) && string(b[i:i+len(lit)]) == lit
+}
+
+func isNumberByte(c byte) bool {
+	return (c >= '0' && c <= '9') || c == '.' || c == 'e' || c == 'E' || c == '+' || c == '-'
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// deltaTracker recognises the records of a run that were not in the
+// previous output, by ObjectId, so a run can report how many records are
+// new since the last one.
+type deltaTracker struct {
+	formatter *Formatter
+	previous  map[string]bool // nil if there was no previous output to compare with
+	newCount  int
+}
+
+// newDeltaTracker reads the ObjectIds of the previous outputs. It has to
+// be called before this run starts writing, since they are overwritten.
+func newDeltaTracker(paths []string, comma rune, idColumn string, f *Formatter) *deltaTracker {
+	d := &deltaTracker{formatter: f}
+	for _, path := range paths {
+		ids, err := readColumn(path, comma, idColumn)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			slog.Warn("cannot read previous output; new records will not be counted", "path", path, "err", err)
+			return &deltaTracker{formatter: f}
+		}
+		if d.previous == nil {
+			d.previous = make(map[string]bool, len(ids))
+		}
+		for _, id := range ids {
+			d.previous[id] = true
+		}
+	}
+	return d
+}
+
+// observe reports whether a record is new, and counts it if so. Records
+// are never new when there is nothing to compare with.
+func (d *deltaTracker) observe(record map[string]interface{}) bool {
+	if d.previous == nil {
+		return false
+	}
+	value, ok := record[idField]
+	if !ok {
+		// ObjectId is not among the fields fetched.
+		d.previous = nil
+		return false
+	}
+	if d.previous[d.formatter.formatValue(idField, value)] {
+		return false
+	}
+	d.newCount++
+	return true
+}
+
+// count returns the number of new records, or -1 if it is unknown.
+func (d *deltaTracker) count() int {
+	if d.previous == nil {
+		return -1
+	}
+	return d.newCount
+}
+
+// readColumn returns one column of a CSV file. A file without the column
+// is an error.
+func readColumn(path string, comma rune, column string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := csv.NewReader(file)
+	r.Comma = comma
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	idx := -1
+	for i, name := range header {
+		if strings.TrimPrefix(name, utf8BOM) == column {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return nil, errors.New("no " + column + " column")
+	}
+
+	var values []string
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if idx < len(row) {
+			values = append(values, row[idx])
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+// countField is the output statistic name used for distinct value counts.
+const countField = "value_count"
+
+// runDistinct implements the distinct subcommand, which lists the unique
+// values of a field together with how many records have each value:
+//
+//	go run . distinct -field Neighborhood
+func runDistinct(args []string) int {
+	fs := flag.NewFlagSet("distinct", flag.ExitOnError)
+	var opts Options
+	opts.registerClient(fs)
+	opts.registerQuery(fs)
+	opts.registerLogging(fs)
+	field := fs.String("field", "", "field to list distinct values for (required)")
+	counts := fs.Bool("counts", true, "include a record count per value (uses a statistics query)")
+	fs.Parse(args)
+	if err := setupLogging(&opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFatal
+	}
+
+	if *field == "" {
+		fmt.Fprintln(os.Stderr, "distinct: -field is required")
+		fs.Usage()
+		return exitFatal
+	}
+
+	query, err := newQuery(&opts)
+	if err != nil {
+		slog.Error("invalid query options", "err", err)
+		return exitFatal
+	}
+
+	client, err := newClient(&opts)
+	if err != nil {
+		slog.Error("invalid connection options", "err", err)
+		return exitFatal
+	}
+
+	params := query.params()
+	params.Del("orderByFields")
+
+	if *counts {
+		stats, _ := json.Marshal([]map[string]string{{
+			"statisticType":         "count",
+			"onStatisticField":      "ObjectId",
+			"outStatisticFieldName": countField,
+		}})
+		params.Set("groupByFieldsForStatistics", *field)
+		params.Set("outStatistics", string(stats))
+	} else {
+		params.Set("returnDistinctValues", "true")
+		params.Set("outFields", *field)
+	}
+
+	var result QueryResult
+	if err := client.getJSON(context.Background(), query.URL, params, &result); err != nil {
+		slog.Error("cannot query distinct values", "err", err)
+		return exitFatal
+	}
+
+	type valueCount struct {
+		value string
+		count float64
+	}
+	formatter := defaultFormatter()
+	values := make([]valueCount, 0, len(result.Features))
+	for _, feature := range result.Features {
+		v := formatter.formatValue(*field, feature.Attributes[*field])
+		if feature.Attributes[*field] == nil {
+			v = "(null)"
+		}
+		n, _ := feature.Attributes[countField].(float64)
+		values = append(values, valueCount{value: v, count: n})
+	}
+
+	// Most common values first; alphabetical when listing values only.
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].count != values[j].count {
+			return values[i].count > values[j].count
+		}
+		return values[i].value < values[j].value
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, vc := range values {
+		if *counts {
+			fmt.Fprintf(w, "%s\t%.0f\n", vc.value, vc.count)
+		} else {
+			fmt.Fprintln(w, vc.value)
+		}
+	}
+	w.Flush()
+
+	slog.Info("distinct values", "field", *field, "count", len(values))
+	if result.ExceededTransferLimit {
+		slog.Warn("the server truncated the result; narrow the query with -where")
+	}
+	return exitOK
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// CountDrift records records added to or deleted from the layer while a
+// run paged through it. Offsets then shift: a deletion moves a record
+// into a page that was already fetched, so it is skipped, and with an
+// -order-by other than ObjectId an addition can move a record into a
+// page still to come, so it arrives twice.
+type CountDrift struct {
+	Before     int `json:"before"`     // records matching when the run started
+	After      int `json:"after"`      // records matching once every page was fetched
+	Written    int `json:"written"`    // distinct ObjectIds the pages returned
+	Duplicates int `json:"duplicates"` // records that arrived again in a later page and were dropped
+	Refetched  int `json:"refetched"`  // records missed by the pages and fetched by ObjectId
+	Deleted    int `json:"deleted"`    // records written that no longer match; they stay in the output
+}
+
+// driftCheck tracks the ObjectIds written by an offset-paginated run, so
+// records that arrive twice can be dropped and, once the run is done,
+// the ones that were skipped fetched. It does nothing if ObjectId is not
+// among the fields fetched.
+type driftCheck struct {
+	seen       map[int64]bool
+	duplicates int
+	raw        *rawArchive // keeps the responses of the refetched records; may be nil
+}
+
+func newDriftCheck(raw *rawArchive) *driftCheck {
+	return &driftCheck{seen: make(map[int64]bool), raw: raw}
+}
+
+// filter drops the records whose ObjectId was written before.
+func (d *driftCheck) filter(records []map[string]interface{}) []map[string]interface{} {
+	kept := records[:0]
+	for _, record := range records {
+		id, ok := record[idField].(float64)
+		if ok && d.seen[int64(id)] {
+			d.duplicates++
+			continue
+		}
+		if ok {
+			d.seen[int64(id)] = true
+		}
+		kept = append(kept, record)
+	}
+	return kept
+}
+
+// reconcile counts the records again after a complete run that started
+// with before of them. If the count changed, records arrived twice, or the
+// pages returned a different number of records than match now, as when a
+// deletion and an addition leave the count as it was, it lists the
+// ObjectIds that match now and passes the records that no page returned
+// to write. It returns nil if nothing drifted.
+func (d *driftCheck) reconcile(ctx context.Context, client *Client, query *Query, before int, write func([]map[string]interface{}) error) (*CountDrift, error) {
+	after, err := fetchCount(ctx, client, query)
+	if err != nil {
+		return nil, fmt.Errorf("recount: %w", err)
+	}
+	written := len(d.seen)
+	if after == before && d.duplicates == 0 && (written == 0 || written == after) {
+		return nil, nil
+	}
+	drift := &CountDrift{Before: before, After: after, Written: written, Duplicates: d.duplicates}
+	slog.Warn("records were added or deleted while the pages were fetched",
+		"before", before, "after", after, "written", written, "duplicates", d.duplicates)
+	if written == 0 {
+		slog.Warn("records may be missing or repeated; add ObjectId to -fields so they can be found")
+		return drift, nil
+	}
+
+	ids, err := fetchObjectIDs(ctx, client, query)
+	if err != nil {
+		return drift, err
+	}
+	current := make(map[int64]bool, len(ids))
+	var missing []int64
+	for _, id := range ids {
+		current[id] = true
+		if !d.seen[id] {
+			missing = append(missing, id)
+		}
+	}
+	for id := range d.seen {
+		if !current[id] {
+			drift.Deleted++
+		}
+	}
+	slices.Sort(missing)
+	// The ObjectIds are part of the URL, like the keys of -join-url.
+	for batch := range slices.Chunk(missing, joinBatch) {
+		records, err := fetchObjects(ctx, client, query, batch, d.raw)
+		if err != nil {
+			return drift, err
+		}
+		records = d.filter(records)
+		if err := write(records); err != nil {
+			return drift, err
+		}
+		drift.Refetched += len(records)
+	}
+	if drift.Refetched > 0 || drift.Deleted > 0 {
+		slog.Info("output reconciled with the layer", "refetched", drift.Refetched, "deleted", drift.Deleted)
+	}
+	return drift, nil
+}
+
+// fetchObjectIDs returns the ObjectIds of every record matching the query.
+func fetchObjectIDs(ctx context.Context, client *Client, query *Query) ([]int64, error) {
+	params := query.params()
+	params.Del("orderByFields")
+	params.Del("outFields")
+	params.Set("returnIdsOnly", "true")
+
+	var result struct {
+		ObjectIDs []int64 `json:"objectIds"`
+	}
+	if err := client.getJSON(ctx, query.URL, params, &result); err != nil {
+		return nil, fmt.Errorf("object ids: %w", err)
+	}
+	return result.ObjectIDs, nil
+}
+
+// fetchObjects fetches the records of the query with the given ObjectIds.
+func fetchObjects(ctx context.Context, client *Client, query *Query, ids []int64, raw *rawArchive) ([]map[string]interface{}, error) {
+	oids := make([]string, len(ids))
+	for i, id := range ids {
+		oids[i] = strconv.FormatInt(id, 10)
+	}
+	params := query.params()
+	params.Set("objectIds", strings.Join(oids, ","))
+	records, _, err := fetchRecords(ctx, client, query, params, raw)
+	return records, err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// A deletion and an addition during the run leave the count as it was,
+// but the record added was not in any page.
+func TestReconcileFetchesMissedRecordsAtUnchangedCount(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		var v interface{}
+		switch {
+		case r.Form.Get("returnCountOnly") == "true":
+			v = map[string]int{"count": 3}
+		case r.Form.Get("returnIdsOnly") == "true":
+			v = map[string][]int{"objectIds": {1, 3, 4}}
+		case r.Form.Get("objectIds") == "4":
+			v = map[string]interface{}{"features": []interface{}{
+				map[string]interface{}{"attributes": map[string]int{"ObjectId": 4}},
+			}}
+		default:
+			t.Errorf("unexpected request %s", r.URL.RawQuery)
+		}
+		json.NewEncoder(w).Encode(v)
+	}))
+	defer server.Close()
+
+	d := newDriftCheck(nil)
+	// The pages returned 1 and 3, then 2 was deleted and 4 added.
+	d.filter([]map[string]interface{}{{idField: 1.0}, {idField: 3.0}})
+	var written []map[string]interface{}
+	client := &Client{HTTP: server.Client()}
+	query := &Query{URL: server.URL + "/query", Where: "1=1"}
+	drift, err := d.reconcile(context.Background(), client, query, 3, func(records []map[string]interface{}) error {
+		written = append(written, records...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drift == nil {
+		t.Fatal("no drift reported")
+	}
+	if drift.Written != 2 || drift.Refetched != 1 {
+		t.Errorf("written %d, refetched %d; want 2 and 1", drift.Written, drift.Refetched)
+	}
+	if len(written) != 1 || written[0][idField] != 4.0 {
+		t.Errorf("refetched %v, want ObjectId 4", written)
+	}
+}
+
+func TestReconcileNoDrift(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]int{"count": 2})
+	}))
+	defer server.Close()
+
+	d := newDriftCheck(nil)
+	d.filter([]map[string]interface{}{{idField: 1.0}, {idField: 2.0}})
+	client := &Client{HTTP: server.Client()}
+	drift, err := d.reconcile(context.Background(), client, &Query{URL: server.URL + "/query"}, 2, nil)
+	if err != nil || drift != nil {
+		t.Errorf("got %v, %v; want no drift", drift, err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// runDuplicates implements the duplicates subcommand, which lists the
+// parcels that appear more than once in the latest extract, with the cases
+// filed against each and the span of their filing dates:
+//
+//	go run . duplicates
+//	go run . duplicates -by Case_ -format csv > data/duplicate_cases.csv
+//
+// A parcel with several cases has been foreclosed on repeatedly; one case
+// listed several times is more likely a data problem.
+func runDuplicates(args []string) int {
+	fs := flag.NewFlagSet("duplicates", flag.ExitOnError)
+	var opts Options
+	opts.registerLogging(fs)
+	by := fs.String("by", "Full_Parcel_ID", "field whose repeated values are listed")
+	least := fs.Int("min", 2, "least number of records a value needs to be listed")
+	caseField := fs.String("case-field", "Case_", "field with the case number")
+	data := fs.String("data", "", "CSV file to analyze, instead of the outputs of the last run recorded in -report")
+	fs.StringVar(&opts.Report, "report", filepath.Join(outputDir, defaultReportFile), "run report naming the latest outputs")
+	fs.StringVar(&opts.DateField, "date-field", "Action_Filed", "date field the span is measured on")
+	fs.StringVar(&opts.DateFormat, "date-format", "default", "-date-format the extract was written with")
+	fs.StringVar(&opts.TZ, "tz", "", "-tz the extract was written with")
+	fs.StringVar(&opts.Delimiter, "delimiter", ",", "-delimiter the extract was written with")
+	format := fs.String("format", "table", "result format: table, csv or json")
+	fs.Parse(args)
+	if err := setupLogging(&opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFatal
+	}
+	if !slices.Contains([]string{"table", "csv", "json"}, *format) {
+		fmt.Fprintln(os.Stderr, "duplicates: -format must be table, csv or json")
+		return exitFatal
+	}
+	if *least < 2 {
+		fmt.Fprintln(os.Stderr, "duplicates: -min must be at least 2")
+		return exitFatal
+	}
+
+	formatter, err := newFormatter(&opts)
+	if err != nil {
+		slog.Error("invalid formatting options", "err", err)
+		return exitFatal
+	}
+	comma, err := parseDelimiter(opts.Delimiter)
+	if err != nil {
+		slog.Error("invalid formatting options", "err", err)
+		return exitFatal
+	}
+	store := &extractStore{comma: comma, dateField: opts.DateField, formatter: formatter}
+	paths := latestOutputs(*data, opts.Report, filepath.Join(outputDir, outputFile))
+	ds, err := store.load(paths, make([]time.Time, len(paths)))
+	if err != nil {
+		slog.Error("cannot load extract", "err", err)
+		return exitFatal
+	}
+
+	key, ok := ds.column(*by)
+	if !ok {
+		slog.Error("the extract has no -by column", "field", *by)
+		return exitFatal
+	}
+	if ds.dateColumn == "" {
+		slog.Error("the extract has no -date-field column", "field", opts.DateField)
+		return exitFatal
+	}
+	cases, _ := ds.column(*caseField)
+
+	result := findDuplicates(ds, key, cases, *least)
+	if err := result.write(os.Stdout, *format, formatter); err != nil {
+		slog.Error("cannot write result", "err", err)
+		return exitFatal
+	}
+	slog.Info("repeated values", "field", key, "values", len(result.rows), "records", len(ds.records))
+	return exitOK
+}
+
+// findDuplicates groups the records of the extract by the key column and
+// returns the groups of -min records or more, those with the most records
+// first, then the longest spans. Records without a key are not grouped.
+func findDuplicates(ds *dataset, key, caseColumn string, least int) *sqlResult {
+	groups := make(map[string][]int)
+	for i, rec := range ds.records {
+		// Placeholders such as "---" are no key either.
+		if v := strings.TrimSpace(rec[key]); strings.Trim(v, "-0 ") != "" {
+			groups[v] = append(groups[v], i)
+		}
+	}
+
+	dates := ds.dates[ds.dateColumn]
+	result := &sqlResult{columns: []string{
+		key, "records", "cases", "first_" + ds.dateColumn, "last_" + ds.dateColumn, "span_days", "case_numbers", "address",
+	}}
+	for value, rows := range groups {
+		if len(rows) < least {
+			continue
+		}
+		// In filing order, undated records last.
+		slices.SortStableFunc(rows, func(a, b int) int {
+			if dates[a].IsZero() != dates[b].IsZero() {
+				if dates[a].IsZero() {
+					return 1
+				}
+				return -1
+			}
+			return dates[a].Compare(dates[b])
+		})
+
+		var numbers []string
+		if caseColumn != "" {
+			for _, i := range rows {
+				if n := strings.TrimSpace(ds.records[i][caseColumn]); n != "" && !slices.Contains(numbers, n) {
+					numbers = append(numbers, n)
+				}
+			}
+		}
+		var first, last, span sqlValue
+		for _, i := range rows {
+			if t := dates[i]; !t.IsZero() {
+				if first == nil {
+					first = t
+				}
+				last = t
+			}
+		}
+		if first != nil {
+			span = float64(int(last.(time.Time).Sub(first.(time.Time)).Hours() / 24))
+		}
+		var caseCount sqlValue
+		if caseColumn != "" {
+			caseCount = float64(len(numbers))
+		}
+
+		// The address of the latest record.
+		latest := ds.records[rows[len(rows)-1]]
+		address := make(map[string]interface{}, len(addressFields))
+		for _, field := range addressFields {
+			if column, ok := ds.column(field); ok {
+				address[field] = latest[column]
+			}
+		}
+		var addr sqlValue
+		if a, ok := normalizeAddress(address).(string); ok {
+			addr = a
+		}
+
+		result.rows = append(result.rows, []sqlValue{
+			value, float64(len(rows)), caseCount, first, last, span, strings.Join(numbers, " "), addr,
+		})
+	}
+
+	slices.SortFunc(result.rows, func(a, b []sqlValue) int {
+		spanA, _ := a[5].(float64)
+		spanB, _ := b[5].(float64)
+		return cmp.Or(
+			cmp.Compare(b[1].(float64), a[1].(float64)),
+			cmp.Compare(spanB, spanA),
+			strings.Compare(a[0].(string), b[0].(string)),
+		)
+	})
+	return result
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxAttachment is the largest -delta file attached to an email; mail
+// servers commonly reject messages much over 10 MB.
+const maxAttachment = 8 << 20
+
+// emailNotifier sends the run summary to a distribution list over SMTP,
+// optionally with the -delta CSV attached. Port 465 uses implicit TLS;
+// other ports upgrade with STARTTLS when the server offers it, and
+// credentials are only sent over TLS (or to localhost).
+type emailNotifier struct {
+	addr        string // host:port
+	username    string
+	password    string
+	from        string
+	to          []*mail.Address
+	attachDelta bool
+}
+
+func newEmailNotifier(opts *Options) *emailNotifier {
+	addr := opts.SMTPHost
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "587")
+	}
+	username := firstNonEmpty(opts.SMTPUser, os.Getenv("SMTP_USERNAME"))
+	to, _ := mail.ParseAddressList(opts.EmailTo) // checked by checkNotifyOptions
+	return &emailNotifier{
+		addr:        addr,
+		username:    username,
+		password:    os.Getenv("SMTP_PASSWORD"),
+		from:        firstNonEmpty(opts.EmailFrom, username),
+		to:          to,
+		attachDelta: opts.EmailAttachDelta,
+	}
+}
+
+func (e *emailNotifier) name() string { return "email " + e.addr }
+
+func (e *emailNotifier) notify(ctx context.Context, report *RunReport) error {
+	msg, err := e.message(report)
+	if err != nil {
+		return err
+	}
+	return e.send(ctx, msg)
+}
+
+// message builds the MIME message: the summary as text, and the delta
+// as a CSV attachment.
+func (e *emailNotifier) message(report *RunReport) ([]byte, error) {
+	m := newRunMessage(report)
+	var text strings.Builder
+	for _, line := range m.Lines {
+		text.WriteString(line + "\r\n")
+	}
+
+	var attachment []byte
+	var attachmentName string
+	if e.attachDelta && report.Delta != nil && report.NewRecords > 0 {
+		// With -encrypt-to, the encrypted copy is attached instead.
+		delta := report.Delta.OutputFile
+		for _, enc := range report.Encrypted {
+			if strings.TrimSuffix(enc.Path, filepath.Ext(enc.Path)) == delta.Path {
+				delta = enc.OutputFile
+			}
+		}
+		switch {
+		case delta.Size > maxAttachment:
+			fmt.Fprintf(&text, "\r\nThe %s new records are in %s (%s), too large to attach.\r\n",
+				formatCount(report.NewRecords), delta.Path, formatBytes(delta.Size))
+		default:
+			data, err := os.ReadFile(delta.Path)
+			if err != nil {
+				return nil, err
+			}
+			attachment, attachmentName = data, filepath.Base(delta.Path)
+			fmt.Fprintf(&text, "\r\nThe new records are attached as %s.\r\n", attachmentName)
+		}
+	}
+
+	var buf bytes.Buffer
+	header := func(name, value string) { fmt.Fprintf(&buf, "%s: %s\r\n", name, value) }
+	header("From", e.from)
+	to := make([]string, len(e.to))
+	for i, a := range e.to {
+		to[i] = a.String()
+	}
+	header("To", strings.Join(to, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Headline))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", "<"+randomToken()+"@"+hostOf(e.from)+">")
+	header("MIME-Version", "1.0")
+
+	if attachment == nil {
+		header("Content-Type", "text/plain; charset=utf-8")
+		header("Content-Transfer-Encoding", "8bit")
+		buf.WriteString("\r\n" + text.String())
+		return buf.Bytes(), nil
+	}
+
+	boundary := "fetch-" + randomToken()
+	header("Content-Type", `multipart/mixed; boundary="`+boundary+`"`)
+	buf.WriteString("\r\n--" + boundary + "\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	buf.WriteString(text.String())
+	buf.WriteString("\r\n--" + boundary + "\r\n")
+	contentType := "text/csv; charset=utf-8"
+	if filepath.Ext(attachmentName) != ".csv" {
+		contentType = "application/octet-stream" // encrypted
+	}
+	fmt.Fprintf(&buf, "Content-Type: %s; name=%q\r\n", contentType, attachmentName)
+	fmt.Fprintf(&buf, "Content-Disposition: attachment; filename=%q\r\n", attachmentName)
+	buf.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+	encoded := base64.StdEncoding.EncodeToString(attachment)
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded + "\r\n--" + boundary + "--\r\n")
+	return buf.Bytes(), nil
+}
+
+func (e *emailNotifier) send(ctx context.Context, msg []byte) error {
+	host, port, _ := net.SplitHostPort(e.addr)
+	tlsConfig := &tls.Config{ServerName: host}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", e.addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if port == "465" {
+		conn = tls.Client(conn, tlsConfig)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok && port != "465" {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if e.username != "" {
+		// PlainAuth refuses to send the password without TLS, except to localhost.
+		if err := c.Auth(smtp.PlainAuth("", e.username, e.password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(addressOf(e.from)); err != nil {
+		return err
+	}
+	for _, to := range e.to {
+		if err := c.Rcpt(to.Address); err != nil {
+			return fmt.Errorf("%s: %w", to.Address, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// addressOf returns the bare address of "Name <addr>" or "addr".
+func addressOf(s string) string {
+	if a, err := mail.ParseAddress(s); err == nil {
+		return a.Address
+	}
+	return strings.TrimSpace(s)
+}
+
+func hostOf(address string) string {
+	if _, host, ok := strings.Cut(addressOf(address), "@"); ok && host != "" {
+		return host
+	}
+	return "localhost"
+}
+
+func randomToken() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
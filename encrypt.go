@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// encrypter writes encrypted copies of the outputs for -encrypt-to, with
+// age (.age) or OpenPGP (.gpg). The run removes the plaintext files once
+// it has succeeded, unless -keep-plaintext keeps them in the output
+// directory for -merge, -delta and serve.
+type encrypter struct {
+	age []*ageRecipient
+	pgp []*pgpRecipient
+}
+
+// newEncrypter parses the -encrypt-to values, or returns nil if there are
+// none. A value is an age recipient (age1...), a file of age recipients,
+// one per line, or an exported OpenPGP public key, armored or binary, as
+// written by "gpg --export --armor".
+func newEncrypter(values []string) (*encrypter, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	e := &encrypter{}
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(strings.ToLower(value), "age1") {
+			r, err := parseAgeRecipient(value)
+			if err != nil {
+				return nil, err
+			}
+			e.age = append(e.age, r)
+			continue
+		}
+
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither an age recipient nor a key file: %w", value, err)
+		}
+		if len(data) > 0 && (data[0]&0x80 != 0 || strings.Contains(string(data), "-----BEGIN PGP PUBLIC KEY BLOCK-----")) {
+			key, err := parsePGPKey(data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", value, err)
+			}
+			e.pgp = append(e.pgp, key)
+			continue
+		}
+		found := false
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			r, err := parseAgeRecipient(line)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", value, err)
+			}
+			e.age = append(e.age, r)
+			found = true
+		}
+		if !found {
+			return nil, fmt.Errorf("%s: no age recipients or OpenPGP key", value)
+		}
+	}
+	if len(e.age) > 0 && len(e.pgp) > 0 {
+		return nil, errors.New("cannot mix age and OpenPGP recipients; a file can only be encrypted one way")
+	}
+	return e, nil
+}
+
+// ext is the suffix of the encrypted copies.
+func (e *encrypter) ext() string {
+	if len(e.pgp) > 0 {
+		return ".gpg"
+	}
+	return ".age"
+}
+
+// encryptFile writes the encrypted copy of a file and returns its path.
+func (e *encrypter) encryptFile(path string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	dst := path + e.ext()
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return "", err
+	}
+	if len(e.pgp) > 0 {
+		err = encryptPGP(out, src, info.Size(), path, e.pgp)
+	} else {
+		err = encryptAge(out, src, e.age)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return dst, os.Rename(tmp, dst)
+}
@@ -1,25 +1,38 @@
 package main
 
 import (
-	"encoding/csv"
-	"encoding/json"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"net/http"
+	"io"
+	"log/slog"
+	"maps"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
 	"strconv"
-	"sync"
-	"time" // Import the time package for date handling
+	"strings"
+	"syscall"
+	"time"
 )
 
 const (
-	url        = "https://services1.arcgis.com/79kfd2K6fskCAkyg/arcgis/rest/services/Louisville_Metro_KY_Property_Foreclosures/FeatureServer/0/query"
-	batchSize  = 1000
-	outputDir  = "data"
-	outputFile = "Louisville_Metro_KY_-_Property_Foreclosures.csv" // Renamed for clarity
-	workers    = 5
-	maxBatches = 300 // safety limit → 300 * 1000 = 300k rows max
+	serviceURL       = "https://services1.arcgis.com/79kfd2K6fskCAkyg/arcgis/rest/services/Louisville_Metro_KY_Property_Foreclosures/FeatureServer/0/query"
+	defaultBatchSize = 1000
+	minBatchSize     = 250 // smallest page a failing range is split into
+	outputDir        = "data"
+	outputFile       = "Louisville_Metro_KY_-_Property_Foreclosures.csv" // Renamed for clarity
+	defaultWorkers   = 5                                                 // starting number of concurrent requests
+	maxRecords       = 300000                                            // safety limit → 300k rows max
 )
 
+// geometryFields are the output columns added for point coordinates by -geometry.
+var geometryFields = []string{"X", "Y"}
+
 // --- DEFINED HEADERS FOR CSV ORDERING ---
 // This slice ensures the output CSV has the exact column order you need.
 var csvHeaders = []string{
@@ -30,171 +43,1570 @@ var csvHeaders = []string{
 
 type Feature struct {
 	Attributes map[string]interface{} `json:"attributes"`
+	Geometry   *Geometry              `json:"geometry"`
+}
+
+// Geometry holds the coordinates of a point feature. It is only present
+// when the query is made with -geometry.
+type Geometry struct {
+	X *float64 `json:"x"`
+	Y *float64 `json:"y"`
 }
 
 type QueryResult struct {
-	Features []Feature `json:"features"`
+	Features              []Feature `json:"features"`
+	ExceededTransferLimit bool      `json:"exceededTransferLimit"`
 }
 
-// formatValue handles converting API data into the correct CSV string format.
-// It specifically processes nil values and date timestamps.
-func formatValue(key string, value interface{}) string {
-	// 1. Handle nil values first, which appear as <nil>
-	if value == nil {
-		return ""
+// fetchBatch requests the page of size records at offset. raw, if not
+// nil, keeps the response.
+func fetchBatch(ctx context.Context, offset, size int, client *Client, query *Query, raw *rawArchive) ([]map[string]interface{}, error) {
+	var records []map[string]interface{}
+	for {
+		q := query.params()
+		q.Set("resultOffset", strconv.Itoa(offset+len(records)))
+		q.Set("resultRecordCount", strconv.Itoa(size-len(records)))
+		page, exceeded, err := fetchRecords(ctx, client, query, q, raw)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, page...)
+		// A server that returns fewer records than asked for, because of
+		// its maxRecordCount or a transfer limit of its own, sets
+		// exceededTransferLimit; the rest of the page is asked for again.
+		if !exceeded || len(page) == 0 || len(records) >= size {
+			return records, nil
+		}
+		slog.Debug("page cut short by the server; requesting the rest",
+			"offset", offset, "size", size, "got", len(records))
+	}
+}
+
+// fetchRecords requests the records of a query page, decoded in the
+// query's format, and whether the server set exceededTransferLimit on it.
+// raw, if not nil, saves the response once it decoded.
+func fetchRecords(ctx context.Context, client *Client, query *Query, q url.Values, raw *rawArchive) ([]map[string]interface{}, bool, error) {
+	// Features are decoded one at a time straight into records, rather
+	// than into a []Feature that is then copied.
+	decode := featureDecoder(query.Format)
+	if query.Format != "" {
+		q.Set("f", query.Format)
 	}
 
-	// 2. Check if the key corresponds to a date field
-	if key == "Action_Filed" || key == "Sale_Date" {
-		// The API returns timestamps as float64 (milliseconds)
-		if timestamp, ok := value.(float64); ok {
-			if timestamp == 0 {
-				return ""
+	var records []map[string]interface{}
+	var exceeded bool
+	var kept bytes.Buffer
+	err := client.get(ctx, query.URL, q, func(body io.Reader) error {
+		records = records[:0]
+		if raw != nil {
+			kept.Reset()
+			body = io.TeeReader(body, &kept)
+		}
+		var err error
+		exceeded, err = decode(body, func(attrs map[string]interface{}, g *Geometry) {
+			if g != nil && g.X != nil && g.Y != nil {
+				if attrs == nil {
+					attrs = make(map[string]interface{})
+				}
+				attrs[geometryFields[0]] = *g.X
+				attrs[geometryFields[1]] = *g.Y
 			}
-			// Convert milliseconds to seconds
-			sec := int64(timestamp / 1000)
-			// Create a time.Time object in UTC
-			t := time.Unix(sec, 0).UTC()
-			// Format to the desired layout: YYYY/MM/DD HH:MM:SS+00
-			return t.Format("2006/01/02 15:04:05+00")
+			records = append(records, attrs)
+		})
+		if err == nil && raw != nil {
+			// The decoder may stop before the end of the body.
+			_, err = io.Copy(io.Discard, body)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if raw != nil {
+		if err := raw.save(q, kept.Bytes()); err != nil {
+			return nil, false, err
 		}
 	}
 
-	// 3. For all other types, convert to a string
-	// Also handles the edge case where a value might literally be "<nil>"
-	s := fmt.Sprintf("%v", value)
-	if s == "<nil>" {
-		return ""
+	return records, exceeded, nil
+}
+
+// commands are the subcommands selected by the first argument. Without
+// one, the program runs the normal fetch.
+var commands = map[string]func(args []string) int{
+	"archive":    runArchive,
+	"bench":      runBench,
+	"dict":       runSchema,
+	"distinct":   runDistinct,
+	"duplicates": runDuplicates,
+	"layers":     runLayers,
+	"query":      runSQL,
+	"reprocess":  runReprocess,
+	"schema":     runSchema,
+	"serve":      runServe,
+	"stats":      runStats,
+	"verify":     runVerify,
+}
+
+// Exit codes, for cron jobs and CI.
+const (
+	exitOK      = 0 // every page was fetched (or failures stayed under -max-error-rate)
+	exitPartial = 1 // output was written but pages are missing; a checkpoint was left
+	exitFatal   = 2 // invalid options, or the run could not produce usable output
+	exitLocked  = 3 // another run held -lock, so this one was skipped
+)
+
+func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+
+	var opts Options
+	opts.register(flag.CommandLine)
+	flag.Parse()
+	if err := setupLogging(&opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitFatal)
+	}
+
+	stopProfiling, err := startProfiling(&opts)
+	if err != nil {
+		fatal(exitFatal, "invalid profiling options", "err", err)
 	}
-	return s
+
+	var code int
+	switch {
+	case opts.AllLayers:
+		code = runAllLayers(&opts)
+	case opts.Watch > 0 || opts.Schedule != "":
+		code = newFetchJob(&opts).watch()
+	default:
+		_, code = newFetchJob(&opts).run(opts.Resume)
+	}
+	stopProfiling()
+	os.Exit(code)
+}
+
+// fetchJob is the fetch described by the command line, validated once and
+// then run once or, with -watch or -schedule, repeatedly.
+type fetchJob struct {
+	opts          *Options
+	query         *Query
+	client        *Client
+	tracer        *tracer
+	schedule      *cronSchedule // nil unless -schedule is set
+	outputPath    string        // the output, or an -out template of it; its directory holds the run's other files
+	stream        string        // -out -: the format written to stdout, csv or ndjson; "" for a file
+	headers       []string      // fields written, in output order
+	columns       []string      // names the headers are written under; nil for the field names
+	partitioner   *Partitioner
+	formatter     *Formatter
+	dialect       CSVDialect
+	showProgress  bool
+	notifiers     []notifier
+	alerts        []*alertRule
+	filter        alertExpr          // nil without -filter
+	transforms    []namedTransformer // -transform steps, in order
+	geocoder      *geocoder          // nil without -geocode
+	census        *censusEnricher    // nil without -census
+	join          *layerJoin         // nil without -join-url
+	encrypter     *encrypter         // nil without -encrypt-to
+	attachments   *attachmentFetcher // nil without -attachments
+	related       *relatedFetcher    // nil without -related
+	replica       *replicaSync       // nil without -sync
+	reportPages   []string           // -report-format pages written next to the run report
+	formatChecked bool               // the layer's query formats have been read
 }
 
-func fetchBatch(offset int, client *http.Client) ([]map[string]interface{}, error) {
-	req, err := http.NewRequest("GET", url, nil)
+// newFetchJob checks the options and builds the query and client, exiting
+// with exitFatal if anything is invalid.
+func newFetchJob(opts *Options) *fetchJob {
+	partitioner, err := parsePartitioner(opts.SplitBy)
+	if err != nil {
+		fatal(exitFatal, "invalid -split-by", "err", err)
+	}
+
+	formatter, err := newFormatter(opts)
 	if err != nil {
-		return nil, err
+		fatal(exitFatal, "invalid formatting options", "err", err)
+	}
+
+	if err := checkNotifyOptions(opts); err != nil {
+		fatal(exitFatal, "invalid notification options", "err", err)
+	}
+
+	if opts.MaxErrorRate < 0 || opts.MaxErrorRate > 1 {
+		fatal(exitFatal, "invalid -max-error-rate: must be between 0 and 1", "value", opts.MaxErrorRate)
+	}
+
+	if opts.Retention != 0 && !opts.Versioned {
+		fatal(exitFatal, "invalid -retention: only applies with -versioned")
+	}
+	if opts.Retention < 0 || (opts.Retention > 0 && opts.Retention < time.Hour) {
+		// Versions are named by the hour, so a shorter window could
+		// remove the one being written.
+		fatal(exitFatal, "invalid -retention: must be at least 1h", "value", opts.Retention)
 	}
 
-	q := req.URL.Query()
-	q.Add("where", "1=1")
-	q.Add("outFields", "*")
-	q.Add("returnGeometry", "false")
-	q.Add("f", "json")
-	q.Add("resultOffset", strconv.Itoa(offset))
-	q.Add("resultRecordCount", strconv.Itoa(batchSize))
-	req.URL.RawQuery = q.Encode()
+	stream, outputPath := "", opts.Out
+	switch {
+	case opts.OutFormat != "csv" && opts.OutFormat != "ndjson":
+		fatal(exitFatal, "invalid -out-format: want csv or ndjson", "value", opts.OutFormat)
+	case opts.Out == "-":
+		// The run's other files stay in the default directory.
+		stream, outputPath = opts.OutFormat, filepath.Join(outputDir, outputFile)
+		for _, opt := range []struct {
+			name string
+			set  bool
+		}{
+			{"-split-by", opts.SplitBy != ""},
+			{"-versioned", opts.Versioned},
+			{"-resume", opts.Resume},
+			{"-if-changed", opts.IfChanged},
+			{"-sync", opts.Sync},
+			{"-watch", opts.Watch > 0},
+			{"-schedule", opts.Schedule != ""},
+			{"-related", opts.Related != ""},
+			{"-attachments", opts.Attachments != ""},
+			{"-datapackage", opts.DataPackage},
+			{"-csvw", opts.CSVW},
+			{"-merge", opts.Merge},
+		} {
+			if opt.set {
+				// These need an output file to read back or replace.
+				fatal(exitFatal, "invalid -out -: cannot be combined with "+opt.name)
+			}
+		}
+	case opts.Out == "":
+		fatal(exitFatal, "invalid -out: use - for stdout")
+	case opts.OutFormat != "csv":
+		fatal(exitFatal, "invalid -out-format: only -out - can be NDJSON; use -tee for an NDJSON file")
+	}
 
-	// fmt.Println("Requesting:", req.URL.String()) // Uncomment for debugging
+	if err := checkOutTemplate(outputPath); err != nil {
+		fatal(exitFatal, "invalid -out", "err", err)
+	}
 
-	resp, err := client.Do(req)
+	if !slices.Contains([]string{"auto", "json", "pbf", "geojson"}, opts.QueryFormat) {
+		fatal(exitFatal, "invalid -query-format: want auto, json, pbf or geojson", "value", opts.QueryFormat)
+	}
+
+	showProgress, err := wantProgress(opts)
+	if err != nil {
+		fatal(exitFatal, "invalid -progress", "err", err)
+	}
+
+	comma, err := parseDelimiter(opts.Delimiter)
+	if err != nil {
+		fatal(exitFatal, "invalid -delimiter", "err", err)
+	}
+	dialect := CSVDialect{
+		Comma:         comma,
+		QuoteAll:      opts.QuoteAll || opts.RFC4180,
+		UseCRLF:       opts.CRLF || opts.RFC4180,
+		RejectControl: opts.RejectControl || opts.RFC4180,
+		BOM:           opts.BOM,
+	}
+
+	query, err := newQuery(opts)
 	if err != nil {
-		return nil, err
+		fatal(exitFatal, "invalid query options", "err", err)
+	}
+
+	headers := csvHeaders
+	if query.ReturnGeometry {
+		headers = append(append([]string(nil), headers...), geometryFields...)
+	}
+	if len(query.Fields) > 0 {
+		headers = append([]string(nil), query.Fields...)
+		if query.ReturnGeometry {
+			headers = append(headers, geometryFields...)
+		}
+		// The partition field has to come back from the server even when
+		// it is not one of the output columns.
+		if partitioner != nil {
+			query.require(partitioner.Field)
+		}
+	}
+	if opts.Address {
+		headers = append(append([]string(nil), headers...), addressField)
+		for _, field := range addressFields {
+			query.require(field)
+		}
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("status code %d", resp.StatusCode)
+	geocoder, err := newGeocoder(opts)
+	if err != nil {
+		fatal(exitFatal, "invalid -geocode", "err", err)
+	}
+	if geocoder != nil {
+		headers = append(append([]string(nil), headers...), latitudeField, longitudeField)
+		for _, field := range geocodeFields {
+			query.require(field)
+		}
 	}
 
-	var result QueryResult
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, err
+	census, err := newCensusEnricher(opts)
+	if err != nil {
+		fatal(exitFatal, "invalid -census", "err", err)
+	}
+	if census != nil {
+		headers = append(append([]string(nil), headers...), census.columns()...)
+		query.require(tractField)
 	}
 
-	records := make([]map[string]interface{}, 0, len(result.Features))
-	for _, feature := range result.Features {
-		records = append(records, feature.Attributes)
+	client, err := newClient(opts)
+	if err != nil {
+		fatal(exitFatal, "invalid connection options", "err", err)
 	}
 
-	return records, nil
+	join, err := newLayerJoin(opts, query, client, headers)
+	if err != nil {
+		fatal(exitFatal, "invalid -join-url", "err", err)
+	}
+	if join != nil {
+		headers = append(append([]string(nil), headers...), join.fields...)
+		query.require(join.on)
+	}
+
+	// -rename and -columns shape the output after every column is known.
+	var columns []string
+	if opts.Rename != "" || opts.Columns != "" {
+		if headers, columns, err = outputColumns(headers, opts.Rename, opts.Columns); err != nil {
+			fatal(exitFatal, "invalid -rename/-columns", "err", err)
+		}
+	}
+
+	for field := range formatter.Coerce {
+		if !slices.Contains(headers, field) {
+			fatal(exitFatal, "invalid -coerce: "+field+" is not an output column")
+		}
+	}
+	transforms, err := parseTransforms(opts.Transforms)
+	if err != nil {
+		fatal(exitFatal, "invalid -transform", "err", err)
+	}
+	if opts.Merge {
+		switch {
+		case !slices.Contains(headers, idField):
+			// Rows are matched by ObjectId.
+			fatal(exitFatal, "invalid -merge: -fields has to include "+idField)
+		case opts.SplitBy != "":
+			fatal(exitFatal, "invalid -merge: cannot be combined with -split-by")
+		case opts.Versioned:
+			fatal(exitFatal, "invalid -merge: cannot be combined with -versioned")
+		case opts.Resume:
+			fatal(exitFatal, "invalid -merge: an unfinished -merge run changes nothing, so run it again instead of -resume")
+		case opts.Timeseries != "":
+			// It would count only the records fetched, not the merged output.
+			fatal(exitFatal, "invalid -merge: cannot be combined with -timeseries")
+		}
+	}
+	reportPages, err := parseReportFormats(opts.ReportFormat)
+	if err != nil {
+		fatal(exitFatal, "invalid -report-format", "err", err)
+	}
+	if len(reportPages) > 0 && opts.Report == "" {
+		fatal(exitFatal, "invalid -report-format: the pages are written next to -report, which is empty")
+	}
+	if err := checkTee(opts.Tee, opts.Resume); err != nil {
+		fatal(exitFatal, "invalid -tee", "err", err)
+	}
+	if len(formatter.Coerce) > 0 && opts.Quarantine == "" {
+		fatal(exitFatal, "invalid -quarantine: -coerce needs a file for the records it rejects")
+	}
+
+	var filter alertExpr
+	if opts.Filter != "" {
+		if filter, err = parseCondition(opts.Filter, headers); err != nil {
+			fatal(exitFatal, "invalid -filter", "err", err)
+		}
+	}
+
+	alerts, err := parseAlertRules(opts.Alerts, headers)
+	if err != nil {
+		fatal(exitFatal, "invalid -alert", "err", err)
+	}
+	if len(alerts) > 0 && !slices.Contains(headers, idField) {
+		// New records are told apart by ObjectId.
+		fatal(exitFatal, "invalid -alert: -fields has to include "+idField)
+	}
+
+	var attachments *attachmentFetcher
+	if opts.Attachments != "" {
+		if !slices.Contains(headers, idField) {
+			// Attachments are listed by the ObjectIds in the output.
+			fatal(exitFatal, "invalid -attachments: -fields has to include "+idField)
+		}
+		attachments = &attachmentFetcher{client: client, layer: layerURL(query.URL), dir: opts.Attachments, workers: opts.Workers}
+	}
+
+	var replica *replicaSync
+	if opts.Sync {
+		switch {
+		case opts.StateFile == "":
+			fatal(exitFatal, "invalid -sync: the replica is recorded in -state, which cannot be empty")
+		case opts.Limit > 0:
+			fatal(exitFatal, "invalid -sync: cannot be combined with -limit")
+		}
+		if replica, err = newReplicaSync(client, query); err != nil {
+			fatal(exitFatal, "invalid -sync", "err", err)
+		}
+	}
+
+	var related *relatedFetcher
+	if opts.Related != "" {
+		if !slices.Contains(headers, idField) {
+			fatal(exitFatal, "invalid -related: -fields has to include "+idField)
+		}
+		related = &relatedFetcher{client: client, layer: layerURL(query.URL), names: splitList(opts.Related), formatter: formatter, dialect: dialect}
+	}
+
+	encrypter, err := newEncrypter(opts.EncryptTo)
+	if err != nil {
+		fatal(exitFatal, "invalid -encrypt-to", "err", err)
+	}
+	if encrypter != nil && !opts.KeepPlaintext {
+		for _, opt := range []struct {
+			name string
+			set  bool
+		}{
+			{"-merge", opts.Merge},
+			{"-delta", opts.Delta != ""},
+			{"-versioned", opts.Versioned},
+		} {
+			if opt.set {
+				// These read the previous plaintext output back.
+				fatal(exitFatal, "invalid -encrypt-to: "+opt.name+" needs -keep-plaintext")
+			}
+		}
+	}
+
+	var schedule *cronSchedule
+	if opts.Schedule != "" {
+		if opts.Watch > 0 {
+			fatal(exitFatal, "invalid -schedule: use either -watch or -schedule")
+		}
+		if schedule, err = parseCron(opts.Schedule); err != nil {
+			fatal(exitFatal, "invalid -schedule", "err", err)
+		}
+	}
+	if opts.Watch > 0 || schedule != nil {
+		if opts.DryRun {
+			fatal(exitFatal, "invalid -watch/-schedule: cannot be combined with -dry-run")
+		}
+		// Between changes to the layer, a run costs one metadata request.
+		opts.IfChanged = true
+	}
+
+	return &fetchJob{
+		opts:         opts,
+		query:        query,
+		client:       client,
+		tracer:       newTracer(opts),
+		schedule:     schedule,
+		outputPath:   outputPath,
+		stream:       stream,
+		headers:      headers,
+		columns:      columns,
+		partitioner:  partitioner,
+		formatter:    formatter,
+		dialect:      dialect,
+		showProgress: showProgress,
+		notifiers:    newNotifiers(opts),
+		alerts:       alerts,
+		filter:       filter,
+		transforms:   transforms,
+		geocoder:     geocoder,
+		census:       census,
+		join:         join,
+		encrypter:    encrypter,
+		attachments:  attachments,
+		related:      related,
+		replica:      replica,
+		reportPages:  reportPages,
+	}
 }
 
-func main() {
-	client := &http.Client{}
+// run fetches the layer once, resuming from the checkpoint if resume is
+// set, and returns the run's status and exit code.
+func (j *fetchJob) run(resume bool) (status string, code int) {
+	opts, query, client := j.opts, j.query, j.client
+	headers, partitioner, formatter := j.headers, j.partitioner, j.formatter
+	start := time.Now()
+	received := client.BytesReceived()
+
+	// -deadline bounds the whole run, including the preflight requests.
+	ctx := context.Background()
+	if opts.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Deadline)
+		defer cancel()
+	}
+
+	// With an OTLP endpoint, the run, each page and each request become
+	// trace spans.
+	ctx = withTracer(ctx, j.tracer)
+	ctx, runSpan := startSpan(ctx, "fetch run", "url", query.URL, "where", query.Where)
+	finish := func() {
+		runSpan.finish()
+		j.tracer.shutdown()
+	}
+
+	// With -versioned the run writes a file of its own, and the plain
+	// path becomes a link to it once the run succeeds.
+	latestPath := j.expandOut(ctx, start)
+	dir := filepath.Dir(latestPath)
+	filePath := latestPath
+	if opts.Versioned {
+		filePath = versionedPath(latestPath, start.In(formatter.Location))
+	}
+	// With -merge the records go to a file of their own first, and are
+	// merged into the output once the run is complete.
+	if opts.Merge {
+		filePath = latestPath + mergeSuffix
+	}
+
+	// Only one run at a time may write the output, checkpoint and state.
+	if opts.Lock != "" && !opts.DryRun {
+		lock, err := acquireLock(opts.Lock, opts.LockWait)
+		if errors.Is(err, errLocked) {
+			slog.Warn("another run is in progress; skipping this one", "lock", opts.Lock, "pid", lockHolder(opts.Lock))
+			finish()
+			return statusLocked, exitLocked
+		}
+		if err != nil {
+			fatal(exitFatal, "cannot take lock", "path", opts.Lock, "err", err)
+		}
+		defer lock.release()
+	}
+
+	// With -if-changed, compare the layer's last edit time with the one
+	// recorded by the previous run and leave the existing output alone if
+	// nothing was edited since.
+	var state *State
+	var lastEditDate int64
+	var layer *LayerInfo
+	if opts.IfChanged || j.replica != nil {
+		var err error
+		if state, err = loadState(opts.StateFile); err != nil {
+			fatal(exitFatal, "cannot read state file", "path", opts.StateFile, "err", err)
+		}
+	}
+	if opts.IfChanged {
+		info, err := fetchLayerInfo(ctx, client, query.URL)
+		if err != nil {
+			slog.Warn("could not read layer metadata, fetching anyway", "err", err)
+		} else {
+			layer = info
+			lastEditDate = info.EditingInfo.LastEditDate
+		}
+
+		prev := state.Runs[query.key()]
+		if lastEditDate != 0 && prev != nil && prev.LastEditDate == lastEditDate && prev.outputsExist() {
+			slog.Info("layer unchanged; keeping existing output",
+				"lastEditDate", time.UnixMilli(lastEditDate).UTC().Format(time.RFC3339))
+			report := newRunReport(statusUnchanged, start, query, statOutputs(prev.Outputs))
+			report.NewRecords = 0
+			j.publish(report)
+			finish()
+			return statusUnchanged, exitOK
+		}
+	}
+
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+	batchSize := opts.BatchSize
 
-	var allData []map[string]interface{}
-	var mu sync.Mutex
+	// A page larger than the layer's maxRecordCount would come back cut
+	// short, so -batch-size is capped at it.
+	if layer == nil {
+		info, err := fetchLayerInfo(ctx, client, query.URL)
+		if err != nil {
+			slog.Warn("could not read layer metadata; the page size is not checked against the server's limit", "err", err)
+		}
+		layer = info
+	}
+	if layer != nil && layer.MaxRecordCount > 0 && batchSize > layer.MaxRecordCount {
+		slog.Info("batch size exceeds the server page limit; using the limit",
+			"batchSize", batchSize, "maxRecordCount", layer.MaxRecordCount)
+		batchSize = layer.MaxRecordCount
+	}
+
+	// Preflight: ask how many records match so only the pages that exist
+	// are requested. If the count fails, fall back to the maxRecords limit.
+	wanted := maxRecords
+	count, countErr := fetchCount(ctx, client, query)
+	if countErr != nil {
+		if opts.DryRun {
+			fatal(exitFatal, "cannot count records", "err", countErr)
+		}
+		slog.Warn("could not count records; requesting up to the safety limit", "limit", maxRecords, "err", countErr)
+	} else if count > maxRecords {
+		slog.Warn("more records match than the safety limit; only the first ones will be fetched", "count", count, "limit", maxRecords)
+	} else {
+		wanted = count
+	}
+
+	// -limit only fetches the pages needed for the first N records.
+	if opts.Limit > 0 && opts.Limit < wanted {
+		wanted = opts.Limit
+	}
+	if opts.Limit > 0 && (count > opts.Limit || countErr != nil) {
+		count = opts.Limit
+	}
+	numBatches := (wanted + batchSize - 1) / batchSize
+
+	if opts.DryRun {
+		shown := filePath
+		if j.stream != "" {
+			shown = "stdout (" + j.stream + ")"
+		}
+		printDryRun(ctx, client, query, opts, count, numBatches, batchSize, shown, partitioner)
+		finish()
+		return statusOK, exitOK
+	}
 
-	offsets := make(chan int, workers)
-	var wg sync.WaitGroup
+	// A checkpoint left by an interrupted run of the same query lets
+	// -resume skip the pages it already wrote.
+	checkpointPath := filepath.Join(dir, checkpointFile)
+	var resumed *Checkpoint
+	if resume {
+		cp, err := loadCheckpoint(checkpointPath)
+		if err != nil {
+			fatal(exitFatal, "cannot read checkpoint", "path", checkpointPath, "err", err)
+		}
+		switch {
+		case cp == nil:
+			slog.Warn("no checkpoint found; starting from the beginning", "path", checkpointPath)
+		case !cp.matches(query, batchSize):
+			slog.Warn("checkpoint is for a different query or batch size; starting from the beginning", "path", checkpointPath)
+		default:
+			resumed = cp
+			slog.Info("resuming from checkpoint", "pages", len(cp.Completed), "records", cp.Records)
+			// A resumed -versioned run finishes the version it started.
+			if opts.Versioned && cp.File != "" {
+				filePath = cp.File
+			}
+		}
+	}
 
-	fmt.Println("Starting data fetch...")
+	// Pages are requested in the -query-format if the layer supports it.
+	// -query-format auto picks f=pbf: a fraction of the size of JSON, and
+	// quicker to decode.
+	if opts.QueryFormat != "json" && !j.formatChecked {
+		info := layer
+		if info == nil {
+			info, _ = fetchLayerInfo(ctx, client, query.URL)
+		}
+		if info != nil {
+			want := opts.QueryFormat
+			if want == "auto" {
+				want = "pbf"
+			}
+			switch {
+			case info.supportsFormat(want):
+				query.Format = want
+			case opts.QueryFormat != "auto":
+				slog.Warn("the layer does not support the -query-format; using json",
+					"format", want, "supportedQueryFormats", info.SupportedQueryFormats)
+			}
+			j.formatChecked = true
+			slog.Debug("query format", "format", query.Format, "supportedQueryFormats", info.SupportedQueryFormats)
+		}
+	}
 
-	// Worker goroutines
-	for i := 0; i < workers; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for offset := range offsets {
-				records, err := fetchBatch(offset, client)
+	// -raw-dir keeps every response in a directory of the run, named by
+	// its start time; a resumed run adds to the one it continues.
+	var raw *rawArchive
+	if opts.RawDir != "" {
+		var resumedDir string
+		if resumed != nil {
+			resumedDir = resumed.RawArchive
+		}
+		expected := -1
+		if countErr == nil {
+			expected = count
+		}
+		var err error
+		if raw, err = openRawArchive(opts.RawDir, resumedDir, start, query, batchSize, expected); err != nil {
+			fatal(exitFatal, "cannot create the raw archive", "dir", opts.RawDir, "err", err)
+		}
+		slog.Info("saving raw responses", "dir", raw.dir)
+	}
+
+	// With -adaptive the pool has -max-workers goroutines and the AIMD
+	// limiter decides how many of them may have a request in flight.
+	poolSize := max(opts.Workers, 1)
+	limiter := newAIMDLimiter(poolSize, poolSize)
+	if opts.Adaptive {
+		limiter = newAIMDLimiter(poolSize, opts.MaxWorkers)
+		poolSize = max(poolSize, opts.MaxWorkers)
+	}
+
+	plan := &fetchPlan{
+		client:    client,
+		query:     query,
+		limiter:   limiter,
+		workers:   poolSize,
+		batchSize: batchSize,
+		wanted:    wanted,
+		failFast:  opts.FailFast,
+		buffered:  opts.MaxBuffered,
+		raw:       raw,
+	}
+	if plan.buffered <= 0 {
+		plan.buffered = 2 * poolSize
+	}
+	if plan.buffered < poolSize {
+		slog.Warn("-max-buffered-batches is below the worker pool; fewer pages will be fetched at once",
+			"maxBufferedBatches", plan.buffered, "workers", poolSize)
+	}
+	if resumed != nil {
+		plan.done = resumed.done()
+	}
+
+	// The output is created when the first page arrives, so a run that
+	// retrieves nothing leaves any existing file alone.
+	var output *CSVOutput // nil with -out -
+	var primary sink      // where each record is written: output, or stdout
+	dates := &dateRange{Field: opts.DateField}
+	delta := newDeltaTracker(latestOutputs("", opts.Report, latestPath), j.dialect.Comma, j.column(idField), formatter)
+	if j.census != nil {
+		j.census.load(ctx)
+	}
+	var deltaOutput *CSVOutput      // -delta: the new records alone
+	var quarantineOutput *CSVOutput // -quarantine: the records -coerce rejected
+	var tees []*teeSink             // -tee: more destinations of the same records
+	quarantined, filtered, dropped := 0, 0, 0
+	var resumedAlerts []AlertMatch
+	if resumed != nil {
+		resumedAlerts = resumed.Alerts
+	}
+	alerts := newAlerter(j.alerts, headers, formatter, resumedAlerts)
+	var series *timeSeries // -timeseries: filings and sales per month
+	if opts.Timeseries != "" {
+		var periods map[string]*periodCount
+		if resumed != nil {
+			periods = resumed.Periods
+		}
+		series = newTimeSeries(opts.DateField, formatter, periods)
+	}
+	prices := newPriceProfiler(headers, formatter)
+	// Attributes the layer returns beyond the known fields are counted,
+	// so a new column does not go unnoticed; -strict fails the run.
+	known := make(map[string]bool)
+	for _, fields := range [][]string{csvHeaders, headers, query.Fields, geometryFields} {
+		for _, field := range fields {
+			known[field] = true
+		}
+	}
+	unexpected := make(map[string]int)
+	unexpectedRecords := 0
+	// Values a writer cannot make sense of, such as text in a date field,
+	// are repaired or nulled, and counted.
+	attrs := newAttributeCheck(formatter)
+	strictFailed := false
+	// Records a -transform or -coerce rule rejects are kept in -quarantine,
+	// with the reason.
+	quarantine := func(record map[string]interface{}, reason error) {
+		if quarantineOutput == nil {
+			slog.Error("record left out of the output", "objectId", record[idField], "err", reason)
+			return
+		}
+		kept := maps.Clone(record)
+		kept[quarantineReasonField] = reason.Error()
+		if err := quarantineOutput.Write(kept); err != nil {
+			slog.Error("cannot write record to -quarantine", "err", err)
+		}
+	}
+	write := func(records []map[string]interface{}) error {
+		if fields := unexpectedFields(records, known, unexpected, &unexpectedRecords); len(fields) > 0 {
+			if opts.Strict {
+				strictFailed = true
+				return fmt.Errorf("-strict: the layer returned fields that are not written: %s", strings.Join(fields, ", "))
+			}
+			slog.Warn("the layer returned fields that are not written", "fields", fields)
+		}
+		if primary == nil {
+			if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+				return err
+			}
+			if j.stream != "" {
+				var err error
+				if primary, err = newStreamOutput(os.Stdout, j.stream, headers, j.columns, formatter, j.dialect); err != nil {
+					return err
+				}
+			} else {
+				output = newCSVOutput(filePath, headers, partitioner, formatter, j.dialect)
+				output.columns = j.columns
+				output.append = resumed != nil
+				// -transform can leave out every record of a run; the
+				// output still replaces the previous one.
+				if partitioner == nil {
+					if _, err := output.writer(""); err != nil {
+						return err
+					}
+				}
+				primary = output
+			}
+			if opts.Delta != "" {
+				if err := os.MkdirAll(filepath.Dir(opts.Delta), os.ModePerm); err != nil {
+					return err
+				}
+				deltaOutput = newCSVOutput(opts.Delta, headers, nil, formatter, j.dialect)
+				deltaOutput.columns = j.columns
+				deltaOutput.append = resumed != nil
+				// Written even when nothing is new, so a delta from an
+				// earlier run is never mistaken for this one's.
+				if _, err := deltaOutput.writer(""); err != nil {
+					return err
+				}
+			}
+			if (len(formatter.Coerce) > 0 || len(j.transforms) > 0) && opts.Quarantine != "" {
+				if err := os.MkdirAll(filepath.Dir(opts.Quarantine), os.ModePerm); err != nil {
+					return err
+				}
+				quarantineOutput = newCSVOutput(opts.Quarantine, append(slices.Clone(headers), quarantineReasonField), nil, formatter, j.dialect)
+				if j.columns != nil {
+					quarantineOutput.columns = append(slices.Clone(j.columns), quarantineReasonField)
+				}
+				quarantineOutput.append = resumed != nil
+				// Like -delta, written even when every record passes.
+				if _, err := quarantineOutput.writer(""); err != nil {
+					return err
+				}
+			}
+			for _, dest := range opts.Tee {
+				t, err := openTee(dest, headers, j.columns, formatter, j.dialect, resumed != nil)
+				if err != nil {
+					return fmt.Errorf("-tee: %w", err)
+				}
+				tees = append(tees, t)
+			}
+		}
+		if j.geocoder != nil {
+			j.geocoder.enrich(records)
+		}
+		if j.join != nil {
+			j.join.enrich(ctx, records)
+		}
+		for _, record := range records {
+			attrs.repair(record)
+			if opts.Address && record != nil {
+				record[addressField] = normalizeAddress(record)
+			}
+			if j.census != nil && record != nil {
+				j.census.enrich(record)
+			}
+			if j.filter != nil && record != nil && !j.filter.eval(record, formatter) {
+				filtered++
+				continue
+			}
+			if len(j.transforms) > 0 && record != nil {
+				out, err := transformRecord(j.transforms, record)
 				if err != nil {
-					fmt.Printf("Error fetching offset %d: %v\n", offset, err)
+					quarantined++
+					quarantine(record, err)
 					continue
 				}
-
-				if len(records) == 0 {
-					// This can happen normally when we reach the end of the data.
-					// To stop fetching once we hit an empty batch, you could add logic here
-					// to close the 'offsets' channel, but for a fixed maxBatches, this is fine.
+				if out == nil {
+					dropped++
+					continue
+				}
+				record = out
+			}
+			if quarantineOutput != nil && record != nil {
+				if err := formatter.checkCoercions(record); err != nil {
+					quarantined++
+					quarantine(record, err)
 					continue
 				}
+			}
+			dates.observe(record)
+			series.observe(record)
+			prices.observe(record)
+			isNew := delta.observe(record)
+			if err := primary.Write(record); err != nil {
+				// Log error but continue trying to write other rows
+				slog.Error("cannot write record", "err", err)
+				continue
+			}
+			for _, t := range tees {
+				t.write(record)
+			}
+			if !isNew {
+				continue
+			}
+			alerts.observe(record)
+			if deltaOutput != nil {
+				if err := deltaOutput.Write(record); err != nil {
+					slog.Error("cannot write record to -delta", "err", err)
+				}
+			}
+		}
+		return nil
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	slog.Info("starting data fetch", "records", wanted, "pages", numBatches, "workers", opts.Workers)
+	if j.showProgress && j.replica == nil {
+		pages := numBatches
+		if resumed != nil {
+			pages -= len(resumed.Completed)
+		}
+		plan.progress = newProgress(pages)
+	}
+	var summary fetchSummary
+	var replica *ReplicaState
+	synced := false
+	if j.replica != nil && resumed == nil {
+		summary, replica, synced = j.sync(ctx, state.Runs[query.key()], write, batchSize)
+	}
+	// Records added or deleted while the pages are fetched shift the
+	// offsets, so the ObjectIds written are tracked: a record that comes
+	// again is dropped, and once every page is in, a changed count has the
+	// records the pages skipped fetched by ObjectId. A resumed run has not
+	// seen the records of the earlier one, and -limit fetches only a part.
+	drift := newDriftCheck(raw)
+	var countDrift *CountDrift
+	paged := func(records []map[string]interface{}) error {
+		return write(drift.filter(records))
+	}
+	if !synced {
+		summary = plan.run(ctx, stop, paged)
+		summary.Records -= drift.duplicates
+		if resumed == nil && countErr == nil && count <= maxRecords && opts.Limit == 0 &&
+			summary.Err == nil && summary.WriteErr == nil && !summary.Interrupted && len(summary.Failed) == 0 {
+			var err error
+			if countDrift, err = drift.reconcile(ctx, client, query, count, write); err != nil {
+				slog.Error("cannot reconcile the output with the layer", "err", err)
+				summary.Err = err
+			}
+			if countDrift != nil {
+				summary.Records += countDrift.Refetched
+			}
+		}
+	}
+	plan.progress.finish()
+	signal.Stop(stop)
+
+	slog.Info("fetch finished", "records", summary.Records, "failedPages", len(summary.Failed), "concurrency", limiter.Limit())
+	if summary.Err != nil && summary.WriteErr == nil {
+		slog.Error("run stopped early", "err", summary.Err)
+	}
+
+	if summary.WriteErr != nil {
+		slog.Error("cannot write output", "err", summary.WriteErr)
+	}
 
-				mu.Lock()
-				allData = append(allData, records...)
-				mu.Unlock()
+	var outputs []string
+	if primary != nil {
+		if err := primary.Close(); err != nil {
+			slog.Error("cannot write output", "err", err)
+			summary.WriteErr = err
+		}
+	}
+	complete := summary.Err == nil && summary.WriteErr == nil && !summary.Interrupted && len(summary.Failed) == 0
+	// The files are written under partialSuffix names and only renamed
+	// over the previous ones if the run succeeded, as its exit status
+	// tells, with every file flushed and closed. Otherwise the previous
+	// outputs stay in place, and -resume carries on in the partial files.
+	resumedRecords := 0
+	if resumed != nil {
+		resumedRecords = resumed.Records
+	}
+	commit := summary.WriteErr == nil && summary.exitCode(summary.Records+resumedRecords, opts.MaxErrorRate) == exitOK
+	unchanged := false // -skip-unchanged kept the previous output
+	if output != nil {
+		outputs = output.Paths()
+		committed := outputs
+		if resumed != nil {
+			committed = mergePaths(resumed.Outputs, outputs)
+		}
+		// A -versioned output is compared with the latest version.
+		previous := func(path string) string {
+			if !opts.Versioned {
+				return path
+			}
+			ext := filepath.Ext(latestPath)
+			rest, _ := strings.CutPrefix(path, strings.TrimSuffix(filePath, ext))
+			return strings.TrimSuffix(latestPath, ext) + rest
+		}
+		if commit && complete && opts.SkipUnchanged && !opts.Merge && unchangedPartials(committed, previous) {
+			unchanged = true
+			for i, path := range committed {
+				os.Remove(path + partialSuffix)
+				committed[i] = previous(path)
+			}
+			outputs = committed
+			slog.Info("the output is identical to the previous one; keeping that", "files", len(outputs))
+		} else if commit {
+			if err := commitPartials(committed); err != nil {
+				slog.Error("cannot write output", "err", err)
+				summary.WriteErr = err
+				commit, complete = false, false
+			}
+		}
+	}
+	teeFiles := closeTees(tees, complete, commit)
+	if j.geocoder != nil {
+		j.geocoder.finish()
+	}
+	if j.join != nil {
+		j.join.finish()
+	}
+	var quarantineFile *OutputFile
+	if quarantineOutput != nil {
+		err := quarantineOutput.Close()
+		if err == nil && commit {
+			err = commitPartials(quarantineOutput.Paths())
+		}
+		if err != nil {
+			slog.Error("cannot write -quarantine", "err", err)
+		} else if commit {
+			quarantineFile = &statOutputs(quarantineOutput.Paths())[0]
+			if quarantined > 0 {
+				slog.Warn("records quarantined by -transform or -coerce", "records", quarantined, "path", quarantineFile.Path)
 			}
-		}()
+		}
+	}
+	if j.filter != nil {
+		slog.Info("records left out by -filter", "records", filtered)
+	}
+	if dropped > 0 {
+		slog.Info("records left out by -transform", "records", dropped)
+	}
+	if unexpectedRecords > 0 && !opts.Strict {
+		slog.Warn("records had fields that were not written; use -fields to choose the columns, or -strict to fail on new ones",
+			"records", unexpectedRecords, "fields", slices.Sorted(maps.Keys(unexpected)))
+	}
+	if attrs.records > 0 {
+		slog.Warn("records had attribute values that were repaired or written as null; see the run report",
+			"records", attrs.records, "fields", slices.Sorted(maps.Keys(attrs.issues)))
+	}
+	var deltaFile *OutputFile
+	if deltaOutput != nil {
+		err := deltaOutput.Close()
+		if err == nil && commit {
+			err = commitPartials(deltaOutput.Paths())
+		}
+		if err != nil {
+			slog.Error("cannot write -delta", "err", err)
+		} else if commit {
+			deltaFile = &statOutputs(deltaOutput.Paths())[0]
+			slog.Info("new records saved", "path", deltaFile.Path)
+		}
 	}
 
-	// Feed offsets up to maxBatches
-	for i := 0; i < maxBatches; i++ {
-		offsets <- i * batchSize
+	profile := prices.result()
+	if profile != nil && profile.Zero > 0 && float64(profile.Zero) > zeroSalesWarnShare*float64(profile.Zero+profile.Priced) {
+		slog.Warn("many sales are at $0; check the feed", "zero", profile.Zero, "sales", profile.Sales)
+	}
+	var seriesFile *OutputFile
+	if series != nil && primary != nil && commit {
+		if err := series.write(opts.Timeseries, j.dialect); err != nil {
+			slog.Error("cannot write -timeseries", "err", err)
+		} else {
+			seriesFile = &statOutputs([]string{opts.Timeseries})[0]
+			slog.Info("filings per month saved", "path", seriesFile.Path)
+		}
 	}
-	close(offsets)
 
-	// Wait for workers to finish
-	wg.Wait()
+	total, newRecords := summary.Records, delta.count()
+	if resumed != nil {
+		outputs = mergePaths(resumed.Outputs, outputs)
+		total += resumed.Records
+		if resumed.NewRecords < 0 || newRecords < 0 {
+			newRecords = -1
+		} else {
+			newRecords += resumed.NewRecords
+		}
+	}
 
-	fmt.Printf("Fetched %d total records.\n", len(allData))
+	// An interrupted run, or one with pages that failed, leaves a
+	// checkpoint so -resume only has to fetch what is missing.
+	// Records streamed to stdout cannot be appended to, and a -merge run
+	// merges nothing until it completes, so those runs leave none.
+	var merged *MergeStats
+	switch {
+	case opts.Merge && output != nil && complete:
+		stats, err := mergeCSV(latestPath, filePath, j.column(idField), j.formatter.NullToken, j.dialect)
+		if err != nil {
+			slog.Error("cannot merge into the output", "path", latestPath, "err", err)
+			summary.WriteErr = err
+			outputs = nil
+			break
+		}
+		slog.Info("records merged", "path", latestPath, "records", stats.Records,
+			"added", stats.Added, "updated", stats.Updated, "unchanged", stats.Unchanged)
+		merged = stats
+		outputs = []string{latestPath}
+		// The output is now the merged file.
+		output.order = outputs
+		output.rows = map[string]int{latestPath: stats.Records}
+	case opts.Merge && output != nil:
+		os.Remove(filePath)
+		os.Remove(filePath + partialSuffix)
+		outputs = nil
+		slog.Warn("the run did not finish; the output was left unchanged")
+	}
+	if j.stream != "" && !complete {
+		slog.Warn("the run did not finish; the records streamed to stdout are incomplete")
+	} else if strictFailed {
+		slog.Info("list the new fields in -fields, or run without -strict, and run again")
+	} else if opts.Merge && !complete {
+		slog.Info("run again to merge the records")
+	} else if !complete {
+		cp := &Checkpoint{
+			Query:      query.key(),
+			BatchSize:  batchSize,
+			File:       filePath,
+			Completed:  summary.Completed,
+			Outputs:    outputs,
+			Records:    total,
+			NewRecords: newRecords,
+			Alerts:     alerts.results(),
+		}
+		if raw != nil {
+			cp.RawArchive = raw.dir
+		}
+		if series != nil {
+			cp.Periods = series.months
+		}
+		if resumed != nil {
+			cp.Completed = append(append([]int(nil), resumed.Completed...), summary.Completed...)
+		}
+		if err := cp.save(checkpointPath); err != nil {
+			slog.Warn("could not save checkpoint", "path", checkpointPath, "err", err)
+		} else {
+			slog.Info("checkpoint saved; rerun with -resume to fetch the rest",
+				"path", checkpointPath, "missingPages", numBatches-len(cp.Completed))
+		}
+	} else if resumed != nil {
+		if err := os.Remove(checkpointPath); err != nil {
+			slog.Warn("could not remove checkpoint", "path", checkpointPath, "err", err)
+		}
+	}
+
+	if !commit && len(outputs) > 0 {
+		slog.Warn("the run did not succeed; the previous output was left in place", "partial", outputs[0]+partialSuffix)
+		outputs = nil
+	} else if len(outputs) == 0 && j.stream == "" {
+		slog.Warn("no data was retrieved from the API")
+	}
+	for _, path := range outputs {
+		slog.Info("data saved", "path", path)
+	}
+	var areaFile *OutputFile
+	if opts.AreaSummary != "" && len(outputs) > 0 && summary.WriteErr == nil {
+		if err := j.writeAreaSummary(opts.AreaSummary, outputs); err != nil {
+			slog.Error("cannot write -area-summary", "err", err)
+		} else {
+			areaFile = &statOutputs([]string{opts.AreaSummary})[0]
+			slog.Info("area summary saved", "path", areaFile.Path)
+		}
+	}
+	var related []string
+	if j.related != nil && len(outputs) > 0 && summary.WriteErr == nil {
+		related = j.fetchRelated(ctx, layer, outputs, filePath)
+	}
+	// Every file the run produces, for -checksums.
+	artifacts := append(append([]string(nil), outputs...), related...)
+	if deltaFile != nil {
+		artifacts = append(artifacts, deltaFile.Path)
+	}
+	if quarantineFile != nil {
+		artifacts = append(artifacts, quarantineFile.Path)
+	}
+	if seriesFile != nil {
+		artifacts = append(artifacts, seriesFile.Path)
+	}
+	if areaFile != nil {
+		artifacts = append(artifacts, areaFile.Path)
+	}
+	artifacts = append(artifacts, teeFiles...)
+	var encrypted []string
+	encryptedFrom := make(map[string]string) // plaintext path to its encrypted copy
+	if j.encrypter != nil {
+		for _, path := range artifacts {
+			dst, err := j.encrypter.encryptFile(path)
+			if err != nil {
+				slog.Error("cannot encrypt output", "path", path, "err", err)
+				continue
+			}
+			slog.Info("encrypted copy saved", "path", dst)
+			encrypted = append(encrypted, dst)
+			encryptedFrom[path] = dst
+		}
+		artifacts = append(artifacts, encrypted...)
+	}
+	if (opts.DataPackage || opts.CSVW) && len(outputs) > 0 && summary.WriteErr == nil {
+		// The field types come from the layer metadata, which
+		// -if-changed has read already.
+		if layer == nil {
+			var err error
+			if layer, err = fetchLayerInfo(ctx, client, query.URL); err != nil {
+				slog.Warn("could not read layer metadata; field types are left out of the output metadata", "err", err)
+				layer = &LayerInfo{}
+			}
+		}
+		if opts.DataPackage {
+			if path, err := j.writeDataPackage(layer, dir, outputs); err != nil {
+				slog.Warn("could not write data package", "err", err)
+			} else {
+				slog.Info("data package saved", "path", path)
+				artifacts = append(artifacts, path)
+			}
+		}
+		if opts.CSVW {
+			written, err := j.writeCSVW(layer, outputs)
+			if err != nil {
+				slog.Warn("could not write CSVW metadata", "err", err)
+			}
+			artifacts = append(artifacts, written...)
+		}
+	}
 
-	// Save to CSV
-	if len(allData) > 0 {
-		if err := os.MkdirAll(outputDir, os.ModePerm); err != nil {
-			panic(err)
+	if j.attachments != nil && len(outputs) > 0 && summary.WriteErr == nil {
+		if manifest := j.fetchAttachments(ctx, layer, outputs); manifest != "" {
+			artifacts = append(artifacts, manifest)
 		}
+	}
+
+	runSummary := &RunSummary{
+		Records:      total,
+		NewRecords:   newRecords,
+		Pages:        len(summary.Completed),
+		FailedPages:  len(summary.Failed),
+		RetriedPages: summary.Retried,
+		Bytes:        client.BytesReceived() - received,
+		WallTime:     time.Since(start),
+		Outputs:      statOutputs(outputs),
+		Dates:        dates,
+		Alerts:       alerts.results(),
+		Quarantined:  quarantined,
+	}
+	// With -out - stdout carries the records, and the summary goes to
+	// stderr with the logs.
+	summaryOut := io.Writer(os.Stdout)
+	if j.stream != "" {
+		summaryOut = os.Stderr
+	}
+	runSummary.print(summaryOut, formatter.Location)
 
-		filePath := outputDir + "/" + outputFile
-		file, err := os.Create(filePath)
+	status = statusOK
+	switch {
+	case summary.WriteErr != nil:
+		status = statusFailed
+	case summary.Interrupted:
+		status = statusInterrupted
+	case summary.Err != nil:
+		status = statusCancelled
+	case len(summary.Failed) > 0:
+		status = statusPartial
+	case unchanged:
+		status = statusUnchanged
+	}
+	report := newRunReport(status, start, query, runSummary.Outputs)
+	report.addSummary(runSummary, summary.Failed)
+	report.Resumed = resumed != nil
+	report.Merged = merged
+	report.SalePrice = profile
+	report.CountDrift = countDrift
+	if raw != nil {
+		report.RawArchive = raw.dir
+		slog.Info("raw responses saved", "dir", raw.dir, "files", raw.pages.Load(), "bytes", raw.bytes.Load())
+	}
+	if len(unexpected) > 0 {
+		report.UnexpectedFields = unexpected
+	}
+	if attrs.records > 0 {
+		report.AttributeIssues = attrs.issues
+		report.MalformedRecords = attrs.records
+	}
+	if deltaFile != nil {
+		sum, _ := fileSHA256(deltaFile.Path)
+		report.Delta = &ReportOutput{OutputFile: *deltaFile, SHA256: sum}
+	}
+	if seriesFile != nil {
+		sum, _ := fileSHA256(seriesFile.Path)
+		report.Timeseries = &ReportOutput{OutputFile: *seriesFile, SHA256: sum}
+	}
+	if areaFile != nil {
+		sum, _ := fileSHA256(areaFile.Path)
+		report.AreaSummary = &ReportOutput{OutputFile: *areaFile, SHA256: sum}
+	}
+	if quarantineFile != nil {
+		sum, _ := fileSHA256(quarantineFile.Path)
+		report.Quarantine = &ReportOutput{OutputFile: *quarantineFile, SHA256: sum}
+		report.Quarantined = quarantined
+	}
+	for _, file := range statOutputs(related) {
+		sum, _ := fileSHA256(file.Path)
+		report.Related = append(report.Related, ReportOutput{OutputFile: file, SHA256: sum})
+	}
+	for _, file := range statOutputs(teeFiles) {
+		sum, _ := fileSHA256(file.Path)
+		report.Tee = append(report.Tee, ReportOutput{OutputFile: file, SHA256: sum})
+	}
+	for _, file := range statOutputs(encrypted) {
+		sum, _ := fileSHA256(file.Path)
+		report.Encrypted = append(report.Encrypted, ReportOutput{OutputFile: file, SHA256: sum})
+	}
+	if countErr == nil {
+		report.ExpectedRecords = count
+	}
+	if summary.Err != nil {
+		report.Error = summary.Err.Error()
+	}
+	if summary.WriteErr != nil {
+		report.Error = summary.WriteErr.Error()
+	}
+	if status != statusOK {
+		report.Checkpoint = checkpointPath
+	}
+	// A kept output still has the sidecar of the run that wrote it.
+	if opts.Provenance && len(outputs) > 0 && !unchanged {
+		written, err := j.writeProvenance(report, output, outputs, lastEditDate)
 		if err != nil {
-			panic(err)
+			slog.Warn("could not write provenance sidecar", "err", err)
+		}
+		artifacts = append(artifacts, written...)
+	}
+	j.publish(report)
+	// Once the run has succeeded and been reported, the encrypted copies
+	// replace the plaintext they were made from, unless -keep-plaintext.
+	removePlaintext := len(encryptedFrom) > 0 && status == statusOK && !opts.KeepPlaintext
+	if removePlaintext {
+		artifacts = slices.DeleteFunc(artifacts, func(path string) bool {
+			_, ok := encryptedFrom[path]
+			return ok
+		})
+	}
+	if opts.Checksums && len(outputs) > 0 {
+		if opts.Report != "" {
+			artifacts = append(artifacts, opts.Report)
+		}
+		path := filepath.Join(dir, checksumFile)
+		if err := writeChecksums(path, artifacts); err != nil {
+			slog.Warn("could not write checksums", "path", path, "err", err)
+		} else {
+			slog.Info("checksums saved", "path", path, "files", len(artifacts))
+		}
+	}
+
+	if opts.Versioned && status == statusOK && len(outputs) > 0 {
+		if err := updateLatest(latestPath, filePath, outputs); err != nil {
+			slog.Warn("could not link the latest output", "path", latestPath, "err", err)
+		}
+		if opts.Retention > 0 {
+			removed, err := pruneVersions(latestPath, opts.Retention, time.Now(), formatter.Location)
+			if err != nil {
+				slog.Warn("could not remove old versions", "err", err)
+			}
+			for _, path := range removed {
+				slog.Info("old version removed", "path", path)
+			}
+		}
+	}
+
+	if removePlaintext {
+		for path, dst := range encryptedFrom {
+			if err := os.Remove(path); err != nil {
+				slog.Warn("could not remove plaintext output", "path", path, "err", err)
+				continue
+			}
+			slog.Debug("plaintext output removed", "path", path, "encrypted", dst)
+		}
+		// -if-changed keeps the encrypted outputs while the layer is
+		// unchanged.
+		for i, path := range outputs {
+			if dst, ok := encryptedFrom[path]; ok {
+				outputs[i] = dst
+			}
+		}
+	}
+
+	if state != nil && (status == statusOK || unchanged) && len(outputs) > 0 {
+		state.Runs[query.key()] = &RunState{
+			LastEditDate: lastEditDate,
+			Outputs:      outputs,
+			Records:      total,
+			FetchedAt:    time.Now().UTC(),
+			Replica:      replica,
+		}
+		if err := state.save(opts.StateFile); err != nil {
+			slog.Warn("could not save state file", "path", opts.StateFile, "err", err)
 		}
-		defer file.Close()
+	}
 
-		writer := csv.NewWriter(file)
-		defer writer.Flush()
+	code = summary.exitCode(total, opts.MaxErrorRate)
+	runSpan.set("status", status, "records", total, "pages", len(summary.Completed),
+		"failed_pages", len(summary.Failed), "exit_code", code)
+	if code != exitOK {
+		runSpan.fail(fmt.Errorf("run finished with status %s", status))
+	}
+	finish()
+	return status, code
+}
 
-		// --- MODIFIED CSV WRITING LOGIC ---
+// sync gets the records through the -sync replica and writes them a page
+// at a time. It reports false, having written nothing, if the layer
+// cannot be fetched that way, and the run falls back to queries.
+func (j *fetchJob) sync(ctx context.Context, prev *RunState, write func([]map[string]interface{}) error, batchSize int) (fetchSummary, *ReplicaState, bool) {
+	var summary fetchSummary
+	var replica *ReplicaState
+	if prev != nil {
+		replica = prev.Replica
+	}
+	records, replica, err := j.replica.features(ctx, replica)
+	if err != nil {
+		slog.Warn("cannot fetch through the sync API; querying every page instead", "err", err)
+		return summary, nil, false
+	}
+	for offset := 0; offset < len(records); offset += batchSize {
+		page := records[offset:min(offset+batchSize, len(records))]
+		if err := write(page); err != nil {
+			summary.WriteErr = err
+			break
+		}
+		summary.Records += len(page)
+		summary.Completed = append(summary.Completed, offset)
+	}
+	return summary, replica, true
+}
 
-		// 1. Write headers using the predefined ordered slice
-		if err := writer.Write(csvHeaders); err != nil {
-			panic(err)
+// fetchRelated writes the records related to the features in the outputs,
+// one file per -related relationship next to the output at base, and
+// returns the files written.
+func (j *fetchJob) fetchRelated(ctx context.Context, layer *LayerInfo, outputs []string, base string) []string {
+	if layer == nil {
+		var err error
+		if layer, err = fetchLayerInfo(ctx, j.client, j.query.URL); err != nil {
+			slog.Error("cannot read the layer's relationships", "err", err)
+			return nil
+		}
+	}
+	rels, err := j.related.selectRelationships(layer)
+	if err != nil {
+		slog.Error("invalid -related", "err", err)
+		return nil
+	}
+	ids, err := objectIDs(outputs, j.dialect.Comma, j.column(idField))
+	if err != nil {
+		slog.Error("cannot read ObjectIds for -related", "err", err)
+		return nil
+	}
+	var written []string
+	for _, rel := range rels {
+		path, records, err := j.related.fetch(ctx, rel, ids, base)
+		if err != nil {
+			slog.Error("cannot fetch related records", "relationship", rel.Name, "err", err)
+			continue
 		}
+		slog.Info("related records saved", "relationship", rel.Name, "path", path, "records", records)
+		written = append(written, path)
+	}
+	return written
+}
 
-		// 2. Write rows, ensuring values are in the correct order
-		for _, record := range allData {
-			row := make([]string, len(csvHeaders))
-			for i, key := range csvHeaders {
-				// Get value from map and format it using our new helper function
-				row[i] = formatValue(key, record[key])
+// fetchAttachments downloads the attachments of the features in the
+// outputs and returns the manifest path, or "" if it was not written.
+// Failures are logged; the extract itself is complete without them.
+func (j *fetchJob) fetchAttachments(ctx context.Context, layer *LayerInfo, outputs []string) string {
+	if layer == nil {
+		if info, err := fetchLayerInfo(ctx, j.client, j.query.URL); err == nil {
+			layer = info
+		}
+	}
+	if layer != nil && layer.Name != "" && !layer.HasAttachments {
+		slog.Warn("the layer has no attachments", "layer", layer.Name)
+		return ""
+	}
+	ids, err := objectIDs(outputs, j.dialect.Comma, j.column(idField))
+	if err != nil {
+		slog.Error("cannot read ObjectIds for -attachments", "err", err)
+		return ""
+	}
+	summary, err := j.attachments.fetch(ctx, ids)
+	if err != nil {
+		slog.Error("cannot fetch attachments", "err", err)
+		return ""
+	}
+	slog.Info("attachments saved", "dir", j.attachments.dir, "features", summary.Features,
+		"attachments", summary.Attachments, "downloaded", summary.Downloaded, "failed", summary.Failed)
+	return filepath.Join(j.attachments.dir, attachmentManifest)
+}
+
+// saveReport writes the run report unless -report is empty. A report that
+// cannot be written is logged but does not fail the run.
+func saveReport(path string, report *RunReport) {
+	if path == "" {
+		return
+	}
+	if err := report.save(path); err != nil {
+		slog.Warn("could not save run report", "path", path, "err", err)
+	}
+}
+
+// unexpectedFields counts the records with attributes that are not known,
+// and the records each such field was in, and returns the fields seen for
+// the first time.
+func unexpectedFields(records []map[string]interface{}, known map[string]bool, counts map[string]int, total *int) []string {
+	var first []string
+	for _, record := range records {
+		found := false
+		for field := range record {
+			if known[field] {
+				continue
 			}
-			if err := writer.Write(row); err != nil {
-				// Log error but continue trying to write other rows
-				fmt.Printf("Error writing record to CSV: %v\n", err)
+			if counts[field] == 0 {
+				first = append(first, field)
 			}
+			counts[field]++
+			found = true
+		}
+		if found {
+			*total++
+		}
+	}
+	slices.Sort(first)
+	return first
+}
+
+// mergePaths appends the paths in b that are not already in a.
+func mergePaths(a, b []string) []string {
+	out := append([]string(nil), a...)
+	for _, path := range b {
+		if !slices.Contains(out, path) {
+			out = append(out, path)
 		}
+	}
+	return out
+}
+
+// printDryRun reports what a fetch would do without downloading any rows.
+func printDryRun(ctx context.Context, client *Client, query *Query, opts *Options, count, numBatches, batchSize int, filePath string, partitioner *Partitioner) {
+	if info, err := fetchLayerInfo(ctx, client, query.URL); err != nil {
+		slog.Warn("could not read layer metadata", "err", err)
+	} else {
+		fmt.Printf("Layer:          %s (%d fields, server page limit %d)\n", info.Name, len(info.Fields), info.MaxRecordCount)
+	}
 
-		fmt.Println("✅ Data saved to", filePath)
+	fmt.Printf("Where:          %s\n", query.Where)
+	fmt.Printf("Records:        %d\n", count)
+	fmt.Printf("Batches:        %d of %d rows, %d workers\n", numBatches, batchSize, opts.Workers)
+	if partitioner != nil {
+		ext := filepath.Ext(filePath)
+		fmt.Printf("Output:         %s_<%s>%s\n", strings.TrimSuffix(filePath, ext), partitionLabel(partitioner), ext)
 	} else {
-		fmt.Println("⚠️ No data was retrieved from the API.")
+		fmt.Printf("Output:         %s\n", filePath)
 	}
+	fmt.Println("Dry run: nothing was downloaded.")
 }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestFetchBatchPagesPastServerLimit(t *testing.T) {
+	layer, err := newFixtureLayer(filepath.Join("testdata", "foreclosures"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(layer)
+	defer server.Close()
+
+	// The fixture's maxRecordCount is 4, so a page of 10 comes back in
+	// three parts, each but the last with exceededTransferLimit set.
+	client := &Client{HTTP: server.Client()}
+	query := &Query{URL: server.URL + "/FeatureServer/0/query", Where: "1=1"}
+	records, err := fetchBatch(context.Background(), 0, 10, client, query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 10 {
+		t.Fatalf("got %d records, want 10", len(records))
+	}
+	seen := make(map[float64]bool)
+	for _, r := range records {
+		id, _ := r[idField].(float64)
+		if seen[id] {
+			t.Errorf("ObjectId %v returned twice", id)
+		}
+		seen[id] = true
+	}
+}
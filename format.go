@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // embed zone data so -tz works on hosts without zoneinfo
+)
+
+// dateFields lists the attributes the API returns as epoch-millisecond timestamps.
+var dateFields = map[string]bool{
+	"Action_Filed": true,
+	"Sale_Date":    true,
+}
+
+// redactedValue replaces the values of -redact-fields.
+const redactedValue = "[REDACTED]"
+
+// datePresets maps the named -date-format values to Go time layouts.
+// "epoch" is handled separately since it is not a layout. The default
+// layout prints the numeric zone offset, which is "+00" for UTC.
+var datePresets = map[string]string{
+	"default":   "2006/01/02 15:04:05-07",
+	"iso8601":   time.RFC3339,
+	"date-only": "2006-01-02",
+}
+
+// Formatter converts API attribute values into CSV strings.
+type Formatter struct {
+	DateLayout string          // Go layout used for date fields
+	EpochDates bool            // emit date fields as epoch seconds instead of a layout
+	Location   *time.Location  // zone date fields are converted to before formatting
+	RawDates   map[string]bool // date fields emitted as untouched epoch milliseconds ("*" for all)
+
+	NumberFields   map[string]bool // currency/number fields that get fixed formatting
+	Decimals       int             // decimal places for number fields; -1 keeps the shortest exact form
+	StripThousands bool            // parse strings like "1,250,000" in number fields as numbers
+
+	NullToken string // written for null attributes so they can be told apart from ""
+
+	HashFields   map[string]bool // written as an HMAC-SHA256 of the value, keyed with HashKey
+	HashKey      []byte
+	RedactFields map[string]bool // written as redactedValue
+
+	Coerce map[string]coercion // -coerce: the type each field is written as
+}
+
+// newFormatter builds a Formatter from the formatting flags.
+func newFormatter(opts *Options) (*Formatter, error) {
+	f := &Formatter{
+		Location:       time.UTC,
+		RawDates:       map[string]bool{},
+		NumberFields:   map[string]bool{},
+		Decimals:       opts.Decimals,
+		StripThousands: opts.StripThousands,
+		NullToken:      opts.NullToken,
+		HashFields:     map[string]bool{},
+		RedactFields:   map[string]bool{},
+	}
+
+	if opts.TZ != "" {
+		loc, err := time.LoadLocation(opts.TZ)
+		if err != nil {
+			return nil, fmt.Errorf("unknown time zone %q: %w", opts.TZ, err)
+		}
+		f.Location = loc
+	}
+
+	if err := f.setDateFormat(opts.DateFormat); err != nil {
+		return nil, err
+	}
+
+	for _, field := range splitList(opts.RawDates) {
+		if strings.EqualFold(field, "all") {
+			field = "*"
+		} else if !dateFields[field] {
+			// A misspelled field would otherwise have no effect.
+			return nil, fmt.Errorf("-raw-dates: %s is not a date field; want %s or all", field, strings.Join(slices.Sorted(maps.Keys(dateFields)), ", "))
+		}
+		f.RawDates[field] = true
+	}
+	for _, field := range splitList(opts.NumberFields) {
+		f.NumberFields[field] = true
+	}
+
+	coerce, err := parseCoercions(opts.Coerce)
+	if err != nil {
+		return nil, fmt.Errorf("-coerce: %w", err)
+	}
+	if len(coerce) > 0 {
+		f.Coerce = coerce
+	}
+
+	for _, field := range splitList(opts.RedactFields) {
+		f.RedactFields[field] = true
+	}
+	for _, field := range splitList(opts.HashFields) {
+		if f.RedactFields[field] {
+			return nil, fmt.Errorf("%s is in both -hash-fields and -redact-fields", field)
+		}
+		f.HashFields[field] = true
+	}
+	if len(f.HashFields) > 0 {
+		// Without a secret salt, a hash of a name is easily reversed by
+		// hashing a list of likely names.
+		salt := os.Getenv("FETCH_HASH_SALT")
+		if salt == "" {
+			return nil, errors.New("-hash-fields needs a salt in $FETCH_HASH_SALT")
+		}
+		f.HashKey = []byte(salt)
+	}
+	return f, nil
+}
+
+// setDateFormat applies the -date-format value, which may be one of the
+// named presets or a custom Go time layout.
+func (f *Formatter) setDateFormat(dateFormat string) error {
+	name := strings.ToLower(strings.TrimSpace(dateFormat))
+	if name == "" {
+		name = "default"
+	}
+
+	if name == "epoch" {
+		f.EpochDates = true
+		return nil
+	}
+	if layout, ok := datePresets[name]; ok {
+		f.DateLayout = layout
+		return nil
+	}
+
+	// Anything else is treated as a Go layout. Reject strings that contain
+	// no layout elements at all, since they would print the same literal
+	// text for every date.
+	ref := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	if ref.Format(dateFormat) == dateFormat {
+		return fmt.Errorf("unknown date format %q", dateFormat)
+	}
+	f.DateLayout = dateFormat
+	return nil
+}
+
+// formatValue converts an API value into the string written to the CSV,
+// hashing or redacting the fields chosen for that. Nulls stay nulls.
+func (f *Formatter) formatValue(key string, value interface{}) string {
+	s := f.formatPlain(key, value)
+	if value == nil || s == f.NullToken {
+		return s
+	}
+	if f.RedactFields[key] {
+		return redactedValue
+	}
+	if f.HashFields[key] {
+		// The same value and salt always give the same hash, so hashed
+		// fields can still be joined on.
+		mac := hmac.New(sha256.New, f.HashKey)
+		mac.Write([]byte(s))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	return s
+}
+
+// formatRow formats the fields of a record in the given order for a CSV
+// row, marking the ones that are null: those written as the null token.
+func (f *Formatter) formatRow(fields []string, record map[string]interface{}) (row []string, null []bool) {
+	row = make([]string, len(fields))
+	null = make([]bool, len(fields))
+	for i, field := range fields {
+		value := record[field]
+		row[i] = f.formatValue(field, value)
+		null[i] = value == nil || f.NullToken != "" && row[i] == f.NullToken
+	}
+	return row, null
+}
+
+// formatDate formats an epoch-millisecond timestamp under -date-format,
+// -tz and -raw-dates.
+func (f *Formatter) formatDate(key string, timestamp float64) string {
+	if f.RawDates["*"] || f.RawDates[key] {
+		return strconv.FormatFloat(timestamp, 'f', -1, 64)
+	}
+	if timestamp == 0 {
+		return ""
+	}
+	// Convert milliseconds to seconds
+	sec := int64(timestamp / 1000)
+	if f.EpochDates {
+		return strconv.FormatInt(sec, 10)
+	}
+	// Create a time.Time object in the configured zone (UTC by default)
+	t := time.Unix(sec, 0).In(f.Location)
+	return t.Format(f.DateLayout)
+}
+
+// formatPlain handles converting API data into the correct CSV string format.
+// It specifically processes nil values and date timestamps.
+func (f *Formatter) formatPlain(key string, value interface{}) string {
+	// 1. Handle nil values first, which appear as <nil>
+	if value == nil {
+		return f.NullToken
+	}
+
+	// -coerce rules decide the format of their fields. Records that break
+	// a rule are quarantined before they get here.
+	if c, ok := f.Coerce[key]; ok {
+		if s, err := c.apply(f, key, value); err == nil {
+			return s
+		}
+	}
+
+	// 2. Check if the key corresponds to a date field
+	if dateFields[key] {
+		// The API returns timestamps as float64 (milliseconds)
+		if timestamp, ok := value.(float64); ok {
+			return f.formatDate(key, timestamp)
+		}
+	}
+
+	// 3. Numbers are written in plain decimal notation. fmt's %v would print
+	// large values such as 1250000 as "1.25e+06".
+	if f.NumberFields[key] {
+		if n, ok := f.parseNumber(value); ok {
+			return strconv.FormatFloat(n, 'f', f.Decimals, 64)
+		}
+	}
+	if n, ok := value.(float64); ok {
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	}
+
+	// 4. For all other types, convert to a string
+	// Also handles the edge case where a value might literally be "<nil>"
+	s := fmt.Sprintf("%v", value)
+	if s == "<nil>" {
+		return f.NullToken
+	}
+	return s
+}
+
+// parseNumber extracts a numeric value from a number field. The API normally
+// sends numbers, but some layers store amounts as text.
+func (f *Formatter) parseNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		s := strings.TrimSpace(v)
+		if f.StripThousands {
+			s = strings.ReplaceAll(s, ",", "")
+		}
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, false
+		}
+		return n, true
+	}
+	return 0, false
+}
+
+// defaultFormatter returns a Formatter with the default fetch settings, for
+// subcommands that print values without exposing the formatting flags.
+func defaultFormatter() *Formatter {
+	f, _ := newFormatter(&Options{DateFormat: "default", Decimals: -1})
+	return f
+}
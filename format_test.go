@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRawDates(t *testing.T) {
+	tests := []struct {
+		rawDates string
+		want     []string // the fields emitted raw
+		err      string
+	}{
+		{rawDates: "Sale_Date", want: []string{"Sale_Date"}},
+		{rawDates: "Action_Filed, Sale_Date", want: []string{"Action_Filed", "Sale_Date"}},
+		{rawDates: "ALL", want: []string{"*"}},
+		{rawDates: "Sale_Dat", err: "-raw-dates: Sale_Dat is not a date field; want Action_Filed, Sale_Date or all"},
+		{rawDates: "Sale_Date,Zip", err: "Zip is not a date field"},
+	}
+	for _, tt := range tests {
+		f, err := newFormatter(&Options{DateFormat: "default", RawDates: tt.rawDates})
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: got error %v, want %q", tt.rawDates, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.rawDates, err)
+			continue
+		}
+		if len(f.RawDates) != len(tt.want) {
+			t.Errorf("%q: raw dates %v, want %v", tt.rawDates, f.RawDates, tt.want)
+		}
+		for _, field := range tt.want {
+			if !f.RawDates[field] {
+				t.Errorf("%q: %s is not raw", tt.rawDates, field)
+			}
+		}
+	}
+}
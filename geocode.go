@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// defaultGeocodeCache is where geocoded addresses are kept between runs,
+// relative to the output directory.
+const defaultGeocodeCache = ".geocode_cache.json"
+
+// censusGeocoder is the US Census Bureau's one-line address geocoder,
+// used for -geocode census.
+const censusGeocoder = "https://geocoding.geo.census.gov/geocoder/locations/onelineaddress"
+
+const (
+	latitudeField  = "Latitude"
+	longitudeField = "Longitude"
+
+	// geocodeWorkers is how many addresses are looked up at once.
+	geocodeWorkers = 4
+	// geocodeMaxFailures consecutive failed lookups turn geocoding off for
+	// the rest of the run, rather than waiting on a geocoder that is down.
+	geocodeMaxFailures = 10
+	// geocodeMinScore is the lowest ArcGIS candidate score accepted.
+	geocodeMinScore = 80
+)
+
+// geocodeFields are the fields an address is built from for geocoding.
+var geocodeFields = append(append([]string(nil), addressFields...), "Zip")
+
+// geoPoint is a geocoded location in WGS84.
+type geoPoint struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// geocoder adds Latitude and Longitude to records from their address,
+// with the Census geocoder or an ArcGIS GeocodeServer. Results, including
+// addresses that did not match, are cached in a file so each address is
+// only looked up once; lookups that fail are retried on the next run.
+type geocoder struct {
+	endpoint  string // censusGeocoder or a GeocodeServer URL
+	locality  string // appended to every address, e.g. "Louisville, KY"
+	client    *http.Client
+	limiter   *rateLimiter
+	cachePath string
+
+	mu        sync.Mutex
+	cache     map[string]*geoPoint // nil for addresses that did not match
+	dirty     bool
+	failures  int // consecutive
+	disabled  bool
+	lastErr   error
+	requested int
+	matched   int
+	failed    int
+}
+
+// newGeocoder builds the geocoder for -geocode, or returns nil if it is
+// off. It has its own HTTP client so credentials for the feature service
+// are never sent to the geocoder.
+func newGeocoder(opts *Options) (*geocoder, error) {
+	if opts.Geocode == "" {
+		return nil, nil
+	}
+	endpoint := opts.Geocode
+	if strings.EqualFold(endpoint, "census") {
+		endpoint = censusGeocoder
+	} else if u, err := url.Parse(endpoint); err != nil || u.Host == "" || !strings.HasSuffix(strings.TrimSuffix(u.Path, "/"), "/GeocodeServer") {
+		return nil, fmt.Errorf("-geocode %q: want census or the URL of an ArcGIS GeocodeServer", opts.Geocode)
+	}
+	if opts.GeocodeRate <= 0 {
+		return nil, errors.New("-geocode-rate must be positive")
+	}
+
+	transport, err := newTransport(opts)
+	if err != nil {
+		return nil, err
+	}
+	g := &geocoder{
+		endpoint:  endpoint,
+		locality:  opts.GeocodeLocality,
+		client:    &http.Client{Transport: transport, Timeout: opts.Timeout},
+		limiter:   newRateLimiter(opts.GeocodeRate, 1),
+		cachePath: opts.GeocodeCache,
+		cache:     make(map[string]*geoPoint),
+	}
+	if g.cachePath != "" {
+		data, err := os.ReadFile(g.cachePath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &g.cache); err != nil {
+				return nil, fmt.Errorf("%s: %w", g.cachePath, err)
+			}
+		}
+	}
+	return g, nil
+}
+
+// address is the one-line address a record is geocoded by, or "" if it
+// has no street.
+func (g *geocoder) address(record map[string]interface{}) string {
+	street, _ := normalizeAddress(record).(string)
+	if street == "" {
+		return ""
+	}
+	line := street
+	if g.locality != "" {
+		line += ", " + g.locality
+	}
+	if zip := addressPart(record["Zip"]); zip != "" {
+		line += " " + zip
+	}
+	return line
+}
+
+// enrich geocodes a page of records. Addresses that are not cached yet are
+// looked up concurrently, within -geocode-rate.
+func (g *geocoder) enrich(records []map[string]interface{}) {
+	addresses := make([]string, len(records))
+	var missing []string
+	seen := make(map[string]bool)
+	g.mu.Lock()
+	for i, record := range records {
+		if record == nil {
+			continue
+		}
+		addresses[i] = g.address(record)
+		if address := addresses[i]; address != "" && !seen[address] {
+			seen[address] = true
+			if _, ok := g.cache[address]; !ok && !g.disabled {
+				missing = append(missing, address)
+			}
+		}
+	}
+	g.mu.Unlock()
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for range min(geocodeWorkers, len(missing)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for address := range jobs {
+				g.resolve(address)
+			}
+		}()
+	}
+	for _, address := range missing {
+		jobs <- address
+	}
+	close(jobs)
+	wg.Wait()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for i, record := range records {
+		if p := g.cache[addresses[i]]; p != nil && addresses[i] != "" {
+			record[latitudeField] = p.Lat
+			record[longitudeField] = p.Lon
+		}
+	}
+}
+
+// resolve looks up one address and caches the result.
+func (g *geocoder) resolve(address string) {
+	g.mu.Lock()
+	disabled := g.disabled
+	g.mu.Unlock()
+	if disabled {
+		return
+	}
+
+	// The rate limiter only fails once its context is done, and
+	// geocoding runs without one.
+	_ = g.limiter.Wait(context.Background())
+	p, err := g.lookup(address)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.requested++
+	if err != nil {
+		slog.Debug("cannot geocode address", "address", address, "err", err)
+		g.failed++
+		g.failures++
+		g.lastErr = err
+		if g.failures >= geocodeMaxFailures && !g.disabled {
+			g.disabled = true
+			slog.Warn("geocoder keeps failing; no more addresses will be geocoded this run", "err", err)
+		}
+		return
+	}
+	g.failures = 0
+	g.cache[address] = p
+	g.dirty = true
+	if p != nil {
+		g.matched++
+	}
+}
+
+// lookup asks the geocoder for an address. It returns nil without an
+// error if the address did not match.
+func (g *geocoder) lookup(address string) (*geoPoint, error) {
+	if g.endpoint == censusGeocoder {
+		params := url.Values{"address": {address}, "benchmark": {"Public_AR_Current"}, "format": {"json"}}
+		var result struct {
+			Result struct {
+				AddressMatches []struct {
+					Coordinates struct{ X, Y float64 } `json:"coordinates"`
+				} `json:"addressMatches"`
+			} `json:"result"`
+		}
+		if err := g.get(g.endpoint, params, &result); err != nil {
+			return nil, err
+		}
+		if matches := result.Result.AddressMatches; len(matches) > 0 {
+			return &geoPoint{Lat: matches[0].Coordinates.Y, Lon: matches[0].Coordinates.X}, nil
+		}
+		return nil, nil
+	}
+
+	// An ArcGIS GeocodeServer. Parameters in the -geocode URL, such as a
+	// token, are kept.
+	u, _ := url.Parse(g.endpoint)
+	params := u.Query()
+	u.RawQuery = ""
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/findAddressCandidates"
+	params.Set("SingleLine", address)
+	params.Set("outSR", "4326")
+	params.Set("maxLocations", "1")
+	params.Set("f", "json")
+	var result struct {
+		Candidates []struct {
+			Location struct{ X, Y float64 } `json:"location"`
+			Score    float64                `json:"score"`
+		} `json:"candidates"`
+	}
+	if err := g.get(u.String(), params, &result); err != nil {
+		return nil, err
+	}
+	if c := result.Candidates; len(c) > 0 && c[0].Score >= geocodeMinScore {
+		return &geoPoint{Lat: c[0].Location.Y, Lon: c[0].Location.X}, nil
+	}
+	return nil, nil
+}
+
+func (g *geocoder) get(endpoint string, params url.Values, v interface{}) error {
+	resp, err := g.client.Get(endpoint + "?" + params.Encode())
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err // the URL holds the address and maybe a token
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &HTTPStatusError{Code: resp.StatusCode}
+	}
+	return decodeBody(resp, v)
+}
+
+// finish saves the cache and logs how geocoding went. With -watch the
+// next run starts afresh, with the cache kept.
+func (g *geocoder) finish() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	defer func() {
+		g.requested, g.matched, g.failed, g.failures = 0, 0, 0, 0
+		g.disabled = false
+	}()
+	slog.Info("geocoding finished", "lookups", g.requested, "matched", g.matched,
+		"unmatched", g.requested-g.matched-g.failed, "failed", g.failed, "cached", len(g.cache))
+	if g.failed > 0 {
+		slog.Warn("some addresses could not be geocoded; they are retried on the next run", "failed", g.failed, "err", g.lastErr)
+	}
+	if !g.dirty || g.cachePath == "" {
+		return
+	}
+	data, err := json.Marshal(g.cache)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(g.cachePath), os.ModePerm)
+	}
+	if err == nil {
+		tmp := g.cachePath + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o644); err == nil {
+			err = os.Rename(tmp, g.cachePath)
+		}
+	}
+	if err != nil {
+		slog.Warn("could not save geocode cache", "path", g.cachePath, "err", err)
+		return
+	}
+	g.dirty = false
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata/golden from the current code instead of comparing them")
+
+// goldenOutputs are the files each golden case writes and compares: the
+// output and a -tee in each of the other formats.
+var goldenOutputs = []string{"out.csv", "out.ndjson", "out.parquet"}
+
+// goldenCases are the fetches TestGolden runs, each with its own
+// directory of golden files. They cover the formatting options that
+// change what formatValue and the writers produce.
+var goldenCases = []struct {
+	name string
+	args []string
+}{
+	{"default", nil},
+	{"formatted", []string{"-date-format", "iso8601", "-tz", "America/Kentucky/Louisville", "-decimals", "2", "-null", `\N`, "-rfc4180"}},
+	{"renamed", []string{
+		"-fields", "ObjectId,Case_,Action_Filed,Sale_Date,Sale_Price,Neighborhood,Purchaser",
+		"-rename", "Case_=case_number,Sale_Price=price", "-date-format", "date-only",
+		"-raw-dates", "Action_Filed", "-delimiter", "tab", "-address",
+	}},
+}
+
+// TestGolden is a regression check of the output formatting: it runs each
+// of goldenCases through the full fetch against the fixture in
+// testdata/foreclosures, and compares the CSV, NDJSON and Parquet outputs
+// byte for byte with the golden files. After an intended change,
+//
+//	go test -run TestGolden -update
+//
+// rewrites them; review their diff before committing it.
+func TestGolden(t *testing.T) {
+	layer, err := newFixtureLayer(filepath.Join("testdata", "foreclosures"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(layer)
+	defer server.Close()
+
+	for _, c := range goldenCases {
+		t.Run(c.name, func(t *testing.T) {
+			out := t.TempDir()
+			args := []string{
+				"-url", server.URL + "/FeatureServer/0",
+				"-out", filepath.Join(out, goldenOutputs[0]),
+				"-tee", filepath.Join(out, goldenOutputs[1]),
+				"-tee", filepath.Join(out, goldenOutputs[2]),
+				// The default -batch-size: the fixture's maxRecordCount
+				// caps it, so the output is put together from several pages.
+				"-report", "", "-lock", "", "-provenance=false", "-progress", "off",
+			}
+			if code := runFixtureFetch(t, append(args, c.args...)); code != exitOK {
+				t.Fatalf("fetch exited with %d", code)
+			}
+
+			for _, name := range goldenOutputs {
+				got, err := os.ReadFile(filepath.Join(out, name))
+				if err != nil {
+					t.Errorf("output not written: %v", err)
+					continue
+				}
+				path := filepath.Join("testdata", "golden", c.name, name)
+				if *updateGolden {
+					if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+						t.Fatal(err)
+					}
+					if err := writeFileAtomic(path, got); err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+				want, err := os.ReadFile(path)
+				if err != nil {
+					t.Errorf("cannot read golden file; run with -update to create it: %v", err)
+					continue
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("%s differs from the golden file: %s", name, goldenDiff(want, got))
+				}
+			}
+		})
+	}
+}
+
+// runFixtureFetch runs a fetch with the given command line, with no
+// notifications or trace spans whatever the environment names.
+func runFixtureFetch(t *testing.T, args []string) int {
+	t.Helper()
+	var opts Options
+	fs := flag.NewFlagSet("fetch", flag.ContinueOnError)
+	opts.register(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	job := newFetchJob(&opts)
+	job.notifiers, job.tracer = nil, nil
+	_, code := job.run(opts.Resume)
+	return code
+}
+
+// goldenDiff describes where got first differs from want: the line and
+// both versions of it for text, the offset for binary files.
+func goldenDiff(want, got []byte) string {
+	n := 0
+	for n < len(want) && n < len(got) && want[n] == got[n] {
+		n++
+	}
+	if bytes.IndexByte(want, 0) >= 0 || bytes.IndexByte(got, 0) >= 0 {
+		return fmt.Sprintf("at offset %d (want %d bytes, got %d)", n, len(want), len(got))
+	}
+	start := bytes.LastIndexByte(want[:n], '\n') + 1
+	line := func(b []byte) string {
+		if start >= len(b) {
+			return ""
+		}
+		b = b[start:]
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			b = b[:i]
+		}
+		return string(b)
+	}
+	return fmt.Sprintf("line %d\nwant %s\ngot  %s", bytes.Count(want[:n], []byte("\n"))+1, line(want), line(got))
+}
@@ -0,0 +1,1177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The GraphQL endpoint of serve mode implements the query subset front
+// ends use against this schema: operations with variables, aliases,
+// fragments, @include/@skip and __typename. Mutations, subscriptions and
+// introspection are not supported.
+//
+//	type Query {
+//	  records(filter: RecordFilter, sort: [Sort!], limit: Int = 100, offset: Int = 0): RecordPage!
+//	  record(objectId: ID!): Record
+//	  stats(field: String!, filter: RecordFilter, limit: Int): [ValueCount!]!
+//	  fields: [String!]!
+//	}
+//	type RecordPage { total: Int!  items: [Record!]! }
+//	type Record { <one String field per column>  }
+//	type ValueCount { value: String  count: Int! }
+//	input RecordFilter { since: String  until: String  <column>: String or [String] }
+//	input Sort { field: String!  order: SortOrder = ASC }
+//	enum SortOrder { ASC DESC }
+//
+// A RecordFilter means the same as the query string of /records.
+
+// maxGraphQLBody bounds the size of a request body.
+const maxGraphQLBody = 1 << 20
+
+// gqlRequest is the standard GraphQL-over-HTTP request.
+type gqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+type gqlResponse struct {
+	Data   interface{} `json:"data,omitempty"`
+	Errors []gqlError  `json:"errors,omitempty"`
+}
+
+type gqlError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// serveGraphQL handles POST /graphql with a JSON body, and GET /graphql
+// with query, operationName and variables in the query string.
+func serveGraphQL(store *extractStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req gqlRequest
+		if r.Method == http.MethodGet {
+			q := r.URL.Query()
+			req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+			if vars := q.Get("variables"); vars != "" {
+				if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+					writeError(w, http.StatusBadRequest, fmt.Errorf("variables: %w", err))
+					return
+				}
+			}
+		} else if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxGraphQLBody)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+			return
+		}
+		if strings.TrimSpace(req.Query) == "" {
+			writeError(w, http.StatusBadRequest, errors.New("missing query"))
+			return
+		}
+
+		ds, ok := loadDataset(w, store)
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, executeGraphQL(ds, store.formatter, &req))
+	}
+}
+
+// executeGraphQL parses and runs a request. Errors in the document are
+// returned without data; errors in a field make that field null.
+func executeGraphQL(ds *dataset, f *Formatter, req *gqlRequest) *gqlResponse {
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		return &gqlResponse{Errors: []gqlError{{Message: err.Error()}}}
+	}
+	op, err := doc.operation(req.OperationName)
+	if err != nil {
+		return &gqlResponse{Errors: []gqlError{{Message: err.Error()}}}
+	}
+	e := &gqlExecutor{ds: ds, f: f, fragments: doc.fragments}
+	if e.vars, err = op.coerceVariables(req.Variables); err != nil {
+		return &gqlResponse{Errors: []gqlError{{Message: err.Error()}}}
+	}
+
+	fields, err := e.collect(op.selections, "Query")
+	if err != nil {
+		return &gqlResponse{Errors: []gqlError{{Message: err.Error()}}}
+	}
+	data := make(gqlObject, 0, len(fields))
+	for _, field := range fields {
+		value, err := e.resolveQueryField(field)
+		if err != nil {
+			e.errors = append(e.errors, gqlError{Message: err.Error(), Path: []interface{}{field.key()}})
+			value = nil
+		}
+		data = append(data, gqlEntry{field.key(), value})
+	}
+	return &gqlResponse{Data: data, Errors: e.errors}
+}
+
+// gqlObject is a result object, which keeps its fields in query order.
+type gqlObject []gqlEntry
+
+type gqlEntry struct {
+	key   string
+	value interface{}
+}
+
+func (o gqlObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, entry := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(entry.key)
+		buf.Write(key)
+		buf.WriteByte(':')
+		value, err := json.Marshal(entry.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+type gqlExecutor struct {
+	ds        *dataset
+	f         *Formatter
+	vars      map[string]interface{}
+	fragments map[string]*gqlFragment
+	errors    []gqlError
+}
+
+func (e *gqlExecutor) resolveQueryField(field *gqlField) (interface{}, error) {
+	args, err := e.arguments(field)
+	if err != nil {
+		return nil, err
+	}
+	switch field.name {
+	case "__typename":
+		return "Query", field.scalar()
+	case "__schema", "__type":
+		return nil, errors.New("introspection is not supported")
+	case "fields":
+		return e.ds.header, field.scalar()
+	case "record":
+		id, ok := args["objectId"]
+		if !ok || id == nil {
+			return nil, errors.New("record: objectId is required")
+		}
+		idx, found := e.ds.byID[gqlString(id)]
+		if !found {
+			return nil, nil
+		}
+		return e.record(field, idx)
+	case "records":
+		matched, err := e.match(args["filter"])
+		if err != nil {
+			return nil, err
+		}
+		if err := e.sort(matched, args["sort"]); err != nil {
+			return nil, err
+		}
+		limit, err := gqlInt(args, "limit", defaultRecordLimit)
+		if err != nil {
+			return nil, err
+		}
+		offset, err := gqlInt(args, "offset", 0)
+		if err != nil {
+			return nil, err
+		}
+		page := matched[min(offset, len(matched)):]
+		page = page[:min(limit, maxRecordLimit, len(page))]
+		return e.recordPage(field, len(matched), page)
+	case "stats":
+		name, ok := args["field"].(string)
+		if !ok {
+			return nil, errors.New("stats: field is required")
+		}
+		column, found := e.ds.column(name)
+		if !found {
+			return nil, fmt.Errorf("stats: unknown field %q", name)
+		}
+		matched, err := e.match(args["filter"])
+		if err != nil {
+			return nil, err
+		}
+		groups := countValues(e.ds, column, matched)
+		limit, err := gqlInt(args, "limit", len(groups))
+		if err != nil {
+			return nil, err
+		}
+		return e.valueCounts(field, groups[:min(limit, len(groups))])
+	}
+	return nil, fmt.Errorf("cannot query field %q on type Query", field.name)
+}
+
+// match applies a RecordFilter argument.
+func (e *gqlExecutor) match(arg interface{}) ([]int, error) {
+	query := make(map[string][]string)
+	if arg != nil {
+		obj, ok := arg.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("filter must be an object")
+		}
+		for key, value := range obj {
+			switch v := value.(type) {
+			case nil:
+			case []interface{}:
+				for _, item := range v {
+					query[key] = append(query[key], gqlString(item))
+				}
+			default:
+				query[key] = []string{gqlString(v)}
+			}
+		}
+	}
+	filter, err := parseRecordFilter(e.ds, e.f, query)
+	if err != nil {
+		return nil, fmt.Errorf("filter: %w", err)
+	}
+	return filter.match(e.ds), nil
+}
+
+// sort orders records by a list of {field, order} keys. Date columns sort
+// by date and columns of numbers numerically; empty values come last in
+// either order.
+func (e *gqlExecutor) sort(matched []int, arg interface{}) error {
+	if arg == nil {
+		return nil
+	}
+	items, ok := arg.([]interface{})
+	if !ok {
+		items = []interface{}{arg} // a single Sort is coerced to a list
+	}
+	type sortKey struct {
+		column string
+		desc   bool
+	}
+	var keys []sortKey
+	for _, item := range items {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			return errors.New("sort: expected {field, order}")
+		}
+		name, _ := obj["field"].(string)
+		column, found := e.ds.column(name)
+		if !found {
+			return fmt.Errorf("sort: unknown field %q", name)
+		}
+		key := sortKey{column: column}
+		switch order := obj["order"]; {
+		case order == nil, strings.EqualFold(gqlString(order), "ASC"):
+		case strings.EqualFold(gqlString(order), "DESC"):
+			key.desc = true
+		default:
+			return fmt.Errorf("sort: order must be ASC or DESC, got %v", order)
+		}
+		keys = append(keys, key)
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		for _, key := range keys {
+			c, decided := e.compare(key.column, a, b)
+			if !decided {
+				continue
+			}
+			if key.desc && c != 0 {
+				// Empty values stay last.
+				if e.ds.records[a][key.column] != "" && e.ds.records[b][key.column] != "" {
+					c = -c
+				}
+			}
+			return c < 0
+		}
+		return false
+	})
+	return nil
+}
+
+// compare orders two records on a column, with empty values last. It
+// reports false when they are equal.
+func (e *gqlExecutor) compare(column string, a, b int) (int, bool) {
+	va, vb := e.ds.records[a][column], e.ds.records[b][column]
+	switch {
+	case va == vb:
+		return 0, false
+	case va == "":
+		return 1, true
+	case vb == "":
+		return -1, true
+	}
+	if dates := e.ds.dates[column]; dates != nil && !dates[a].IsZero() && !dates[b].IsZero() {
+		if c := dates[a].Compare(dates[b]); c != 0 {
+			return c, true
+		}
+		return 0, false
+	}
+	if na, ok := e.f.parseNumber(va); ok {
+		if nb, ok := e.f.parseNumber(vb); ok {
+			switch {
+			case na < nb:
+				return -1, true
+			case na > nb:
+				return 1, true
+			}
+			return 0, false
+		}
+	}
+	return strings.Compare(va, vb), true
+}
+
+func (e *gqlExecutor) recordPage(field *gqlField, total int, page []int) (interface{}, error) {
+	fields, err := e.object(field, "RecordPage")
+	if err != nil {
+		return nil, err
+	}
+	obj := make(gqlObject, 0, len(fields))
+	for _, sub := range fields {
+		var value interface{}
+		switch sub.name {
+		case "__typename":
+			value, err = "RecordPage", sub.scalar()
+		case "total":
+			value, err = total, sub.scalar()
+		case "items":
+			items := make([]interface{}, len(page))
+			for i, idx := range page {
+				if items[i], err = e.record(sub, idx); err != nil {
+					break
+				}
+			}
+			value = items
+		default:
+			err = fmt.Errorf("cannot query field %q on type RecordPage", sub.name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		obj = append(obj, gqlEntry{sub.key(), value})
+	}
+	return obj, nil
+}
+
+func (e *gqlExecutor) record(field *gqlField, idx int) (interface{}, error) {
+	fields, err := e.object(field, "Record")
+	if err != nil {
+		return nil, err
+	}
+	rec := e.ds.records[idx]
+	obj := make(gqlObject, 0, len(fields))
+	for _, sub := range fields {
+		if err := sub.scalar(); err != nil {
+			return nil, err
+		}
+		if sub.name == "__typename" {
+			obj = append(obj, gqlEntry{sub.key(), "Record"})
+			continue
+		}
+		value, ok := rec[sub.name]
+		if !ok && !e.hasColumn(sub.name) {
+			return nil, fmt.Errorf("cannot query field %q on type Record", sub.name)
+		}
+		if e.f.NullToken != "" && value == e.f.NullToken {
+			obj = append(obj, gqlEntry{sub.key(), nil})
+			continue
+		}
+		obj = append(obj, gqlEntry{sub.key(), value})
+	}
+	return obj, nil
+}
+
+func (e *gqlExecutor) hasColumn(name string) bool {
+	for _, h := range e.ds.header {
+		if h == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *gqlExecutor) valueCounts(field *gqlField, groups []valueCount) (interface{}, error) {
+	fields, err := e.object(field, "ValueCount")
+	if err != nil {
+		return nil, err
+	}
+	list := make([]interface{}, len(groups))
+	for i, g := range groups {
+		obj := make(gqlObject, 0, len(fields))
+		for _, sub := range fields {
+			var value interface{}
+			switch sub.name {
+			case "__typename":
+				value = "ValueCount"
+			case "value":
+				value = g.Value
+			case "count":
+				value = g.Count
+			default:
+				return nil, fmt.Errorf("cannot query field %q on type ValueCount", sub.name)
+			}
+			if err := sub.scalar(); err != nil {
+				return nil, err
+			}
+			obj = append(obj, gqlEntry{sub.key(), value})
+		}
+		list[i] = obj
+	}
+	return list, nil
+}
+
+// object returns the fields selected on an object-typed field.
+func (e *gqlExecutor) object(field *gqlField, typeName string) ([]*gqlField, error) {
+	if field.selections == nil {
+		return nil, fmt.Errorf("field %q of type %s must have a selection of subfields", field.name, typeName)
+	}
+	return e.collect(field.selections, typeName)
+}
+
+// collect flattens a selection set for an object type, expanding fragments
+// and applying @include and @skip.
+func (e *gqlExecutor) collect(selections []gqlSelection, typeName string) ([]*gqlField, error) {
+	var fields []*gqlField
+	err := e.collectInto(&fields, selections, typeName, map[string]bool{})
+	return fields, err
+}
+
+func (e *gqlExecutor) collectInto(fields *[]*gqlField, selections []gqlSelection, typeName string, visited map[string]bool) error {
+	for _, sel := range selections {
+		ok, err := e.included(sel.directives)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		switch {
+		case sel.field != nil:
+			*fields = append(*fields, sel.field)
+		case sel.spread != "":
+			frag, found := e.fragments[sel.spread]
+			if !found {
+				return fmt.Errorf("unknown fragment %q", sel.spread)
+			}
+			if visited[sel.spread] {
+				return fmt.Errorf("fragment %q spreads itself", sel.spread)
+			}
+			if frag.typeCondition != typeName {
+				continue
+			}
+			visited[sel.spread] = true
+			if err := e.collectInto(fields, frag.selections, typeName, visited); err != nil {
+				return err
+			}
+			delete(visited, sel.spread)
+		default:
+			if sel.typeCondition != "" && sel.typeCondition != typeName {
+				continue
+			}
+			if err := e.collectInto(fields, sel.selections, typeName, visited); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (e *gqlExecutor) included(directives []gqlDirective) (bool, error) {
+	for _, d := range directives {
+		if d.name != "include" && d.name != "skip" {
+			return false, fmt.Errorf("unknown directive @%s", d.name)
+		}
+		value, err := e.value(d.args["if"])
+		if err != nil {
+			return false, err
+		}
+		cond, ok := value.(bool)
+		if !ok {
+			return false, fmt.Errorf("@%s requires a Boolean if argument", d.name)
+		}
+		if cond == (d.name == "skip") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// arguments resolves the variables in a field's arguments.
+func (e *gqlExecutor) arguments(field *gqlField) (map[string]interface{}, error) {
+	args := make(map[string]interface{}, len(field.args))
+	for name, raw := range field.args {
+		value, err := e.value(raw)
+		if err != nil {
+			return nil, err
+		}
+		args[name] = value
+	}
+	return args, nil
+}
+
+// value replaces variables, at any depth, by their values.
+func (e *gqlExecutor) value(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case gqlVariable:
+		value, ok := e.vars[string(v)]
+		if !ok {
+			return nil, fmt.Errorf("variable $%s is not defined", v)
+		}
+		return value, nil
+	case gqlEnum:
+		return string(v), nil
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			value, err := e.value(item)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = value
+		}
+		return list, nil
+	case map[string]interface{}:
+		obj := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			value, err := e.value(item)
+			if err != nil {
+				return nil, err
+			}
+			obj[key] = value
+		}
+		return obj, nil
+	}
+	return v, nil
+}
+
+// gqlString formats a scalar argument as the string a filter compares.
+func gqlString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// gqlInt returns a non-negative Int argument.
+func gqlInt(args map[string]interface{}, name string, def int) (int, error) {
+	var n int64
+	switch v := args[name].(type) {
+	case nil:
+		return def, nil
+	case int64:
+		n = v
+	case float64:
+		// JSON variables decode as float64.
+		if v != float64(int64(v)) {
+			return 0, fmt.Errorf("%s must be an Int", name)
+		}
+		n = int64(v)
+	default:
+		return 0, fmt.Errorf("%s must be an Int", name)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%s must not be negative", name)
+	}
+	return int(min(n, math.MaxInt32)), nil
+}
+
+// GraphQL documents.
+
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+type gqlOperation struct {
+	kind       string // query, mutation or subscription
+	name       string
+	variables  []gqlVariableDef
+	selections []gqlSelection
+}
+
+type gqlVariableDef struct {
+	name       string
+	nonNull    bool
+	defaultVal interface{}
+	hasDefault bool
+}
+
+type gqlFragment struct {
+	typeCondition string
+	selections    []gqlSelection
+}
+
+// gqlSelection is a field, a fragment spread, or an inline fragment.
+type gqlSelection struct {
+	field         *gqlField
+	spread        string
+	typeCondition string
+	selections    []gqlSelection
+	directives    []gqlDirective
+}
+
+type gqlField struct {
+	alias      string
+	name       string
+	args       map[string]interface{}
+	selections []gqlSelection // nil for a scalar
+}
+
+type gqlDirective struct {
+	name string
+	args map[string]interface{}
+}
+
+// Argument values are strings, int64, float64, bool, nil, gqlEnum,
+// []interface{}, map[string]interface{} and gqlVariable.
+type (
+	gqlVariable string
+	gqlEnum     string
+)
+
+// key is the response key of a field: its alias, or its name.
+func (f *gqlField) key() string {
+	if f.alias != "" {
+		return f.alias
+	}
+	return f.name
+}
+
+// scalar rejects a selection set on a scalar field.
+func (f *gqlField) scalar() error {
+	if f.selections != nil {
+		return fmt.Errorf("field %q is a scalar and cannot have a selection of subfields", f.name)
+	}
+	return nil
+}
+
+// operation picks the operation to run, by name when there are several.
+func (d *gqlDocument) operation(name string) (*gqlOperation, error) {
+	var op *gqlOperation
+	switch {
+	case name != "":
+		for _, o := range d.operations {
+			if o.name == name {
+				op = o
+			}
+		}
+		if op == nil {
+			return nil, fmt.Errorf("unknown operation %q", name)
+		}
+	case len(d.operations) == 1:
+		op = d.operations[0]
+	case len(d.operations) == 0:
+		return nil, errors.New("the document has no operation")
+	default:
+		return nil, errors.New("the document has several operations; set operationName")
+	}
+	if op.kind != "query" {
+		return nil, fmt.Errorf("%s operations are not supported; the API is read-only", op.kind)
+	}
+	return op, nil
+}
+
+// coerceVariables applies defaults and checks that required variables
+// were given.
+func (op *gqlOperation) coerceVariables(given map[string]interface{}) (map[string]interface{}, error) {
+	vars := make(map[string]interface{}, len(op.variables))
+	for _, def := range op.variables {
+		value, ok := given[def.name]
+		switch {
+		case ok && (value != nil || !def.nonNull):
+			vars[def.name] = value
+		case !ok && def.hasDefault:
+			vars[def.name] = def.defaultVal
+		case def.nonNull:
+			return nil, fmt.Errorf("variable $%s is required", def.name)
+		default:
+			vars[def.name] = nil
+		}
+	}
+	return vars, nil
+}
+
+// gqlParser is a recursive-descent parser for GraphQL executable documents.
+type gqlParser struct {
+	src string
+	pos int
+	tok gqlToken
+}
+
+type gqlToken struct {
+	kind byte // 'n' name, 'i' int, 'f' float, 's' string, 'p' punctuator, 0 end
+	text string
+	pos  int
+}
+
+func parseGraphQL(src string) (*gqlDocument, error) {
+	p := &gqlParser{src: src}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	doc := &gqlDocument{fragments: make(map[string]*gqlFragment)}
+	for p.tok.kind != 0 {
+		switch {
+		case p.isPunct("{"):
+			selections, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &gqlOperation{kind: "query", selections: selections})
+		case p.tok.kind == 'n' && p.tok.text == "fragment":
+			name, frag, err := p.fragmentDefinition()
+			if err != nil {
+				return nil, err
+			}
+			if doc.fragments[name] != nil {
+				return nil, fmt.Errorf("fragment %q is defined twice", name)
+			}
+			doc.fragments[name] = frag
+		case p.tok.kind == 'n' && (p.tok.text == "query" || p.tok.text == "mutation" || p.tok.text == "subscription"):
+			op, err := p.operationDefinition()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) operationDefinition() (*gqlOperation, error) {
+	op := &gqlOperation{kind: p.tok.text}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind == 'n' {
+		op.name = p.tok.text
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	if p.isPunct("(") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		for !p.isPunct(")") {
+			def, err := p.variableDefinition()
+			if err != nil {
+				return nil, err
+			}
+			op.variables = append(op.variables, def)
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	var err error
+	op.selections, err = p.selectionSet()
+	return op, err
+}
+
+func (p *gqlParser) variableDefinition() (gqlVariableDef, error) {
+	var def gqlVariableDef
+	if err := p.expect("$"); err != nil {
+		return def, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return def, err
+	}
+	def.name = name
+	if err := p.expect(":"); err != nil {
+		return def, err
+	}
+	if def.nonNull, err = p.typeRef(); err != nil {
+		return def, err
+	}
+	if p.isPunct("=") {
+		if err := p.advance(); err != nil {
+			return def, err
+		}
+		if def.defaultVal, err = p.value(true); err != nil {
+			return def, err
+		}
+		if e, ok := def.defaultVal.(gqlEnum); ok {
+			def.defaultVal = string(e)
+		}
+		def.hasDefault = true
+	}
+	_, err = p.directives()
+	return def, err
+}
+
+// typeRef skips a type such as [String!]!, reporting whether it is non-null.
+func (p *gqlParser) typeRef() (bool, error) {
+	if p.isPunct("[") {
+		if err := p.advance(); err != nil {
+			return false, err
+		}
+		if _, err := p.typeRef(); err != nil {
+			return false, err
+		}
+		if err := p.expect("]"); err != nil {
+			return false, err
+		}
+	} else if _, err := p.name(); err != nil {
+		return false, err
+	}
+	if p.isPunct("!") {
+		return true, p.advance()
+	}
+	return false, nil
+}
+
+func (p *gqlParser) fragmentDefinition() (string, *gqlFragment, error) {
+	if err := p.advance(); err != nil {
+		return "", nil, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return "", nil, err
+	}
+	if p.tok.kind != 'n' || p.tok.text != "on" {
+		return "", nil, p.unexpected()
+	}
+	if err := p.advance(); err != nil {
+		return "", nil, err
+	}
+	frag := &gqlFragment{}
+	if frag.typeCondition, err = p.name(); err != nil {
+		return "", nil, err
+	}
+	if _, err := p.directives(); err != nil {
+		return "", nil, err
+	}
+	frag.selections, err = p.selectionSet()
+	return name, frag, err
+}
+
+func (p *gqlParser) selectionSet() ([]gqlSelection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	selections := []gqlSelection{}
+	for !p.isPunct("}") {
+		sel, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, sel)
+	}
+	if len(selections) == 0 {
+		return nil, p.unexpected()
+	}
+	return selections, p.advance()
+}
+
+func (p *gqlParser) selection() (gqlSelection, error) {
+	var sel gqlSelection
+	var err error
+	if p.isPunct("...") {
+		if err := p.advance(); err != nil {
+			return sel, err
+		}
+		if p.tok.kind == 'n' && p.tok.text != "on" {
+			sel.spread = p.tok.text
+			if err := p.advance(); err != nil {
+				return sel, err
+			}
+			sel.directives, err = p.directives()
+			return sel, err
+		}
+		if p.tok.kind == 'n' {
+			if err := p.advance(); err != nil {
+				return sel, err
+			}
+			if sel.typeCondition, err = p.name(); err != nil {
+				return sel, err
+			}
+		}
+		if sel.directives, err = p.directives(); err != nil {
+			return sel, err
+		}
+		sel.selections, err = p.selectionSet()
+		return sel, err
+	}
+
+	field := &gqlField{}
+	if field.name, err = p.name(); err != nil {
+		return sel, err
+	}
+	if p.isPunct(":") {
+		if err := p.advance(); err != nil {
+			return sel, err
+		}
+		field.alias = field.name
+		if field.name, err = p.name(); err != nil {
+			return sel, err
+		}
+	}
+	if field.args, err = p.arguments(); err != nil {
+		return sel, err
+	}
+	if sel.directives, err = p.directives(); err != nil {
+		return sel, err
+	}
+	if p.isPunct("{") {
+		if field.selections, err = p.selectionSet(); err != nil {
+			return sel, err
+		}
+	}
+	sel.field = field
+	return sel, nil
+}
+
+func (p *gqlParser) arguments() (map[string]interface{}, error) {
+	args := make(map[string]interface{})
+	if !p.isPunct("(") {
+		return args, nil
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	for !p.isPunct(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		if args[name], err = p.value(false); err != nil {
+			return nil, err
+		}
+	}
+	return args, p.advance()
+}
+
+func (p *gqlParser) directives() ([]gqlDirective, error) {
+	var directives []gqlDirective
+	for p.isPunct("@") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		args, err := p.arguments()
+		if err != nil {
+			return nil, err
+		}
+		directives = append(directives, gqlDirective{name: name, args: args})
+	}
+	return directives, nil
+}
+
+// value parses a value; constant values (variable defaults) cannot
+// contain variables.
+func (p *gqlParser) value(constant bool) (interface{}, error) {
+	tok := p.tok
+	switch {
+	case tok.kind == 'p' && tok.text == "$" && !constant:
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		return gqlVariable(name), err
+	case tok.kind == 'i':
+		n, err := strconv.ParseInt(tok.text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Int %s at offset %d", tok.text, tok.pos)
+		}
+		return n, p.advance()
+	case tok.kind == 'f':
+		n, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Float %s at offset %d", tok.text, tok.pos)
+		}
+		return n, p.advance()
+	case tok.kind == 's':
+		return tok.text, p.advance()
+	case tok.kind == 'n':
+		var v interface{}
+		switch tok.text {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+			v = nil
+		default:
+			v = gqlEnum(tok.text)
+		}
+		return v, p.advance()
+	case p.isPunct("["):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		list := []interface{}{}
+		for !p.isPunct("]") {
+			item, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+		return list, p.advance()
+	case p.isPunct("{"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		obj := make(map[string]interface{})
+		for !p.isPunct("}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if obj[name], err = p.value(constant); err != nil {
+				return nil, err
+			}
+		}
+		return obj, p.advance()
+	}
+	return nil, p.unexpected()
+}
+
+func (p *gqlParser) isPunct(text string) bool {
+	return p.tok.kind == 'p' && p.tok.text == text
+}
+
+func (p *gqlParser) expect(text string) error {
+	if !p.isPunct(text) {
+		return p.unexpected()
+	}
+	return p.advance()
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.tok.kind != 'n' {
+		return "", p.unexpected()
+	}
+	name := p.tok.text
+	return name, p.advance()
+}
+
+func (p *gqlParser) unexpected() error {
+	if p.tok.kind == 0 {
+		return errors.New("syntax error: unexpected end of document")
+	}
+	return fmt.Errorf("syntax error: unexpected %q at offset %d", p.tok.text, p.tok.pos)
+}
+
+// advance reads the next token, skipping whitespace, commas and comments.
+func (p *gqlParser) advance() error {
+	src := p.src
+	for p.pos < len(src) {
+		c := src[p.pos]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			p.pos++
+			continue
+		}
+		if c == '#' {
+			for p.pos < len(src) && src[p.pos] != '\n' && src[p.pos] != '\r' {
+				p.pos++
+			}
+			continue
+		}
+		break
+	}
+	start := p.pos
+	if start == len(src) {
+		p.tok = gqlToken{pos: start}
+		return nil
+	}
+
+	c := src[start]
+	switch {
+	case strings.HasPrefix(src[start:], "..."):
+		p.pos += 3
+		p.tok = gqlToken{kind: 'p', text: "...", pos: start}
+	case strings.IndexByte("!$&()=:@[]{}|", c) >= 0:
+		p.pos++
+		p.tok = gqlToken{kind: 'p', text: string(c), pos: start}
+	case c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z':
+		for p.pos < len(src) && isNameByte(src[p.pos]) {
+			p.pos++
+		}
+		p.tok = gqlToken{kind: 'n', text: src[start:p.pos], pos: start}
+	case c == '-' || c >= '0' && c <= '9':
+		kind := byte('i')
+		p.pos++
+		for p.pos < len(src) {
+			d := src[p.pos]
+			if d == '.' || d == 'e' || d == 'E' {
+				kind = 'f'
+			} else if !(d >= '0' && d <= '9' || (d == '+' || d == '-') && kind == 'f') {
+				break
+			}
+			p.pos++
+		}
+		p.tok = gqlToken{kind: kind, text: src[start:p.pos], pos: start}
+	case strings.HasPrefix(src[start:], `"""`):
+		end := strings.Index(src[start+3:], `"""`)
+		if end < 0 {
+			return fmt.Errorf("syntax error: unterminated block string at offset %d", start)
+		}
+		p.pos = start + 3 + end + 3
+		text := strings.ReplaceAll(src[start+3:start+3+end], `\"""`, `"""`)
+		p.tok = gqlToken{kind: 's', text: strings.TrimSpace(text), pos: start}
+	case c == '"':
+		p.pos++
+		for p.pos < len(src) && src[p.pos] != '"' {
+			if src[p.pos] == '\n' {
+				break
+			}
+			if src[p.pos] == '\\' {
+				p.pos++
+			}
+			p.pos++
+		}
+		if p.pos >= len(src) || src[p.pos] != '"' {
+			return fmt.Errorf("syntax error: unterminated string at offset %d", start)
+		}
+		p.pos++
+		// GraphQL string escapes are a subset of JSON's.
+		var text string
+		if err := json.Unmarshal([]byte(src[start:p.pos]), &text); err != nil {
+			return fmt.Errorf("syntax error: invalid string at offset %d", start)
+		}
+		p.tok = gqlToken{kind: 's', text: text, pos: start}
+	default:
+		r, _ := utf8.DecodeRuneInString(src[start:])
+		return fmt.Errorf("syntax error: unexpected character %q at offset %d", r, start)
+	}
+	return nil
+}
+
+func isNameByte(c byte) bool {
+	return c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9'
+}
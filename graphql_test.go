@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestExecuteGraphQL(t *testing.T) {
+	ds, f := loadTestExtract(t)
+	tests := []struct {
+		name string
+		req  gqlRequest
+		want string // the response as JSON
+	}{
+		{
+			name: "filter and sort",
+			req:  gqlRequest{Query: `{ records(filter: {Zip: "40203", Neighborhood: "Russell"}, sort: [{field: "ObjectId", order: DESC}], limit: 2) { total items { ObjectId Zip } } }`},
+			want: `{"data":{"records":{"total":5,"items":[{"ObjectId":"1011","Zip":"40203"},{"ObjectId":"1004","Zip":"40203"}]}}}`,
+		},
+		{
+			name: "alias, __typename and list filter",
+			req:  gqlRequest{Query: `query { n: records(filter: {Zip: ["40211", "40210"]}) { total } __typename }`},
+			want: `{"data":{"n":{"total":2},"__typename":"Query"}}`,
+		},
+		{
+			name: "variables, fragments and directives",
+			req: gqlRequest{
+				Query: `query One($id: ID!, $withZip: Boolean = false) {
+					record(objectId: $id) { ...place Zip @include(if: $withZip) Purchaser @skip(if: true) }
+				}
+				fragment place on Record { Neighborhood Street_Name }`,
+				Variables: map[string]interface{}{"id": "1401", "withZip": true},
+			},
+			want: `{"data":{"record":{"Neighborhood":"Clifton","Street_Name":"William","Zip":"40206"}}}`,
+		},
+		{
+			name: "operation name",
+			req:  gqlRequest{Query: `query A { fields } query B { record(objectId: 1) { Zip } }`, OperationName: "B"},
+			want: `{"data":{"record":null}}`,
+		},
+		{
+			name: "stats",
+			req:  gqlRequest{Query: `{ stats(field: "neighborhood", limit: 2) { value count } }`},
+			want: `{"data":{"stats":[{"value":"Russell","count":6},{"value":"Clifton","count":1}]}}`,
+		},
+		{
+			name: "field error",
+			req:  gqlRequest{Query: `{ stats(field: "Owner") { value } fields }`},
+			want: `{"data":{"stats":null,"fields":["House_Nr","Dir","Street_Name","St_Type","Post_Dir","Zip","L_S","CD","Neighborhood","Full_Parcel_ID","Census_Tract","Action_Filed","Case_","Case_Style","Sale_Date","Sale_Price","Purchaser","ObjectId"]},"errors":[{"message":"stats: unknown field \"Owner\"","path":["stats"]}]}`,
+		},
+		{
+			name: "several operations without a name",
+			req:  gqlRequest{Query: `query A { fields } query B { fields }`},
+			want: `{"errors":[{"message":"the document has several operations; set operationName"}]}`,
+		},
+		{
+			name: "no operation",
+			req:  gqlRequest{Query: `# nothing`},
+			want: `{"errors":[{"message":"the document has no operation"}]}`,
+		},
+		{
+			name: "mutation",
+			req:  gqlRequest{Query: `mutation { fields }`},
+			want: `{"errors":[{"message":"mutation operations are not supported; the API is read-only"}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := json.Marshal(executeGraphQL(ds, f, &tt.req))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseGraphQL(t *testing.T) {
+	valid := []string{
+		`{ fields }`,
+		`query { records { total } }`,
+		`query Q($f: RecordFilter, $s: [Sort!] = [{field: "Zip"}]) { records(filter: $f, sort: $s) { total } }`,
+		`{ a: fields, b: fields } # a comment`,
+		`{ records(filter: {Zip: """40203"""}, limit: 1e1, offset: -0) { items { ...F } } } fragment F on Record { Zip }`,
+		`{ ... on Query { fields } ... @skip(if: false) { fields } }`,
+	}
+	for _, src := range valid {
+		if _, err := parseGraphQL(src); err != nil {
+			t.Errorf("%s: %v", src, err)
+		}
+	}
+
+	invalid := []struct {
+		src  string
+		want string
+	}{
+		{`{ fields`, "unexpected end of document"},
+		{`{ records(limit: ) { total } }`, `unexpected ")" at offset 17`},
+		{`{ records(filter: {Zip: "40203) { total } }`, "unterminated string at offset 24"},
+		{`query ($x) { fields }`, `unexpected ")" at offset 9`},
+		{`{ fields } fragment F Record { Zip }`, `unexpected "Record" at offset 22`},
+		{`{ fields } }`, `unexpected "}" at offset 11`},
+		{`{ fields } fragment F on Record { Zip } fragment F on Record { Zip }`, `fragment "F" is defined twice`},
+	}
+	for _, tt := range invalid {
+		_, err := parseGraphQL(tt.src)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want %q", tt.src, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reportPages are the -report-format formats written for people next to
+// the JSON run report, with the extension each is saved under.
+var reportPages = map[string]string{"html": ".html", "markdown": ".md"}
+
+// reportRecentFilings is the length of the recent filings list of the
+// report pages.
+const reportRecentFilings = 20
+
+// parseReportFormats checks -report-format, a comma-separated list of
+// json and page formats, and returns the pages to write. The JSON report
+// is written whatever the list, as the other subcommands read it.
+func parseReportFormats(spec string) ([]string, error) {
+	var pages []string
+	for _, format := range splitList(spec) {
+		format = strings.ToLower(format)
+		if format == "json" {
+			continue
+		}
+		if _, ok := reportPages[format]; !ok {
+			return nil, fmt.Errorf("unknown format %q; want json, html or markdown", format)
+		}
+		if !slices.Contains(pages, format) {
+			pages = append(pages, format)
+		}
+	}
+	return pages, nil
+}
+
+// reportPagePath is where a page of the report at path is saved:
+// data/run_report.html for data/run_report.json.
+func reportPagePath(path, format string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + reportPages[format]
+}
+
+// reportDigest is what the report pages show besides the run report: an
+// overview of the extract the run left, read back from its outputs.
+type reportDigest struct {
+	Extracted     int // records in the outputs
+	DateColumn    string
+	Years         []chartBar
+	Neighborhoods []neighborhoodRow
+	Filings       []filingRow
+	Warnings      []string
+}
+
+// neighborhoodRow is one line of the neighborhood table.
+type neighborhoodRow struct {
+	Name        string
+	Filings     int
+	Sales       int
+	MedianPrice string // of the sales with a price; "" if there are none
+}
+
+// filingRow is one line of the recent filings list.
+type filingRow struct {
+	Date         string
+	Case         string
+	Address      string
+	Neighborhood string
+	Sold         string // the sale date, if the property has been sold
+}
+
+// digest reads the outputs of the report back and summarizes them. The
+// columns are looked up under their -rename names; a section whose
+// columns were left out of the extract is left out of the page.
+func (j *fetchJob) digest(report *RunReport) *reportDigest {
+	d := &reportDigest{Warnings: reportWarnings(report)}
+	var paths []string
+	for _, out := range report.Outputs {
+		paths = append(paths, out.Path)
+	}
+	if len(paths) == 0 {
+		return d
+	}
+	ds, column, err := j.loadOutputs(paths)
+	if err != nil {
+		d.Warnings = append(d.Warnings, fmt.Sprintf("The outputs could not be read back for this report: %v.", err))
+		return d
+	}
+	f := j.formatter
+	d.Extracted = len(ds.records)
+	d.DateColumn = ds.dateColumn
+
+	filed := ds.dates[ds.dateColumn]
+	if filed != nil {
+		counts := make(map[int]int)
+		for _, t := range filed {
+			if !t.IsZero() {
+				counts[t.In(f.Location).Year()]++
+			}
+		}
+		for _, year := range slices.Sorted(maps.Keys(counts)) {
+			d.Years = append(d.Years, chartBar{Label: strconv.Itoa(year), Count: counts[year]})
+		}
+		scaleBars(d.Years)
+	}
+
+	neighborhood := column(neighborhoodField)
+	saleDate := column(saleDateField)
+	sold := ds.dates[saleDate]
+	if neighborhood != "" {
+		price := column(salePriceField)
+		prices := make(map[string][]float64)
+		sales := make(map[string]int)
+		for i, rec := range ds.records {
+			if sold == nil || sold[i].IsZero() {
+				continue
+			}
+			sales[rec[neighborhood]]++
+			if n, ok := f.parseNumber(rec[price]); ok && price != "" && n > 0 {
+				prices[rec[neighborhood]] = append(prices[rec[neighborhood]], n)
+			}
+		}
+		for _, g := range countValues(ds, neighborhood, allRecords(ds)) {
+			row := neighborhoodRow{Name: g.Value, Filings: g.Count, Sales: sales[g.Value]}
+			if row.Name == "" {
+				row.Name = "(none)"
+			}
+			if p := prices[g.Value]; len(p) > 0 {
+				row.MedianPrice = formatDollars(median(p))
+			}
+			d.Neighborhoods = append(d.Neighborhoods, row)
+		}
+	}
+
+	if filed != nil {
+		var dated []int
+		for i, t := range filed {
+			if !t.IsZero() {
+				dated = append(dated, i)
+			}
+		}
+		slices.SortStableFunc(dated, func(a, b int) int { return filed[b].Compare(filed[a]) })
+		for _, i := range dated[:min(len(dated), reportRecentFilings)] {
+			rec := ds.records[i]
+			row := filingRow{
+				Date:         filed[i].In(f.Location).Format(time.DateOnly),
+				Case:         rec[column("Case_")],
+				Neighborhood: rec[neighborhood],
+			}
+			var address []string
+			for _, field := range addressFields {
+				if v := rec[column(field)]; column(field) != "" && v != "" && v != f.NullToken {
+					address = append(address, v)
+				}
+			}
+			row.Address = strings.Join(address, " ")
+			if sold != nil && !sold[i].IsZero() {
+				row.Sold = sold[i].In(f.Location).Format(time.DateOnly)
+			}
+			d.Filings = append(d.Filings, row)
+		}
+	}
+
+	d.Warnings = append(d.Warnings, extractWarnings(ds, column)...)
+	return d
+}
+
+// loadOutputs reads the outputs of the run back, and returns with them a
+// function that finds the column of a field under its -rename name, or ""
+// if the field was left out.
+func (j *fetchJob) loadOutputs(paths []string) (*dataset, func(string) string, error) {
+	store := &extractStore{comma: j.dialect.Comma, dateField: j.column(j.opts.DateField), formatter: j.formatter}
+	ds, err := store.load(paths, make([]time.Time, len(paths)))
+	if err != nil {
+		return nil, nil, err
+	}
+	column := func(field string) string {
+		name, _ := ds.column(j.column(field))
+		return name
+	}
+	// The store parses the date fields under their own names.
+	for field := range dateFields {
+		if name := column(field); name != "" && ds.dates[name] == nil {
+			parsed := make([]time.Time, len(ds.records))
+			for i, rec := range ds.records {
+				parsed[i], _ = j.formatter.parseDate(rec[name])
+			}
+			ds.dates[name] = parsed
+		}
+	}
+	return ds, column, nil
+}
+
+// reportWarnings lists what the run report says went wrong.
+func reportWarnings(report *RunReport) []string {
+	var warnings []string
+	if report.Status != statusOK && report.Status != statusUnchanged {
+		w := "The run did not finish (" + report.Status + ")"
+		if report.Error != "" {
+			w += ": " + report.Error
+		}
+		warnings = append(warnings, w+".")
+	}
+	if n := len(report.Failures); n > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d pages could not be fetched; their records are missing.", n))
+	}
+	if report.Quarantined > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d records broke a -coerce or -transform rule and were quarantined.", report.Quarantined))
+	}
+	if p := report.SalePrice; p != nil {
+		if p.Zero > 0 {
+			warnings = append(warnings, fmt.Sprintf("%d of %d sales are at $0.", p.Zero, p.Sales))
+		}
+		if p.Null > 0 {
+			warnings = append(warnings, fmt.Sprintf("%d of %d sales have no price.", p.Null, p.Sales))
+		}
+	}
+	if d := report.CountDrift; d != nil {
+		warnings = append(warnings, fmt.Sprintf("The layer went from %d to %d records during the run and the pages returned %d; %d skipped records were fetched again and %d repeated ones dropped.", d.Before, d.After, d.Written, d.Refetched, d.Duplicates))
+	}
+	for _, field := range slices.Sorted(maps.Keys(report.AttributeIssues)) {
+		issues := report.AttributeIssues[field]
+		for _, issue := range slices.Sorted(maps.Keys(issues)) {
+			warnings = append(warnings, fmt.Sprintf("%d values of %s had an issue (%s) and were repaired or written as null.", issues[issue], field, issue))
+		}
+	}
+	for _, field := range slices.Sorted(maps.Keys(report.UnexpectedFields)) {
+		warnings = append(warnings, fmt.Sprintf("The layer returned a field that is not written, %s, in %d records.", field, report.UnexpectedFields[field]))
+	}
+	return warnings
+}
+
+// extractWarnings lists records that look wrong: without a filing date
+// or parcel, sold before they were filed, or listed more than once.
+func extractWarnings(ds *dataset, column func(string) string) []string {
+	var warnings []string
+	count := func(n int, what string) {
+		if n > 0 {
+			warnings = append(warnings, fmt.Sprintf("%d %s", n, what))
+		}
+	}
+	if filed := ds.dates[ds.dateColumn]; filed != nil {
+		undated, early := 0, 0
+		sold := ds.dates[column(saleDateField)]
+		for i, t := range filed {
+			if t.IsZero() {
+				undated++
+			} else if sold != nil && !sold[i].IsZero() && sold[i].Before(t) {
+				early++
+			}
+		}
+		count(undated, "records have no "+ds.dateColumn+" date.")
+		count(early, "records were sold before they were filed.")
+	}
+	if parcel := column("Full_Parcel_ID"); parcel != "" {
+		missing := 0
+		for _, rec := range ds.records {
+			if strings.Trim(rec[parcel], "-0 ") == "" {
+				missing++
+			}
+		}
+		count(missing, "records have no parcel ID.")
+		if ds.dateColumn != "" {
+			repeated := findDuplicates(ds, parcel, column("Case_"), 2)
+			count(len(repeated.rows), "parcels appear more than once; the duplicates subcommand lists them.")
+		}
+	}
+	if id := column(idField); id != "" {
+		seen := make(map[string]bool, len(ds.records))
+		twice := 0
+		for _, rec := range ds.records {
+			if v := rec[id]; v != "" {
+				if seen[v] {
+					twice++
+				}
+				seen[v] = true
+			}
+		}
+		count(twice, "records repeat an "+idField+" listed before them.")
+	}
+	return warnings
+}
+
+// median returns the middle value, or the mean of the middle two.
+func median(values []float64) float64 {
+	return percentile(slices.Sorted(slices.Values(values)), 50)
+}
+
+// formatDollars writes an amount as whole dollars with thousands
+// separators: $125,000.
+func formatDollars(n float64) string {
+	s := strconv.FormatFloat(n, 'f', 0, 64)
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	if neg {
+		return "-$" + s
+	}
+	return "$" + s
+}
+
+// reportPageData is what the report page templates render.
+type reportPageData struct {
+	*RunReport
+	*reportDigest
+	Title       string
+	StartedAt   string
+	FinishedAt  string
+	Outputs     []reportPageOutput
+	Downloaded  string
+	GeneratedBy string
+}
+
+type reportPageOutput struct {
+	Path string
+	Size string
+}
+
+// writeReportPages writes the -report-format pages of a run report.
+// Like the JSON report, a page that cannot be written is logged but does
+// not fail the run.
+func (j *fetchJob) writeReportPages(report *RunReport) {
+	if len(j.reportPages) == 0 || j.opts.Report == "" {
+		return
+	}
+	loc := j.formatter.Location
+	data := reportPageData{
+		RunReport:    report,
+		reportDigest: j.digest(report),
+		Title:        "Foreclosures run report",
+		StartedAt:    report.StartedAt.In(loc).Format("2006-01-02 15:04:05 MST"),
+		FinishedAt:   report.FinishedAt.In(loc).Format("2006-01-02 15:04:05 MST"),
+		Downloaded:   formatBytes(report.BytesDownloaded),
+		GeneratedBy:  filepath.Base(os.Args[0]),
+	}
+	for _, out := range report.Outputs {
+		data.Outputs = append(data.Outputs, reportPageOutput{Path: out.Path, Size: formatBytes(out.Size)})
+	}
+
+	for _, format := range j.reportPages {
+		var buf bytes.Buffer
+		var err error
+		switch format {
+		case "html":
+			err = reportPage.Execute(&buf, data)
+		case "markdown":
+			err = markdownReport.Execute(&buf, data)
+		}
+		path := reportPagePath(j.opts.Report, format)
+		if err == nil {
+			err = writeFileAtomic(path, buf.Bytes())
+		}
+		if err != nil {
+			slog.Warn("could not save run report", "path", path, "err", err)
+			continue
+		}
+		slog.Info("run report saved", "path", path)
+	}
+}
+
+// writeFileAtomic replaces path with data through a temporary file, so
+// a reader never sees half of it.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+var reportPage = template.Must(template.New("report").Parse(reportTemplate))
+
+// reportTemplate is a standalone page: the styles are inline and nothing
+// is loaded from elsewhere, so it can be attached to an email.
+const reportTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font: 14px/1.4 system-ui, sans-serif; margin: 0 auto; max-width: 1000px; padding: 1em 2em; color: #222; }
+h1 { font-size: 1.6em; margin-bottom: 0.2em; }
+h2 { font-size: 1.15em; margin-top: 2em; border-bottom: 1px solid #ddd; padding-bottom: 0.3em; }
+.muted { color: #777; }
+.status { display: inline-block; padding: 0 0.5em; border-radius: 3px; color: #fff; background: #b00; }
+.status.ok, .status.unchanged { background: #2e7d32; }
+.warnings li { color: #8a4b00; }
+.bars { display: grid; grid-template-columns: 5em 1fr 5em; gap: 4px 8px; align-items: center; }
+.bars .bar { background: #3a78b5; height: 1.1em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 4px 8px; border-bottom: 1px solid #eee; }
+.num { text-align: right; font-variant-numeric: tabular-nums; }
+.meta th { width: 11em; color: #555; font-weight: normal; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p><span class="status {{.Status}}">{{.Status}}</span> <span class="muted">{{.StartedAt}} to {{.FinishedAt}}</span></p>
+
+<table class="meta">
+<tr><th>Records written</th><td>{{.Records}}{{if ge .ExpectedRecords 0}} of {{.ExpectedRecords}} in the layer{{end}}</td></tr>
+{{if ge .NewRecords 0}}<tr><th>New records</th><td>{{.NewRecords}}</td></tr>{{end}}
+<tr><th>Pages</th><td>{{.PagesFetched}} fetched, {{len .Failures}} failed, {{.PagesRetried}} retried</td></tr>
+<tr><th>Downloaded</th><td>{{.Downloaded}} in {{printf "%.1f" .WallTimeSeconds}}s</td></tr>
+<tr><th>Source</th><td>{{.URL}}</td></tr>
+{{range .Outputs}}<tr><th>Output</th><td>{{.Path}} ({{.Size}})</td></tr>
+{{end}}</table>
+
+<h2>Data-quality warnings</h2>
+{{if .Warnings}}<ul class="warnings">
+{{range .Warnings}}<li>{{.}}</li>
+{{end}}</ul>
+{{else}}<p class="muted">None.</p>{{end}}
+
+<h2>Filings by year{{if .DateColumn}} <span class="muted">({{.DateColumn}})</span>{{end}}</h2>
+{{if .Years}}
+<div class="bars">
+{{range .Years}}<span>{{.Label}}</span><div><div class="bar" style="width: {{.Percent}}%"></div></div><span class="num">{{.Count}}</span>
+{{end}}</div>
+{{else}}<p class="muted">No dated records.</p>{{end}}
+
+<h2>Neighborhoods</h2>
+{{if .Neighborhoods}}
+<table>
+<tr><th>Neighborhood</th><th class="num">Filings</th><th class="num">Sales</th><th class="num">Median sale price</th></tr>
+{{range .Neighborhoods}}<tr><td>{{.Name}}</td><td class="num">{{.Filings}}</td><td class="num">{{.Sales}}</td><td class="num">{{.MedianPrice}}</td></tr>
+{{end}}</table>
+{{else}}<p class="muted">No neighborhoods in the extract.</p>{{end}}
+
+<h2>Recent filings</h2>
+{{if .Filings}}
+<table>
+<tr><th>Filed</th><th>Case</th><th>Address</th><th>Neighborhood</th><th>Sold</th></tr>
+{{range .Filings}}<tr><td>{{.Date}}</td><td>{{.Case}}</td><td>{{.Address}}</td><td>{{.Neighborhood}}</td><td>{{.Sold}}</td></tr>
+{{end}}</table>
+{{else}}<p class="muted">No dated records.</p>{{end}}
+
+<p class="muted">Written by {{.GeneratedBy}} from {{.Extracted}} records.</p>
+</body>
+</html>
+`
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// joinBatch is how many keys are looked up per request; the IN list is
+// part of the URL.
+const joinBatch = 100
+
+// layerJoin appends fields from a second feature layer, such as the PVA
+// assessment parcels, to each record: the record's -join-on value (the
+// parcel ID) is looked up in the layer's -join-key field. Keys are looked
+// up a page at a time and remembered for the rest of the run.
+type layerJoin struct {
+	client  *Client
+	url     string     // query endpoint
+	params  url.Values // from the -join-url query string, e.g. a token
+	on      string
+	key     string
+	fields  []string
+	matches map[string]map[string]interface{} // nil for keys without a match
+
+	failed  int
+	lastErr error
+}
+
+// newLayerJoin builds the join for -join-url, or returns nil if it is off.
+// The fetch client, with its credentials, is only used when the layer is
+// on the same server as -url.
+func newLayerJoin(opts *Options, query *Query, fetchClient *Client, headers []string) (*layerJoin, error) {
+	if opts.JoinURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(strings.TrimSpace(opts.JoinURL))
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("-join-url %q: want the URL of a feature layer", opts.JoinURL)
+	}
+	u.Path = queryURL(u.Path)
+	fields := splitList(opts.JoinFields)
+	if len(fields) == 0 {
+		return nil, errors.New("-join-url needs -join-fields")
+	}
+	if opts.JoinKey == "" || opts.JoinOn == "" {
+		return nil, errors.New("-join-key and -join-on cannot be empty")
+	}
+	for _, field := range fields {
+		if slices.Contains(headers, field) {
+			return nil, fmt.Errorf("-join-fields: %s is already a column", field)
+		}
+	}
+
+	client := fetchClient
+	if main, err := url.Parse(query.URL); err != nil || !strings.EqualFold(main.Host, u.Host) {
+		transport, err := newTransport(opts)
+		if err != nil {
+			return nil, err
+		}
+		client = &Client{HTTP: &http.Client{Transport: transport, Timeout: opts.Timeout}}
+	}
+	params := u.Query()
+	u.RawQuery = ""
+	return &layerJoin{
+		client:  client,
+		url:     u.String(),
+		params:  params,
+		on:      opts.JoinOn,
+		key:     opts.JoinKey,
+		fields:  fields,
+		matches: make(map[string]map[string]interface{}),
+	}, nil
+}
+
+// enrich adds the joined fields to a page of records.
+func (j *layerJoin) enrich(ctx context.Context, records []map[string]interface{}) {
+	var missing []string
+	for _, record := range records {
+		key := joinValue(record[j.on])
+		if _, ok := j.matches[key]; !ok && key != "" && !slices.Contains(missing, key) {
+			missing = append(missing, key)
+		}
+	}
+	for chunk := range slices.Chunk(missing, joinBatch) {
+		if err := j.lookup(ctx, chunk); err != nil {
+			slog.Debug("join lookup failed", "keys", len(chunk), "err", err)
+			j.failed += len(chunk)
+			j.lastErr = err
+		}
+	}
+
+	for _, record := range records {
+		if record == nil {
+			continue
+		}
+		attrs := j.matches[joinValue(record[j.on])]
+		for _, field := range j.fields {
+			record[field] = attrs[field]
+		}
+	}
+}
+
+// lookup queries the layer for a set of keys. Keys it does not return are
+// remembered as having no match.
+func (j *layerJoin) lookup(ctx context.Context, keys []string) error {
+	quoted := make([]string, len(keys))
+	for i, key := range keys {
+		quoted[i] = "'" + strings.ReplaceAll(key, "'", "''") + "'"
+	}
+	params := cloneValues(j.params)
+	params.Set("where", j.key+" IN ("+strings.Join(quoted, ",")+")")
+	params.Set("outFields", strings.Join(append([]string{j.key}, j.fields...), ","))
+	params.Set("returnGeometry", "false")
+	params.Set("f", "json")
+
+	var result QueryResult
+	if err := j.client.getJSON(ctx, j.url, params, &result); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		j.matches[key] = nil
+	}
+	for _, f := range result.Features {
+		if key := joinValue(f.Attributes[j.key]); key != "" {
+			j.matches[key] = f.Attributes
+		}
+	}
+	return nil
+}
+
+// finish logs how the join went. Keys that failed are looked up again
+// whenever they come up.
+func (j *layerJoin) finish() {
+	matched := 0
+	for _, attrs := range j.matches {
+		if attrs != nil {
+			matched++
+		}
+	}
+	slog.Info("join finished", "layer", layerLabel(j.url), "keys", len(j.matches), "matched", matched)
+	if j.failed > 0 {
+		slog.Warn("some records could not be joined", "keys", j.failed, "err", j.lastErr)
+	}
+	j.failed, j.lastErr = 0, nil
+	// With -watch, assessments may have changed by the next run.
+	clear(j.matches)
+}
+
+// joinValue is a key as text, trimmed; numbers and strings compare alike.
+func joinValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
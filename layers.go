@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// ServiceInfo is the subset of a FeatureServer's metadata (the service
+// endpoint with f=json) that lists its layers and tables.
+type ServiceInfo struct {
+	Layers []struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	} `json:"layers"`
+	Tables []struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	} `json:"tables"`
+}
+
+// ServiceLayer describes one layer or table of a service, for the layers
+// subcommand.
+type ServiceLayer struct {
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	Type         string `json:"type"` // Feature Layer or Table
+	URL          string `json:"url"`
+	Records      int    `json:"records"` // -1 if the count failed
+	GeometryType string `json:"geometryType,omitempty"`
+	Capabilities string `json:"capabilities"`
+	Formats      string `json:"supportedQueryFormats"`
+
+	info *LayerInfo // nil if the metadata could not be read
+}
+
+// serviceRoot returns the FeatureServer endpoint of a service, layer or
+// query URL.
+func serviceRoot(u string) string {
+	u = strings.TrimSuffix(strings.TrimRight(strings.TrimSpace(u), "/"), "/query")
+	if i := strings.LastIndexByte(u, '/'); i >= 0 {
+		if _, err := strconv.Atoi(u[i+1:]); err == nil {
+			u = u[:i]
+		}
+	}
+	return u
+}
+
+// fetchServiceLayers reads the layers and tables of a service, in id order
+// with the layers first, and the metadata and record count of each.
+func fetchServiceLayers(ctx context.Context, client *Client, service string) ([]ServiceLayer, error) {
+	var info ServiceInfo
+	if err := client.getJSON(ctx, service, url.Values{"f": {"json"}}, &info); err != nil {
+		return nil, err
+	}
+	var layers []ServiceLayer
+	add := func(id int, name, typ string) {
+		l := ServiceLayer{ID: id, Name: name, Type: typ, URL: service + "/" + strconv.Itoa(id), Records: -1}
+		if meta, err := fetchLayerInfo(ctx, client, l.URL); err != nil {
+			slog.Warn("cannot read layer metadata", "layer", id, "err", err)
+		} else {
+			l.info = meta
+			l.Name = firstNonEmpty(meta.Name, name)
+			l.Type = firstNonEmpty(meta.Type, typ)
+			l.GeometryType = meta.GeometryType
+			l.Capabilities = meta.Capabilities
+			l.Formats = meta.SupportedQueryFormats
+		}
+		if n, err := fetchCount(ctx, client, &Query{URL: queryURL(l.URL), Where: "1=1"}); err != nil {
+			slog.Warn("cannot count records", "layer", id, "err", err)
+		} else {
+			l.Records = n
+		}
+		layers = append(layers, l)
+	}
+	for _, l := range info.Layers {
+		add(l.ID, l.Name, "Feature Layer")
+	}
+	for _, t := range info.Tables {
+		add(t.ID, t.Name, "Table")
+	}
+	return layers, nil
+}
+
+// runLayers implements the layers subcommand, which lists the layers and
+// tables of a FeatureServer with their record counts, so the right layer
+// index for -url can be found without browsing the REST endpoint:
+//
+//	go run . layers https://services1.arcgis.com/.../FeatureServer
+func runLayers(args []string) int {
+	fs := flag.NewFlagSet("layers", flag.ExitOnError)
+	var opts Options
+	opts.registerClient(fs)
+	opts.registerLogging(fs)
+	asJSON := fs.Bool("json", false, "print the layers as JSON")
+	fs.Parse(args)
+	if err := setupLogging(&opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFatal
+	}
+	if fs.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "layers: expected at most one service URL")
+		fs.Usage()
+		return exitFatal
+	}
+	// Without an argument, the service of -url is listed.
+	if fs.NArg() == 1 {
+		opts.URL = fs.Arg(0)
+	}
+	service := serviceRoot(opts.URL)
+
+	client, err := newClient(&opts)
+	if err != nil {
+		slog.Error("invalid connection options", "err", err)
+		return exitFatal
+	}
+	layers, err := fetchServiceLayers(context.Background(), client, service)
+	if err != nil {
+		slog.Error("cannot read service metadata", "url", service, "err", err)
+		return exitFatal
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(layers); err != nil {
+			slog.Error("cannot write layers", "err", err)
+			return exitFatal
+		}
+		return exitOK
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTYPE\tNAME\tRECORDS\tGEOMETRY\tCAPABILITIES")
+	for _, l := range layers {
+		records := "?"
+		if l.Records >= 0 {
+			records = formatCount(l.Records)
+		}
+		geometry := strings.TrimPrefix(l.GeometryType, "esriGeometry")
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", l.ID, l.Type, l.Name, records, firstNonEmpty(geometry, "-"), l.Capabilities)
+	}
+	w.Flush()
+	slog.Info("service layers", "url", service, "count", len(layers))
+	return exitOK
+}
+
+// runAllLayers implements -all-layers: every layer and table of the -url
+// service is fetched in turn by a job of its own, with the layer's fields
+// as the columns and its output, report and checkpoint in a directory of
+// its own. It returns the worst exit code of the layers.
+func runAllLayers(opts *Options) int {
+	// These options name fields of one layer, or one file for the run.
+	for _, opt := range []struct {
+		name string
+		set  bool
+	}{
+		{"-fields", opts.Fields != ""},
+		{"-rename", opts.Rename != ""},
+		{"-columns", opts.Columns != ""},
+		{"-coerce", opts.Coerce != ""},
+		{"-split-by", opts.SplitBy != ""},
+		{"-address", opts.Address},
+		{"-geocode", opts.Geocode != ""},
+		{"-census", opts.Census != ""},
+		{"-join-url", opts.JoinURL != ""},
+		{"-alert", len(opts.Alerts) > 0},
+		{"-attachments", opts.Attachments != ""},
+		{"-related", opts.Related != ""},
+		{"-delta", opts.Delta != ""},
+		{"-out", opts.Out != filepath.Join(outputDir, outputFile)},
+		{"-tee", len(opts.Tee) > 0},
+		{"-watch", opts.Watch > 0},
+		{"-schedule", opts.Schedule != ""},
+	} {
+		if opt.set {
+			fatal(exitFatal, "invalid -all-layers: cannot be combined with "+opt.name)
+		}
+	}
+
+	client, err := newClient(opts)
+	if err != nil {
+		fatal(exitFatal, "invalid connection options", "err", err)
+	}
+	service := serviceRoot(opts.URL)
+	layers, err := fetchServiceLayers(context.Background(), client, service)
+	if err != nil {
+		fatal(exitFatal, "cannot read service metadata", "url", service, "err", err)
+	}
+	if len(layers) == 0 {
+		fatal(exitFatal, "the service has no layers or tables", "url", service)
+	}
+	serviceDir := filepath.Join(outputDir, serviceFileName(service))
+
+	type layerRun struct {
+		layer  ServiceLayer
+		path   string
+		status string
+	}
+	var runs []layerRun
+	code := exitOK
+	for _, l := range layers {
+		meta := l.info
+		if meta == nil {
+			slog.Error("skipping a layer without metadata", "layer", l.ID)
+			runs = append(runs, layerRun{layer: l, status: statusFailed})
+			code = max(code, exitFatal)
+			continue
+		}
+		name := fileNamePart(l.Name, strconv.Itoa(l.ID))
+		dir := filepath.Join(serviceDir, strconv.Itoa(l.ID)+"_"+name)
+
+		layerOpts := *opts
+		layerOpts.URL = queryURL(l.URL)
+		// Only point geometry becomes columns.
+		layerOpts.Geometry = opts.Geometry && meta.GeometryType == "esriGeometryPoint"
+		if opts.OrderBy == idField && meta.ObjectIDField != "" {
+			layerOpts.OrderBy = meta.ObjectIDField
+		}
+		if opts.Report != "" {
+			layerOpts.Report = filepath.Join(dir, filepath.Base(opts.Report))
+		}
+
+		job := newFetchJob(&layerOpts)
+		job.outputPath = filepath.Join(dir, name+".csv")
+		job.headers = schemaHeaders(meta, layerOpts.Geometry)
+
+		slog.Info("fetching layer", "layer", l.ID, "name", l.Name, "type", l.Type, "output", job.outputPath)
+		status, c := job.run(opts.Resume)
+		runs = append(runs, layerRun{layer: l, path: job.outputPath, status: status})
+		code = max(code, c)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tSTATUS\tOUTPUT")
+	for _, r := range runs {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", r.layer.ID, r.layer.Name, r.status, firstNonEmpty(r.path, "-"))
+	}
+	w.Flush()
+	return code
+}
+
+// schemaHeaders returns the output columns of a layer from its fields, in
+// the layer's order. Date fields are added to dateFields so they are
+// formatted like those of the foreclosures layer.
+func schemaHeaders(layer *LayerInfo, geometry bool) []string {
+	var headers []string
+	for _, field := range layer.Fields {
+		switch field.Type {
+		case "esriFieldTypeGeometry", "esriFieldTypeBlob", "esriFieldTypeRaster":
+			continue
+		case "esriFieldTypeDate":
+			dateFields[field.Name] = true
+		}
+		headers = append(headers, field.Name)
+	}
+	if geometry {
+		headers = append(headers, geometryFields...)
+	}
+	return headers
+}
+
+// serviceFileName names the service of a -url in file names, e.g.
+// Louisville_Metro_KY_Property_Foreclosures.
+func serviceFileName(u string) string {
+	return fileNamePart(filepath.Base(strings.TrimSuffix(serviceRoot(u), "/FeatureServer")), "service")
+}
+
+// fileNamePart turns a name into a part of a file name, e.g. "Case
+// History" into Case_History, or returns fallback if nothing is left.
+func fileNamePart(name, fallback string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' || r < ' ' || strings.ContainsRune(`/\:*?"<>|.`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(name))
+	if name == "" {
+		return fallback
+	}
+	return name
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// lexToken is a token of an -alert condition or a query statement.
+type lexToken struct {
+	kind byte // 'i' identifier or keyword, 'q' "quoted identifier", 's' string, 'n' number, 'o' operator or punctuation
+	text string
+	at   int // offset in the text, for naming result columns
+}
+
+// lexer splits -alert conditions and query statements into tokens. The
+// two languages share words, numbers, 'strings' with a doubled ' for a
+// quote and the comparisons of alertOperators, of which <> and == are read
+// as != and =; a lexer says where they differ.
+type lexer struct {
+	// quotedNames reads "double quotes" as a name, with "" for a quote, as
+	// in SQL; otherwise they are a string, with \" for a quote.
+	quotedNames bool
+	// cOperators reads && and || as AND and OR, and ! as NOT.
+	cOperators bool
+	// signedNumbers lets a number start with -.
+	signedNumbers bool
+	// operators are the operators and punctuation beyond the comparisons.
+	// A ; ends the text.
+	operators []string
+}
+
+// alertLexer and sqlLexer are the lexers of -alert conditions and of
+// query statements.
+var (
+	alertLexer = lexer{cOperators: true, signedNumbers: true, operators: []string{"(", ")", ","}}
+	sqlLexer   = lexer{quotedNames: true, operators: []string{"(", ")", ",", ";", "+", "-", "*", "/", "%", "||"}}
+)
+
+// lex returns the tokens of s.
+func (l lexer) lex(s string) ([]lexToken, error) {
+	isOperator := func(op string) bool { return alertOperators[op] || slices.Contains(l.operators, op) }
+	var tokens []lexToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'' || c == '"':
+			quoteName := c == '"' && l.quotedNames
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(s); j++ {
+				if c == '"' && !quoteName && s[j] == '\\' && j+1 < len(s) { // \" in a "string"
+					j++
+					b.WriteByte(s[j])
+					continue
+				}
+				if s[j] == c {
+					if (c == '\'' || quoteName) && j+1 < len(s) && s[j+1] == c { // '' or "" is a quote
+						b.WriteByte(c)
+						j++
+						continue
+					}
+					break
+				}
+				b.WriteByte(s[j])
+			}
+			if j >= len(s) {
+				return nil, errors.New("unterminated string")
+			}
+			kind := byte('s')
+			if quoteName {
+				kind = 'q'
+			}
+			tokens = append(tokens, lexToken{kind, b.String(), i})
+			i = j + 1
+		case c >= '0' && c <= '9' || c == '-' && l.signedNumbers || c == '.' && (l.signedNumbers || i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9'):
+			j := i + 1
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.') {
+				j++
+			}
+			if _, err := strconv.ParseFloat(s[i:j], 64); err != nil {
+				return nil, fmt.Errorf("bad number %q", s[i:j])
+			}
+			tokens = append(tokens, lexToken{'n', s[i:j], i})
+			i = j
+		case c == '_' || isAlpha(c):
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || isAlpha(s[j]) || s[j] >= '0' && s[j] <= '9') {
+				j++
+			}
+			tokens = append(tokens, lexToken{'i', s[i:j], i})
+			i = j
+		case l.cOperators && i+1 < len(s) && cOperators[s[i:i+2]] != "":
+			tokens = append(tokens, lexToken{'i', cOperators[s[i:i+2]], i})
+			i += 2
+		case l.cOperators && c == '!' && (i+1 == len(s) || s[i+1] != '='):
+			tokens = append(tokens, lexToken{'i', "NOT", i})
+			i++
+		default:
+			op := string(c)
+			if i+1 < len(s) && isOperator(s[i:i+2]) {
+				op = s[i : i+2]
+			}
+			if !isOperator(op) {
+				return nil, fmt.Errorf("unexpected %q", op)
+			}
+			at := i
+			i += len(op)
+			switch op {
+			case "<>":
+				op = "!="
+			case "==":
+				op = "="
+			case ";":
+				if strings.TrimSpace(s[i:]) != "" {
+					return nil, errors.New("expected one statement")
+				}
+				continue
+			}
+			tokens = append(tokens, lexToken{'o', op, at})
+		}
+	}
+	return tokens, nil
+}
+
+// tokenStream is the position of a recursive-descent parser in the
+// tokens of its text.
+type tokenStream struct {
+	tokens []lexToken
+	pos    int
+	end    int // length of the text, the offset past the last token
+}
+
+func (p *tokenStream) peek() lexToken {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return lexToken{at: p.end}
+}
+
+// keyword consumes the next token if it is the keyword kw.
+func (p *tokenStream) keyword(kw string) bool {
+	if t := p.peek(); t.kind == 'i' && strings.EqualFold(t.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// punct consumes the next token if it is the operator or punctuation op.
+func (p *tokenStream) punct(op string) bool {
+	if t := p.peek(); t.kind == 'o' && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
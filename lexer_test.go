@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLex(t *testing.T) {
+	tests := []struct {
+		lexer lexer
+		text  string
+		want  string // the tokens as kind:text, or the error
+	}{
+		{alertLexer, `Zip = 40203 OR Neighborhood <> 'Shawnee'`, `[i:Zip o:= n:40203 i:OR i:Neighborhood o:!= s:Shawnee]`},
+		{alertLexer, `Sale_Price > -1.5 && !(Purchaser == "O\"Neil")`, `[i:Sale_Price o:> n:-1.5 i:AND i:NOT o:( i:Purchaser o:= s:O"Neil o:)]`},
+		{alertLexer, `Purchaser = 'O''Neil' || Zip != 1`, `[i:Purchaser o:= s:O'Neil i:OR i:Zip o:!= n:1]`},
+		{alertLexer, "Zip\n=\t1", `[i:Zip o:= n:1]`},
+		{alertLexer, `Zip = 'open`, `unterminated string`},
+		{alertLexer, `Zip = 1.2.3`, `bad number "1.2.3"`},
+		{alertLexer, `Zip + 1`, `unexpected "+"`},
+		{alertLexer, `Zip = 1;`, `unexpected ";"`},
+		{sqlLexer, `SELECT "Sale Price" * 2, a || 'b' FROM extract;`, `[i:SELECT q:Sale Price o:* n:2 o:, i:a o:|| s:b i:FROM i:extract]`},
+		{sqlLexer, `SELECT x-1, .5, "a""b" FROM t`, `[i:SELECT i:x o:- n:1 o:, n:.5 o:, q:a"b i:FROM i:t]`},
+		{sqlLexer, `SELECT 1 == 1 <> 2`, `[i:SELECT n:1 o:= n:1 o:!= n:2]`},
+		{sqlLexer, `SELECT 1; SELECT 2`, `expected one statement`},
+		{sqlLexer, `SELECT a && b`, `unexpected "&"`},
+		{sqlLexer, `SELECT !a`, `unexpected "!"`},
+		{sqlLexer, `  `, `[]`},
+	}
+	for _, tt := range tests {
+		tokens, err := tt.lexer.lex(tt.text)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		} else {
+			var parts []string
+			for _, tok := range tokens {
+				parts = append(parts, string(tok.kind)+":"+tok.text)
+			}
+			got = fmt.Sprint(parts)
+		}
+		if got != tt.want {
+			t.Errorf("lex(%q) = %s, want %s", tt.text, got, tt.want)
+		}
+	}
+}
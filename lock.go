@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultLockFile is held while a run writes to the output directory.
+const defaultLockFile = ".fetch.lock"
+
+// errLocked means another process holds the lock.
+var errLocked = errors.New("another run holds the lock")
+
+// runLock keeps a second fetch, e.g. cron firing while the previous run
+// is still going, from writing the same output, checkpoint and state
+// files at the same time. lockFile and unlock are per platform: flock on
+// Unix, a pidfile elsewhere.
+type runLock struct {
+	path string
+	file *os.File
+}
+
+// acquireLock takes the lock at path, waiting up to wait for the run that
+// holds it to finish. It returns errLocked if the lock is still held.
+func acquireLock(path string, wait time.Duration) (*runLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(wait)
+	logged := false
+	for {
+		file, err := lockFile(path)
+		if err == nil {
+			// The pid is only for operators looking at a stuck lock.
+			file.Truncate(0)
+			file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+			return &runLock{path: path, file: file}, nil
+		}
+		if !errors.Is(err, errLocked) || !time.Now().Before(deadline) {
+			return nil, err
+		}
+		if !logged {
+			slog.Info("waiting for the run holding the lock", "path", path, "pid", lockHolder(path), "wait", wait)
+			logged = true
+		}
+		time.Sleep(min(time.Second, time.Until(deadline)))
+	}
+}
+
+// lockHolder returns the pid written in the lock file, or "unknown".
+func lockHolder(path string) string {
+	data, err := os.ReadFile(path)
+	if pid := strings.TrimSpace(string(data)); err == nil && pid != "" {
+		return pid
+	}
+	return "unknown"
+}
+
+// release gives the lock up. It is safe to call on a nil lock.
+func (l *runLock) release() {
+	if l == nil {
+		return
+	}
+	if err := l.unlock(); err != nil {
+		slog.Warn("could not release lock", "path", l.path, "err", err)
+	}
+}
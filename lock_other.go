@@ -0,0 +1,25 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// lockFile creates path as a pidfile, failing if it already exists.
+// Without flock a run that crashes leaves the file behind; it has to be
+// deleted by hand before the next run.
+func lockFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if errors.Is(err, os.ErrExist) {
+		return nil, errLocked
+	}
+	return file, err
+}
+
+// unlock closes and removes the pidfile.
+func (l *runLock) unlock() error {
+	l.file.Close()
+	return os.Remove(l.path)
+}
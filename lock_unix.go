@@ -0,0 +1,34 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFile opens path and takes an exclusive flock on it. The kernel
+// drops the lock when the process exits, so a crashed run never leaves
+// a stale lock behind.
+func lockFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errLocked
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+// unlock closes the file, which releases the flock. The file itself is
+// left in place: removing it would let a process that opened the old
+// file and one that creates a new one both hold "the" lock.
+func (l *runLock) unlock() error {
+	return l.file.Close()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// registerLogging binds the flags that control log output. Every command
+// accepts them.
+func (o *Options) registerLogging(fs *flag.FlagSet) {
+	fs.StringVar(&o.LogLevel, "log-level", "info", "minimum log level: debug, info, warn or error")
+	fs.StringVar(&o.LogFormat, "log-format", "text", "log format: text, or json for log aggregators")
+}
+
+// setupLogging installs the default slog logger. Logs go to stderr so they
+// never mix with data written to stdout.
+func setupLogging(opts *Options) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(opts.LogLevel)); err != nil {
+		return fmt.Errorf("invalid -log-level %q (use debug, info, warn or error)", opts.LogLevel)
+	}
+	handlerOpts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch strings.ToLower(opts.LogFormat) {
+	case "", "text":
+		handler = slog.NewTextHandler(stderr, handlerOpts)
+	case "json":
+		handler = slog.NewJSONHandler(stderr, handlerOpts)
+	default:
+		return fmt.Errorf("invalid -log-format %q (use text or json)", opts.LogFormat)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// fatal logs an error and exits with the given status.
+func fatal(code int, msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(code)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Issues with attribute values, as counted in the run report.
+const (
+	issueDateText      = "date_text"         // a date sent as text; converted to a timestamp
+	issueInvalidDate   = "invalid_date"      // a date field that is neither a timestamp nor date text; written as null
+	issueDateRange     = "date_out_of_range" // a timestamp outside dateRangeLimits; written as null
+	issueInvalidNumber = "invalid_number"    // a -number-fields value that is not a number; written as null
+	issueNotFinite     = "not_finite"        // a NaN or infinite number; written as null
+	issueNested        = "nested_value"      // an object or array; written as JSON
+	issueInvalidUTF8   = "invalid_utf8"      // text that is not UTF-8; the bad bytes are replaced
+)
+
+// dateRangeLimits are the years a timestamp has to fall in. Anything
+// outside is a garbled value, and would print as a five-digit year.
+var dateRangeLimits = [2]int{1800, 2200}
+
+// fieldIssues counts issues by field, then by issue.
+type fieldIssues map[string]map[string]int
+
+// attributeCheck repairs the attribute values a writer cannot make sense
+// of before a record is written, so one odd value in a page never turns
+// into garbage in every output, and counts what it repaired. Fields with
+// a -coerce rule are left to the rule, which quarantines what breaks it.
+type attributeCheck struct {
+	formatter *Formatter
+	issues    fieldIssues
+	records   int // records with at least one issue
+}
+
+func newAttributeCheck(f *Formatter) *attributeCheck {
+	return &attributeCheck{formatter: f, issues: make(fieldIssues)}
+}
+
+// repair fixes the values of a record in place.
+func (a *attributeCheck) repair(record map[string]interface{}) {
+	if record == nil {
+		return
+	}
+	found := false
+	for field, value := range record {
+		if value == nil {
+			continue
+		}
+		if _, ok := a.formatter.Coerce[field]; ok {
+			continue
+		}
+		fixed, issue := a.check(field, value)
+		if issue == "" {
+			continue
+		}
+		record[field] = fixed
+		if a.issues[field] == nil {
+			a.issues[field] = make(map[string]int)
+		}
+		a.issues[field][issue]++
+		found = true
+		slog.Debug("attribute value repaired", "objectId", record[idField], "field", field, "issue", issue)
+	}
+	if found {
+		a.records++
+	}
+}
+
+// check returns the issue with a value and the value to write in its
+// place, or "" if the value is fine as it is.
+func (a *attributeCheck) check(field string, value interface{}) (interface{}, string) {
+	switch v := value.(type) {
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(v)
+		return string(b), issueNested
+	case string:
+		if !utf8.ValidString(v) {
+			return strings.ToValidUTF8(v, "�"), issueInvalidUTF8
+		}
+	}
+
+	switch {
+	case dateFields[field]:
+		return checkDate(a.formatter, field, value)
+	case a.formatter.NumberFields[field]:
+		if s, ok := value.(string); ok && strings.TrimSpace(s) == "" {
+			return value, ""
+		}
+		n, ok := a.formatter.parseNumber(value)
+		switch {
+		case !ok:
+			return nil, issueInvalidNumber
+		case math.IsNaN(n) || math.IsInf(n, 0):
+			return nil, issueNotFinite
+		}
+	}
+	return value, ""
+}
+
+// checkDate accepts an epoch-millisecond timestamp. Text holding one, or
+// a date such as 2024-02-01, is converted to a timestamp.
+func checkDate(f *Formatter, field string, value interface{}) (interface{}, string) {
+	ms, ok := value.(float64)
+	if s, isText := value.(string); isText {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return value, ""
+		}
+		var err error
+		if ms, err = strconv.ParseFloat(s, 64); err != nil {
+			t, ok := f.typedValue(field, kindTime, s)
+			if !ok {
+				return nil, issueInvalidDate
+			}
+			return float64(t.(time.Time).UnixMilli()), issueDateText
+		}
+		if fixed, issue := checkDate(f, field, ms); issue != "" {
+			return fixed, issue
+		}
+		return ms, issueDateText
+	}
+	switch {
+	case !ok:
+		return nil, issueInvalidDate
+	case math.IsNaN(ms) || math.IsInf(ms, 0):
+		return nil, issueNotFinite
+	case ms == 0:
+		// Written as an empty date, as always.
+		return ms, ""
+	}
+	if year := time.UnixMilli(int64(ms)).UTC().Year(); year < dateRangeLimits[0] || year >= dateRangeLimits[1] {
+		return nil, issueDateRange
+	}
+	return ms, ""
+}
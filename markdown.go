@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"text/template"
+)
+
+// markdownReport renders the -report-format markdown page, for a wiki or
+// a pull request description: the run's metadata and the key tables of
+// the HTML page, as GitHub-flavored Markdown.
+var markdownReport = template.Must(template.New("markdown").Funcs(template.FuncMap{"cell": markdownCell}).Parse(markdownTemplate))
+
+// markdownCell makes a value safe for a table cell: pipes are escaped and
+// line breaks become spaces.
+func markdownCell(s string) string {
+	s = strings.NewReplacer("|", `\|`, "\r\n", " ", "\n", " ", "\r", " ").Replace(s)
+	if s == "" {
+		return " "
+	}
+	return s
+}
+
+const markdownTemplate = `## {{.Title}}
+
+| Run | |
+| --- | --- |
+| Status | **{{.Status}}**{{if .Error}}: {{cell .Error}}{{end}} |
+| Started | {{.StartedAt}} |
+| Finished | {{.FinishedAt}} ({{printf "%.1f" .WallTimeSeconds}}s) |
+| Records written | {{.Records}}{{if ge .ExpectedRecords 0}} of {{.ExpectedRecords}} in the layer{{end}} |
+{{- if ge .NewRecords 0}}
+| New records | {{.NewRecords}} |
+{{- end}}
+| Pages | {{.PagesFetched}} fetched, {{len .Failures}} failed, {{.PagesRetried}} retried |
+| Downloaded | {{.Downloaded}} |
+| Source | {{cell .URL}} |
+{{- range .Outputs}}
+| Output | ` + "`{{cell .Path}}`" + ` ({{.Size}}) |
+{{- end}}
+
+### Data-quality warnings
+{{if .Warnings}}
+{{range .Warnings}}- {{.}}
+{{end}}{{else}}
+None.
+{{end}}
+{{- if .Years}}
+### Filings by year ({{.DateColumn}})
+
+| Year | Filings |
+| --- | ---: |
+{{range .Years}}| {{.Label}} | {{.Count}} |
+{{end}}{{end}}
+{{- if .Neighborhoods}}
+### Neighborhoods
+
+| Neighborhood | Filings | Sales | Median sale price |
+| --- | ---: | ---: | ---: |
+{{range .Neighborhoods}}| {{cell .Name}} | {{.Filings}} | {{.Sales}} | {{cell .MedianPrice}} |
+{{end}}{{end}}
+{{- if .Filings}}
+### Recent filings
+
+| Filed | Case | Address | Neighborhood | Sold |
+| --- | --- | --- | --- | --- |
+{{range .Filings}}| {{.Date}} | {{cell .Case}} | {{cell .Address}} | {{cell .Neighborhood}} | {{cell .Sold}} |
+{{end}}{{end}}`
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// layerFeature is a feature as a query response holds it. The attribute
+// values are kept as the service wrote them, so numbers and dates come
+// back byte for byte.
+type layerFeature struct {
+	Attributes map[string]json.RawMessage `json:"attributes"`
+	Geometry   json.RawMessage            `json:"geometry,omitempty"`
+}
+
+// memoryLayer answers the requests a fetch run makes of a feature layer
+// from features held in memory: the layer metadata at any path but
+// /query, and at /query the count, and pages by resultOffset and
+// resultRecordCount up to pageSize, with exceededTransferLimit set while
+// more follow. The features are taken to answer the query already, so
+// its where clause and spatial filter are not looked at. Pages are esri
+// JSON only.
+type memoryLayer struct {
+	layer    map[string]interface{}
+	pageSize int
+	features []layerFeature
+}
+
+func (l *memoryLayer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := r.Form
+	if !strings.HasSuffix(strings.TrimRight(r.URL.Path, "/"), "/query") {
+		writeLayerJSON(w, l.layer)
+		return
+	}
+	if q.Get("returnCountOnly") == "true" {
+		writeLayerJSON(w, map[string]int{"count": len(l.features)})
+		return
+	}
+
+	offset, _ := strconv.Atoi(q.Get("resultOffset"))
+	size, err := strconv.Atoi(q.Get("resultRecordCount"))
+	if err != nil || size <= 0 || size > l.pageSize {
+		size = l.pageSize
+	}
+	offset = min(max(offset, 0), len(l.features))
+	end := min(offset+size, len(l.features))
+	l.writePage(w, q, l.features[offset:end], end < len(l.features))
+}
+
+// writePage answers a query with features, keeping only the outFields and,
+// unless returnGeometry is false, the geometry.
+func (l *memoryLayer) writePage(w http.ResponseWriter, q url.Values, features []layerFeature, exceeded bool) {
+	var fields []string
+	if out := q.Get("outFields"); out != "" && out != "*" {
+		fields = splitList(out)
+	}
+	page := make([]layerFeature, 0, len(features))
+	for _, feature := range features {
+		if fields != nil {
+			attrs := make(map[string]json.RawMessage, len(fields))
+			for name, value := range feature.Attributes {
+				if slices.ContainsFunc(fields, func(f string) bool { return strings.EqualFold(f, name) }) {
+					attrs[name] = value
+				}
+			}
+			feature.Attributes = attrs
+		}
+		if q.Get("returnGeometry") == "false" {
+			feature.Geometry = nil
+		}
+		page = append(page, feature)
+	}
+	writeLayerJSON(w, map[string]interface{}{
+		"features":              page,
+		"exceededTransferLimit": exceeded,
+	})
+}
+
+func writeLayerJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeLayerError answers as ArcGIS does: HTTP 200 with an error object.
+func writeLayerError(w http.ResponseWriter, message string) {
+	writeLayerJSON(w, map[string]interface{}{
+		"error": map[string]interface{}{"code": 400, "message": "Unable to complete operation.", "details": []string{message}},
+	})
+}
+
+// handlerTransport answers requests with a handler in-process, so nothing
+// goes over the network.
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (t handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	w := &memoryResponse{header: make(http.Header)}
+	t.handler.ServeHTTP(w, req)
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(w.status) + " " + http.StatusText(w.status),
+		StatusCode:    w.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header,
+		Body:          io.NopCloser(&w.body),
+		ContentLength: int64(w.body.Len()),
+		Request:       req,
+	}, nil
+}
+
+// memoryResponse is the http.ResponseWriter of handlerTransport.
+type memoryResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *memoryResponse) Header() http.Header { return w.header }
+
+func (w *memoryResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *memoryResponse) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// mergeSuffix names the file a -merge run writes its records to before
+// they are merged into the output.
+const mergeSuffix = ".fetched.tmp"
+
+// MergeStats counts what a -merge run did to the output.
+type MergeStats struct {
+	Records   int `json:"records"` // rows in the merged output
+	Added     int `json:"added"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"` // fetched again with the same values
+}
+
+// mergeCSV merges the rows of fetched into the CSV at path, matching them
+// by the id column: a fetched row replaces the row with its id in place
+// and drops any later rows with that id, rows fetched for the first time
+// are added at the end, and rows that were not fetched are kept. Of rows
+// fetched more than once, the last is merged. Fields that hold nullToken
+// are written as nulls. The result replaces path with a rename, so readers see either
+// the old file or the new one, and fetched is removed.
+func mergeCSV(path, fetched, idColumn, nullToken string, dialect CSVDialect) (*MergeStats, error) {
+	header, rows, err := readCSV(fetched, dialect.Comma)
+	if err != nil {
+		return nil, err
+	}
+	id := slices.Index(header, idColumn)
+	if id < 0 {
+		return nil, fmt.Errorf("%s has no %s column", fetched, idColumn)
+	}
+
+	existingHeader, existing, err := readCSV(path, dialect.Comma)
+	if errors.Is(err, os.ErrNotExist) {
+		// Nothing to merge into yet.
+		if err := os.Rename(fetched, path); err != nil {
+			return nil, err
+		}
+		return &MergeStats{Records: len(rows), Added: len(rows)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Equal(header, existingHeader) {
+		return nil, fmt.Errorf("the columns of %s differ from this run's; -merge needs the same -fields, -rename and -columns as the runs before", path)
+	}
+
+	tmp := path + ".merge.tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	// The rows were checked for control characters when first written.
+	dialect.RejectControl = false
+	w := newCSVWriter(file, dialect)
+	stats, err := mergeRows(w, header, existing, rows, id, nullToken, dialect.BOM)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	os.Remove(fetched)
+	return stats, nil
+}
+
+// mergeRows writes the merged rows to w; see mergeCSV.
+func mergeRows(w *csvWriter, header []string, existing, rows [][]string, id int, nullToken string, bom bool) (*MergeStats, error) {
+	if bom {
+		if _, err := w.w.WriteString(utf8BOM); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Write(header, nil); err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]int, len(rows))
+	for i, row := range rows {
+		if row[id] != "" {
+			byID[row[id]] = i
+		}
+	}
+	stats := &MergeStats{}
+	used := make([]bool, len(rows))
+	for _, row := range existing {
+		if i, ok := byID[row[id]]; ok && row[id] != "" {
+			if used[i] {
+				// A duplicate of a row already replaced.
+				continue
+			}
+			used[i] = true
+			if slices.Equal(row, rows[i]) {
+				stats.Unchanged++
+			} else {
+				stats.Updated++
+			}
+			row = rows[i]
+		}
+		if err := w.Write(row, nullFields(row, nullToken)); err != nil {
+			return nil, err
+		}
+		stats.Records++
+	}
+	for i, row := range rows {
+		// Of rows fetched twice, the last is the one merged.
+		if used[i] || row[id] != "" && byID[row[id]] != i {
+			continue
+		}
+		if err := w.Write(row, nullFields(row, nullToken)); err != nil {
+			return nil, err
+		}
+		stats.Added++
+		stats.Records++
+	}
+	return stats, nil
+}
+
+// readCSV reads a whole CSV file: its header, without a byte order mark,
+// and its rows, padded or cut to the header's length.
+func readCSV(path string, comma rune) ([]string, [][]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	r := csv.NewReader(file)
+	r.Comma = comma
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, nil, fmt.Errorf("%s is empty", path)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], utf8BOM)
+	}
+	var rows [][]string
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			return header, rows, nil
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		rows = append(rows, append(row, make([]string, max(len(header)-len(row), 0))...)[:len(header)])
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMergeCSV(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string // "" for no output yet
+		fetched  string
+		want     string
+		stats    MergeStats
+		err      string
+	}{
+		{
+			name:    "first run",
+			fetched: "ObjectId,Zip\n1,40203\n2,40211\n",
+			want:    "ObjectId,Zip\n1,40203\n2,40211\n",
+			stats:   MergeStats{Records: 2, Added: 2},
+		},
+		{
+			name:     "update in place, append and keep",
+			existing: "ObjectId,Zip\n1,40203\n2,40211\n3,40212\n",
+			fetched:  "ObjectId,Zip\n4,40206\n2,40210\n1,40203\n",
+			want:     "ObjectId,Zip\n1,40203\n2,40210\n3,40212\n4,40206\n",
+			stats:    MergeStats{Records: 4, Added: 1, Updated: 1, Unchanged: 1},
+		},
+		{
+			name:     "duplicate ids on both sides",
+			existing: "ObjectId,Zip\n1,40203\n2,40211\n1,40299\n3,40212\n3,40213\n",
+			fetched:  "ObjectId,Zip\n1,40204\n5,40206\n1,40205\n5,40207\n",
+			// The last fetched row of an id replaces its first row and
+			// drops the others; ids not fetched keep their duplicates.
+			want:  "ObjectId,Zip\n1,40205\n2,40211\n3,40212\n3,40213\n5,40207\n",
+			stats: MergeStats{Records: 5, Added: 1, Updated: 1},
+		},
+		{
+			name:     "rows without an id",
+			existing: "ObjectId,Zip\n,40203\n1,40211\n",
+			fetched:  "ObjectId,Zip\n,40203\n1,40211\n",
+			want:     "ObjectId,Zip\n,40203\n1,40211\n,40203\n",
+			stats:    MergeStats{Records: 3, Added: 1, Unchanged: 1},
+		},
+		{
+			name:     "nulls stay bare",
+			existing: "ObjectId,Zip\n1,40203\n",
+			fetched:  "ObjectId,Zip\n1,NULL\n",
+			want:     "ObjectId,Zip\n1,NULL\n",
+			stats:    MergeStats{Records: 1, Updated: 1},
+		},
+		{
+			name:     "header mismatch",
+			existing: "ObjectId,Zip\n1,40203\n",
+			fetched:  "ObjectId,Zip,CD\n1,40203,4\n",
+			err:      "differ from this run's",
+		},
+		{
+			name:     "no id column",
+			existing: "ObjectId,Zip\n1,40203\n",
+			fetched:  "Zip\n40203\n",
+			err:      "has no ObjectId column",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path, fetched := filepath.Join(dir, "out.csv"), filepath.Join(dir, "out.csv"+mergeSuffix)
+			if tt.existing != "" {
+				writeTestFile(t, path, tt.existing)
+			}
+			writeTestFile(t, fetched, tt.fetched)
+
+			stats, err := mergeCSV(path, fetched, idField, "NULL", CSVDialect{Comma: ','})
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				// The output is left as it was.
+				if got, _ := os.ReadFile(path); string(got) != tt.existing {
+					t.Errorf("output changed to %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *stats != tt.stats {
+				t.Errorf("stats %+v, want %+v", *stats, tt.stats)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+			// The merge replaced the output with a rename and cleaned up.
+			for _, leftover := range []string{fetched, path + ".merge.tmp"} {
+				if _, err := os.Stat(leftover); !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("%s left behind", filepath.Base(leftover))
+				}
+			}
+		})
+	}
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A write error stops the merge as soon as it happens, not only at the
+// final Flush.
+func TestMergeRowsWriteError(t *testing.T) {
+	var existing [][]string
+	for range 1000 {
+		existing = append(existing, []string{"1", strings.Repeat("x", 100)})
+	}
+	w := newCSVWriter(failingWriter{}, CSVDialect{Comma: ','})
+	if _, err := mergeRows(w, []string{"ObjectId", "Zip"}, existing, nil, 0, "", false); err == nil {
+		t.Fatal("merge into a failing writer succeeded")
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
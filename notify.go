@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"os"
+	"time"
+)
+
+// notifyTimeout bounds the time spent delivering each notification,
+// retries included.
+const notifyTimeout = time.Minute
+
+// notifyClient sends the HTTP notifications.
+var notifyClient = &http.Client{Timeout: 30 * time.Second}
+
+// -notify-on values: which runs are notified. Runs with -alert matches
+// are notified whatever the choice.
+var notifyConditions = map[string]func(r *RunReport) bool{
+	"always":   func(*RunReport) bool { return true },
+	"changes":  func(r *RunReport) bool { return r.Status != statusUnchanged },
+	"failures": func(r *RunReport) bool { return r.Status != statusOK && r.Status != statusUnchanged },
+	"alerts":   func(*RunReport) bool { return false },
+}
+
+// A notifier tells something outside the process how a run ended. A
+// notification that cannot be delivered is logged; it never changes the
+// outcome of the run.
+type notifier interface {
+	name() string
+	notify(ctx context.Context, report *RunReport) error
+}
+
+// newNotifiers builds the notifiers selected by the options.
+func newNotifiers(opts *Options) []notifier {
+	var notifiers []notifier
+	for _, url := range opts.Webhooks {
+		notifiers = append(notifiers, &webhook{url: url, client: notifyClient})
+	}
+	if url := firstNonEmpty(opts.SlackWebhook, os.Getenv("SLACK_WEBHOOK_URL")); url != "" {
+		notifiers = append(notifiers, &slackNotifier{url: url, client: notifyClient})
+	}
+	if url := firstNonEmpty(opts.TeamsWebhook, os.Getenv("TEAMS_WEBHOOK_URL")); url != "" {
+		notifiers = append(notifiers, &teamsNotifier{url: url, client: notifyClient})
+	}
+	if opts.SMTPHost != "" {
+		notifiers = append(notifiers, newEmailNotifier(opts))
+	}
+	return notifiers
+}
+
+// checkNotifyOptions validates the notification flags.
+func checkNotifyOptions(opts *Options) error {
+	if notifyConditions[opts.NotifyOn] == nil {
+		return fmt.Errorf("-notify-on %q: want always, changes, failures or alerts", opts.NotifyOn)
+	}
+	if (opts.SMTPHost == "") != (opts.EmailTo == "") {
+		return errors.New("-smtp-host and -email-to go together")
+	}
+	if opts.SMTPHost != "" {
+		if _, err := mail.ParseAddressList(opts.EmailTo); err != nil {
+			return fmt.Errorf("-email-to: %w", err)
+		}
+		if firstNonEmpty(opts.EmailFrom, opts.SMTPUser, os.Getenv("SMTP_USERNAME")) == "" {
+			return errors.New("-email-from is required without -smtp-user")
+		}
+	}
+	if opts.EmailAttachDelta && opts.Delta == "" {
+		return errors.New("-email-attach-delta needs -delta")
+	}
+	return nil
+}
+
+// publish saves the run report and sends it to the notifiers, if
+// -notify-on selects runs with its status or an -alert matched.
+func (j *fetchJob) publish(report *RunReport) {
+	saveReport(j.opts.Report, report)
+	j.writeReportPages(report)
+	if !notifyConditions[j.opts.NotifyOn](report) && len(report.Alerts) == 0 {
+		return
+	}
+	if j.opts.SkipUnchanged && report.Status == statusUnchanged {
+		slog.Info("output unchanged; no notifications sent")
+		return
+	}
+	for _, n := range j.notifiers {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		if err := n.notify(ctx, report); err != nil {
+			slog.Warn("could not send notification", "notifier", n.name(), "err", err)
+		} else {
+			slog.Debug("notification sent", "notifier", n.name())
+		}
+		cancel()
+	}
+}
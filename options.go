@@ -0,0 +1,321 @@
+package main
+
+import (
+	"flag"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Options holds the command-line settings shared by the fetch run and the
+// subcommands.
+type Options struct {
+	URL      string
+	Token    string
+	Username string
+	TokenURL string
+	ClientID string
+	OAuthURL string
+	APIKey   string
+	Headers  listFlag
+	Proxy    string
+	CAFile   string
+	Insecure bool
+
+	ClientCert string
+	ClientKey  string
+	UserAgent  string
+	CacheDir   string
+	Rate       float64
+	Timeout    time.Duration
+
+	DebugHTTP    bool
+	DebugHTTPDir string
+
+	Workers    int
+	MaxWorkers int
+	Adaptive   bool
+	BatchSize  int
+
+	Out       string
+	Merge     bool
+	OutFormat string
+	SplitBy   string
+	Address   bool
+
+	Geocode         string
+	GeocodeCache    string
+	GeocodeRate     float64
+	GeocodeLocality string
+
+	Census       string
+	CensusYear   int
+	CensusCounty string
+	CensusCache  string
+
+	JoinURL    string
+	JoinOn     string
+	JoinKey    string
+	JoinFields string
+	DateFormat string
+	TZ         string
+	RawDates   string
+
+	NumberFields   string
+	Decimals       int
+	StripThousands bool
+	NullToken      string
+
+	HashFields   string
+	RedactFields string
+	Coerce       string
+	Quarantine   string
+	Transforms   listFlag
+	Filter       string
+
+	Delimiter     string
+	QuoteAll      bool
+	CRLF          bool
+	RejectControl bool
+	RFC4180       bool
+	BOM           bool
+
+	Fields    string
+	Strict    bool
+	Rename    string
+	Columns   string
+	AllLayers bool
+	Where     string
+	Since     string
+	Until     string
+	DateField string
+
+	BBox    string
+	BBoxSR  string
+	Polygon string
+
+	Geometry    bool
+	Attachments string
+	Related     string
+	OutSR       string
+
+	OrderBy     string
+	QueryFormat string
+	RawDir      string
+
+	DryRun bool
+	Limit  int
+
+	IfChanged     bool
+	SkipUnchanged bool
+	Sync          bool
+	StateFile     string
+
+	Resume       bool
+	FailFast     bool
+	Deadline     time.Duration
+	MaxErrorRate float64
+	MaxBuffered  int
+
+	Watch    time.Duration
+	Schedule string
+	Lock     string
+	LockWait time.Duration
+
+	LogLevel      string
+	LogFormat     string
+	Progress      string
+	Report        string
+	ReportFormat  string
+	Delta         string
+	Timeseries    string
+	AreaSummary   string
+	Tee           listFlag
+	Versioned     bool
+	Retention     time.Duration
+	DataPackage   bool
+	CSVW          bool
+	Provenance    bool
+	Checksums     bool
+	EncryptTo     listFlag
+	KeepPlaintext bool
+	Alerts        listFlag
+	Webhooks      listFlag
+	SlackWebhook  string
+	TeamsWebhook  string
+	NotifyOn      string
+
+	SMTPHost         string
+	SMTPUser         string
+	EmailFrom        string
+	EmailTo          string
+	EmailAttachDelta bool
+
+	OTLPEndpoint string
+
+	PprofAddr  string
+	CPUProfile string
+	MemProfile string
+}
+
+// register binds the options to command-line flags.
+func (o *Options) register(fs *flag.FlagSet) {
+	o.registerClient(fs)
+	o.registerQuery(fs)
+	o.registerLogging(fs)
+	fs.StringVar(&o.Out, "out", filepath.Join(outputDir, outputFile), "output CSV file, which may contain {dataset}, {layer}, {yyyy}, {mm}, {dd}, {hh} and {yyyy-mm-dd}; - streams the records to stdout, with the logs and run summary on stderr")
+	fs.BoolVar(&o.Merge, "merge", false, "merge the records into the existing output by ObjectId instead of replacing it: changed records are updated, new ones added and the rest kept, e.g. with -since for a maintained master file")
+	fs.StringVar(&o.OutFormat, "out-format", "csv", "format of -out -: csv or ndjson (one JSON object per line)")
+	fs.StringVar(&o.SplitBy, "split-by", "", "write one file per partition: a field name (Zip) or year(Field)/month(Field)")
+	fs.BoolVar(&o.Address, "address", false, "add an Address column: House_Nr, Dir, Street_Name, St_Type and Post_Dir joined and standardized with USPS abbreviations")
+	fs.StringVar(&o.Geocode, "geocode", "", "add Latitude and Longitude columns by geocoding each address: census for the US Census geocoder, or the URL of an ArcGIS GeocodeServer")
+	fs.StringVar(&o.GeocodeCache, "geocode-cache", filepath.Join(outputDir, defaultGeocodeCache), "file that keeps geocoded addresses between runs; empty to disable")
+	fs.Float64Var(&o.GeocodeRate, "geocode-rate", 5, "maximum geocoding requests per second")
+	fs.StringVar(&o.GeocodeLocality, "geocode-locality", "Louisville, KY", "city and state added to each address for -geocode")
+	fs.StringVar(&o.Census, "census", "", "comma-separated ACS estimates to join by Census_Tract: median_income, poverty_rate, median_home_value, median_rent, population, owner_occupied, or ACS variable codes (API key in $CENSUS_API_KEY, optional)")
+	fs.IntVar(&o.CensusYear, "census-year", 2022, "year of the ACS 5-year estimates for -census")
+	fs.StringVar(&o.CensusCounty, "census-county", "21111", "state and county FIPS code of the tracts, for -census (21111 is Jefferson County, KY)")
+	fs.StringVar(&o.CensusCache, "census-cache", filepath.Join(outputDir, defaultCensusCache), "file that keeps the -census tables between runs; empty to disable")
+	fs.StringVar(&o.JoinURL, "join-url", "", "feature layer to join to each record, e.g. the PVA assessment parcels; credentials are only sent if it is on the -url server")
+	fs.StringVar(&o.JoinOn, "join-on", "Full_Parcel_ID", "field of the records looked up in -join-key")
+	fs.StringVar(&o.JoinKey, "join-key", "PARCELID", "field of the -join-url layer matched against -join-on")
+	fs.StringVar(&o.JoinFields, "join-fields", "", "comma-separated fields of the -join-url layer to append, e.g. assessed value and property class")
+	fs.StringVar(&o.DateFormat, "date-format", "default", "date layout: default, iso8601, date-only, epoch, or a Go time layout")
+	fs.StringVar(&o.TZ, "tz", "", "convert date fields to this IANA time zone before formatting (e.g. America/Kentucky/Louisville)")
+	fs.StringVar(&o.RawDates, "raw-dates", "", "comma-separated date fields to emit as raw epoch milliseconds, or \"all\"")
+	fs.StringVar(&o.NumberFields, "number-fields", "Sale_Price", "comma-separated currency/number fields that get fixed-point formatting")
+	fs.IntVar(&o.Decimals, "decimals", -1, "decimal places for -number-fields (-1 keeps the shortest exact value)")
+	fs.BoolVar(&o.StripThousands, "strip-thousands", false, "strip thousands separators from text values in -number-fields")
+	fs.StringVar(&o.NullToken, "null", "", "token written for null attributes (e.g. \\N or NULL); empty strings stay empty")
+	fs.StringVar(&o.HashFields, "hash-fields", "", "comma-separated fields written as a salted SHA-256 (HMAC) of their value, with the salt in $FETCH_HASH_SALT")
+	fs.StringVar(&o.RedactFields, "redact-fields", "", "comma-separated fields written as "+redactedValue)
+	fs.StringVar(&o.Filter, "filter", "", "only write the records matching this condition, checked after download for what -where cannot express, e.g. 'Sale_Price > 50000 && Neighborhood == \"Portland\"'")
+	fs.Var(&o.Transforms, "transform", "transform each record before it is written: trim[:fields], upper:fields, lower:fields, default:field=value or drop-null:fields; repeatable, applied in order")
+	fs.StringVar(&o.Coerce, "coerce", "", "comma-separated field=type rules for the output: int, float, float(decimals), string, string(length, zero-padded) or date, e.g. \"Zip=string(5),Sale_Price=float(2)\"; records that break one go to -quarantine")
+	fs.StringVar(&o.Quarantine, "quarantine", filepath.Join(outputDir, defaultQuarantineFile), "CSV file for the records that break a -coerce rule, with a "+quarantineReasonField+" column")
+	fs.StringVar(&o.Delimiter, "delimiter", ",", "field delimiter: a single character or tab, pipe, comma, semicolon")
+	fs.BoolVar(&o.QuoteAll, "quote-all", false, "quote every field")
+	fs.BoolVar(&o.CRLF, "crlf", false, "use CRLF line endings")
+	fs.BoolVar(&o.RejectControl, "reject-control", false, "skip records whose fields contain control characters")
+	fs.BoolVar(&o.RFC4180, "rfc4180", false, "strict RFC 4180 output: shorthand for -quote-all -crlf -reject-control")
+	fs.BoolVar(&o.BOM, "bom", false, "prefix the CSV with a UTF-8 byte order mark for Excel")
+	fs.StringVar(&o.Fields, "fields", "", "comma-separated fields to request (outFields) and write, in output order; default is all")
+	fs.BoolVar(&o.Strict, "strict", false, "fail the run if the layer returns fields that are not written, such as a newly added column; without it they are counted in the logs and run report")
+	fs.StringVar(&o.Rename, "rename", "", "comma-separated field=name pairs renaming output columns, e.g. Case_=case_number")
+	fs.StringVar(&o.Columns, "columns", "", "comma-separated output columns, by field or -rename name, in the order to write them; columns not listed are left out")
+	fs.BoolVar(&o.AllLayers, "all-layers", false, "treat -url as a FeatureServer and export each of its layers and tables, with the columns of its own schema, to "+filepath.Join(outputDir, "<service>", "<id>_<name>")+"/<name>.csv")
+	fs.BoolVar(&o.Geometry, "geometry", false, "request point geometry and add X and Y columns")
+	fs.StringVar(&o.Attachments, "attachments", "", "download the attachments (photos, documents) of each feature into this directory, as <dir>/<ObjectId>/<id>_<name>, with a manifest "+attachmentManifest)
+	fs.StringVar(&o.Related, "related", "", "comma-separated relationships (names or ids) of the layer whose related records are written to <output>_related_<name>.csv, or \"all\"")
+	fs.StringVar(&o.OutSR, "out-sr", "", "spatial reference (WKID) for exported geometry, e.g. 4326; default is the layer's own")
+	fs.StringVar(&o.OrderBy, "order-by", "ObjectId", "server-side orderByFields; keeps pagination deterministic (empty to disable)")
+	fs.StringVar(&o.QueryFormat, "query-format", "json", "format pages are requested in: json, pbf (protocol buffers) or geojson, if the layer lists it in supportedQueryFormats; auto uses pbf when it can")
+	fs.StringVar(&o.RawDir, "raw-dir", "", "save every query response as the server sent it to <dir>/<run>/offset_<n>.json (.pbf with -query-format pbf), e.g. "+filepath.Join(outputDir, "raw")+", with the query in "+rawManifestFile+"; a source archive independent of the CSV")
+	fs.IntVar(&o.BatchSize, "batch-size", defaultBatchSize, "records per page (resultRecordCount); failing pages are retried in halves down to 250")
+	fs.IntVar(&o.Workers, "workers", defaultWorkers, "concurrent batch requests (the starting point with -adaptive)")
+	fs.IntVar(&o.MaxWorkers, "max-workers", 2*defaultWorkers, "upper bound for -adaptive concurrency")
+	fs.BoolVar(&o.Adaptive, "adaptive", true, "adjust concurrency between 1 and -max-workers based on latency and throttling")
+	fs.IntVar(&o.MaxBuffered, "max-buffered-batches", 0, "most pages held in memory at once, in flight or waiting to be written (0 = twice the worker pool)")
+	fs.BoolVar(&o.DryRun, "dry-run", false, "report the record count, batches and output location, then exit without downloading")
+	fs.BoolVar(&o.IfChanged, "if-changed", false, "skip the download when the layer's lastEditDate matches the previous run")
+	fs.BoolVar(&o.SkipUnchanged, "skip-unchanged", false, "when the new output is byte for byte the previous one, keep the previous file, report the run as unchanged and send no notifications")
+	fs.BoolVar(&o.Sync, "sync", false, "fetch through the feature service sync API (createReplica/synchronizeReplica), downloading only the edits since the previous run; falls back to queries if the service has sync disabled")
+	fs.StringVar(&o.StateFile, "state", filepath.Join(outputDir, defaultStateFile), "file that remembers previous runs")
+	fs.IntVar(&o.Limit, "limit", 0, "only fetch the first N records, for quick checks of the output (0 = all)")
+	fs.DurationVar(&o.Watch, "watch", 0, "keep running and fetch again at this interval, e.g. 1h; implies -if-changed (0 = fetch once)")
+	fs.StringVar(&o.Schedule, "schedule", "", "keep running and fetch at the times of a cron expression, e.g. \"0 6 * * *\"; prefix CRON_TZ=Zone for a zone other than local; implies -if-changed")
+	fs.StringVar(&o.Lock, "lock", filepath.Join(outputDir, defaultLockFile), "lock file held during a run so overlapping runs do not write the same output; empty to disable")
+	fs.DurationVar(&o.LockWait, "lock-wait", 0, "wait this long for a run holding -lock to finish instead of exiting at once with code 3")
+	fs.BoolVar(&o.Resume, "resume", false, "continue an interrupted run from its checkpoint, appending to the existing output")
+	fs.BoolVar(&o.FailFast, "fail-fast", false, "stop the run and cancel outstanding requests at the first page that cannot be fetched")
+	fs.Float64Var(&o.MaxErrorRate, "max-error-rate", 0, "fraction of failed pages (0-1) tolerated before the run exits with status 1")
+	fs.DurationVar(&o.Deadline, "deadline", 0, "give up on the run after this long, keeping a checkpoint (0 = no limit)")
+	fs.StringVar(&o.Report, "report", filepath.Join(outputDir, defaultReportFile), "machine-readable run report (JSON) written after each run; empty to disable")
+	fs.StringVar(&o.ReportFormat, "report-format", "json", "comma-separated formats of the run report: json, and html for a standalone page or markdown for a wiki summary, written next to it")
+	fs.StringVar(&o.Delta, "delta", "", "also write the records that were not in the previous output to this CSV file")
+	fs.StringVar(&o.Timeseries, "timeseries", "", "also write the filings and sales per month and per year to this CSV file")
+	fs.StringVar(&o.AreaSummary, "area-summary", "", "also write the records, sales, median sale price and filing dates per Neighborhood and per council district (CD) to this CSV file")
+	fs.Var(&o.Tee, "tee", "also write the records to this destination from the same download: a .csv, .tsv, .ndjson, .jsonl or .parquet file, or a postgres://user@host/db?table=name URL; repeatable")
+	fs.BoolVar(&o.Versioned, "versioned", false, "write each run to a new output with a timestamp in its name (<output>_2006-01-02T15.csv) and keep the plain output path as a link to the latest one")
+	fs.DurationVar(&o.Retention, "retention", 0, "with -versioned, remove versions older than this, e.g. 720h for 30 days (0 = keep all)")
+	fs.BoolVar(&o.DataPackage, "datapackage", false, "write "+filepath.Join(outputDir, dataPackageFile)+", a Frictionless Data Package descriptor of the output with its field types and checksums")
+	fs.BoolVar(&o.CSVW, "csvw", false, "write a W3C CSVW metadata file (<output>-metadata.json) next to each output, with column datatypes and date formats")
+	fs.BoolVar(&o.Provenance, "provenance", true, "write a sidecar (<output>"+provenanceSuffix+") recording the service URL, query, fetch times and record count of each output")
+	fs.BoolVar(&o.Checksums, "checksums", false, "write "+filepath.Join(outputDir, checksumFile)+", a sha256sum manifest of every file the run produces")
+	fs.Var(&o.EncryptTo, "encrypt-to", "write an encrypted copy of each output for this age recipient (age1...), age recipients file, or exported OpenPGP public key file, and remove the plaintext after a successful run; repeatable")
+	fs.BoolVar(&o.KeepPlaintext, "keep-plaintext", false, "with -encrypt-to, keep the plaintext outputs next to the encrypted copies")
+	fs.Var(&o.Alerts, "alert", "notify when a new record matches this condition, e.g. \"Zip = 40203 OR Neighborhood = 'Shawnee'\"; repeatable")
+	fs.Var(&o.Webhooks, "webhook", "POST the run report as JSON to this URL after each run; repeatable")
+	fs.StringVar(&o.SlackWebhook, "slack-webhook", "", "Slack incoming webhook URL for a run summary after each run (default $SLACK_WEBHOOK_URL)")
+	fs.StringVar(&o.TeamsWebhook, "teams-webhook", "", "Microsoft Teams webhook URL for a run summary after each run (default $TEAMS_WEBHOOK_URL)")
+	fs.StringVar(&o.SMTPHost, "smtp-host", "", "SMTP server as host:port (port 587 if omitted; 465 for implicit TLS) for emailing a run summary to -email-to")
+	fs.StringVar(&o.SMTPUser, "smtp-user", "", "SMTP username, with the password in $SMTP_PASSWORD (default $SMTP_USERNAME)")
+	fs.StringVar(&o.EmailFrom, "email-from", "", "sender of the summary email (default -smtp-user)")
+	fs.StringVar(&o.EmailTo, "email-to", "", "comma-separated recipients of the summary email")
+	fs.BoolVar(&o.EmailAttachDelta, "email-attach-delta", false, "attach the -delta CSV of new records to the summary email")
+	fs.StringVar(&o.NotifyOn, "notify-on", "always", "which runs send notifications: always, changes (not unchanged runs), failures or alerts (only runs with -alert matches); runs with alert matches always notify")
+	fs.StringVar(&o.OTLPEndpoint, "otlp-endpoint", "", "OpenTelemetry collector (OTLP/HTTP) for trace spans, e.g. http://localhost:4318; default $OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, or $OTEL_EXPORTER_OTLP_ENDPOINT/v1/traces")
+	fs.StringVar(&o.PprofAddr, "pprof", "", "serve net/http/pprof on this address during the run, e.g. localhost:6060")
+	fs.StringVar(&o.CPUProfile, "cpuprofile", "", "write a CPU profile of the run to this file")
+	fs.StringVar(&o.MemProfile, "memprofile", "", "write a heap profile to this file at the end of the run")
+	fs.StringVar(&o.Progress, "progress", "auto", "progress bar on stderr: auto (only on a terminal), on or off")
+}
+
+// registerClient binds the flags that choose the service and how to
+// connect to it. They are shared by the fetch run and the subcommands.
+func (o *Options) registerClient(fs *flag.FlagSet) {
+	fs.StringVar(&o.URL, "url", serviceURL, "feature layer (or its /query endpoint) to fetch from")
+	fs.StringVar(&o.Token, "token", "", "ArcGIS token for secured services (default $ARCGIS_TOKEN)")
+	fs.StringVar(&o.Username, "username", "", "generate and refresh tokens for this user, with the password in $ARCGIS_PASSWORD (default $ARCGIS_USERNAME)")
+	fs.StringVar(&o.TokenURL, "token-url", defaultTokenURL, "generateToken endpoint used with -username")
+	fs.StringVar(&o.ClientID, "client-id", "", "OAuth2 app client id for client-credentials login, with the secret in $ARCGIS_CLIENT_SECRET (default $ARCGIS_CLIENT_ID)")
+	fs.StringVar(&o.OAuthURL, "oauth-url", defaultOAuthURL, "OAuth2 token endpoint used with -client-id")
+	fs.StringVar(&o.APIKey, "api-key", "", "ArcGIS API key, sent as an X-Esri-Authorization bearer header (default $ARCGIS_API_KEY)")
+	fs.Var(&o.Headers, "header", "extra request header as \"Name: value\"; repeatable")
+	fs.StringVar(&o.UserAgent, "user-agent", "", "User-Agent sent with every request, to identify the client to the data publisher (default \"CY_project/<version> (+"+projectURL+")\")")
+	fs.StringVar(&o.Proxy, "proxy", "", "HTTP(S) proxy URL for all requests (default from HTTP_PROXY/HTTPS_PROXY/NO_PROXY)")
+	fs.StringVar(&o.CAFile, "ca-file", "", "PEM file of extra CA certificates to trust, e.g. for a TLS-intercepting proxy")
+	fs.BoolVar(&o.Insecure, "insecure", false, "skip TLS certificate verification (lab environments only)")
+	fs.StringVar(&o.ClientCert, "client-cert", "", "PEM client certificate for mutual TLS")
+	fs.StringVar(&o.ClientKey, "client-key", "", "PEM private key for -client-cert")
+	fs.DurationVar(&o.Timeout, "timeout", 2*time.Minute, "timeout for each HTTP request")
+	fs.Float64Var(&o.Rate, "rate", 0, "maximum requests per second across all workers (0 = unlimited)")
+	fs.BoolVar(&o.DebugHTTP, "debug-http", false, "log every request: the URL (without a token), status, timing and response size")
+	fs.StringVar(&o.DebugHTTPDir, "debug-http-dir", "", "save each response that fails, an HTTP error or an error object or body that cannot be decoded, to a file in this directory with the URL, status and headers")
+	fs.StringVar(&o.CacheDir, "cache-dir", "", "cache responses here and revalidate them with ETag/If-Modified-Since on later runs")
+}
+
+// registerQuery binds the flags that select which features are queried.
+// They are shared by the fetch run and the subcommands.
+func (o *Options) registerQuery(fs *flag.FlagSet) {
+	fs.StringVar(&o.Where, "where", "1=1", "server-side where clause, e.g. \"Sale_Price > 100000 AND Zip = '40202'\"")
+	fs.StringVar(&o.Since, "since", "", "only records with -date-field on or after this date (YYYY-MM-DD)")
+	fs.StringVar(&o.Until, "until", "", "only records with -date-field on or before this date (YYYY-MM-DD)")
+	fs.StringVar(&o.DateField, "date-field", "Action_Filed", "date field used by -since and -until")
+	fs.StringVar(&o.BBox, "bbox", "", "only features intersecting xmin,ymin,xmax,ymax")
+	fs.StringVar(&o.BBoxSR, "bbox-sr", "4326", "spatial reference (WKID) of the -bbox coordinates")
+	fs.StringVar(&o.Polygon, "polygon", "", "only features intersecting the polygons in this GeoJSON file")
+}
+
+// splitList splits a comma-separated flag value, trimming blanks.
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// listFlag is a repeatable string flag: every occurrence adds a value.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Partitioner decides which output file a record belongs to when the
+// extract is split with -split-by. It accepts either a plain field name
+// (e.g. "Zip") or a date function applied to a date field, such as
+// "year(Action_Filed)" or "month(Sale_Date)".
+type Partitioner struct {
+	Func  string // "", "year" or "month"
+	Field string
+}
+
+// parsePartitioner parses the -split-by expression.
+func parsePartitioner(spec string) (*Partitioner, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+
+	open := strings.Index(spec, "(")
+	if open < 0 {
+		return &Partitioner{Field: spec}, nil
+	}
+	if !strings.HasSuffix(spec, ")") {
+		return nil, fmt.Errorf("invalid partition expression %q", spec)
+	}
+
+	fn := strings.ToLower(strings.TrimSpace(spec[:open]))
+	field := strings.TrimSpace(spec[open+1 : len(spec)-1])
+	if field == "" {
+		return nil, fmt.Errorf("partition expression %q is missing a field", spec)
+	}
+	if fn != "year" && fn != "month" {
+		return nil, fmt.Errorf("unsupported partition function %q (use year or month)", fn)
+	}
+	return &Partitioner{Func: fn, Field: field}, nil
+}
+
+// Key returns the partition value for a record. Records with no value for
+// the partition field land in the "unknown" partition.
+func (p *Partitioner) Key(record map[string]interface{}, f *Formatter) string {
+	value := record[p.Field]
+
+	if p.Func != "" {
+		// Date fields arrive from the API as epoch milliseconds.
+		timestamp, ok := value.(float64)
+		if !ok || timestamp == 0 {
+			return "unknown"
+		}
+		t := time.UnixMilli(int64(timestamp)).In(f.Location)
+		if p.Func == "year" {
+			return t.Format("2006")
+		}
+		return t.Format("2006-01")
+	}
+
+	if value == nil {
+		return "unknown"
+	}
+	key := sanitizeFileComponent(f.formatValue(p.Field, value))
+	if key == "" {
+		return "unknown"
+	}
+	return key
+}
+
+// partitionLabel describes the partition expression, e.g. "year(Action_Filed)".
+func partitionLabel(p *Partitioner) string {
+	if p.Func == "" {
+		return p.Field
+	}
+	return p.Func + "(" + p.Field + ")"
+}
+
+// sanitizeFileComponent makes a partition value safe to use in a file name.
+func sanitizeFileComponent(s string) string {
+	s = strings.TrimSpace(s)
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '-' || r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
+
+// CSVDialect controls the low-level layout of the CSV files.
+type CSVDialect struct {
+	Comma         rune // field delimiter
+	QuoteAll      bool // quote every field, not just the ones that need it
+	UseCRLF       bool // terminate lines with \r\n as RFC 4180 specifies
+	RejectControl bool // refuse records containing control characters
+	BOM           bool // start each file with a UTF-8 byte order mark for Excel
+}
+
+// utf8BOM is the byte order mark Excel looks for to detect UTF-8 text.
+const utf8BOM = "\xEF\xBB\xBF"
+
+// parseDelimiter accepts a literal single-character delimiter or one of the
+// names tab, pipe, comma and semicolon.
+func parseDelimiter(s string) (rune, error) {
+	switch strings.ToLower(s) {
+	case "", ",", "comma":
+		return ',', nil
+	case "tab", `\t`, "\t":
+		return '\t', nil
+	case "pipe", "|":
+		return '|', nil
+	case "semicolon", ";":
+		return ';', nil
+	}
+
+	runes := []rune(s)
+	if len(runes) != 1 {
+		return 0, fmt.Errorf("delimiter %q must be a single character", s)
+	}
+	r := runes[0]
+	if r == '"' || r == '\r' || r == '\n' {
+		return 0, fmt.Errorf("delimiter %q cannot be a quote or line break", s)
+	}
+	return r, nil
+}
+
+// partialSuffix is added to the name of an output while it is written.
+// Only a run that succeeds renames its files into place (commitPartials),
+// so a crash or a failed run never leaves a truncated file where the
+// previous output was; an unfinished run's partial files are where
+// -resume carries on.
+const partialSuffix = ".partial"
+
+// openPartial opens the partial file of an output. With appending set it
+// continues the partial file an unfinished run left, or if that was
+// already renamed into place, a copy of the output.
+func openPartial(path string, appending bool) (*os.File, error) {
+	partial := path + partialSuffix
+	if !appending {
+		return os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o666)
+	}
+	if _, err := os.Stat(partial); errors.Is(err, os.ErrNotExist) {
+		if src, err := os.Open(path); err == nil {
+			defer src.Close()
+			dst, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o666)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := io.Copy(dst, src); err != nil {
+				dst.Close()
+				return nil, err
+			}
+			return dst, nil
+		}
+	}
+	return os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o666)
+}
+
+// commitPartials flushes the partial files of the given outputs to disk
+// and renames them into place. An output without one is skipped: a
+// resumed run lists the files of the run before it.
+func commitPartials(paths []string) error {
+	for _, path := range paths {
+		file, err := os.OpenFile(path+partialSuffix, os.O_WRONLY, 0)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = file.Sync()
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		// A -versioned run left a link to its output here; the link is
+		// replaced rather than the version it points to.
+		if err := os.Rename(path+partialSuffix, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unchangedPartials reports whether the partial file of every output holds
+// exactly the bytes of the file it would replace, previous(path).
+func unchangedPartials(paths []string, previous func(path string) string) bool {
+	for _, path := range paths {
+		got, err := fileSHA256(path + partialSuffix)
+		if err != nil {
+			return false
+		}
+		if want, err := fileSHA256(previous(path)); err != nil || want != got {
+			return false
+		}
+	}
+	return len(paths) > 0
+}
+
+// CSVOutput writes records to a single CSV file, or to one CSV file per
+// partition when a Partitioner is configured. Partition files are opened
+// lazily the first time a record for that partition is written, as
+// partial files (see partialSuffix) until commitPartials.
+type CSVOutput struct {
+	path        string
+	headers     []string
+	columns     []string // header line, if the columns are renamed
+	partitioner *Partitioner
+	formatter   *Formatter
+	dialect     CSVDialect
+	append      bool // add to existing files instead of replacing them (-resume)
+
+	files   map[string]*os.File
+	writers map[string]*csvWriter
+	order   []string
+	rows    map[string]int // records written to each file (path)
+}
+
+func newCSVOutput(path string, headers []string, partitioner *Partitioner, formatter *Formatter, dialect CSVDialect) *CSVOutput {
+	return &CSVOutput{
+		path:        path,
+		headers:     headers,
+		partitioner: partitioner,
+		formatter:   formatter,
+		dialect:     dialect,
+		files:       make(map[string]*os.File),
+		writers:     make(map[string]*csvWriter),
+		rows:        make(map[string]int),
+	}
+}
+
+// partitionPath returns the file name for a partition, e.g.
+// data/Louisville_Metro_KY_-_Property_Foreclosures_2023.csv.
+func (o *CSVOutput) partitionPath(key string) string {
+	if o.partitioner == nil {
+		return o.path
+	}
+	ext := filepath.Ext(o.path)
+	return strings.TrimSuffix(o.path, ext) + "_" + key + ext
+}
+
+func (o *CSVOutput) writer(key string) (*csvWriter, error) {
+	if w, ok := o.writers[key]; ok {
+		return w, nil
+	}
+
+	path := o.partitionPath(key)
+	file, err := openPartial(path, o.append)
+	if err != nil {
+		return nil, err
+	}
+
+	// A file being appended to already starts with the BOM and header.
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	fresh := info.Size() == 0
+
+	if o.dialect.BOM && fresh {
+		if _, err := file.WriteString(utf8BOM); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	w := newCSVWriter(file, o.dialect)
+	if fresh {
+		header := o.headers
+		if o.columns != nil {
+			header = o.columns
+		}
+		if err := w.Write(header, nil); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	o.files[key] = file
+	o.writers[key] = w
+	o.order = append(o.order, path)
+	return w, nil
+}
+
+// Write formats a record in header order and writes it to its file.
+func (o *CSVOutput) Write(record map[string]interface{}) error {
+	key := ""
+	if o.partitioner != nil {
+		key = o.partitioner.Key(record, o.formatter)
+	}
+
+	w, err := o.writer(key)
+	if err != nil {
+		return err
+	}
+
+	if err := w.Write(o.formatter.formatRow(o.headers, record)); err != nil {
+		return err
+	}
+	o.rows[o.partitionPath(key)]++
+	return nil
+}
+
+// Records is how many records were written to a file in this run.
+func (o *CSVOutput) Records(path string) int {
+	return o.rows[path]
+}
+
+// Paths lists the files written so far, in the order they were created,
+// by the names they have once committed.
+func (o *CSVOutput) Paths() []string {
+	return o.order
+}
+
+// Close flushes and closes every open file, returning the first error.
+func (o *CSVOutput) Close() error {
+	var firstErr error
+	for key, w := range o.writers {
+		if err := w.Flush(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := o.files[key].Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
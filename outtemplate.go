@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+	"time"
+)
+
+// outTemplateVars are the placeholders -out may contain. They are filled
+// in at the start of each run, the dates in the -tz zone:
+//
+//	-out "data/{dataset}/{yyyy}/{mm}/foreclosures_{yyyy-mm-dd}.csv"
+var outTemplateVars = map[string]func(v outTemplateValues) string{
+	"dataset":    func(v outTemplateValues) string { return v.dataset },
+	"layer":      func(v outTemplateValues) string { return v.layer },
+	"yyyy":       func(v outTemplateValues) string { return v.date.Format("2006") },
+	"mm":         func(v outTemplateValues) string { return v.date.Format("01") },
+	"dd":         func(v outTemplateValues) string { return v.date.Format("02") },
+	"hh":         func(v outTemplateValues) string { return v.date.Format("15") },
+	"yyyy-mm-dd": func(v outTemplateValues) string { return v.date.Format(time.DateOnly) },
+}
+
+// outTemplateValues are what the placeholders of -out stand for in a run.
+type outTemplateValues struct {
+	dataset string // the service, as -all-layers names its directory
+	layer   string // the layer's name
+	date    time.Time
+}
+
+// isOutTemplate reports whether an -out path has placeholders.
+func isOutTemplate(out string) bool {
+	return strings.Contains(out, "{")
+}
+
+// checkOutTemplate validates the placeholders of an -out path.
+func checkOutTemplate(out string) error {
+	_, err := expandOutTemplate(out, outTemplateValues{})
+	return err
+}
+
+// expandOutTemplate fills in the placeholders of an -out path.
+func expandOutTemplate(out string, v outTemplateValues) (string, error) {
+	var b strings.Builder
+	rest := out
+	for {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			break
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("%q: unclosed {", out)
+		}
+		name := rest[open+1 : open+end]
+		value, ok := outTemplateVars[name]
+		if !ok {
+			return "", fmt.Errorf("%q: unknown placeholder {%s}; want {dataset}, {layer}, {yyyy}, {mm}, {dd}, {hh} or {yyyy-mm-dd}", out, name)
+		}
+		b.WriteString(rest[:open])
+		b.WriteString(value(v))
+		rest = rest[open+end+1:]
+	}
+	b.WriteString(rest)
+	return b.String(), nil
+}
+
+// expandOut returns the output path of a run started at start, with the
+// placeholders of a -out template filled in. The layer metadata is only
+// read if the template names the layer.
+func (j *fetchJob) expandOut(ctx context.Context, start time.Time) string {
+	if !isOutTemplate(j.outputPath) {
+		return j.outputPath
+	}
+	v := outTemplateValues{
+		dataset: serviceFileName(j.query.URL),
+		date:    start.In(j.formatter.Location),
+	}
+	if strings.Contains(j.outputPath, "{layer}") {
+		// The layer id is the last part of the layer's URL.
+		v.layer = path.Base(layerURL(j.query.URL))
+		if info, err := fetchLayerInfo(ctx, j.client, j.query.URL); err != nil {
+			slog.Warn("could not read the layer name for -out; using its id", "layer", v.layer, "err", err)
+		} else {
+			v.layer = fileNamePart(info.Name, v.layer)
+		}
+	}
+	// The template was checked by newFetchJob.
+	out, _ := expandOutTemplate(j.outputPath, v)
+	return out
+}
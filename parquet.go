@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"time"
+)
+
+// The Parquet files written for -tee are as plain as the format allows
+// (https://parquet.apache.org/docs/file-format/): every column is
+// optional, PLAIN encoded and uncompressed, with one data page per column
+// in each row group. The metadata is Thrift in the compact protocol; the
+// field ids used are those of parquet.thrift.
+const (
+	parquetMagic        = "PAR1"
+	parquetRowGroupSize = 100000 // rows held in memory before a row group is written
+
+	parquetInt64     = 2 // physical types
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetUTF8            = 0 // converted types
+	parquetTimestampMillis = 9
+
+	parquetOptional     = 1 // repetition type
+	parquetPlain        = 0 // encodings
+	parquetRLE          = 3
+	parquetUncompressed = 0
+	parquetDataPage     = 0
+)
+
+// parquetOutput writes records to a Parquet file. Text columns hold the
+// CSV text; see columnKind for the typed ones.
+type parquetOutput struct {
+	file      *os.File
+	w         *bufio.Writer
+	offset    int64 // bytes written so far
+	headers   []string
+	columns   []string
+	kinds     []byte
+	formatter *Formatter
+
+	// The row group being collected: for each column, whether each row
+	// has a value, and the PLAIN encoded values.
+	present  [][]bool
+	values   []bytes.Buffer
+	rows     int
+	groups   []parquetRowGroup
+	rowsDone int64
+}
+
+type parquetRowGroup struct {
+	rows    int64
+	size    int64
+	columns []parquetChunk
+}
+
+type parquetChunk struct {
+	offset int64 // of the data page
+	size   int64 // page header and data
+	values int64
+}
+
+func createParquet(path string, headers, columns []string, f *Formatter) (*parquetOutput, error) {
+	file, err := openPartial(path, false)
+	if err != nil {
+		return nil, err
+	}
+	o := &parquetOutput{
+		file:      file,
+		w:         bufio.NewWriter(file),
+		headers:   headers,
+		columns:   columns,
+		formatter: f,
+		present:   make([][]bool, len(headers)),
+		values:    make([]bytes.Buffer, len(headers)),
+	}
+	for _, field := range headers {
+		o.kinds = append(o.kinds, f.columnKind(field))
+	}
+	o.write([]byte(parquetMagic))
+	return o, nil
+}
+
+func (o *parquetOutput) write(b []byte) {
+	o.w.Write(b)
+	o.offset += int64(len(b))
+}
+
+func (o *parquetOutput) Write(record map[string]interface{}) error {
+	for i, field := range o.headers {
+		v, ok := o.formatter.typedValue(field, o.kinds[i], record[field])
+		o.present[i] = append(o.present[i], ok)
+		if !ok {
+			continue
+		}
+		buf := &o.values[i]
+		switch v := v.(type) {
+		case string:
+			binary.Write(buf, binary.LittleEndian, uint32(len(v)))
+			buf.WriteString(v)
+		case float64:
+			binary.Write(buf, binary.LittleEndian, math.Float64bits(v))
+		case int64:
+			binary.Write(buf, binary.LittleEndian, v)
+		case time.Time:
+			binary.Write(buf, binary.LittleEndian, v.UnixMilli())
+		}
+	}
+	o.rows++
+	if o.rows == parquetRowGroupSize {
+		o.flush()
+	}
+	return nil
+}
+
+// flush writes the collected rows as a row group.
+func (o *parquetOutput) flush() {
+	group := parquetRowGroup{rows: int64(o.rows)}
+	for i := range o.headers {
+		// A page is the definition levels (1 for a value, 0 for a null)
+		// as one bit-packed run with a length prefix, then the values.
+		levels := parquetBitPacked(o.present[i])
+		page := binary.LittleEndian.AppendUint32(nil, uint32(len(levels)))
+		page = append(page, levels...)
+		page = append(page, o.values[i].Bytes()...)
+
+		var header thriftWriter
+		header.i32(1, parquetDataPage)
+		header.i32(2, int32(len(page)))
+		header.i32(3, int32(len(page)))
+		header.structBegin(5) // DataPageHeader
+		header.i32(1, int32(o.rows))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRLE)
+		header.i32(4, parquetRLE)
+		header.structEnd()
+		header.stop()
+
+		chunk := parquetChunk{offset: o.offset, size: int64(header.buf.Len() + len(page)), values: int64(o.rows)}
+		o.write(header.buf.Bytes())
+		o.write(page)
+		group.columns = append(group.columns, chunk)
+		group.size += chunk.size
+
+		o.present[i] = o.present[i][:0]
+		o.values[i].Reset()
+	}
+	o.groups = append(o.groups, group)
+	o.rowsDone += int64(o.rows)
+	o.rows = 0
+}
+
+// parquetBitPacked encodes levels of bit width 1 as one bit-packed run of
+// the RLE/bit-packing hybrid encoding, padded to a multiple of 8.
+func parquetBitPacked(levels []bool) []byte {
+	groups := (len(levels) + 7) / 8
+	out := binary.AppendUvarint(nil, uint64(groups)<<1|1)
+	packed := make([]byte, groups)
+	for i, set := range levels {
+		if set {
+			packed[i/8] |= 1 << (i % 8)
+		}
+	}
+	return append(out, packed...)
+}
+
+// Close writes the last row group and the footer.
+func (o *parquetOutput) Close() error {
+	if o.rows > 0 {
+		o.flush()
+	}
+
+	var meta thriftWriter
+	meta.i32(1, 1) // version
+	meta.listBegin(2, thriftStruct, len(o.headers)+1)
+	meta.elemBegin() // the root of the schema
+	meta.binary(4, "schema")
+	meta.i32(5, int32(len(o.headers)))
+	meta.elemEnd()
+	for i, name := range o.columns {
+		meta.elemBegin()
+		meta.i32(1, parquetPhysicalType(o.kinds[i]))
+		meta.i32(3, parquetOptional)
+		meta.binary(4, name)
+		switch o.kinds[i] {
+		case kindTime:
+			meta.i32(6, parquetTimestampMillis)
+		case kindText:
+			meta.i32(6, parquetUTF8)
+		}
+		meta.elemEnd()
+	}
+	meta.i64(3, o.rowsDone)
+	meta.listBegin(4, thriftStruct, len(o.groups))
+	for _, group := range o.groups {
+		meta.elemBegin()
+		meta.listBegin(1, thriftStruct, len(group.columns))
+		for i, chunk := range group.columns {
+			meta.elemBegin()
+			meta.i64(2, chunk.offset)
+			meta.structBegin(3) // ColumnMetaData
+			meta.i32(1, parquetPhysicalType(o.kinds[i]))
+			meta.listBegin(2, thriftI32, 2)
+			meta.elemI32(parquetPlain)
+			meta.elemI32(parquetRLE)
+			meta.listBegin(3, thriftBinary, 1)
+			meta.elemBinary(o.columns[i])
+			meta.i32(4, parquetUncompressed)
+			meta.i64(5, chunk.values)
+			meta.i64(6, chunk.size)
+			meta.i64(7, chunk.size)
+			meta.i64(9, chunk.offset)
+			meta.structEnd()
+			meta.elemEnd()
+		}
+		meta.i64(2, group.size)
+		meta.i64(3, group.rows)
+		meta.elemEnd()
+	}
+	meta.binary(6, "CY_project fetchData")
+	meta.stop()
+
+	o.write(meta.buf.Bytes())
+	o.write(binary.LittleEndian.AppendUint32(nil, uint32(meta.buf.Len())))
+	o.write([]byte(parquetMagic))
+	err := o.w.Flush()
+	if cerr := o.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func parquetPhysicalType(kind byte) int32 {
+	switch kind {
+	case kindNumber:
+		return parquetDouble
+	case kindInt, kindTime:
+		return parquetInt64
+	}
+	return parquetByteArray
+}
+
+// Thrift compact protocol types.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes a struct in the Thrift compact protocol. Fields
+// have to be written in increasing id order, which the short field
+// headers rely on.
+type thriftWriter struct {
+	buf   bytes.Buffer
+	last  int16   // id of the previous field of the current struct
+	stack []int16 // of the enclosing structs
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	if delta := id - t.last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.varint(int64(id))
+	}
+	t.last = id
+}
+
+// varint writes a zigzag varint.
+func (t *thriftWriter) varint(v int64) {
+	t.buf.Write(binary.AppendUvarint(nil, uint64(v<<1^v>>63)))
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(v)
+}
+
+func (t *thriftWriter) binary(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.elemBinary(s)
+}
+
+func (t *thriftWriter) elemBinary(s string) {
+	t.buf.Write(binary.AppendUvarint(nil, uint64(len(s))))
+	t.buf.WriteString(s)
+}
+
+func (t *thriftWriter) elemI32(v int32) { t.varint(int64(v)) }
+
+func (t *thriftWriter) listBegin(id int16, elem byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n)<<4 | elem)
+		return
+	}
+	t.buf.WriteByte(0xf0 | elem)
+	t.buf.Write(binary.AppendUvarint(nil, uint64(n)))
+}
+
+// structBegin starts a struct field; elemBegin starts a struct in a list.
+func (t *thriftWriter) structBegin(id int16) {
+	t.field(id, thriftStruct)
+	t.elemBegin()
+}
+
+func (t *thriftWriter) elemBegin() {
+	t.stack = append(t.stack, t.last)
+	t.last = 0
+}
+
+func (t *thriftWriter) structEnd() { t.elemEnd() }
+
+func (t *thriftWriter) elemEnd() {
+	t.stop()
+	t.last = t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+}
+
+// stop ends the current struct.
+func (t *thriftWriter) stop() { t.buf.WriteByte(0) }
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// The f=pbf query format is the esriPBuffer FeatureCollectionPBuffer
+// message
+// (https://github.com/Esri/arcgis-pbf/tree/main/proto/FeatureCollection).
+// Only the parts a query of attributes and points needs are decoded; the
+// field numbers used are listed here.
+const (
+	pbfQueryResult   = 2  // FeatureCollectionPBuffer.queryResult
+	pbfFeatureResult = 1  // QueryResult.featureResult
+	pbfExceeded      = 9  // FeatureResult.exceededTransferLimit
+	pbfTransform     = 12 // FeatureResult.transform
+	pbfFields        = 13 // FeatureResult.fields
+	pbfFeatures      = 15 // FeatureResult.features
+)
+
+// Protocol Buffers wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// pbfTransformValues converts quantized coordinates back to the spatial
+// reference of the query.
+type pbfTransformValues struct {
+	upperLeft              bool // y grows downwards from the origin
+	xScale, yScale         float64
+	xTranslate, yTranslate float64
+}
+
+// decodePBF decodes a f=pbf query response, calling visit for each feature
+// like decodeFeatures. Attribute values are converted to the types the
+// JSON format gives them: numbers (dates included) as float64.
+func decodePBF(r io.Reader, visit func(attrs map[string]interface{}, geometry *Geometry)) (bool, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return false, err
+	}
+	// Errors come back as JSON whatever the requested format.
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		return false, decodeResponse(trimmed, &struct{}{})
+	}
+
+	result, err := pbfField(data, pbfQueryResult)
+	if err != nil || result == nil {
+		return false, pbfError(err, "no query result")
+	}
+	features, err := pbfField(result, pbfFeatureResult)
+	if err != nil || features == nil {
+		return false, pbfError(err, "no feature result")
+	}
+
+	var fields []string
+	var encoded [][]byte
+	var exceeded bool
+	transform := pbfTransformValues{xScale: 1, yScale: 1}
+	m := pbfMessage{b: features}
+	for !m.done() {
+		num, typ, err := m.key()
+		if err != nil {
+			return false, pbfError(err, "")
+		}
+		if num == pbfExceeded && typ == wireVarint {
+			v, err := m.varint()
+			if err != nil {
+				return false, pbfError(err, "")
+			}
+			exceeded = v != 0
+			continue
+		}
+		if typ != wireBytes {
+			if err := m.skip(typ); err != nil {
+				return false, pbfError(err, "")
+			}
+			continue
+		}
+		b, err := m.bytes()
+		if err != nil {
+			return false, pbfError(err, "")
+		}
+		switch num {
+		case pbfFields:
+			name, err := pbfField(b, 1)
+			if err != nil {
+				return false, pbfError(err, "")
+			}
+			fields = append(fields, string(name))
+		case pbfTransform:
+			if transform, err = decodePBFTransform(b); err != nil {
+				return false, pbfError(err, "")
+			}
+		case pbfFeatures:
+			// Decoded once every field is known.
+			encoded = append(encoded, b)
+		}
+	}
+
+	for _, b := range encoded {
+		attrs, geometry, err := decodePBFFeature(b, fields, transform)
+		if err != nil {
+			return false, pbfError(err, "")
+		}
+		visit(attrs, geometry)
+	}
+	return exceeded, nil
+}
+
+func pbfError(err error, msg string) error {
+	if err == nil {
+		err = errors.New(msg)
+	}
+	return fmt.Errorf("pbf response: %w", err)
+}
+
+// decodePBFFeature decodes a Feature: its attributes, in field order, and
+// the first point of its geometry.
+func decodePBFFeature(b []byte, fields []string, t pbfTransformValues) (map[string]interface{}, *Geometry, error) {
+	attrs := make(map[string]interface{}, len(fields))
+	var geometry *Geometry
+	i := 0
+	m := pbfMessage{b: b}
+	for !m.done() {
+		num, typ, err := m.key()
+		if err != nil {
+			return nil, nil, err
+		}
+		if typ != wireBytes {
+			if err := m.skip(typ); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		v, err := m.bytes()
+		if err != nil {
+			return nil, nil, err
+		}
+		switch num {
+		case 1: // attributes
+			value, err := decodePBFValue(v)
+			if err != nil {
+				return nil, nil, err
+			}
+			if i < len(fields) {
+				attrs[fields[i]] = value
+			}
+			i++
+		case 2: // geometry
+			if geometry, err = decodePBFPoint(v, t); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return attrs, geometry, nil
+}
+
+// decodePBFValue decodes a Value. An empty Value is a null.
+func decodePBFValue(b []byte) (interface{}, error) {
+	m := pbfMessage{b: b}
+	var value interface{}
+	for !m.done() {
+		num, typ, err := m.key()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case num == 1 && typ == wireBytes: // string_value
+			s, err := m.bytes()
+			if err != nil {
+				return nil, err
+			}
+			value = string(s)
+		case num == 2 && typ == wireFixed32: // float_value
+			u, err := m.fixed32()
+			if err != nil {
+				return nil, err
+			}
+			// The shortest decimal that reads back as the float32, as the
+			// JSON format writes an esriFieldTypeSingle, rather than the
+			// float32 widened digit for digit.
+			f := strconv.FormatFloat(float64(math.Float32frombits(u)), 'g', -1, 32)
+			value, _ = strconv.ParseFloat(f, 64)
+		case num == 3 && typ == wireFixed64: // double_value
+			u, err := m.fixed64()
+			if err != nil {
+				return nil, err
+			}
+			value = math.Float64frombits(u)
+		case typ == wireVarint && num >= 4 && num <= 9:
+			u, err := m.varint()
+			if err != nil {
+				return nil, err
+			}
+			switch num {
+			case 4, 8: // sint_value, sint64_value (zigzag)
+				value = float64(int64(u>>1) ^ -int64(u&1))
+			case 5, 7: // uint_value, uint64_value
+				value = float64(u)
+			case 6: // int64_value
+				value = float64(int64(u))
+			case 9: // bool_value
+				value = u != 0
+			}
+		default:
+			if err := m.skip(typ); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return value, nil
+}
+
+// decodePBFPoint decodes the first vertex of a Geometry: its coords are
+// zigzag-encoded deltas from the previous vertex, the first from zero.
+func decodePBFPoint(b []byte, t pbfTransformValues) (*Geometry, error) {
+	m := pbfMessage{b: b}
+	for !m.done() {
+		num, typ, err := m.key()
+		if err != nil {
+			return nil, err
+		}
+		if num != 3 || typ != wireBytes {
+			if err := m.skip(typ); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		packed, err := m.bytes()
+		if err != nil {
+			return nil, err
+		}
+		coords := pbfMessage{b: packed}
+		ux, err := coords.varint()
+		if err != nil {
+			return nil, err
+		}
+		uy, err := coords.varint()
+		if err != nil {
+			return nil, err
+		}
+		qx, qy := float64(int64(ux>>1)^-int64(ux&1)), float64(int64(uy>>1)^-int64(uy&1))
+		x := qx*t.xScale + t.xTranslate
+		y := qy*t.yScale + t.yTranslate
+		if t.upperLeft {
+			y = t.yTranslate - qy*t.yScale
+		}
+		return &Geometry{X: &x, Y: &y}, nil
+	}
+	return nil, nil
+}
+
+// decodePBFTransform decodes the Transform that quantized the coordinates.
+// The origin is upper left unless the message says otherwise, since that
+// is the enum's zero value and so not encoded.
+func decodePBFTransform(b []byte) (pbfTransformValues, error) {
+	t := pbfTransformValues{upperLeft: true, xScale: 1, yScale: 1}
+	m := pbfMessage{b: b}
+	for !m.done() {
+		num, typ, err := m.key()
+		if err != nil {
+			return t, err
+		}
+		switch {
+		case num == 1 && typ == wireVarint: // quantizeOriginPostion
+			u, err := m.varint()
+			if err != nil {
+				return t, err
+			}
+			t.upperLeft = u == 0
+		case (num == 2 || num == 3) && typ == wireBytes: // scale, translate
+			v, err := m.bytes()
+			if err != nil {
+				return t, err
+			}
+			x, y, err := pbfXY(v)
+			if err != nil {
+				return t, err
+			}
+			if num == 2 {
+				t.xScale, t.yScale = x, y
+			} else {
+				t.xTranslate, t.yTranslate = x, y
+			}
+		default:
+			if err := m.skip(typ); err != nil {
+				return t, err
+			}
+		}
+	}
+	return t, nil
+}
+
+// pbfXY decodes the x and y doubles (fields 1 and 2) of a Scale or
+// Translate.
+func pbfXY(b []byte) (x, y float64, err error) {
+	m := pbfMessage{b: b}
+	for !m.done() {
+		num, typ, err := m.key()
+		if err != nil {
+			return 0, 0, err
+		}
+		if (num != 1 && num != 2) || typ != wireFixed64 {
+			if err := m.skip(typ); err != nil {
+				return 0, 0, err
+			}
+			continue
+		}
+		u, err := m.fixed64()
+		if err != nil {
+			return 0, 0, err
+		}
+		if num == 1 {
+			x = math.Float64frombits(u)
+		} else {
+			y = math.Float64frombits(u)
+		}
+	}
+	return x, y, nil
+}
+
+// pbfField returns the first length-delimited field num of a message, or
+// nil if it has none.
+func pbfField(b []byte, num int) ([]byte, error) {
+	m := pbfMessage{b: b}
+	for !m.done() {
+		n, typ, err := m.key()
+		if err != nil {
+			return nil, err
+		}
+		if n == num && typ == wireBytes {
+			return m.bytes()
+		}
+		if err := m.skip(typ); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+var errPBFTruncated = errors.New("truncated message")
+
+// pbfMessage reads the fields of an encoded Protocol Buffers message.
+type pbfMessage struct {
+	b []byte
+	i int
+}
+
+func (m *pbfMessage) done() bool { return m.i >= len(m.b) }
+
+func (m *pbfMessage) key() (num int, typ int, err error) {
+	u, err := m.varint()
+	return int(u >> 3), int(u & 7), err
+}
+
+func (m *pbfMessage) varint() (uint64, error) {
+	u, n := binary.Uvarint(m.b[m.i:])
+	if n <= 0 {
+		return 0, errPBFTruncated
+	}
+	m.i += n
+	return u, nil
+}
+
+func (m *pbfMessage) bytes() ([]byte, error) {
+	n, err := m.varint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(m.b)-m.i) {
+		return nil, errPBFTruncated
+	}
+	b := m.b[m.i : m.i+int(n)]
+	m.i += int(n)
+	return b, nil
+}
+
+func (m *pbfMessage) fixed32() (uint32, error) {
+	if len(m.b)-m.i < 4 {
+		return 0, errPBFTruncated
+	}
+	u := binary.LittleEndian.Uint32(m.b[m.i:])
+	m.i += 4
+	return u, nil
+}
+
+func (m *pbfMessage) fixed64() (uint64, error) {
+	if len(m.b)-m.i < 8 {
+		return 0, errPBFTruncated
+	}
+	u := binary.LittleEndian.Uint64(m.b[m.i:])
+	m.i += 8
+	return u, nil
+}
+
+// skip passes over a field of the given wire type.
+func (m *pbfMessage) skip(typ int) error {
+	var err error
+	switch typ {
+	case wireVarint:
+		_, err = m.varint()
+	case wireFixed64:
+		_, err = m.fixed64()
+	case wireBytes:
+		_, err = m.bytes()
+	case wireFixed32:
+		_, err = m.fixed32()
+	default:
+		err = fmt.Errorf("unsupported wire type %d", typ)
+	}
+	return err
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func TestDecodePBFValueSingle(t *testing.T) {
+	// Value.float_value (field 2, fixed32) holding float32(1.1).
+	b := []byte{2<<3 | wireFixed32, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(b[1:], math.Float32bits(1.1))
+	v, err := decodePBFValue(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 1.1 {
+		t.Errorf("got %v, want 1.1 as the JSON format sends it", v)
+	}
+}
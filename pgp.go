@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// OpenPGP packet tags and algorithm IDs (RFC 4880, RFC 6637).
+const (
+	pgpTagPKESK     = 1
+	pgpTagSignature = 2
+	pgpTagPublicKey = 6
+	pgpTagLiteral   = 11
+	pgpTagSubkey    = 14
+	pgpTagSEIPD     = 18
+
+	pgpAlgoRSA        = 1
+	pgpAlgoRSAEncrypt = 2
+	pgpAlgoECDH       = 18
+
+	pgpAES256 = 9
+)
+
+// curve25519OID identifies Curve25519 ECDH keys; other curves are not
+// supported.
+var curve25519OID = []byte{0x2b, 0x06, 0x01, 0x04, 0x01, 0x97, 0x55, 0x01, 0x05, 0x01}
+
+// pgpRecipient is the encryption key of an OpenPGP public key: an RSA or
+// Curve25519 (cv25519) primary key or subkey.
+type pgpRecipient struct {
+	owner       string // user ID, for messages
+	fingerprint []byte // v4, 20 bytes; the key ID is its last 8
+	algo        byte
+
+	rsa *rsa.PublicKey
+
+	point      []byte // ECDH: the 32-byte X25519 public key
+	kdfHash    byte
+	kdfCipher  byte
+	kdfParamsB []byte // ECDH: the KDF parameters as encoded in the key
+}
+
+// pgpPacket is one packet of an OpenPGP message.
+type pgpPacket struct {
+	tag  byte
+	body []byte
+}
+
+// parsePGPKey reads an exported public key, armored or binary, and picks
+// the key to encrypt to: the newest subkey that may encrypt and has not
+// expired or been revoked, or the primary key if it has none.
+func parsePGPKey(data []byte) (*pgpRecipient, error) {
+	if bytes.Contains(data, []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----")) {
+		var err error
+		if data, err = pgpDearmor(data); err != nil {
+			return nil, err
+		}
+	}
+	packets, err := pgpPackets(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(packets) == 0 || packets[0].tag != pgpTagPublicKey {
+		return nil, errors.New("not an OpenPGP public key")
+	}
+
+	// Each key is followed by its signatures; the key flags and expiry
+	// come from the self-signatures and subkey binding signatures.
+	type candidate struct {
+		key      *pgpRecipient
+		created  time.Time
+		flags    int // -1 if no signature gave key flags
+		expires  time.Time
+		revoked  bool
+		isSubkey bool
+	}
+	var keys []*candidate
+	owner := ""
+	for _, p := range packets {
+		switch p.tag {
+		case pgpTagPublicKey, pgpTagSubkey:
+			key, created, err := parsePGPPublicKey(p.body)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, &candidate{key: key, created: created, flags: -1, isSubkey: p.tag == pgpTagSubkey})
+		case 13: // user ID
+			if owner == "" {
+				owner = string(p.body)
+			}
+		case pgpTagSignature:
+			c := keys[len(keys)-1]
+			sigType, flags, lifetime, ok := parsePGPSignature(p.body)
+			if !ok {
+				continue
+			}
+			switch {
+			case sigType == 0x20 || sigType == 0x28:
+				c.revoked = true
+			case sigType == 0x18 || (!c.isSubkey && sigType >= 0x10 && sigType <= 0x13):
+				if flags >= 0 {
+					c.flags = flags
+				}
+				if lifetime > 0 {
+					c.expires = c.created.Add(time.Duration(lifetime) * time.Second)
+				}
+			}
+		}
+	}
+	if keys[0].revoked {
+		return nil, errors.New("the key has been revoked")
+	}
+
+	var best *candidate
+	for _, c := range keys {
+		canEncrypt := c.key.algo == pgpAlgoRSA || c.key.algo == pgpAlgoRSAEncrypt || c.key.algo == pgpAlgoECDH
+		if c.flags >= 0 {
+			canEncrypt = canEncrypt && c.flags&0x0c != 0
+		}
+		expired := !c.expires.IsZero() && time.Now().After(c.expires)
+		if !canEncrypt || c.revoked || expired || c.key.algo == 0 {
+			continue
+		}
+		if best == nil || (c.isSubkey && !best.isSubkey) || (c.isSubkey == best.isSubkey && c.created.After(best.created)) {
+			best = c
+		}
+	}
+	if best == nil {
+		return nil, errors.New("the key has no usable RSA or Curve25519 encryption key")
+	}
+	best.key.owner = owner
+	return best.key, nil
+}
+
+// pgpDearmor decodes ASCII armor, ignoring the headers and the CRC line.
+func pgpDearmor(data []byte) ([]byte, error) {
+	text := string(data)
+	_, text, _ = strings.Cut(text, "-----BEGIN PGP PUBLIC KEY BLOCK-----")
+	text, _, ok := strings.Cut(text, "-----END PGP PUBLIC KEY BLOCK-----")
+	if !ok {
+		return nil, errors.New("truncated armor")
+	}
+	var b64 strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "=") {
+			break // the checksum
+		}
+		// Armor headers have a colon, which base64 does not.
+		if !strings.Contains(line, ":") {
+			b64.WriteString(line)
+		}
+	}
+	return base64.StdEncoding.DecodeString(b64.String())
+}
+
+// pgpPackets splits a binary OpenPGP message into packets.
+func pgpPackets(data []byte) ([]pgpPacket, error) {
+	var packets []pgpPacket
+	for len(data) > 0 {
+		b := data[0]
+		if b&0x80 == 0 {
+			return nil, errors.New("invalid OpenPGP packet")
+		}
+		var tag byte
+		var length, hdr int
+		if b&0x40 != 0 { // new format
+			tag = b & 0x3f
+			if len(data) < 2 {
+				return nil, errors.New("truncated OpenPGP packet")
+			}
+			switch l := int(data[1]); {
+			case l < 192:
+				length, hdr = l, 2
+			case l < 224 && len(data) >= 3:
+				length, hdr = (l-192)<<8+int(data[2])+192, 3
+			case l == 255 && len(data) >= 6:
+				length, hdr = int(binary.BigEndian.Uint32(data[2:6])), 6
+			default:
+				return nil, errors.New("unsupported OpenPGP packet length")
+			}
+		} else { // old format
+			tag = (b >> 2) & 0x0f
+			switch b & 3 {
+			case 0:
+				if len(data) >= 2 {
+					length, hdr = int(data[1]), 2
+				}
+			case 1:
+				if len(data) >= 3 {
+					length, hdr = int(binary.BigEndian.Uint16(data[1:3])), 3
+				}
+			case 2:
+				if len(data) >= 5 {
+					length, hdr = int(binary.BigEndian.Uint32(data[1:5])), 5
+				}
+			case 3:
+				length, hdr = len(data)-1, 1
+			}
+		}
+		if hdr == 0 || hdr+length > len(data) {
+			return nil, errors.New("truncated OpenPGP packet")
+		}
+		packets = append(packets, pgpPacket{tag: tag, body: data[hdr : hdr+length]})
+		data = data[hdr+length:]
+	}
+	return packets, nil
+}
+
+// parsePGPPublicKey reads a v4 public key or subkey packet. Keys with
+// algorithms that cannot be encrypted to have algo 0.
+func parsePGPPublicKey(body []byte) (*pgpRecipient, time.Time, error) {
+	if len(body) < 6 || body[0] != 4 {
+		return nil, time.Time{}, errors.New("only version 4 OpenPGP keys are supported")
+	}
+	h := sha1.New()
+	h.Write([]byte{0x99, byte(len(body) >> 8), byte(len(body))})
+	h.Write(body)
+	key := &pgpRecipient{fingerprint: h.Sum(nil)}
+	created := time.Unix(int64(binary.BigEndian.Uint32(body[1:5])), 0)
+	rest := body[6:]
+	switch body[5] {
+	case pgpAlgoRSA, pgpAlgoRSAEncrypt:
+		n, rest, ok := readMPI(rest)
+		e, _, ok2 := readMPI(rest)
+		if !ok || !ok2 || len(e) > 4 {
+			return nil, created, errors.New("malformed RSA key")
+		}
+		key.algo = body[5]
+		key.rsa = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case pgpAlgoECDH:
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return nil, created, errors.New("malformed ECDH key")
+		}
+		oid := rest[1 : 1+int(rest[0])]
+		point, kdf, ok := readMPI(rest[1+int(rest[0]):])
+		if !ok || len(kdf) < 4 || kdf[0] != 3 || kdf[1] != 1 {
+			return nil, created, errors.New("malformed ECDH key")
+		}
+		if !bytes.Equal(oid, curve25519OID) || len(point) != 33 || point[0] != 0x40 {
+			break // another curve
+		}
+		key.algo = pgpAlgoECDH
+		key.point = point[1:]
+		key.kdfHash, key.kdfCipher = kdf[2], kdf[3]
+		key.kdfParamsB = append(append([]byte{byte(len(oid))}, oid...), pgpAlgoECDH)
+		key.kdfParamsB = append(key.kdfParamsB, kdf[:4]...)
+	}
+	return key, created, nil
+}
+
+// parsePGPSignature reads the type of a v4 signature and the key flags
+// and key lifetime (seconds, 0 for none) from its hashed subpackets.
+func parsePGPSignature(body []byte) (sigType byte, flags int, lifetime uint32, ok bool) {
+	if len(body) < 6 || body[0] != 4 {
+		return 0, 0, 0, false
+	}
+	sigType, flags = body[1], -1
+	n := int(binary.BigEndian.Uint16(body[4:6]))
+	if 6+n > len(body) {
+		return 0, 0, 0, false
+	}
+	sub := body[6 : 6+n]
+	for len(sub) > 0 {
+		var length, hdr int
+		switch l := int(sub[0]); {
+		case l < 192:
+			length, hdr = l, 1
+		case l < 255 && len(sub) >= 2:
+			length, hdr = (l-192)<<8+int(sub[1])+192, 2
+		case len(sub) >= 5:
+			length, hdr = int(binary.BigEndian.Uint32(sub[1:5])), 5
+		default:
+			return sigType, flags, lifetime, true
+		}
+		if length == 0 || hdr+length > len(sub) {
+			break
+		}
+		data := sub[hdr+1 : hdr+length]
+		switch sub[hdr] & 0x7f {
+		case 9: // key expiration time
+			if len(data) == 4 {
+				lifetime = binary.BigEndian.Uint32(data)
+			}
+		case 27: // key flags
+			if len(data) > 0 {
+				flags = int(data[0])
+			}
+		}
+		sub = sub[hdr+length:]
+	}
+	return sigType, flags, lifetime, true
+}
+
+func readMPI(b []byte) (value, rest []byte, ok bool) {
+	if len(b) < 2 {
+		return nil, nil, false
+	}
+	n := (int(binary.BigEndian.Uint16(b)) + 7) / 8
+	if 2+n > len(b) {
+		return nil, nil, false
+	}
+	return b[2 : 2+n], b[2+n:], true
+}
+
+func writeMPI(b []byte) []byte {
+	b = bytes.TrimLeft(b, "\x00")
+	bitLen := 0
+	if len(b) > 0 {
+		bitLen = 8*(len(b)-1) + big.NewInt(int64(b[0])).BitLen()
+	}
+	return append([]byte{byte(bitLen >> 8), byte(bitLen)}, b...)
+}
+
+// pgpPacketHeader is a new-format header with a five-octet length.
+func pgpPacketHeader(tag byte, length int) []byte {
+	h := []byte{0xc0 | tag, 0xff, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(h[2:], uint32(length))
+	return h
+}
+
+// encryptPGP writes src, a file of size bytes, as an OpenPGP message for
+// the recipients: one session key packet each, then the file as a
+// literal data packet in an AES-256 integrity-protected data packet,
+// which every current OpenPGP implementation reads.
+func encryptPGP(w io.Writer, src io.Reader, size int64, name string, recipients []*pgpRecipient) error {
+	sessionKey := make([]byte, 32)
+	rand.Read(sessionKey)
+	var sum uint16
+	for _, b := range sessionKey {
+		sum += uint16(b)
+	}
+	message := append(append([]byte{pgpAES256}, sessionKey...), byte(sum>>8), byte(sum))
+
+	for _, r := range recipients {
+		body := append([]byte{3}, r.fingerprint[12:]...)
+		body = append(body, r.algo)
+		switch r.algo {
+		case pgpAlgoRSA, pgpAlgoRSAEncrypt:
+			c, err := rsa.EncryptPKCS1v15(rand.Reader, r.rsa, message)
+			if err != nil {
+				return err
+			}
+			body = append(body, writeMPI(c)...)
+		case pgpAlgoECDH:
+			ephemeral, wrapped, err := r.wrapECDH(message)
+			if err != nil {
+				return err
+			}
+			body = append(body, writeMPI(append([]byte{0x40}, ephemeral...))...)
+			body = append(body, byte(len(wrapped)))
+			body = append(body, wrapped...)
+		}
+		if _, err := w.Write(append(pgpPacketHeader(pgpTagPKESK, len(body)), body...)); err != nil {
+			return err
+		}
+	}
+
+	// Packet lengths are 32 bits.
+	if size > 1<<32-1024 {
+		return errors.New("file too large for OpenPGP encryption")
+	}
+	name = filepath.Base(name)
+	if len(name) > 255 {
+		name = name[:255]
+	}
+	literalLen := 2 + len(name) + 4 + int(size)
+	literalHdr := pgpPacketHeader(pgpTagLiteral, literalLen)
+	inner := 18 + len(literalHdr) + literalLen + 22 // prefix, literal packet, MDC packet
+	if _, err := w.Write(append(pgpPacketHeader(pgpTagSEIPD, 1+inner), 1)); err != nil {
+		return err
+	}
+
+	block, err := aes.NewCipher(sessionKey)
+	if err != nil {
+		return err
+	}
+	enc := &cfbWriter{w: w, block: block, register: make([]byte, block.BlockSize())}
+	mdc := sha1.New()
+	plain := io.MultiWriter(mdc, enc)
+
+	// A random block with its last two octets repeated, then the packets.
+	prefix := make([]byte, 18)
+	rand.Read(prefix[:16])
+	prefix[16], prefix[17] = prefix[14], prefix[15]
+	plain.Write(prefix)
+	plain.Write(literalHdr)
+	plain.Write(append([]byte{'b', byte(len(name))}, name...))
+	plain.Write([]byte{0, 0, 0, 0}) // no date
+	if n, err := io.Copy(plain, src); err != nil {
+		return err
+	} else if n != size {
+		return fmt.Errorf("%s changed size while it was encrypted", name)
+	}
+	plain.Write([]byte{0xd3, 0x14}) // modification detection code packet
+	enc.Write(mdc.Sum(nil))
+	return enc.err
+}
+
+// wrapECDH encrypts the session key message for a Curve25519 key
+// (RFC 6637): AES key wrap with a key derived from an X25519 exchange.
+func (r *pgpRecipient) wrapECDH(message []byte) (ephemeral, wrapped []byte, err error) {
+	pub, err := ecdh.X25519().NewPublicKey(r.point)
+	if err != nil {
+		return nil, nil, err
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var newHash func() hash.Hash
+	switch r.kdfHash {
+	case 8:
+		newHash = sha256.New
+	case 9:
+		newHash = sha512.New384
+	case 10:
+		newHash = sha512.New
+	default:
+		return nil, nil, fmt.Errorf("unsupported ECDH KDF hash %d", r.kdfHash)
+	}
+	keyLen := map[byte]int{7: 16, 8: 24, 9: 32}[r.kdfCipher]
+	if keyLen == 0 {
+		return nil, nil, fmt.Errorf("unsupported ECDH key wrap cipher %d", r.kdfCipher)
+	}
+	h := newHash()
+	h.Write([]byte{0, 0, 0, 1})
+	h.Write(shared)
+	h.Write(r.kdfParamsB)
+	h.Write([]byte("Anonymous Sender    "))
+	h.Write(r.fingerprint)
+	kek, err := aes.NewCipher(h.Sum(nil)[:keyLen])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// PKCS #5 padding to a multiple of 8 octets, then RFC 3394 key wrap.
+	pad := 8 - len(message)%8
+	padded := append(append([]byte(nil), message...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	return priv.PublicKey().Bytes(), aesKeyWrap(kek, padded), nil
+}
+
+// aesKeyWrap implements the RFC 3394 key wrap.
+func aesKeyWrap(kek cipher.Block, plaintext []byte) []byte {
+	n := len(plaintext) / 8
+	out := make([]byte, 8+len(plaintext))
+	a := out[:8]
+	for i := range a {
+		a[i] = 0xa6
+	}
+	copy(out[8:], plaintext)
+	var b [16]byte
+	for j := range 6 {
+		for i := 1; i <= n; i++ {
+			copy(b[:8], a)
+			copy(b[8:], out[8*i:8*i+8])
+			kek.Encrypt(b[:], b[:])
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(b[:8])^t)
+			copy(out[8*i:], b[8:])
+		}
+	}
+	return out
+}
+
+// cfbWriter encrypts in CFB mode with a zero IV, as the integrity
+// protected data packet uses it.
+type cfbWriter struct {
+	w        io.Writer
+	block    cipher.Block
+	register []byte // the last ciphertext block
+	stream   [16]byte
+	pos      int // bytes of the current block written
+	buf      []byte
+	err      error
+}
+
+func (c *cfbWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	c.buf = c.buf[:0]
+	for _, b := range p {
+		if c.pos == 0 {
+			c.block.Encrypt(c.stream[:], c.register)
+		}
+		x := b ^ c.stream[c.pos]
+		c.register[c.pos] = x
+		c.buf = append(c.buf, x)
+		c.pos = (c.pos + 1) % len(c.register)
+	}
+	if _, err := c.w.Write(c.buf); err != nil {
+		c.err = err
+		return 0, err
+	}
+	return len(p), nil
+}
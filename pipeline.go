@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fetchPlan describes the pages a run fetches.
+type fetchPlan struct {
+	client    *Client
+	query     *Query
+	limiter   *aimdLimiter
+	workers   int
+	batchSize int
+	wanted    int          // number of records to fetch
+	done      map[int]bool // offsets already written by an interrupted run
+	failFast  bool         // cancel the run at the first failed page
+	buffered  int          // pages fetched or in flight but not yet written
+	progress  *progress    // nil without a progress bar
+	raw       *rawArchive  // -raw-dir; nil without
+
+	retries atomic.Int64 // pages split and retried by fetchRange
+
+	// dispatch is set by run and cancelled by the first signal. A page
+	// still waiting for the limiter then gives up instead of starting.
+	dispatch context.Context
+}
+
+// pageResult is one fetched page, handed from a worker to the writer.
+type pageResult struct {
+	offset  int
+	records []map[string]interface{}
+	err     error
+	skipped bool // not fetched because a signal arrived first
+}
+
+// fetchSummary is the outcome of fetchPlan.run.
+type fetchSummary struct {
+	Records     int
+	Completed   []int         // offsets of the pages written, in order
+	Failed      []PageFailure // pages that could not be fetched
+	Retried     int           // times a failing page was split and retried
+	Interrupted bool          // a signal stopped the run before every page was fetched
+	Err         error         // why the run was cancelled: the -deadline or the -fail-fast page
+	WriteErr    error         // the output could not be written; later pages were dropped
+}
+
+// exitCode maps the outcome to the program's exit status. total is the
+// number of records in the output. Failed pages only make the run exit
+// nonzero once their share of the pages attempted exceeds maxErrorRate;
+// a run that failed without writing anything is fatal.
+func (s *fetchSummary) exitCode(total int, maxErrorRate float64) int {
+	switch {
+	case s.WriteErr != nil:
+		return exitFatal
+	case len(s.Failed) > 0 && total == 0:
+		return exitFatal
+	case s.Interrupted || s.Err != nil:
+		return exitPartial
+	}
+	if attempted := len(s.Completed) + len(s.Failed); attempted > 0 {
+		if float64(len(s.Failed))/float64(attempted) > maxErrorRate {
+			return exitPartial
+		}
+	}
+	return exitOK
+}
+
+// PageFailure is a page that could not be fetched and why.
+type PageFailure struct {
+	Offset int    `json:"offset"`
+	Error  string `json:"error"`
+}
+
+// errInterrupted is the cancellation cause when signals stop the run: the
+// first halts dispatch, a second aborts the pages still in flight.
+var errInterrupted = errors.New("interrupted")
+
+// errSkipped is returned by fetchRange for a page that had not started
+// when a signal halted the run.
+var errSkipped = errors.New("skipped after signal")
+
+// next returns the first offset at or after offset that still has to be fetched.
+func (p *fetchPlan) next(offset int) int {
+	for offset < p.wanted && p.done[offset] {
+		offset += p.batchSize
+	}
+	return offset
+}
+
+// run fetches the pages with a pool of workers and passes each page's
+// records to write as soon as every earlier page has been written, so the
+// output keeps the server's order without holding the whole extract in
+// memory.
+//
+// At most p.buffered pages are in memory at once, counting the ones being
+// fetched: a page that is slow to arrive holds back the dispatch of pages
+// after it instead of letting finished pages pile up behind it.
+//
+// A signal on stop ends the dispatch of new pages, and pages that workers
+// have not started on yet are skipped. Pages already in flight are still
+// fetched and written, so the output ends on a page boundary and
+// the summary says exactly which pages are missing. A second signal, the
+// end of ctx, a page the server rejects (see rejected), or with failFast
+// the first failed page cancels the requests still in flight as well.
+func (p *fetchPlan) run(ctx context.Context, stop <-chan os.Signal, write func(records []map[string]interface{}) error) fetchSummary {
+	var summary fetchSummary
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	dispatch, halt := context.WithCancelCause(ctx)
+	defer halt(nil)
+	p.dispatch = dispatch
+
+	// offsets is unbuffered so that after a signal no page is left queued
+	// behind the ones the workers are already fetching.
+	offsets := make(chan int)
+	results := make(chan pageResult, p.workers)
+
+	// The dispatcher takes a slot for each page and the writer gives it
+	// back once the page is written.
+	slots := make(chan struct{}, max(p.buffered, 1))
+
+	// Signals are watched for the whole run, not only while pages are
+	// being dispatched: with a large worker pool every page can be handed
+	// out at the start.
+	go func() {
+		select {
+		case sig := <-stop:
+			slog.Warn("signal received; finishing in-flight pages (press Ctrl-C again to cancel them)", "signal", sig.String())
+			halt(errInterrupted)
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-stop:
+			slog.Warn("cancelling in-flight requests")
+			cancel(errInterrupted)
+		case <-ctx.Done():
+		}
+	}()
+	go func() {
+		defer close(offsets)
+		for offset := p.next(0); offset < p.wanted; offset = p.next(offset + p.batchSize) {
+			select {
+			case <-dispatch.Done():
+				return
+			case slots <- struct{}{}:
+			}
+
+			select {
+			case <-dispatch.Done():
+				return
+			case offsets <- offset:
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for offset := range offsets {
+				size := p.batchSize
+				if offset+size > p.wanted {
+					size = p.wanted - offset
+				}
+				records, err := p.fetchRange(ctx, offset, size, 1)
+				if errors.Is(err, errSkipped) {
+					results <- pageResult{offset: offset, skipped: true}
+					continue
+				}
+				switch {
+				case err == nil || ctx.Err() != nil:
+				case rejected(err):
+					// The other pages would be refused the same way.
+					cancel(fmt.Errorf("the server rejected the query: %w", err))
+				case p.failFast:
+					cancel(fmt.Errorf("offset %d failed with -fail-fast: %w", offset, err))
+				}
+				results <- pageResult{offset: offset, records: records, err: err}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Pages finish out of order; hold each one until the pages before it
+	// have been written. Offsets are dispatched in order, so once results
+	// is closed nothing is left waiting.
+	pending := make(map[int]pageResult)
+	next := p.next(0)
+	skipped := 0
+	for res := range results {
+		p.progress.page(len(res.records))
+		pending[res.offset] = res
+		for {
+			page, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next = p.next(next + p.batchSize)
+			<-slots
+
+			if page.skipped {
+				skipped++
+				continue
+			}
+			if page.err != nil {
+				// Pages aborted by the cancellation are only counted.
+				if !cancelled(ctx, page.err) {
+					slog.Error("page failed", "offset", page.offset, "err", page.err)
+				}
+				summary.Failed = append(summary.Failed, PageFailure{Offset: page.offset, Error: page.err.Error()})
+				continue
+			}
+			// An empty page can happen normally at the end of the data,
+			// e.g. if records were deleted after the preflight count.
+			if summary.WriteErr != nil {
+				continue
+			}
+			if len(page.records) > 0 {
+				if err := write(page.records); err != nil {
+					summary.WriteErr = err
+					cancel(fmt.Errorf("writing output: %w", err))
+					continue
+				}
+				summary.Records += len(page.records)
+			}
+			summary.Completed = append(summary.Completed, page.offset)
+		}
+	}
+
+	// A signal after the last page was fetched changes nothing.
+	summary.Interrupted = context.Cause(dispatch) == errInterrupted && (skipped > 0 || next < p.wanted)
+	summary.Retried = int(p.retries.Load())
+	if cause := context.Cause(ctx); ctx.Err() != nil && cause != errInterrupted {
+		summary.Err = cause
+	}
+	return summary
+}
+
+// fetchRange fetches size records starting at offset. If the request
+// fails with an error that a smaller page might avoid (a timeout, a server
+// error), the range is split in half and each half fetched on its own,
+// down to minBatchSize: 1000 → 500 → 250. Nothing is retried once ctx is done.
+// attempt counts the requests made for the range so far, starting at 1.
+func (p *fetchPlan) fetchRange(ctx context.Context, offset, size, attempt int) ([]map[string]interface{}, error) {
+	ctx, sp := startSpan(ctx, "fetch page", "offset", offset, "size", size, "attempt", attempt)
+	defer sp.finish()
+
+	queued := time.Now()
+	wait := ctx
+	if attempt == 1 && p.dispatch != nil {
+		wait = p.dispatch
+	}
+	if err := p.limiter.Acquire(wait); err != nil {
+		if ctx.Err() == nil {
+			err = errSkipped
+		}
+		sp.fail(err)
+		return nil, err
+	}
+	start := time.Now()
+	records, err := fetchBatch(ctx, offset, size, p.client, p.query, p.raw)
+	duration := time.Since(start)
+	p.limiter.Release(duration, err)
+	sp.set("queue_wait", start.Sub(queued), "rows", len(records))
+
+	log := slog.With("offset", offset, "size", size, "attempt", attempt, "duration", duration)
+	if err == nil {
+		log.Debug("fetched page", "rows", len(records))
+	}
+	if err == nil || ctx.Err() != nil || size <= minBatchSize || !shrinkable(err) {
+		sp.fail(err)
+		return records, err
+	}
+
+	p.retries.Add(1)
+	half := size / 2
+	log.Warn("retrying page as two smaller pages", "first", half, "second", size-half, "err", err)
+
+	first, err := p.fetchRange(ctx, offset, half, attempt+1)
+	if err != nil {
+		sp.fail(err)
+		return nil, err
+	}
+	second, err := p.fetchRange(ctx, offset+half, size-half, attempt+1)
+	if err != nil {
+		sp.fail(err)
+		return nil, err
+	}
+	return append(first, second...), nil
+}
+
+// cancelled reports whether err is ctx giving up rather than a failure of
+// its own. Requests report either ctx.Err() or the cancellation cause.
+func cancelled(ctx context.Context, err error) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+	return errors.Is(err, ctx.Err()) || errors.Is(err, context.Cause(ctx))
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultPostgresTable is the table -tee loads when the URL names none.
+const defaultPostgresTable = "foreclosures"
+
+// postgresSink loads the records into a Postgres table with COPY, speaking
+// the frontend/backend protocol
+// (https://www.postgresql.org/docs/current/protocol.html) directly. The
+// table is created if it does not exist and emptied, and the whole load is
+// one transaction: readers see the previous contents until the run
+// finishes, and keep them if it does not.
+//
+// The destination is a URL such as
+//
+//	postgres://etl@db.internal/gis?table=public.foreclosures&sslmode=require
+//
+// with the password in the URL or $PGPASSWORD. mode=append adds to the
+// table instead of replacing its contents. sslmode is disable, prefer
+// (the default: TLS if the server offers it), require, or verify-full,
+// which also checks the server's certificate.
+type postgresSink struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	headers []string
+	kinds   []byte
+	f       *Formatter
+	row     []byte
+}
+
+func openPostgresSink(dest string, headers, columns []string, f *Formatter) (*postgresSink, error) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, err
+	}
+	params := u.Query()
+	table := params.Get("table")
+	if table == "" {
+		table = defaultPostgresTable
+	}
+	mode := params.Get("mode")
+	if mode != "" && mode != "replace" && mode != "append" {
+		return nil, fmt.Errorf("%s: mode must be replace or append", u.Redacted())
+	}
+
+	p := &postgresSink{headers: headers, f: f}
+	if err := p.connect(u); err != nil {
+		return nil, fmt.Errorf("%s: %w", u.Redacted(), err)
+	}
+
+	var defs, names []string
+	for i, field := range headers {
+		kind := f.columnKind(field)
+		p.kinds = append(p.kinds, kind)
+		typ := "text"
+		switch kind {
+		case kindNumber:
+			typ = "double precision"
+		case kindInt:
+			typ = "bigint"
+		case kindTime:
+			typ = "timestamptz"
+		}
+		names = append(names, postgresIdent(columns[i]))
+		defs = append(defs, postgresIdent(columns[i])+" "+typ)
+	}
+	name := postgresTable(table)
+	setup := "BEGIN; CREATE TABLE IF NOT EXISTS " + name + " (" + strings.Join(defs, ", ") + ");"
+	if mode != "append" {
+		// DELETE rather than TRUNCATE, which would lock readers out of
+		// the table until the load commits.
+		setup += " DELETE FROM " + name + ";"
+	}
+	if err := p.exec(setup); err != nil {
+		p.close()
+		return nil, fmt.Errorf("%s: %w", u.Redacted(), err)
+	}
+	if err := p.copyIn("COPY " + name + " (" + strings.Join(names, ", ") + ") FROM STDIN"); err != nil {
+		p.close()
+		return nil, fmt.Errorf("%s: %w", u.Redacted(), err)
+	}
+	return p, nil
+}
+
+// postgresIdent quotes an identifier.
+func postgresIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// postgresTable quotes a table name, which may have a schema.
+func postgresTable(name string) string {
+	var parts []string
+	for _, part := range strings.Split(name, ".") {
+		parts = append(parts, postgresIdent(part))
+	}
+	return strings.Join(parts, ".")
+}
+
+// connect opens the connection and logs in.
+func (p *postgresSink) connect(u *url.URL) error {
+	host := u.Hostname()
+	if host == "" {
+		host = "localhost"
+	}
+	port := u.Port()
+	if port == "" {
+		port = "5432"
+	}
+	user := u.User.Username()
+	if user == "" {
+		user = os.Getenv("PGUSER")
+	}
+	if user == "" {
+		return errors.New("no user in the URL or $PGUSER")
+	}
+	password, ok := u.User.Password()
+	if !ok {
+		password = os.Getenv("PGPASSWORD")
+	}
+	database := strings.TrimPrefix(u.Path, "/")
+	if database == "" {
+		database = user
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), 30*time.Second)
+	if err != nil {
+		return err
+	}
+	p.conn = conn
+
+	sslmode := u.Query().Get("sslmode")
+	if sslmode == "" {
+		sslmode = "prefer"
+	}
+	switch sslmode {
+	case "disable":
+	case "prefer", "require", "verify-full":
+		// SSLRequest: the server answers S or N before the startup.
+		conn.Write(binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 8), 80877103))
+		var answer [1]byte
+		if _, err := io.ReadFull(conn, answer[:]); err != nil {
+			conn.Close()
+			return err
+		}
+		switch {
+		case answer[0] == 'S':
+			config := &tls.Config{ServerName: host, InsecureSkipVerify: sslmode != "verify-full"}
+			tlsConn := tls.Client(conn, config)
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return err
+			}
+			p.conn = tlsConn
+		case sslmode != "prefer":
+			conn.Close()
+			return errors.New("the server does not support TLS")
+		}
+	default:
+		conn.Close()
+		return fmt.Errorf("unsupported sslmode %q (use disable, prefer, require or verify-full)", sslmode)
+	}
+	p.r = bufio.NewReader(p.conn)
+	p.w = bufio.NewWriter(p.conn)
+
+	startup := binary.BigEndian.AppendUint32(nil, 3<<16) // protocol 3.0
+	for _, kv := range []string{"user", user, "database", database, "application_name", "fetchData"} {
+		startup = append(append(startup, kv...), 0)
+	}
+	startup = append(startup, 0)
+	p.w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(startup)+4)))
+	p.w.Write(startup)
+	if err := p.w.Flush(); err != nil {
+		p.conn.Close()
+		return err
+	}
+	if err := p.authenticate(user, password); err != nil {
+		p.conn.Close()
+		return err
+	}
+	if err := p.ready(); err != nil {
+		p.conn.Close()
+		return err
+	}
+	return nil
+}
+
+// authenticate answers the server's authentication requests: cleartext,
+// MD5 or SCRAM-SHA-256.
+func (p *postgresSink) authenticate(user, password string) error {
+	var scram *scramClient
+	for {
+		typ, body, err := p.receive()
+		if err != nil {
+			return err
+		}
+		if typ != 'R' {
+			return fmt.Errorf("unexpected message %q during login", typ)
+		}
+		if len(body) < 4 {
+			return errors.New("short authentication message")
+		}
+		switch code, data := binary.BigEndian.Uint32(body), body[4:]; code {
+		case 0: // AuthenticationOk
+			return nil
+		case 3: // AuthenticationCleartextPassword
+			p.send('p', append([]byte(password), 0))
+		case 5: // AuthenticationMD5Password
+			inner := md5.Sum([]byte(password + user))
+			outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), data[:4]...))
+			p.send('p', append([]byte("md5"+hex.EncodeToString(outer[:])), 0))
+		case 10: // AuthenticationSASL
+			if !strings.Contains(string(data), "SCRAM-SHA-256\x00") {
+				return errors.New("the server offers no supported SASL mechanism")
+			}
+			scram = newSCRAMClient(password)
+			first := scram.first()
+			msg := append([]byte("SCRAM-SHA-256\x00"), binary.BigEndian.AppendUint32(nil, uint32(len(first)))...)
+			p.send('p', append(msg, first...))
+		case 11: // AuthenticationSASLContinue
+			if scram == nil {
+				return errors.New("unexpected SASL message")
+			}
+			final, err := scram.final(string(data))
+			if err != nil {
+				return err
+			}
+			p.send('p', []byte(final))
+		case 12: // AuthenticationSASLFinal
+			if scram == nil || !scram.verify(string(data)) {
+				return errors.New("the server's SCRAM signature does not match")
+			}
+		default:
+			return fmt.Errorf("unsupported authentication method %d", code)
+		}
+		if err := p.w.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// send queues a message; the caller flushes.
+func (p *postgresSink) send(typ byte, body []byte) {
+	p.w.WriteByte(typ)
+	p.w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(body)+4)))
+	p.w.Write(body)
+}
+
+// receive reads a message, skipping notices and parameter reports, and
+// returns server errors as errors.
+func (p *postgresSink) receive() (byte, []byte, error) {
+	for {
+		var head [5]byte
+		if _, err := io.ReadFull(p.r, head[:]); err != nil {
+			return 0, nil, err
+		}
+		body := make([]byte, binary.BigEndian.Uint32(head[1:])-4)
+		if _, err := io.ReadFull(p.r, body); err != nil {
+			return 0, nil, err
+		}
+		switch head[0] {
+		case 'N', 'S', 'K': // NoticeResponse, ParameterStatus, BackendKeyData
+			continue
+		case 'E':
+			return 'E', body, postgresError(body)
+		}
+		return head[0], body, nil
+	}
+}
+
+// postgresError formats an ErrorResponse from its severity, message and
+// detail fields.
+func postgresError(body []byte) error {
+	fields := make(map[byte]string)
+	for _, field := range strings.Split(string(body), "\x00") {
+		if field != "" {
+			fields[field[0]] = field[1:]
+		}
+	}
+	msg := fields['S'] + ": " + fields['M']
+	if fields['D'] != "" {
+		msg += " (" + fields['D'] + ")"
+	}
+	return errors.New("postgres: " + msg)
+}
+
+// ready reads up to ReadyForQuery, returning the first error on the way.
+func (p *postgresSink) ready() error {
+	var first error
+	for {
+		typ, _, err := p.receive()
+		if err != nil && typ != 'E' {
+			return err
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+		if typ == 'Z' {
+			return first
+		}
+	}
+}
+
+// exec runs statements with the simple query protocol.
+func (p *postgresSink) exec(sql string) error {
+	p.send('Q', append([]byte(sql), 0))
+	if err := p.w.Flush(); err != nil {
+		return err
+	}
+	return p.ready()
+}
+
+// copyIn starts a COPY FROM STDIN.
+func (p *postgresSink) copyIn(sql string) error {
+	p.send('Q', append([]byte(sql), 0))
+	if err := p.w.Flush(); err != nil {
+		return err
+	}
+	typ, _, err := p.receive()
+	if err != nil {
+		p.ready()
+		return err
+	}
+	if typ != 'G' { // CopyInResponse
+		return fmt.Errorf("unexpected message %q to COPY", typ)
+	}
+	return nil
+}
+
+// Write sends a record as a row of COPY text: tab-separated, \N for
+// null, with backslash escapes.
+func (p *postgresSink) Write(record map[string]interface{}) error {
+	row := p.row[:0]
+	for i, field := range p.headers {
+		if i > 0 {
+			row = append(row, '\t')
+		}
+		v, ok := p.f.typedValue(field, p.kinds[i], record[field])
+		if !ok {
+			row = append(row, `\N`...)
+			continue
+		}
+		switch v := v.(type) {
+		case string:
+			for j := 0; j < len(v); j++ {
+				switch c := v[j]; c {
+				case '\\':
+					row = append(row, `\\`...)
+				case '\t':
+					row = append(row, `\t`...)
+				case '\n':
+					row = append(row, `\n`...)
+				case '\r':
+					row = append(row, `\r`...)
+				default:
+					row = append(row, c)
+				}
+			}
+		case float64:
+			row = strconv.AppendFloat(row, v, 'g', -1, 64)
+		case int64:
+			row = strconv.AppendInt(row, v, 10)
+		case time.Time:
+			row = v.AppendFormat(row, "2006-01-02 15:04:05.000Z07:00")
+		}
+	}
+	p.row = append(row, '\n')
+	p.send('d', p.row)
+	return nil
+}
+
+// Close ends the COPY and commits the load.
+func (p *postgresSink) Close() error {
+	p.send('c', nil) // CopyDone
+	if err := p.w.Flush(); err != nil {
+		p.conn.Close()
+		return err
+	}
+	err := p.ready()
+	if err == nil {
+		err = p.exec("COMMIT")
+	} else {
+		p.exec("ROLLBACK")
+	}
+	p.close()
+	return err
+}
+
+// Abort cancels the COPY and rolls the load back.
+func (p *postgresSink) Abort() error {
+	p.send('f', []byte("run did not finish\x00")) // CopyFail
+	p.w.Flush()
+	p.ready() // reports the failure just asked for
+	err := p.exec("ROLLBACK")
+	p.close()
+	return err
+}
+
+func (p *postgresSink) close() {
+	p.send('X', nil) // Terminate
+	p.w.Flush()
+	p.conn.Close()
+}
+
+// scramClient is the client side of SCRAM-SHA-256 (RFC 5802, RFC 7677),
+// without channel binding.
+type scramClient struct {
+	password    string
+	nonce       string
+	firstBare   string
+	authMessage string
+	salted      []byte
+}
+
+func newSCRAMClient(password string) *scramClient {
+	return &scramClient{password: password, nonce: rand.Text()}
+}
+
+// first is the client-first-message. Postgres takes the user from the
+// startup message, so the name is left empty.
+func (c *scramClient) first() string {
+	c.firstBare = "n=,r=" + c.nonce
+	return "n,," + c.firstBare
+}
+
+// final answers the server-first-message with the client proof.
+func (c *scramClient) final(serverFirst string) (string, error) {
+	var nonce, salt string
+	iterations := 0
+	for _, attr := range strings.Split(serverFirst, ",") {
+		key, value, _ := strings.Cut(attr, "=")
+		switch key {
+		case "r":
+			nonce = value
+		case "s":
+			salt = value
+		case "i":
+			iterations, _ = strconv.Atoi(value)
+		}
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil || !strings.HasPrefix(nonce, c.nonce) || iterations <= 0 {
+		return "", errors.New("invalid SCRAM server message")
+	}
+	if c.salted, err = pbkdf2.Key(sha256.New, c.password, saltBytes, iterations, sha256.Size); err != nil {
+		return "", err
+	}
+	withoutProof := "c=biws,r=" + nonce
+	c.authMessage = c.firstBare + "," + serverFirst + "," + withoutProof
+
+	clientKey := scramHMAC(c.salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	signature := scramHMAC(storedKey[:], c.authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// verify checks the server-final-message, which proves the server knows
+// the password too.
+func (c *scramClient) verify(serverFinal string) bool {
+	v, ok := strings.CutPrefix(serverFinal, "v=")
+	if !ok {
+		return false
+	}
+	got, err := base64.StdEncoding.DecodeString(v)
+	want := scramHMAC(scramHMAC(c.salted, "Server Key"), c.authMessage)
+	return err == nil && hmac.Equal(got, want)
+}
+
+func scramHMAC(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math"
+	"slices"
+)
+
+// zeroSalesWarnShare is the share of $0 sales above which a run warns:
+// the feed has at times sent a flood of them.
+const zeroSalesWarnShare = 0.1
+
+// PriceProfile describes the Sale_Price values of the records a run wrote,
+// to catch anomalies in the feed. A sale is a record with a Sale_Date, or
+// any record if Sale_Date is not written. The statistics are of the
+// prices above $0; $0 and missing prices are only counted.
+type PriceProfile struct {
+	Sales  int      `json:"sales"`
+	Priced int      `json:"priced"` // sales with a price above $0
+	Zero   int      `json:"zero"`   // sales at $0
+	Null   int      `json:"null"`   // sales without a price
+	Min    *float64 `json:"min,omitempty"`
+	P10    *float64 `json:"p10,omitempty"`
+	P25    *float64 `json:"p25,omitempty"`
+	Median *float64 `json:"median,omitempty"`
+	P75    *float64 `json:"p75,omitempty"`
+	P90    *float64 `json:"p90,omitempty"`
+	Max    *float64 `json:"max,omitempty"`
+	Mean   *float64 `json:"mean,omitempty"`
+}
+
+// priceProfiler collects the sale prices as records are written.
+type priceProfiler struct {
+	soldField bool // Sale_Date is written, so it tells sales apart
+	formatter *Formatter
+	profile   PriceProfile
+	prices    []float64
+}
+
+// newPriceProfiler returns nil if Sale_Price is not written.
+func newPriceProfiler(headers []string, f *Formatter) *priceProfiler {
+	if !slices.Contains(headers, salePriceField) {
+		return nil
+	}
+	return &priceProfiler{soldField: slices.Contains(headers, saleDateField), formatter: f}
+}
+
+func (p *priceProfiler) observe(record map[string]interface{}) {
+	if p == nil || record == nil {
+		return
+	}
+	if p.soldField {
+		if _, sold := p.formatter.typedValue(saleDateField, kindTime, record[saleDateField]); !sold {
+			return
+		}
+	}
+	p.profile.Sales++
+	n, ok := p.formatter.parseNumber(record[salePriceField])
+	switch {
+	case !ok:
+		p.profile.Null++
+	case n == 0:
+		p.profile.Zero++
+	default:
+		p.prices = append(p.prices, n)
+	}
+}
+
+// result returns the profile, or nil if there were no sales.
+func (p *priceProfiler) result() *PriceProfile {
+	if p == nil || p.profile.Sales == 0 {
+		return nil
+	}
+	profile := p.profile
+	profile.Priced = len(p.prices)
+	if len(p.prices) > 0 {
+		sorted := slices.Sorted(slices.Values(p.prices))
+		at := func(q float64) *float64 {
+			v := percentile(sorted, q)
+			return &v
+		}
+		profile.Min, profile.P10, profile.P25, profile.Median = at(0), at(10), at(25), at(50)
+		profile.P75, profile.P90, profile.Max = at(75), at(90), at(100)
+		sum := 0.0
+		for _, v := range sorted {
+			sum += v
+		}
+		mean := math.Round(sum/float64(len(sorted))*100) / 100
+		profile.Mean = &mean
+	}
+	return &profile
+}
+
+// percentile interpolates the q-th percentile (0 to 100) of sorted values
+// linearly between the closest ranks.
+func percentile(sorted []float64, q float64) float64 {
+	pos := q / 100 * float64(len(sorted)-1)
+	lower := int(pos)
+	if lower >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[lower] + (pos-float64(lower))*(sorted[lower+1]-sorted[lower])
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	runtimepprof "runtime/pprof"
+)
+
+// startProfiling turns on the profiling flags: -pprof serves the
+// net/http/pprof endpoints for the life of the process, -cpuprofile
+// records a CPU profile and -memprofile writes a heap profile when the
+// returned stop function is called at the end of the run.
+func startProfiling(opts *Options) (stop func(), err error) {
+	if opts.PprofAddr != "" {
+		// Listen before returning so a busy port is reported as a flag error.
+		ln, err := net.Listen("tcp", opts.PprofAddr)
+		if err != nil {
+			return nil, fmt.Errorf("-pprof: %w", err)
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		go http.Serve(ln, mux)
+		slog.Info("pprof listening", "url", "http://"+ln.Addr().String()+"/debug/pprof/")
+	}
+
+	var cpuFile *os.File
+	if opts.CPUProfile != "" {
+		cpuFile, err = os.Create(opts.CPUProfile)
+		if err != nil {
+			return nil, fmt.Errorf("-cpuprofile: %w", err)
+		}
+		if err := runtimepprof.StartCPUProfile(cpuFile); err != nil {
+			cpuFile.Close()
+			return nil, fmt.Errorf("-cpuprofile: %w", err)
+		}
+	}
+
+	stop = func() {
+		if cpuFile != nil {
+			runtimepprof.StopCPUProfile()
+			cpuFile.Close()
+			slog.Info("CPU profile written", "path", opts.CPUProfile)
+		}
+		if opts.MemProfile != "" {
+			if err := writeHeapProfile(opts.MemProfile); err != nil {
+				slog.Warn("could not write heap profile", "path", opts.MemProfile, "err", err)
+			} else {
+				slog.Info("heap profile written", "path", opts.MemProfile)
+			}
+		}
+	}
+	return stop, nil
+}
+
+func writeHeapProfile(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	// Collect first so the profile shows live memory, not garbage.
+	runtime.GC()
+	if err := runtimepprof.WriteHeapProfile(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// terminal is where logs go. While a progress bar is shown it keeps the
+// bar on the last line: each log line first clears the bar and then
+// redraws it underneath.
+type terminal struct {
+	mu  sync.Mutex
+	out *os.File
+	bar string
+}
+
+var stderr = &terminal{out: os.Stderr}
+
+func (t *terminal) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.bar == "" {
+		return t.out.Write(p)
+	}
+	fmt.Fprint(t.out, "\r\033[K")
+	n, err := t.out.Write(p)
+	fmt.Fprint(t.out, t.bar)
+	return n, err
+}
+
+// setBar replaces the progress bar line; an empty bar removes it.
+func (t *terminal) setBar(bar string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprint(t.out, "\r\033[K"+bar)
+	t.bar = bar
+}
+
+// isTerminal reports whether f is a terminal rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// wantProgress decides from -progress whether to draw a progress bar. In
+// auto mode the bar is only drawn on an interactive terminal with text
+// logs, so cron jobs and log files do not fill up with redraws.
+func wantProgress(opts *Options) (bool, error) {
+	switch strings.ToLower(opts.Progress) {
+	case "auto", "":
+		return isTerminal(os.Stderr) && !strings.EqualFold(opts.LogFormat, "json"), nil
+	case "on", "true":
+		return true, nil
+	case "off", "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid -progress %q (use auto, on or off)", opts.Progress)
+}
+
+// progress draws a bar of pages completed with the row rate and the time
+// left at that rate. Methods on a nil *progress do nothing.
+type progress struct {
+	mu    sync.Mutex
+	pages int // pages to fetch in this run
+	done  int
+	rows  int
+	start time.Time
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newProgress starts a progress bar that redraws twice a second, so the
+// rate and ETA keep moving while a slow page is outstanding.
+func newProgress(pages int) *progress {
+	p := &progress{pages: pages, start: time.Now(), stop: make(chan struct{})}
+	stderr.setBar(p.line())
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				stderr.setBar(p.line())
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// page records a finished page, successful or not, and its row count.
+func (p *progress) page(rows int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.done++
+	p.rows += rows
+	p.mu.Unlock()
+	stderr.setBar(p.line())
+}
+
+// finish draws the final state and leaves it on its own line.
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	p.wg.Wait()
+	line := p.line()
+	stderr.setBar("")
+	fmt.Fprintln(stderr.out, line)
+}
+
+const barWidth = 30
+
+func (p *progress) line() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	filled := barWidth
+	if p.pages > 0 {
+		filled = barWidth * p.done / p.pages
+	}
+	bar := strings.Repeat("█", filled) + strings.Repeat("░", barWidth-filled)
+
+	elapsed := time.Since(p.start)
+	rate := 0.0
+	if s := elapsed.Seconds(); s > 0 {
+		rate = float64(p.rows) / s
+	}
+	eta := "--:--"
+	if p.done > 0 && p.done < p.pages {
+		left := time.Duration(float64(elapsed) / float64(p.done) * float64(p.pages-p.done))
+		eta = formatClock(left)
+	} else if p.done >= p.pages {
+		eta = formatClock(0)
+	}
+
+	return fmt.Sprintf("%s %d/%d pages  %d rows  %.0f rows/s  ETA %s",
+		bar, p.done, p.pages, p.rows, rate, eta)
+}
+
+// formatClock formats a duration as m:ss, or h:mm:ss from an hour up.
+func formatClock(d time.Duration) string {
+	d = d.Round(time.Second)
+	h, m, s := int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%d:%02d", m, s)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+)
+
+// provenanceSuffix names the sidecar written next to each output, e.g.
+// data/Louisville_Metro_KY_-_Property_Foreclosures.csv.provenance.json.
+const provenanceSuffix = ".provenance.json"
+
+// Provenance records how one output file was produced, so it can be
+// traced back to the service and query long after the run report has
+// been replaced by later runs.
+type Provenance struct {
+	File         string            `json:"file"`
+	URL          string            `json:"url"`
+	Where        string            `json:"where"`
+	Fields       []string          `json:"fields"` // requested outFields; ["*"] for all
+	Columns      []string          `json:"columns"`
+	Params       map[string]string `json:"params"` // every query parameter sent
+	Partition    string            `json:"partition,omitempty"`
+	Status       string            `json:"status"`
+	StartedAt    time.Time         `json:"startedAt"`
+	FinishedAt   time.Time         `json:"finishedAt"`
+	Resumed      bool              `json:"resumed,omitempty"`
+	LastEditDate *time.Time        `json:"layerLastEditDate,omitempty"` // when -if-changed read it
+	Records      int               `json:"records"`
+	SHA256       string            `json:"sha256"`
+}
+
+// writeProvenance writes the sidecar of each output and returns their
+// paths. A resumed run adds the records it appended to the count in the
+// sidecar left by the run it continues.
+func (j *fetchJob) writeProvenance(report *RunReport, output *CSVOutput, outputs []string, lastEditDate int64) ([]string, error) {
+	fields := j.query.Fields
+	if len(fields) == 0 {
+		fields = []string{"*"}
+	}
+	columns := j.headers
+	if j.columns != nil {
+		columns = j.columns
+	}
+	var edited *time.Time
+	if lastEditDate != 0 {
+		t := time.UnixMilli(lastEditDate).UTC()
+		edited = &t
+	}
+	var written []string
+	var errs []error
+	for _, path := range outputs {
+		p := &Provenance{
+			File:         path,
+			URL:          j.query.URL,
+			Where:        j.query.Where,
+			Fields:       fields,
+			Columns:      columns,
+			Params:       report.Params,
+			Status:       report.Status,
+			StartedAt:    report.StartedAt,
+			FinishedAt:   report.FinishedAt,
+			Resumed:      report.Resumed,
+			LastEditDate: edited,
+		}
+		if j.partitioner != nil {
+			p.Partition = j.opts.SplitBy
+		}
+		if output != nil {
+			p.Records = output.Records(path)
+		}
+		if report.Resumed {
+			if prev, err := loadProvenance(path); err == nil {
+				p.StartedAt = prev.StartedAt
+				p.Records += prev.Records
+			}
+		}
+		p.SHA256, _ = fileSHA256(path)
+
+		data, err := json.MarshalIndent(p, "", "  ")
+		if err == nil {
+			err = os.WriteFile(path+provenanceSuffix, data, 0o644)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		written = append(written, path+provenanceSuffix)
+	}
+	return written, errors.Join(errs...)
+}
+
+func loadProvenance(path string) (*Provenance, error) {
+	data, err := os.ReadFile(path + provenanceSuffix)
+	if err != nil {
+		return nil, err
+	}
+	var p Provenance
+	return &p, json.Unmarshal(data, &p)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query describes the server-side parameters sent with every query request.
+type Query struct {
+	URL    string   // query endpoint of the layer
+	Where  string   // SQL-92 where clause evaluated by the server
+	Fields []string // outFields; empty requests every field
+
+	Spatial *SpatialFilter // optional -bbox / -polygon filter
+
+	ReturnGeometry bool   // include feature geometry in the response
+	OutSR          string // spatial reference the geometry is returned in
+
+	OrderBy string // orderByFields, e.g. "ObjectId" or "Sale_Date DESC"
+
+	Format string // f of the page requests, pbf or geojson; the key and other requests stay f=json
+}
+
+// newQuery builds the query from the command-line options.
+func newQuery(opts *Options) (*Query, error) {
+	where := strings.TrimSpace(opts.Where)
+	if where == "" {
+		where = "1=1"
+	}
+
+	dateWhere, err := dateRangeClause(opts.DateField, opts.Since, opts.Until)
+	if err != nil {
+		return nil, err
+	}
+	if dateWhere != "" {
+		if where == "1=1" {
+			where = dateWhere
+		} else {
+			where = "(" + where + ") AND " + dateWhere
+		}
+	}
+
+	q := &Query{
+		URL:            queryURL(opts.URL),
+		Where:          where,
+		Fields:         splitList(opts.Fields),
+		ReturnGeometry: opts.Geometry,
+		OutSR:          strings.TrimSpace(opts.OutSR),
+		OrderBy:        strings.TrimSpace(opts.OrderBy),
+	}
+	if q.OutSR != "" && !q.ReturnGeometry {
+		return nil, fmt.Errorf("-out-sr requires -geometry")
+	}
+
+	switch {
+	case opts.BBox != "" && opts.Polygon != "":
+		return nil, fmt.Errorf("-bbox and -polygon cannot be combined")
+	case opts.BBox != "":
+		if q.Spatial, err = parseBBox(opts.BBox, opts.BBoxSR); err != nil {
+			return nil, err
+		}
+	case opts.Polygon != "":
+		if q.Spatial, err = loadPolygon(opts.Polygon); err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
+}
+
+// dateRangeClause turns -since/-until (YYYY-MM-DD, both inclusive) into a
+// where clause using DATE literals, which the server compares against the
+// epoch-millisecond date field for us. -until is converted to an exclusive
+// upper bound on the following day so filings later that day are kept.
+func dateRangeClause(field, since, until string) (string, error) {
+	var parts []string
+
+	if since != "" {
+		t, err := time.Parse("2006-01-02", since)
+		if err != nil {
+			return "", fmt.Errorf("invalid -since %q: want YYYY-MM-DD", since)
+		}
+		parts = append(parts, fmt.Sprintf("%s >= DATE '%s'", field, t.Format("2006-01-02")))
+	}
+
+	if until != "" {
+		t, err := time.Parse("2006-01-02", until)
+		if err != nil {
+			return "", fmt.Errorf("invalid -until %q: want YYYY-MM-DD", until)
+		}
+		parts = append(parts, fmt.Sprintf("%s < DATE '%s'", field, t.AddDate(0, 0, 1).Format("2006-01-02")))
+	}
+
+	return strings.Join(parts, " AND "), nil
+}
+
+// params returns the query string shared by all pages of a fetch.
+func (q *Query) params() url.Values {
+	v := url.Values{}
+	v.Set("where", q.Where)
+	v.Set("outFields", q.outFields())
+	v.Set("returnGeometry", strconv.FormatBool(q.ReturnGeometry))
+	if q.ReturnGeometry && q.OutSR != "" {
+		v.Set("outSR", q.OutSR)
+	}
+	v.Set("f", "json")
+	// Offset pagination is only stable when the server sorts the results.
+	if q.OrderBy != "" {
+		v.Set("orderByFields", q.OrderBy)
+	}
+	if q.Spatial != nil {
+		q.Spatial.params(v)
+	}
+	return v
+}
+
+// require adds a field to outFields if a field list is in use and does not
+// already include it.
+func (q *Query) require(field string) {
+	if len(q.Fields) == 0 {
+		return
+	}
+	for _, f := range q.Fields {
+		if f == field {
+			return
+		}
+	}
+	q.Fields = append(q.Fields, field)
+}
+
+// key identifies the extract a query produces, for the state file.
+func (q *Query) key() string {
+	return q.URL + "?" + q.params().Encode()
+}
+
+func (q *Query) outFields() string {
+	if len(q.Fields) == 0 {
+		return "*"
+	}
+	return strings.Join(q.Fields, ",")
+}
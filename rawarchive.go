@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// rawManifestFile describes a run's directory of -raw-dir responses.
+const rawManifestFile = "run.json"
+
+// rawManifest records how the responses in a -raw-dir run directory were
+// requested, so they can be decoded and told apart later.
+type rawManifest struct {
+	URL       string            `json:"url"`
+	Params    map[string]string `json:"params"` // query parameters of every page, without the paging ones
+	Format    string            `json:"format"` // f= of the pages: json, pbf or geojson
+	BatchSize int               `json:"batchSize"`
+	Count     int               `json:"count"` // preflight count, -1 if it failed
+	StartedAt time.Time         `json:"startedAt"`
+}
+
+// rawArchive saves the query responses of a run as the server sent them,
+// for -raw-dir: one file per page, offset_<n>.json (.pbf or .geojson in
+// those formats), and objects_<first ObjectId> for records fetched by
+// ObjectId after count drift. Together with the manifest they are the
+// source of the outputs, independent of how the records were formatted.
+type rawArchive struct {
+	dir   string // <-raw-dir>/<run>
+	ext   string
+	pages atomic.Int64
+	bytes atomic.Int64
+}
+
+// openRawArchive creates the directory of a run under root, named by its
+// start time, and writes the manifest. A resumed run passes the directory
+// of the run it continues, whose manifest is kept.
+func openRawArchive(root, resumed string, start time.Time, query *Query, batchSize, count int) (*rawArchive, error) {
+	dir := resumed
+	if dir == "" {
+		dir = filepath.Join(root, start.UTC().Format("20060102T150405Z"))
+	}
+	format := query.Format
+	if format == "" {
+		format = "json"
+	}
+	a := &rawArchive{dir: dir, ext: "." + format}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	manifest := filepath.Join(dir, rawManifestFile)
+	if _, err := os.Stat(manifest); err == nil || !errors.Is(err, os.ErrNotExist) {
+		return a, err
+	}
+	m := rawManifest{
+		URL:       query.URL,
+		Params:    make(map[string]string),
+		Format:    format,
+		BatchSize: batchSize,
+		Count:     count,
+		StartedAt: start.UTC(),
+	}
+	for key, values := range query.params() {
+		if key != "f" {
+			m.Params[key] = values[0]
+		}
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return a, writeFileAtomic(manifest, data)
+}
+
+// save writes the body of the response to the request with parameters q.
+func (a *rawArchive) save(q url.Values, body []byte) error {
+	name := "offset_" + q.Get("resultOffset")
+	if ids := q.Get("objectIds"); ids != "" {
+		name, _, _ = strings.Cut(ids, ",")
+		name = "objects_" + name
+	}
+	if err := writeFileAtomic(filepath.Join(a.dir, name+a.ext), body); err != nil {
+		return fmt.Errorf("raw archive: %w", err)
+	}
+	a.pages.Add(1)
+	a.bytes.Add(int64(len(body)))
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// relatedParentField is the column each related record file starts with:
+// the ObjectId of the feature the record is related to.
+const relatedParentField = "Parent_" + idField
+
+// Relationship is a relationship class of a layer, such as the case
+// history kept in a related table of parcels.
+type Relationship struct {
+	ID             int    `json:"id"`
+	Name           string `json:"name"`
+	RelatedTableID int    `json:"relatedTableId"`
+	Cardinality    string `json:"cardinality"`
+	KeyField       string `json:"keyField"`
+}
+
+// relatedFetcher writes the records related to the features of a run, one
+// CSV per relationship, for -related.
+type relatedFetcher struct {
+	client    *Client
+	layer     string   // layer endpoint
+	names     []string // relationship names or ids; "all" for every one
+	formatter *Formatter
+	dialect   CSVDialect
+}
+
+// selectRelationships picks the relationships named by -related.
+func (r *relatedFetcher) selectRelationships(layer *LayerInfo) ([]Relationship, error) {
+	if slices.Contains(r.names, "all") {
+		return layer.Relationships, nil
+	}
+	var selected []Relationship
+	for _, name := range r.names {
+		i := slices.IndexFunc(layer.Relationships, func(rel Relationship) bool {
+			return strings.EqualFold(rel.Name, name) || strconv.Itoa(rel.ID) == name
+		})
+		if i < 0 {
+			var known []string
+			for _, rel := range layer.Relationships {
+				known = append(known, fmt.Sprintf("%d (%s)", rel.ID, rel.Name))
+			}
+			if len(known) == 0 {
+				return nil, fmt.Errorf("relationship %q: the layer has no relationships", name)
+			}
+			return nil, fmt.Errorf("relationship %q not found; the layer has %s", name, strings.Join(known, ", "))
+		}
+		selected = append(selected, layer.Relationships[i])
+	}
+	return selected, nil
+}
+
+// fetch writes the records related to the features with the given
+// ObjectIds through rel, next to the output at base, and returns the
+// path of the file and the number of records.
+func (r *relatedFetcher) fetch(ctx context.Context, rel Relationship, ids []int64, base string) (string, int, error) {
+	var fields []string
+	var groups []relatedGroup
+	for batch := range slices.Chunk(ids, joinBatch) {
+		got, names, err := r.query(ctx, rel, batch)
+		if err != nil {
+			return "", 0, err
+		}
+		groups = append(groups, got...)
+		for _, name := range names {
+			if !slices.Contains(fields, name) {
+				fields = append(fields, name)
+			}
+		}
+	}
+
+	ext := filepath.Ext(base)
+	path := strings.TrimSuffix(base, ext) + "_related_" + relationshipFileName(rel) + ext
+	output := newCSVOutput(path, append([]string{relatedParentField}, fields...), nil, r.formatter, r.dialect)
+	// The header is written even if no feature has related records.
+	if _, err := output.writer(""); err != nil {
+		return "", 0, err
+	}
+	records := 0
+	for _, group := range groups {
+		for _, related := range group.RelatedRecords {
+			record := related.Attributes
+			if record == nil {
+				record = make(map[string]interface{})
+			}
+			record[relatedParentField] = float64(group.ObjectID)
+			if err := output.Write(record); err != nil {
+				output.Close()
+				return "", 0, err
+			}
+			records++
+		}
+	}
+	if err := output.Close(); err != nil {
+		return "", 0, err
+	}
+	return path, records, commitPartials(output.Paths())
+}
+
+// relatedGroup is the records related to one feature.
+type relatedGroup struct {
+	ObjectID       int64 `json:"objectId"`
+	RelatedRecords []struct {
+		Attributes map[string]interface{} `json:"attributes"`
+	} `json:"relatedRecords"`
+}
+
+// query asks queryRelatedRecords about a batch of features. If the server
+// cut the answer short, the batch is split in halves and asked again.
+func (r *relatedFetcher) query(ctx context.Context, rel Relationship, ids []int64) ([]relatedGroup, []string, error) {
+	oids := make([]string, len(ids))
+	for i, id := range ids {
+		oids[i] = strconv.FormatInt(id, 10)
+	}
+	params := url.Values{
+		"f":              {"json"},
+		"objectIds":      {strings.Join(oids, ",")},
+		"relationshipId": {strconv.Itoa(rel.ID)},
+		"outFields":      {"*"},
+		"returnGeometry": {"false"},
+	}
+	var result struct {
+		Fields []struct {
+			Name string `json:"name"`
+		} `json:"fields"`
+		RelatedRecordGroups   []relatedGroup `json:"relatedRecordGroups"`
+		ExceededTransferLimit bool           `json:"exceededTransferLimit"`
+	}
+	if err := r.client.getJSON(ctx, r.layer+"/queryRelatedRecords", params, &result); err != nil {
+		return nil, nil, fmt.Errorf("relationship %s: %w", rel.Name, err)
+	}
+	if result.ExceededTransferLimit {
+		if len(ids) == 1 {
+			slog.Warn("the server returned only part of the related records of a feature",
+				"relationship", rel.Name, "objectId", ids[0], "records", countRelated(result.RelatedRecordGroups))
+		} else {
+			half := len(ids) / 2
+			first, fields, err := r.query(ctx, rel, ids[:half])
+			if err != nil {
+				return nil, nil, err
+			}
+			second, _, err := r.query(ctx, rel, ids[half:])
+			return append(first, second...), fields, err
+		}
+	}
+	var fields []string
+	for _, field := range result.Fields {
+		fields = append(fields, field.Name)
+	}
+	return result.RelatedRecordGroups, fields, nil
+}
+
+func countRelated(groups []relatedGroup) int {
+	n := 0
+	for _, group := range groups {
+		n += len(group.RelatedRecords)
+	}
+	return n
+}
+
+// relationshipFileName turns a relationship name into a file name part,
+// e.g. "Case History" into Case_History.
+func relationshipFileName(rel Relationship) string {
+	return fileNamePart(rel.Name, strconv.Itoa(rel.ID))
+}
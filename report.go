@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+)
+
+// defaultReportFile is written to the output directory after each run.
+const defaultReportFile = "run_report.json"
+
+// Run outcomes recorded in RunReport.Status.
+const (
+	statusOK          = "ok"          // every page was fetched
+	statusPartial     = "partial"     // some pages failed; a checkpoint was left
+	statusInterrupted = "interrupted" // stopped by a signal; a checkpoint was left
+	statusCancelled   = "cancelled"   // stopped by -deadline, -fail-fast or a rejected query
+	statusUnchanged   = "unchanged"   // -if-changed found nothing new to fetch, or -skip-unchanged an identical output
+	statusFailed      = "failed"      // the output could not be written
+	statusLocked      = "locked"      // another run held -lock; no report is written
+)
+
+// RunReport is the machine-readable record of a run, so schedulers can
+// check the outcome without parsing the logs.
+type RunReport struct {
+	Status           string            `json:"status"`
+	Error            string            `json:"error,omitempty"`
+	StartedAt        time.Time         `json:"startedAt"`
+	FinishedAt       time.Time         `json:"finishedAt"`
+	WallTimeSeconds  float64           `json:"wallTimeSeconds"`
+	URL              string            `json:"url"`
+	Params           map[string]string `json:"params"`
+	Resumed          bool              `json:"resumed"`
+	ExpectedRecords  int               `json:"expectedRecords"` // preflight count after -limit, -1 if the count failed
+	Records          int               `json:"records"`
+	NewRecords       int               `json:"newRecords"` // records not in the previous output, -1 if there was none to compare with
+	PagesFetched     int               `json:"pagesFetched"`
+	PagesRetried     int               `json:"pagesRetried"`
+	Failures         []PageFailure     `json:"failures"`
+	BytesDownloaded  int64             `json:"bytesDownloaded"`
+	Outputs          []ReportOutput    `json:"outputs"`
+	Delta            *ReportOutput     `json:"delta,omitempty"`      // -delta file of the new records
+	Quarantine       *ReportOutput     `json:"quarantine,omitempty"` // -quarantine file of the records -coerce rejected
+	Quarantined      int               `json:"quarantined,omitempty"`
+	Timeseries       *ReportOutput     `json:"timeseries,omitempty"`       // -timeseries file of the filings and sales per month
+	AreaSummary      *ReportOutput     `json:"areaSummary,omitempty"`      // -area-summary file of the statistics per neighborhood and district
+	Merged           *MergeStats       `json:"merged,omitempty"`           // what -merge did to the output
+	UnexpectedFields map[string]int    `json:"unexpectedFields,omitempty"` // attributes returned but not written, with the records each was in
+	AttributeIssues  fieldIssues       `json:"attributeIssues,omitempty"`  // values repaired or written as null, by field and issue
+	MalformedRecords int               `json:"malformedRecords,omitempty"` // records with at least one of them
+	SalePrice        *PriceProfile     `json:"salePrice,omitempty"`        // Sale_Price of the records written
+	CountDrift       *CountDrift       `json:"countDrift,omitempty"`       // records added or deleted while the run paged through the layer
+	RawArchive       string            `json:"rawArchive,omitempty"`       // -raw-dir directory the query responses of the run were saved in
+	Related          []ReportOutput    `json:"related,omitempty"`          // -related records of the outputs
+	Encrypted        []ReportOutput    `json:"encrypted,omitempty"`        // -encrypt-to copies of the outputs and delta
+	Tee              []ReportOutput    `json:"tee,omitempty"`              // -tee files
+	Alerts           []AlertMatch      `json:"alerts,omitempty"`           // -alert rules that new records matched
+	DateField        string            `json:"dateField,omitempty"`
+	FirstDate        *time.Time        `json:"firstDate,omitempty"`
+	LastDate         *time.Time        `json:"lastDate,omitempty"`
+	Checkpoint       string            `json:"checkpoint,omitempty"`
+}
+
+// ReportOutput is an output file with its size and checksum.
+type ReportOutput struct {
+	OutputFile
+	SHA256 string `json:"sha256"`
+}
+
+// newRunReport fills in the fields every report has, whatever the outcome.
+func newRunReport(status string, start time.Time, query *Query, outputs []OutputFile) *RunReport {
+	now := time.Now().UTC()
+	r := &RunReport{
+		Status:          status,
+		StartedAt:       start.UTC(),
+		FinishedAt:      now,
+		WallTimeSeconds: now.Sub(start).Seconds(),
+		URL:             query.URL,
+		Params:          make(map[string]string),
+		ExpectedRecords: -1,
+		NewRecords:      -1,
+		Failures:        []PageFailure{},
+		Outputs:         make([]ReportOutput, 0, len(outputs)),
+	}
+	for key, values := range query.params() {
+		r.Params[key] = values[0]
+	}
+	for _, out := range outputs {
+		// A checksum that cannot be computed is left empty rather than
+		// failing the run after the data has been written.
+		sum, _ := fileSHA256(out.Path)
+		r.Outputs = append(r.Outputs, ReportOutput{OutputFile: out, SHA256: sum})
+	}
+	return r
+}
+
+// addSummary copies the counts of a finished fetch into the report.
+func (r *RunReport) addSummary(s *RunSummary, failures []PageFailure) {
+	r.Records = s.Records
+	r.NewRecords = s.NewRecords
+	r.Alerts = s.Alerts
+	r.PagesFetched = s.Pages
+	r.PagesRetried = s.RetriedPages
+	r.BytesDownloaded = s.Bytes
+	if failures != nil {
+		r.Failures = failures
+	}
+	if first, last, ok := s.Dates.Bounds(); ok {
+		first, last = first.UTC(), last.UTC()
+		r.DateField = s.Dates.Field
+		r.FirstDate, r.LastDate = &first, &last
+	}
+}
+
+// save writes the report via a temporary file, like State.save.
+func (r *RunReport) save(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// fileSHA256 returns the hex SHA-256 of a file's contents.
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
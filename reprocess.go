@@ -0,0 +1,206 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// reprocessOffline are the flags that need the service or another one to
+// fetch from, so reprocess refuses them.
+var reprocessOffline = []string{
+	"all-layers", "attachments", "census", "geocode", "if-changed", "join-url",
+	"raw-dir", "related", "resume", "schedule", "sync", "watch",
+}
+
+// runReprocess implements the reprocess subcommand, which rebuilds the
+// outputs of a run from its -raw-dir archive instead of the service, so
+// new formatting options can be applied to historical data:
+//
+//	go run . reprocess -archive data/raw/20250601T060000Z -out data/2025-06-01.csv -date-format iso8601 -tee data/2025-06-01.parquet
+//
+// It takes the fetch run's flags. The query, its where clause, geometry
+// and sort order come from the archive's manifest; the records go through
+// the same pipeline as a fetch, served in-process from the archive, and
+// no request leaves the machine: notifications and tracing are off.
+func runReprocess(args []string) int {
+	fs := flag.NewFlagSet("reprocess", flag.ExitOnError)
+	var opts Options
+	opts.register(fs)
+	archive := fs.String("archive", "", "run directory of a -raw-dir archive (default the latest run in "+filepath.Join(outputDir, "raw")+")")
+	fs.Parse(args)
+	if err := setupLogging(&opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFatal
+	}
+	var refused []string
+	fs.Visit(func(f *flag.Flag) {
+		if slices.Contains(reprocessOffline, f.Name) {
+			refused = append(refused, "-"+f.Name)
+		}
+	})
+	if len(refused) > 0 {
+		fmt.Fprintln(os.Stderr, "reprocess: works offline, so it cannot be combined with "+strings.Join(refused, ", "))
+		return exitFatal
+	}
+
+	dir := *archive
+	if dir == "" {
+		var err error
+		if dir, err = latestRawRun(filepath.Join(outputDir, "raw")); err != nil {
+			slog.Error("no raw archive to reprocess; pass -archive", "err", err)
+			return exitFatal
+		}
+	}
+	layer, m, err := loadArchiveLayer(dir)
+	if err != nil {
+		slog.Error("cannot load raw archive", "dir", dir, "err", err)
+		return exitFatal
+	}
+	slog.Info("reprocessing raw archive", "dir", dir, "url", m.URL, "startedAt", m.StartedAt, "records", len(layer.features))
+
+	opts.URL = m.URL
+	opts.Where = m.Params["where"]
+	opts.Since, opts.Until, opts.BBox, opts.Polygon = "", "", "", ""
+	opts.OrderBy = m.Params["orderByFields"]
+	opts.Geometry = m.Params["returnGeometry"] == "true"
+	opts.OutSR = m.Params["outSR"]
+	opts.QueryFormat = "json"
+
+	job := newFetchJob(&opts)
+	// Not even a webhook or collector named in the environment is sent to.
+	job.notifiers, job.tracer = nil, nil
+	job.client.HTTP.Transport = handlerTransport{handler: layer}
+	_, code := job.run(false)
+	return code
+}
+
+// latestRawRun returns the newest run directory under a -raw-dir; their
+// names are start times, so that is the last in name order.
+func latestRawRun(root string) (string, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return "", err
+	}
+	for _, e := range slices.Backward(entries) {
+		if _, err := os.Stat(filepath.Join(root, e.Name(), rawManifestFile)); e.IsDir() && err == nil {
+			return filepath.Join(root, e.Name()), nil
+		}
+	}
+	return "", fmt.Errorf("no run with a %s in %s", rawManifestFile, root)
+}
+
+// loadArchiveLayer reads a -raw-dir run directory into a memory layer
+// that serves its records in the order the run wrote them: the pages by
+// offset, then the records fetched by ObjectId. Where pages overlap, as
+// after a page was split and later fetched whole by a resumed run, the
+// records already covered are left out.
+func loadArchiveLayer(dir string) (*memoryLayer, *rawManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, rawManifestFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	var m rawManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", rawManifestFile, err)
+	}
+	ext := "." + m.Format
+
+	type rawFile struct {
+		name    string
+		objects bool  // objects_<first ObjectId> rather than offset_<n>
+		key     int64 // the offset or the ObjectId
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var files []rawFile
+	for _, e := range entries {
+		base, ok := strings.CutSuffix(e.Name(), ext)
+		if !ok || e.IsDir() {
+			continue
+		}
+		f := rawFile{name: e.Name()}
+		n, isOffset := strings.CutPrefix(base, "offset_")
+		if !isOffset {
+			if n, ok = strings.CutPrefix(base, "objects_"); !ok {
+				continue
+			}
+			f.objects = true
+		}
+		if f.key, err = strconv.ParseInt(n, 10, 64); err != nil {
+			continue
+		}
+		files = append(files, f)
+	}
+	slices.SortFunc(files, func(a, b rawFile) int {
+		if a.objects != b.objects {
+			if a.objects {
+				return 1
+			}
+			return -1
+		}
+		return cmp.Compare(a.key, b.key)
+	})
+	if len(files) == 0 {
+		return nil, nil, fmt.Errorf("no %s responses in %s", m.Format, dir)
+	}
+
+	decode := featureDecoder(m.Format)
+	var features []layerFeature
+	next := int64(0) // offset of the first record no page has covered yet
+	for _, f := range files {
+		body, err := os.Open(filepath.Join(dir, f.name))
+		if err != nil {
+			return nil, nil, err
+		}
+		var page []layerFeature
+		_, err = decode(body, func(attrs map[string]interface{}, g *Geometry) {
+			page = append(page, archivedFeature(attrs, g))
+		})
+		body.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", f.name, err)
+		}
+		if !f.objects {
+			end := f.key + int64(len(page))
+			switch {
+			case f.key > next:
+				slog.Warn("the archive is missing records; pages that failed were not saved", "from", next, "to", f.key)
+			case f.key < next:
+				page = page[min(next-f.key, int64(len(page))):]
+			}
+			next = max(next, end)
+		}
+		features = append(features, page...)
+	}
+
+	l := &memoryLayer{
+		layer:    map[string]interface{}{"supportedQueryFormats": "JSON"},
+		pageSize: max(len(features), 1),
+		features: features,
+	}
+	return l, &m, nil
+}
+
+// archivedFeature turns a decoded record back into the esri JSON the
+// memory layer serves. Numbers are float64 either way, so the values
+// decode as the original response's did.
+func archivedFeature(attrs map[string]interface{}, g *Geometry) layerFeature {
+	f := layerFeature{Attributes: make(map[string]json.RawMessage, len(attrs))}
+	for name, value := range attrs {
+		f.Attributes[name], _ = json.Marshal(value)
+	}
+	if g != nil {
+		f.Geometry, _ = json.Marshal(g)
+	}
+	return f
+}
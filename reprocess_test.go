@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Reprocessing the raw archive of a run writes the output the run did.
+func TestReprocessMatchesFetch(t *testing.T) {
+	_, server := newFixtureServer(t)
+	dir := t.TempDir()
+	common := []string{"-report", "", "-lock", "", "-provenance=false", "-progress", "off"}
+	fetched := filepath.Join(dir, "fetched.csv")
+	args := append([]string{
+		"-url", server.URL + "/FeatureServer/0", "-out", fetched, "-raw-dir", filepath.Join(dir, "raw"),
+	}, common...)
+	if code := runFixtureFetch(t, args); code != exitOK {
+		t.Fatalf("fetch exited with %d", code)
+	}
+	server.Close() // nothing may be requested from here on
+
+	run, err := latestRawRun(filepath.Join(dir, "raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reprocessed := filepath.Join(dir, "reprocessed.csv")
+	if code := runReprocess(append([]string{"-archive", run, "-out", reprocessed}, common...)); code != exitOK {
+		t.Fatalf("reprocess exited with %d", code)
+	}
+	want, err := os.ReadFile(fetched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(reprocessed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("reprocessed output differs: %s", goldenDiff(want, got))
+	}
+}
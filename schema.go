@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DictionaryField is one row of the data dictionary.
+type DictionaryField struct {
+	Name     string   `json:"name"`
+	Alias    string   `json:"alias,omitempty"`
+	Type     string   `json:"type"`
+	Length   int      `json:"length,omitempty"`
+	Nullable *bool    `json:"nullable,omitempty"`
+	Domain   []string `json:"domain,omitempty"` // "code = description" pairs, or a "min to max" range
+	Nulls    int      `json:"nulls"`            // null or empty values in the sample
+	Example  string   `json:"example,omitempty"`
+}
+
+// Dictionary describes the fields of a layer, for a data delivery.
+type Dictionary struct {
+	Layer       string            `json:"layer"`
+	URL         string            `json:"url"`
+	GeneratedAt time.Time         `json:"generatedAt"`
+	SampleSize  int               `json:"sampleSize"`
+	Fields      []DictionaryField `json:"fields"`
+}
+
+// runSchema implements the schema subcommand (also called dict), which
+// writes a data dictionary of the layer: each field's alias, type, length
+// and domain from the layer metadata, and how many values are null in a
+// sample of the records:
+//
+//	go run . schema -format markdown -out data/dictionary.md
+func runSchema(args []string) int {
+	fs := flag.NewFlagSet("schema", flag.ExitOnError)
+	var opts Options
+	opts.registerClient(fs)
+	opts.registerQuery(fs)
+	opts.registerLogging(fs)
+	format := fs.String("format", "markdown", "output format: markdown, csv or json")
+	sample := fs.Int("sample", 1000, "records sampled for null counts and examples (0 to skip)")
+	out := fs.String("out", "", "write the dictionary to this file instead of printing it")
+	fs.Parse(args)
+	if err := setupLogging(&opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFatal
+	}
+
+	write, ok := dictionaryWriters[*format]
+	if !ok {
+		slog.Error("invalid -format: want markdown, csv or json", "format", *format)
+		return exitFatal
+	}
+
+	query, err := newQuery(&opts)
+	if err != nil {
+		slog.Error("invalid query options", "err", err)
+		return exitFatal
+	}
+
+	client, err := newClient(&opts)
+	if err != nil {
+		slog.Error("invalid connection options", "err", err)
+		return exitFatal
+	}
+
+	ctx := context.Background()
+	info, err := fetchLayerInfo(ctx, client, query.URL)
+	if err != nil {
+		slog.Error("cannot read layer metadata", "err", err)
+		return exitFatal
+	}
+
+	var records []map[string]interface{}
+	if *sample > 0 {
+		if records, err = fetchBatch(ctx, 0, *sample, client, query, nil); err != nil {
+			slog.Error("cannot fetch sample records", "err", err)
+			return exitFatal
+		}
+	}
+
+	dict := newDictionary(info, query, records)
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			slog.Error("cannot create dictionary", "err", err)
+			return exitFatal
+		}
+		defer file.Close()
+		w = file
+	}
+	if err := write(w, dict); err != nil {
+		slog.Error("cannot write dictionary", "err", err)
+		return exitFatal
+	}
+	if *out != "" {
+		slog.Info("data dictionary saved", "path", *out, "fields", len(dict.Fields))
+	}
+	return exitOK
+}
+
+// newDictionary describes the layer fields.
+func newDictionary(info *LayerInfo, query *Query, records []map[string]interface{}) *Dictionary {
+	dict := &Dictionary{
+		Layer:       info.Name,
+		URL:         layerURL(query.URL),
+		GeneratedAt: time.Now().UTC().Truncate(time.Second),
+		SampleSize:  len(records),
+	}
+	formatter := defaultFormatter()
+	for _, field := range info.Fields {
+		d := DictionaryField{
+			Name:     field.Name,
+			Alias:    field.Alias,
+			Type:     strings.TrimPrefix(field.Type, "esriFieldType"),
+			Length:   field.Length,
+			Nullable: field.Nullable,
+		}
+		if d.Alias == d.Name {
+			d.Alias = ""
+		}
+		if field.Type != "esriFieldTypeString" {
+			d.Length = 0
+		}
+		if dom := field.Domain; dom != nil {
+			for _, cv := range dom.CodedValues {
+				d.Domain = append(d.Domain, fmt.Sprintf("%v = %s", cv.Code, cv.Name))
+			}
+			if len(dom.Range) == 2 {
+				d.Domain = append(d.Domain, strconv.FormatFloat(dom.Range[0], 'f', -1, 64)+" to "+strconv.FormatFloat(dom.Range[1], 'f', -1, 64))
+			}
+		}
+		for _, record := range records {
+			value := record[field.Name]
+			if value == nil || value == "" {
+				d.Nulls++
+			} else if d.Example == "" {
+				d.Example = formatter.formatValue(field.Name, value)
+			}
+		}
+		dict.Fields = append(dict.Fields, d)
+	}
+	return dict
+}
+
+// dictionaryWriters are the -format values of the schema subcommand.
+var dictionaryWriters = map[string]func(io.Writer, *Dictionary) error{
+	"markdown": writeDictionaryMarkdown,
+	"csv":      writeDictionaryCSV,
+	"json": func(w io.Writer, d *Dictionary) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(d)
+	},
+}
+
+func writeDictionaryMarkdown(w io.Writer, d *Dictionary) error {
+	cell := func(s string) string { return strings.ReplaceAll(s, "|", `\|`) }
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Data dictionary: %s\n\n", d.Layer)
+	fmt.Fprintf(&b, "Source: %s  \nGenerated: %s", d.URL, d.GeneratedAt.Format(time.RFC3339))
+	if d.SampleSize > 0 {
+		fmt.Fprintf(&b, "  \nNull counts are from a sample of %s records.", formatCount(d.SampleSize))
+	}
+	b.WriteString("\n\n| Field | Alias | Type | Length | Nullable | Values | Nulls | Example |\n")
+	b.WriteString("|---|---|---|---|---|---|---|---|\n")
+	for _, f := range d.Fields {
+		length, nullable, nulls := "", "", ""
+		if f.Length > 0 {
+			length = strconv.Itoa(f.Length)
+		}
+		if f.Nullable != nil {
+			nullable = map[bool]string{true: "yes", false: "no"}[*f.Nullable]
+		}
+		if d.SampleSize > 0 {
+			nulls = fmt.Sprintf("%d (%.0f%%)", f.Nulls, 100*float64(f.Nulls)/float64(d.SampleSize))
+		}
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %s | %s | %s | %s |\n", cell(f.Name), cell(f.Alias), f.Type,
+			length, nullable, cell(strings.Join(f.Domain, "; ")), nulls, cell(f.Example))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeDictionaryCSV(w io.Writer, d *Dictionary) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"field", "alias", "type", "length", "nullable", "values", "nulls", "sample_size", "example"})
+	for _, f := range d.Fields {
+		nullable := ""
+		if f.Nullable != nil {
+			nullable = strconv.FormatBool(*f.Nullable)
+		}
+		cw.Write([]string{f.Name, f.Alias, f.Type, strconv.Itoa(f.Length), nullable,
+			strings.Join(f.Domain, "; "), strconv.Itoa(f.Nulls), strconv.Itoa(d.SampleSize), f.Example})
+	}
+	cw.Flush()
+	return cw.Error()
+}
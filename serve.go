@@ -0,0 +1,573 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// idField is the column /records/{objectId} looks records up by.
+const idField = "ObjectId"
+
+// reloadInterval is how often the server checks whether the extract on
+// disk has been replaced by a newer run.
+const reloadInterval = 5 * time.Second
+
+// defaultRecordLimit and maxRecordLimit bound the page size of /records.
+const (
+	defaultRecordLimit = 100
+	maxRecordLimit     = 10000
+)
+
+// runServe implements the serve subcommand, a small read-only HTTP API over
+// the most recent extract, so internal tools can query it without a
+// database:
+//
+//	go run . serve -addr localhost:8080
+//	curl 'localhost:8080/records?zip=40211&since=2024-01-01'
+//	curl localhost:8080/records/1001
+//	curl localhost:8080/stats/neighborhood
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var opts Options
+	opts.registerLogging(fs)
+	addr := fs.String("addr", "localhost:8080", "address to listen on")
+	data := fs.String("data", "", "CSV file to serve, instead of the outputs of the last run recorded in -report")
+	fs.StringVar(&opts.Report, "report", filepath.Join(outputDir, defaultReportFile), "run report naming the latest outputs")
+	fs.StringVar(&opts.DateField, "date-field", "Action_Filed", "date field that since and until filter on")
+	fs.StringVar(&opts.DateFormat, "date-format", "default", "-date-format the extract was written with")
+	fs.StringVar(&opts.TZ, "tz", "", "-tz the extract was written with")
+	fs.StringVar(&opts.Delimiter, "delimiter", ",", "-delimiter the extract was written with")
+	verify := fs.Bool("verify", false, "only load files that match the "+checksumFile+" manifest next to them, written by -checksums")
+	fs.Parse(args)
+	if err := setupLogging(&opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFatal
+	}
+
+	formatter, err := newFormatter(&opts)
+	if err != nil {
+		slog.Error("invalid formatting options", "err", err)
+		return exitFatal
+	}
+	comma, err := parseDelimiter(opts.Delimiter)
+	if err != nil {
+		slog.Error("invalid formatting options", "err", err)
+		return exitFatal
+	}
+
+	store := &extractStore{
+		paths:     func() []string { return latestOutputs(*data, opts.Report, filepath.Join(outputDir, outputFile)) },
+		comma:     comma,
+		dateField: opts.DateField,
+		formatter: formatter,
+		verify:    *verify,
+	}
+	ds, err := store.get()
+	if err != nil {
+		slog.Error("cannot load extract", "err", err)
+		return exitFatal
+	}
+	slog.Info("extract loaded", "files", ds.paths, "records", len(ds.records))
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		slog.Error("cannot listen", "addr", *addr, "err", err)
+		return exitFatal
+	}
+	server := &http.Server{Handler: newServeMux(store), ReadHeaderTimeout: 10 * time.Second}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdown)
+	}()
+
+	slog.Info("serving", "url", "http://"+ln.Addr().String()+"/records")
+	if err := server.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("server failed", "err", err)
+		return exitFatal
+	}
+	slog.Info("server stopped")
+	return exitOK
+}
+
+// latestOutputs returns the files of the latest extract: data if given,
+// otherwise the outputs of the run in the report, otherwise fallback.
+func latestOutputs(data, reportPath, fallback string) []string {
+	if data != "" {
+		return []string{data}
+	}
+	if reportPath != "" {
+		var report RunReport
+		if raw, err := os.ReadFile(reportPath); err == nil && json.Unmarshal(raw, &report) == nil {
+			var paths []string
+			for _, out := range report.Outputs {
+				paths = append(paths, out.Path)
+			}
+			if len(paths) > 0 {
+				return paths
+			}
+		}
+	}
+	return []string{fallback}
+}
+
+// dataset is an extract loaded into memory. Partitioned outputs (-split-by)
+// are concatenated.
+type dataset struct {
+	paths    []string
+	modTimes []time.Time
+	header   []string
+	records  []map[string]string
+	dates    map[string][]time.Time // parsed values of each date column; zero if empty or unparseable
+	byID     map[string]int
+
+	dateColumn string // the -date-field column, which since and until filter on
+}
+
+// column returns the header spelling of a field name, which queries may
+// give in any case (zip for Zip).
+func (ds *dataset) column(name string) (string, bool) {
+	for _, h := range ds.header {
+		if strings.EqualFold(h, name) {
+			return h, true
+		}
+	}
+	return "", false
+}
+
+// extractStore holds the current dataset and reloads it when a newer run
+// replaces the files, so the server can stay up across fetches.
+type extractStore struct {
+	paths     func() []string
+	comma     rune
+	dateField string
+	formatter *Formatter
+	verify    bool // check the files against their checksum manifest before loading
+
+	mu      sync.Mutex
+	current *dataset
+	checked time.Time
+}
+
+// get returns the current dataset, reloading it if the files have changed
+// since it was read. A reload that fails keeps serving the old data.
+func (s *extractStore) get() (*dataset, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current != nil && time.Since(s.checked) < reloadInterval {
+		return s.current, nil
+	}
+	s.checked = time.Now()
+
+	paths := s.paths()
+	modTimes := make([]time.Time, len(paths))
+	for i, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			if s.current != nil {
+				slog.Warn("extract not reloaded", "err", err)
+				return s.current, nil
+			}
+			return nil, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	if s.current != nil && sameFiles(s.current, paths, modTimes) {
+		return s.current, nil
+	}
+
+	ds, err := s.load(paths, modTimes)
+	if err != nil {
+		if s.current != nil {
+			slog.Warn("extract not reloaded", "err", err)
+			return s.current, nil
+		}
+		return nil, err
+	}
+	if s.current != nil {
+		slog.Info("extract reloaded", "files", ds.paths, "records", len(ds.records))
+	}
+	s.current = ds
+	return ds, nil
+}
+
+func sameFiles(ds *dataset, paths []string, modTimes []time.Time) bool {
+	if len(ds.paths) != len(paths) {
+		return false
+	}
+	for i := range paths {
+		if ds.paths[i] != paths[i] || !ds.modTimes[i].Equal(modTimes[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *extractStore) load(paths []string, modTimes []time.Time) (*dataset, error) {
+	if s.verify {
+		if err := verifyChecksums(paths); err != nil {
+			return nil, err
+		}
+	}
+	ds := &dataset{paths: paths, modTimes: modTimes, byID: make(map[string]int)}
+	for _, path := range paths {
+		if err := s.loadFile(ds, path); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	ds.dateColumn, _ = ds.column(s.dateField)
+	ds.dates = make(map[string][]time.Time)
+	for _, column := range ds.header {
+		if !dateFields[column] && column != ds.dateColumn {
+			continue
+		}
+		parsed := make([]time.Time, len(ds.records))
+		for i, rec := range ds.records {
+			parsed[i], _ = s.formatter.parseDate(rec[column])
+		}
+		ds.dates[column] = parsed
+	}
+
+	if idColumn, ok := ds.column(idField); ok {
+		for i, rec := range ds.records {
+			if rec[idColumn] != "" {
+				ds.byID[rec[idColumn]] = i
+			}
+		}
+	}
+	return ds, nil
+}
+
+func (s *extractStore) loadFile(ds *dataset, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := csv.NewReader(file)
+	r.Comma = s.comma
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+
+	header, err := r.Read()
+	if err != nil {
+		return err
+	}
+	header = append([]string(nil), header...)
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], utf8BOM)
+	}
+	if ds.header == nil {
+		ds.header = header
+	}
+
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rec := make(map[string]string, len(header))
+		for i, name := range header {
+			if i < len(row) {
+				rec[name] = row[i]
+			}
+		}
+		ds.records = append(ds.records, rec)
+	}
+}
+
+// parseDate parses a date field value written by this Formatter, or given
+// as a query parameter: the -date-format layout, epoch seconds, or one of
+// the preset layouts. Dates without a zone are in the -tz zone.
+func (f *Formatter) parseDate(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == f.NullToken {
+		return time.Time{}, false
+	}
+	if f.EpochDates {
+		if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return time.Unix(sec, 0), true
+		}
+	}
+	layouts := []string{f.DateLayout, datePresets["default"], datePresets["iso8601"], datePresets["date-only"]}
+	for _, layout := range layouts {
+		if layout == "" {
+			continue
+		}
+		if t, err := time.ParseInLocation(layout, s, f.Location); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// recordFilter is the filter given by the query string of /records and
+// /stats: field=value equality, where repeating a field matches any of its
+// values, and since/until bounds on the date field.
+type recordFilter struct {
+	fields map[string][]string // header column -> accepted values
+	since  time.Time
+	until  time.Time
+}
+
+// reservedParams are query parameters that are not field filters.
+var reservedParams = map[string]bool{"since": true, "until": true, "limit": true, "offset": true}
+
+func parseRecordFilter(ds *dataset, f *Formatter, query map[string][]string) (*recordFilter, error) {
+	filter := &recordFilter{fields: make(map[string][]string)}
+	for name, values := range query {
+		key := strings.ToLower(name)
+		if reservedParams[key] {
+			continue
+		}
+		column, ok := ds.column(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown field %q", name)
+		}
+		filter.fields[column] = append(filter.fields[column], values...)
+	}
+
+	for _, bound := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &filter.since}, {"until", &filter.until}} {
+		value := firstParam(query, bound.name)
+		if value == "" {
+			continue
+		}
+		t, ok := f.parseDate(value)
+		if !ok {
+			return nil, fmt.Errorf("%s: cannot parse date %q; use YYYY-MM-DD", bound.name, value)
+		}
+		// As with -until, a plain date includes the whole day.
+		if _, err := time.Parse(datePresets["date-only"], value); err == nil && bound.name == "until" {
+			t = t.AddDate(0, 0, 1)
+		}
+		*bound.t = t
+	}
+	return filter, nil
+}
+
+// firstParam returns a query parameter, matching its name in any case.
+func firstParam(query map[string][]string, name string) string {
+	for key, values := range query {
+		if strings.EqualFold(key, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// match returns the indexes of the records the filter accepts, in file order.
+func (filter *recordFilter) match(ds *dataset) []int {
+	var matched []int
+	for i, rec := range ds.records {
+		if filter.accepts(ds, i, rec) {
+			matched = append(matched, i)
+		}
+	}
+	return matched
+}
+
+func (filter *recordFilter) accepts(ds *dataset, i int, rec map[string]string) bool {
+	// until has been moved to the start of the following day when it was
+	// a date, so it is exclusive here.
+	if !filter.since.IsZero() || !filter.until.IsZero() {
+		dates := ds.dates[ds.dateColumn]
+		if dates == nil || dates[i].IsZero() {
+			return false
+		}
+		if !filter.since.IsZero() && dates[i].Before(filter.since) {
+			return false
+		}
+		if !filter.until.IsZero() && !dates[i].Before(filter.until) {
+			return false
+		}
+	}
+	for column, values := range filter.fields {
+		ok := false
+		for _, v := range values {
+			if strings.EqualFold(rec[column], v) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// newServeMux routes the serve API.
+func newServeMux(store *extractStore) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", serveDashboard(store))
+	mux.HandleFunc("GET /graphql", serveGraphQL(store))
+	mux.HandleFunc("POST /graphql", serveGraphQL(store))
+	mux.HandleFunc("GET /records", func(w http.ResponseWriter, r *http.Request) {
+		ds, ok := loadDataset(w, store)
+		if !ok {
+			return
+		}
+		query := r.URL.Query()
+		filter, err := parseRecordFilter(ds, store.formatter, query)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		limit, err := intParam(query, "limit", defaultRecordLimit, maxRecordLimit)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		offset, err := intParam(query, "offset", 0, -1)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		matched := filter.match(ds)
+		page := matched[min(offset, len(matched)):]
+		page = page[:min(limit, len(page))]
+		records := make([]map[string]string, len(page))
+		for i, idx := range page {
+			records[i] = ds.records[idx]
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"total":   len(matched),
+			"offset":  offset,
+			"limit":   limit,
+			"records": records,
+		})
+	})
+	mux.HandleFunc("GET /records/{objectId}", func(w http.ResponseWriter, r *http.Request) {
+		ds, ok := loadDataset(w, store)
+		if !ok {
+			return
+		}
+		id := r.PathValue("objectId")
+		idx, found := ds.byID[id]
+		if !found {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no record with %s %s", idField, id))
+			return
+		}
+		writeJSON(w, http.StatusOK, ds.records[idx])
+	})
+	mux.HandleFunc("GET /stats/{field}", func(w http.ResponseWriter, r *http.Request) {
+		ds, ok := loadDataset(w, store)
+		if !ok {
+			return
+		}
+		column, found := ds.column(r.PathValue("field"))
+		if !found {
+			writeError(w, http.StatusNotFound, fmt.Errorf("unknown field %q", r.PathValue("field")))
+			return
+		}
+		filter, err := parseRecordFilter(ds, store.formatter, r.URL.Query())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		matched := filter.match(ds)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"field":  column,
+			"total":  len(matched),
+			"groups": countValues(ds, column, matched),
+		})
+	})
+	return mux
+}
+
+// valueCount is one group of /stats.
+type valueCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// countValues counts the records per value of a column, most frequent first.
+func countValues(ds *dataset, column string, matched []int) []valueCount {
+	counts := make(map[string]int)
+	for _, idx := range matched {
+		counts[ds.records[idx][column]]++
+	}
+	groups := make([]valueCount, 0, len(counts))
+	for value, n := range counts {
+		groups = append(groups, valueCount{Value: value, Count: n})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Count != groups[j].Count {
+			return groups[i].Count > groups[j].Count
+		}
+		return groups[i].Value < groups[j].Value
+	})
+	return groups
+}
+
+func loadDataset(w http.ResponseWriter, store *extractStore) (*dataset, bool) {
+	ds, err := store.get()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return nil, false
+	}
+	return ds, true
+}
+
+// intParam parses a non-negative integer parameter, capped at max unless
+// max is negative.
+func intParam(query map[string][]string, name string, def, max int) (int, error) {
+	value := firstParam(query, name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer, got %q", name, value)
+	}
+	if max >= 0 && n > max {
+		n = max
+	}
+	return n, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		slog.Debug("response not written", "err", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const serveTestCSV = `Zip,Neighborhood,Action_Filed,ObjectId
+40211,Shawnee,2023/12/31 23:59:59+00,1
+40211,Shawnee,2024/01/01 00:00:00+00,2
+40211,Chickasaw,2024/03/15 12:00:00+00,3
+40203,Russell,2024/03/15 23:30:00+00,4
+40203,Russell,2024/03/16 00:00:00+00,5
+40212,Portland,,6
+`
+
+// newServeTest serves the CSV content from a file in a temporary directory.
+func newServeTest(t *testing.T, content string) (*extractStore, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "out.csv")
+	writeTestFile(t, path, content)
+	f, err := newFormatter(&Options{DateFormat: "default"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &extractStore{
+		paths:     func() []string { return []string{path} },
+		comma:     ',',
+		dateField: "Action_Filed",
+		formatter: f,
+	}
+	return store, path
+}
+
+// serveGet requests target from the serve API and decodes the JSON body.
+func serveGet(t *testing.T, mux http.Handler, target string, v interface{}) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("GET %s: Content-Type %q", target, ct)
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("GET %s: %v\n%s", target, err, rec.Body)
+	}
+	return rec.Code
+}
+
+type recordsPage struct {
+	Total   int                 `json:"total"`
+	Offset  int                 `json:"offset"`
+	Limit   int                 `json:"limit"`
+	Records []map[string]string `json:"records"`
+	Error   string              `json:"error"`
+}
+
+func (p recordsPage) ids() []string {
+	ids := []string{}
+	for _, rec := range p.Records {
+		ids = append(ids, rec[idField])
+	}
+	return ids
+}
+
+func TestServeRecords(t *testing.T) {
+	store, _ := newServeTest(t, serveTestCSV)
+	mux := newServeMux(store)
+
+	tests := []struct {
+		target     string
+		wantStatus int
+		wantTotal  int
+		wantIDs    []string
+		wantLimit  int
+		wantErr    string
+	}{
+		{"/records", 200, 6, []string{"1", "2", "3", "4", "5", "6"}, defaultRecordLimit, ""},
+		{"/records?zip=40211&since=2024-01-01", 200, 2, []string{"2", "3"}, defaultRecordLimit, ""},
+		{"/records?Neighborhood=russell", 200, 2, []string{"4", "5"}, defaultRecordLimit, ""},
+		{"/records?neighborhood=Shawnee&neighborhood=Portland", 200, 3, []string{"1", "2", "6"}, defaultRecordLimit, ""},
+		// A plain date includes the whole day; a time does not.
+		{"/records?until=2024-03-15", 200, 4, []string{"1", "2", "3", "4"}, defaultRecordLimit, ""},
+		{"/records?until=2024/03/15%2012:00:00%2B00", 200, 2, []string{"1", "2"}, defaultRecordLimit, ""},
+		{"/records?since=2024-03-15&until=2024-03-15", 200, 2, []string{"3", "4"}, defaultRecordLimit, ""},
+		// Records without a date never match a date bound.
+		{"/records?zip=40212&since=2000-01-01", 200, 0, []string{}, defaultRecordLimit, ""},
+		{"/records?limit=2", 200, 6, []string{"1", "2"}, 2, ""},
+		{"/records?limit=2&offset=4", 200, 6, []string{"5", "6"}, 2, ""},
+		{"/records?offset=6", 200, 6, []string{}, defaultRecordLimit, ""},
+		{"/records?offset=100", 200, 6, []string{}, defaultRecordLimit, ""},
+		{"/records?limit=0", 200, 6, []string{}, 0, ""},
+		{"/records?limit=1000000", 200, 6, []string{"1", "2", "3", "4", "5", "6"}, maxRecordLimit, ""},
+		{"/records?limit=-1", 400, 0, []string{}, 0, "limit must be a non-negative integer"},
+		{"/records?offset=x", 400, 0, []string{}, 0, "offset must be a non-negative integer"},
+		{"/records?since=yesterday", 400, 0, []string{}, 0, "since: cannot parse date"},
+		{"/records?color=red", 400, 0, []string{}, 0, `unknown field "color"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			var page recordsPage
+			status := serveGet(t, mux, tt.target, &page)
+			if status != tt.wantStatus {
+				t.Fatalf("status %d, want %d (%s)", status, tt.wantStatus, page.Error)
+			}
+			if tt.wantErr != "" {
+				if !strings.Contains(page.Error, tt.wantErr) {
+					t.Errorf("error %q, want it to contain %q", page.Error, tt.wantErr)
+				}
+				return
+			}
+			if page.Total != tt.wantTotal || page.Limit != tt.wantLimit {
+				t.Errorf("total %d, limit %d; want %d, %d", page.Total, page.Limit, tt.wantTotal, tt.wantLimit)
+			}
+			if got := page.ids(); !reflect.DeepEqual(got, tt.wantIDs) {
+				t.Errorf("records %v, want %v", got, tt.wantIDs)
+			}
+		})
+	}
+}
+
+func TestServeRecordByID(t *testing.T) {
+	store, _ := newServeTest(t, serveTestCSV)
+	mux := newServeMux(store)
+
+	var rec map[string]string
+	if status := serveGet(t, mux, "/records/3", &rec); status != http.StatusOK {
+		t.Fatalf("status %d, want 200", status)
+	}
+	want := map[string]string{"Zip": "40211", "Neighborhood": "Chickasaw", "Action_Filed": "2024/03/15 12:00:00+00", "ObjectId": "3"}
+	if !reflect.DeepEqual(rec, want) {
+		t.Errorf("record %v, want %v", rec, want)
+	}
+
+	var notFound map[string]string
+	if status := serveGet(t, mux, "/records/99", &notFound); status != http.StatusNotFound {
+		t.Fatalf("status %d, want 404", status)
+	}
+	if notFound["error"] != "no record with ObjectId 99" {
+		t.Errorf("error %q", notFound["error"])
+	}
+}
+
+func TestServeStats(t *testing.T) {
+	store, _ := newServeTest(t, serveTestCSV)
+	mux := newServeMux(store)
+
+	type stats struct {
+		Field  string       `json:"field"`
+		Total  int          `json:"total"`
+		Groups []valueCount `json:"groups"`
+		Error  string       `json:"error"`
+	}
+	tests := []struct {
+		target     string
+		wantStatus int
+		want       stats
+	}{
+		{"/stats/neighborhood", 200, stats{Field: "Neighborhood", Total: 6, Groups: []valueCount{{"Russell", 2}, {"Shawnee", 2}, {"Chickasaw", 1}, {"Portland", 1}}}},
+		{"/stats/Zip?since=2024-01-01", 200, stats{Field: "Zip", Total: 4, Groups: []valueCount{{"40203", 2}, {"40211", 2}}}},
+		{"/stats/zip?neighborhood=Portland", 200, stats{Field: "Zip", Total: 1, Groups: []valueCount{{"40212", 1}}}},
+		{"/stats/color", 404, stats{Error: `unknown field "color"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			var got stats
+			if status := serveGet(t, mux, tt.target, &got); status != tt.wantStatus {
+				t.Fatalf("status %d, want %d", status, tt.wantStatus)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractStoreReload(t *testing.T) {
+	store, path := newServeTest(t, serveTestCSV)
+	mux := newServeMux(store)
+
+	var page recordsPage
+	serveGet(t, mux, "/records", &page)
+	if page.Total != 6 {
+		t.Fatalf("total %d before the new run, want 6", page.Total)
+	}
+
+	// A newer run replaces the file. Within reloadInterval the server keeps
+	// the data it has without looking at the file.
+	writeTestFile(t, path, "Zip,Neighborhood,Action_Filed,ObjectId\n40211,Shawnee,2024/05/01 00:00:00+00,7\n")
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	serveGet(t, mux, "/records", &page)
+	if page.Total != 6 {
+		t.Fatalf("total %d within the reload interval, want 6", page.Total)
+	}
+
+	store.checked = time.Time{}
+	serveGet(t, mux, "/records", &page)
+	if got := page.ids(); !reflect.DeepEqual(got, []string{"7"}) {
+		t.Fatalf("records %v after the new run, want [7]", got)
+	}
+
+	// A reload that fails keeps serving the old data.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	store.checked = time.Time{}
+	serveGet(t, mux, "/records", &page)
+	if got := page.ids(); !reflect.DeepEqual(got, []string{"7"}) {
+		t.Errorf("records %v after the file went away, want [7]", got)
+	}
+}
+
+func TestExtractStoreMissing(t *testing.T) {
+	store, path := newServeTest(t, serveTestCSV)
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	var body map[string]string
+	if status := serveGet(t, newServeMux(store), "/records", &body); status != http.StatusServiceUnavailable {
+		t.Errorf("status %d without an extract, want 503", status)
+	}
+	if body["error"] == "" {
+		t.Error("no error message")
+	}
+}
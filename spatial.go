@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// SpatialFilter restricts a query to features intersecting a geometry.
+type SpatialFilter struct {
+	Geometry     string // esri JSON geometry (or "xmin,ymin,xmax,ymax" for envelopes)
+	GeometryType string // esriGeometryEnvelope or esriGeometryPolygon
+	InSR         string // spatial reference of Geometry
+}
+
+// params adds the spatial query parameters to a request.
+func (s *SpatialFilter) params(v url.Values) {
+	v.Set("geometry", s.Geometry)
+	v.Set("geometryType", s.GeometryType)
+	v.Set("spatialRel", "esriSpatialRelIntersects")
+	if s.InSR != "" {
+		v.Set("inSR", s.InSR)
+	}
+}
+
+// parseBBox parses a "xmin,ymin,xmax,ymax" envelope given in the -bbox-sr
+// spatial reference (WGS84 longitude/latitude by default).
+func parseBBox(spec, sr string) (*SpatialFilter, error) {
+	parts := strings.Split(spec, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("bbox %q must be xmin,ymin,xmax,ymax", spec)
+	}
+
+	var coords [4]float64
+	for i, p := range parts {
+		n, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, fmt.Errorf("bbox %q: %q is not a number", spec, p)
+		}
+		coords[i] = n
+	}
+	if coords[0] > coords[2] || coords[1] > coords[3] {
+		return nil, fmt.Errorf("bbox %q: min values must not exceed max values", spec)
+	}
+
+	return &SpatialFilter{
+		Geometry: fmt.Sprintf("%s,%s,%s,%s",
+			strconv.FormatFloat(coords[0], 'f', -1, 64), strconv.FormatFloat(coords[1], 'f', -1, 64),
+			strconv.FormatFloat(coords[2], 'f', -1, 64), strconv.FormatFloat(coords[3], 'f', -1, 64)),
+		GeometryType: "esriGeometryEnvelope",
+		InSR:         sr,
+	}, nil
+}
+
+// geoJSON covers the GeoJSON objects accepted by -polygon: a Polygon or
+// MultiPolygon geometry, a Feature, or a FeatureCollection.
+type geoJSON struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+	Geometry    *geoJSON        `json:"geometry"`
+	Features    []geoJSON       `json:"features"`
+}
+
+// loadPolygon reads a GeoJSON file and converts every polygon in it into a
+// single esri JSON polygon. GeoJSON coordinates are always WGS84, so the
+// filter is sent with inSR=4326.
+func loadPolygon(path string) (*SpatialFilter, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc geoJSON
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var rings [][][2]float64
+	if err := collectRings(&doc, &rings); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(rings) == 0 {
+		return nil, fmt.Errorf("%s: no Polygon or MultiPolygon geometry found", path)
+	}
+
+	geometry, err := json.Marshal(map[string]interface{}{
+		"rings":            rings,
+		"spatialReference": map[string]int{"wkid": 4326},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &SpatialFilter{
+		Geometry:     string(geometry),
+		GeometryType: "esriGeometryPolygon",
+		InSR:         "4326",
+	}, nil
+}
+
+func collectRings(g *geoJSON, rings *[][][2]float64) error {
+	switch g.Type {
+	case "FeatureCollection":
+		for i := range g.Features {
+			if err := collectRings(&g.Features[i], rings); err != nil {
+				return err
+			}
+		}
+	case "Feature":
+		if g.Geometry != nil {
+			return collectRings(g.Geometry, rings)
+		}
+	case "Polygon":
+		var polygon [][][2]float64
+		if err := json.Unmarshal(g.Coordinates, &polygon); err != nil {
+			return fmt.Errorf("invalid Polygon coordinates: %w", err)
+		}
+		*rings = append(*rings, esriRings(polygon)...)
+	case "MultiPolygon":
+		var polygons [][][][2]float64
+		if err := json.Unmarshal(g.Coordinates, &polygons); err != nil {
+			return fmt.Errorf("invalid MultiPolygon coordinates: %w", err)
+		}
+		for _, polygon := range polygons {
+			*rings = append(*rings, esriRings(polygon)...)
+		}
+	default:
+		return fmt.Errorf("unsupported GeoJSON type %q", g.Type)
+	}
+	return nil
+}
+
+// esriRings reorients a GeoJSON polygon's rings for esri JSON, where outer
+// rings run clockwise and holes counter-clockwise (the opposite of RFC 7946).
+func esriRings(polygon [][][2]float64) [][][2]float64 {
+	out := make([][][2]float64, 0, len(polygon))
+	for i, ring := range polygon {
+		clockwise := signedArea(ring) < 0
+		outer := i == 0
+		if clockwise != outer {
+			reversed := make([][2]float64, len(ring))
+			for j := range ring {
+				reversed[j] = ring[len(ring)-1-j]
+			}
+			ring = reversed
+		}
+		out = append(out, ring)
+	}
+	return out
+}
+
+// signedArea uses the shoelace formula; the result is negative for
+// clockwise rings.
+func signedArea(ring [][2]float64) float64 {
+	var area float64
+	for i := range ring {
+		j := (i + 1) % len(ring)
+		area += ring[i][0]*ring[j][1] - ring[j][0]*ring[i][1]
+	}
+	return area / 2
+}
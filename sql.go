@@ -0,0 +1,1312 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runSQL implements the query subcommand, which runs a SQL SELECT over the
+// latest extract, so one-off questions need neither a database nor a
+// spreadsheet:
+//
+//	go run . query "SELECT Purchaser, SUM(Sale_Price) AS total FROM extract
+//	    WHERE year(Sale_Date) = 2024 GROUP BY Purchaser ORDER BY total DESC LIMIT 10"
+//
+// The engine is small: one table, no joins or subqueries. See sqlParser
+// for what it understands.
+func runSQL(args []string) int {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	var opts Options
+	opts.registerLogging(fs)
+	data := fs.String("data", "", "CSV file to query, instead of the outputs of the last run recorded in -report")
+	fs.StringVar(&opts.Report, "report", filepath.Join(outputDir, defaultReportFile), "run report naming the latest outputs")
+	fs.StringVar(&opts.DateFormat, "date-format", "default", "-date-format the extract was written with")
+	fs.StringVar(&opts.TZ, "tz", "", "-tz the extract was written with")
+	fs.StringVar(&opts.Delimiter, "delimiter", ",", "-delimiter the extract was written with")
+	format := fs.String("format", "table", "result format: table, csv or json")
+	fs.Parse(args)
+	if err := setupLogging(&opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFatal
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, `query: expected one SELECT statement, e.g. "SELECT Zip, COUNT(*) FROM extract GROUP BY Zip"`)
+		fs.Usage()
+		return exitFatal
+	}
+	if !slices.Contains([]string{"table", "csv", "json"}, *format) {
+		fmt.Fprintln(os.Stderr, "query: -format must be table, csv or json")
+		return exitFatal
+	}
+
+	formatter, err := newFormatter(&opts)
+	if err != nil {
+		slog.Error("invalid formatting options", "err", err)
+		return exitFatal
+	}
+	comma, err := parseDelimiter(opts.Delimiter)
+	if err != nil {
+		slog.Error("invalid formatting options", "err", err)
+		return exitFatal
+	}
+	store := &extractStore{comma: comma, formatter: formatter}
+	paths := latestOutputs(*data, opts.Report, filepath.Join(outputDir, outputFile))
+	ds, err := store.load(paths, make([]time.Time, len(paths)))
+	if err != nil {
+		slog.Error("cannot load extract", "err", err)
+		return exitFatal
+	}
+	slog.Debug("extract loaded", "files", ds.paths, "records", len(ds.records))
+
+	stmt, err := parseSQL(fs.Arg(0), ds.header)
+	if err != nil {
+		slog.Error("invalid query", "err", err)
+		return exitFatal
+	}
+	result, err := stmt.run(ds, formatter)
+	if err != nil {
+		slog.Error("query failed", "err", err)
+		return exitFatal
+	}
+	if err := result.write(os.Stdout, *format, formatter); err != nil {
+		slog.Error("cannot write result", "err", err)
+		return exitFatal
+	}
+	return exitOK
+}
+
+// A sqlValue is nil (NULL), a string as read from the extract, a float64,
+// a bool, or a time.Time for the date fields. Text is read as a number
+// where a number is needed, so "1250.00" sums like 1250.
+type sqlValue interface{}
+
+// sqlContext is what an expression is evaluated against: one record of
+// the extract, or with GROUP BY a group of them.
+type sqlContext struct {
+	ds    *dataset
+	f     *Formatter
+	row   int   // the record; -1 for an empty group
+	group []int // the records of the group, for aggregates; nil outside one
+}
+
+type sqlExpr interface {
+	eval(c *sqlContext) (sqlValue, error)
+}
+
+type sqlLiteral struct{ value sqlValue }
+
+func (e sqlLiteral) eval(*sqlContext) (sqlValue, error) { return e.value, nil }
+
+type sqlColumn struct{ name string }
+
+func (e sqlColumn) eval(c *sqlContext) (sqlValue, error) {
+	if c.row < 0 {
+		return nil, nil
+	}
+	if dates, ok := c.ds.dates[e.name]; ok {
+		if t := dates[c.row]; !t.IsZero() {
+			return t, nil
+		}
+		return nil, nil
+	}
+	s := c.ds.records[c.row][e.name]
+	if s == "" || s == c.f.NullToken {
+		return nil, nil
+	}
+	return s, nil
+}
+
+type sqlUnary struct {
+	op string // - or NOT
+	x  sqlExpr
+}
+
+func (e sqlUnary) eval(c *sqlContext) (sqlValue, error) {
+	v, err := e.x.eval(c)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	if e.op == "NOT" {
+		return !sqlTruth(v), nil
+	}
+	n, ok := sqlNumber(v)
+	if !ok {
+		return nil, fmt.Errorf("cannot negate %v", v)
+	}
+	return -n, nil
+}
+
+type sqlBinary struct {
+	op   string
+	l, r sqlExpr
+}
+
+func (e sqlBinary) eval(c *sqlContext) (sqlValue, error) {
+	l, err := e.l.eval(c)
+	if err != nil {
+		return nil, err
+	}
+	// AND and OR skip the right side when the left one decides.
+	switch e.op {
+	case "AND":
+		if l != nil && !sqlTruth(l) {
+			return false, nil
+		}
+	case "OR":
+		if l != nil && sqlTruth(l) {
+			return true, nil
+		}
+	}
+	r, err := e.r.eval(c)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "AND", "OR":
+		if r == nil || l == nil {
+			if r != nil && sqlTruth(r) == (e.op == "OR") {
+				return e.op == "OR", nil
+			}
+			return nil, nil
+		}
+		return sqlTruth(r), nil
+	}
+	if l == nil || r == nil {
+		return nil, nil
+	}
+	switch e.op {
+	case "||":
+		return sqlText(l, c.f) + sqlText(r, c.f), nil
+	case "=", "!=", "<", "<=", ">", ">=":
+		cmp, ok := sqlCompare(l, r, c.f)
+		if !ok {
+			return nil, nil
+		}
+		switch e.op {
+		case "=":
+			return cmp == 0, nil
+		case "!=":
+			return cmp != 0, nil
+		case "<":
+			return cmp < 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		case ">":
+			return cmp > 0, nil
+		}
+		return cmp >= 0, nil
+	}
+	x, okX := sqlNumber(l)
+	y, okY := sqlNumber(r)
+	if !okX || !okY {
+		return nil, fmt.Errorf("%s needs numbers, not %v and %v", e.op, l, r)
+	}
+	switch e.op {
+	case "+":
+		return x + y, nil
+	case "-":
+		return x - y, nil
+	case "*":
+		return x * y, nil
+	case "/":
+		if y == 0 {
+			return nil, nil
+		}
+		return x / y, nil
+	}
+	if y == 0 {
+		return nil, nil
+	}
+	return math.Mod(x, y), nil
+}
+
+type sqlIn struct {
+	x    sqlExpr
+	list []sqlExpr
+	not  bool
+}
+
+func (e sqlIn) eval(c *sqlContext) (sqlValue, error) {
+	v, err := e.x.eval(c)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	for _, item := range e.list {
+		w, err := item.eval(c)
+		if err != nil {
+			return nil, err
+		}
+		if cmp, ok := sqlCompare(v, w, c.f); ok && cmp == 0 {
+			return !e.not, nil
+		}
+	}
+	return e.not, nil
+}
+
+type sqlLike struct {
+	x       sqlExpr
+	pattern string
+	not     bool
+}
+
+func (e sqlLike) eval(c *sqlContext) (sqlValue, error) {
+	v, err := e.x.eval(c)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	return likePattern(e.pattern).MatchString(sqlText(v, c.f)) != e.not, nil
+}
+
+type sqlIsNull struct {
+	x   sqlExpr
+	not bool
+}
+
+func (e sqlIsNull) eval(c *sqlContext) (sqlValue, error) {
+	v, err := e.x.eval(c)
+	if err != nil {
+		return nil, err
+	}
+	return (v == nil) != e.not, nil
+}
+
+type sqlBetween struct {
+	x, lo, hi sqlExpr
+	not       bool
+}
+
+func (e sqlBetween) eval(c *sqlContext) (sqlValue, error) {
+	ge, err := sqlBinary{op: ">=", l: e.x, r: e.lo}.eval(c)
+	if err != nil || ge == nil {
+		return nil, err
+	}
+	le, err := sqlBinary{op: "<=", l: e.x, r: e.hi}.eval(c)
+	if err != nil || le == nil {
+		return nil, err
+	}
+	return (ge.(bool) && le.(bool)) != e.not, nil
+}
+
+// sqlAggregates are the aggregate functions.
+var sqlAggregates = map[string]bool{"COUNT": true, "SUM": true, "AVG": true, "MIN": true, "MAX": true}
+
+type sqlCall struct {
+	name     string // upper case
+	args     []sqlExpr
+	star     bool // COUNT(*)
+	distinct bool // COUNT(DISTINCT x)
+}
+
+func (e sqlCall) eval(c *sqlContext) (sqlValue, error) {
+	if sqlAggregates[e.name] {
+		return e.aggregate(c)
+	}
+	args := make([]sqlValue, len(e.args))
+	for i, arg := range e.args {
+		v, err := arg.eval(c)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	if e.name == "COALESCE" {
+		for _, v := range args {
+			if v != nil {
+				return v, nil
+			}
+		}
+		return nil, nil
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+	switch e.name {
+	case "YEAR", "MONTH", "DAY", "DATE":
+		t, ok := sqlTime(args[0], c.f)
+		if !ok {
+			return nil, fmt.Errorf("%s: %v is not a date", strings.ToLower(e.name), args[0])
+		}
+		switch e.name {
+		case "YEAR":
+			return float64(t.Year()), nil
+		case "MONTH":
+			return float64(t.Month()), nil
+		case "DAY":
+			return float64(t.Day()), nil
+		}
+		return t.Format(time.DateOnly), nil
+	case "LOWER":
+		return strings.ToLower(sqlText(args[0], c.f)), nil
+	case "UPPER":
+		return strings.ToUpper(sqlText(args[0], c.f)), nil
+	case "TRIM":
+		return strings.TrimSpace(sqlText(args[0], c.f)), nil
+	case "LENGTH":
+		return float64(len([]rune(sqlText(args[0], c.f)))), nil
+	case "SUBSTR":
+		s := []rune(sqlText(args[0], c.f))
+		start, ok := sqlNumber(args[1])
+		if !ok {
+			return nil, errors.New("substr: the start must be a number")
+		}
+		from := min(max(int(start)-1, 0), len(s))
+		to := len(s)
+		if len(args) == 3 {
+			n, ok := sqlNumber(args[2])
+			if !ok {
+				return nil, errors.New("substr: the length must be a number")
+			}
+			to = min(from+max(int(n), 0), len(s))
+		}
+		return string(s[from:to]), nil
+	}
+	// ABS and ROUND
+	x, ok := sqlNumber(args[0])
+	if !ok {
+		return nil, fmt.Errorf("%s: %v is not a number", strings.ToLower(e.name), args[0])
+	}
+	if e.name == "ABS" {
+		return math.Abs(x), nil
+	}
+	places := 0.0
+	if len(args) == 2 {
+		if places, ok = sqlNumber(args[1]); !ok {
+			return nil, errors.New("round: the decimal places must be a number")
+		}
+	}
+	scale := math.Pow(10, places)
+	return math.Round(x*scale) / scale, nil
+}
+
+func (e sqlCall) aggregate(c *sqlContext) (sqlValue, error) {
+	if e.star {
+		return float64(len(c.group)), nil
+	}
+	var values []sqlValue
+	seen := make(map[string]bool)
+	for _, row := range c.group {
+		v, err := e.args[0].eval(&sqlContext{ds: c.ds, f: c.f, row: row})
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			continue
+		}
+		if e.distinct {
+			key := sqlKey(v, c.f)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		values = append(values, v)
+	}
+
+	switch e.name {
+	case "COUNT":
+		return float64(len(values)), nil
+	case "MIN", "MAX":
+		var best sqlValue
+		for _, v := range values {
+			if best == nil {
+				best = v
+				continue
+			}
+			cmp := sqlOrder(v, best, c.f)
+			if (e.name == "MIN" && cmp < 0) || (e.name == "MAX" && cmp > 0) {
+				best = v
+			}
+		}
+		return best, nil
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+	sum := 0.0
+	for _, v := range values {
+		n, ok := sqlNumber(v)
+		if !ok {
+			return nil, fmt.Errorf("%s: %v is not a number", strings.ToLower(e.name), v)
+		}
+		sum += n
+	}
+	if e.name == "AVG" {
+		return sum / float64(len(values)), nil
+	}
+	return sum, nil
+}
+
+// sqlTruth is the truth of a condition's value.
+func sqlTruth(v sqlValue) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case nil:
+		return false
+	}
+	n, ok := sqlNumber(v)
+	return ok && n != 0
+}
+
+// sqlNumber reads a value as a number.
+func sqlNumber(v sqlValue) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return n, err == nil
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// sqlTime reads a value as a date: a date field, or text such as
+// '2024-01-01' or a date the extract's -date-format writes.
+func sqlTime(v sqlValue, f *Formatter) (time.Time, bool) {
+	switch v := v.(type) {
+	case time.Time:
+		return v, true
+	case string:
+		return f.parseDate(v)
+	}
+	return time.Time{}, false
+}
+
+// sqlCompare compares two values that are not NULL: dates as dates when
+// either is one, numbers as numbers when both read as numbers, and text
+// otherwise. It reports false if a date is compared with something that
+// is not one.
+func sqlCompare(a, b sqlValue, f *Formatter) (int, bool) {
+	_, aTime := a.(time.Time)
+	_, bTime := b.(time.Time)
+	if aTime || bTime {
+		x, okX := sqlTime(a, f)
+		y, okY := sqlTime(b, f)
+		if !okX || !okY {
+			return 0, false
+		}
+		return x.Compare(y), true
+	}
+	if x, ok := sqlNumber(a); ok {
+		if y, ok := sqlNumber(b); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	return strings.Compare(sqlText(a, f), sqlText(b, f)), true
+}
+
+// sqlOrder is sqlCompare for sorting: NULLs first, and values that cannot
+// be compared in their text order.
+func sqlOrder(a, b sqlValue, f *Formatter) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	if cmp, ok := sqlCompare(a, b, f); ok {
+		return cmp
+	}
+	return strings.Compare(sqlText(a, f), sqlText(b, f))
+}
+
+// sqlText formats a value for output. Dates are written the way the
+// extract writes them.
+func sqlText(v sqlValue, f *Formatter) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return f.formatDate("", float64(v.UnixMilli()))
+	}
+	return fmt.Sprint(v)
+}
+
+// sqlKey identifies a value for GROUP BY and DISTINCT; NULLs group
+// together.
+func sqlKey(v sqlValue, f *Formatter) string {
+	if v == nil {
+		return "\x00"
+	}
+	if n, ok := v.(float64); ok {
+		return strconv.FormatFloat(n, 'g', -1, 64)
+	}
+	return sqlText(v, f)
+}
+
+// sqlSelect is a parsed SELECT statement.
+type sqlSelect struct {
+	distinct bool
+	items    []sqlItem
+	where    sqlExpr
+	groupBy  []sqlExpr
+	having   sqlExpr
+	grouped  bool // GROUP BY or aggregates: one result row per group
+	orderBy  []sqlOrdering
+	limit    int // -1 for no LIMIT
+	offset   int
+}
+
+type sqlItem struct {
+	expr sqlExpr // nil for *
+	name string
+}
+
+type sqlOrdering struct {
+	expr   sqlExpr
+	column int // result column the ordering names, -1 if it is an expression
+	desc   bool
+}
+
+// sqlResult is the result set of a query.
+type sqlResult struct {
+	columns []string
+	rows    [][]sqlValue
+}
+
+// run evaluates the statement against the extract.
+func (s *sqlSelect) run(ds *dataset, f *Formatter) (*sqlResult, error) {
+	var matched []int
+	for i := range ds.records {
+		if s.where != nil {
+			v, err := s.where.eval(&sqlContext{ds: ds, f: f, row: i})
+			if err != nil {
+				return nil, err
+			}
+			if !sqlTruth(v) {
+				continue
+			}
+		}
+		matched = append(matched, i)
+	}
+
+	// Each result row is the context it was computed in, so ORDER BY can
+	// be evaluated in the same one.
+	var contexts []*sqlContext
+	if s.grouped {
+		groups := make(map[string]int)
+		for _, i := range matched {
+			key := ""
+			for _, e := range s.groupBy {
+				v, err := e.eval(&sqlContext{ds: ds, f: f, row: i})
+				if err != nil {
+					return nil, err
+				}
+				key += sqlKey(v, f) + "\x1f"
+			}
+			g, ok := groups[key]
+			if !ok {
+				g = len(contexts)
+				groups[key] = g
+				contexts = append(contexts, &sqlContext{ds: ds, f: f, row: i})
+			}
+			contexts[g].group = append(contexts[g].group, i)
+		}
+		// Aggregates without GROUP BY make one row, even of no records.
+		if len(s.groupBy) == 0 && len(contexts) == 0 {
+			contexts = append(contexts, &sqlContext{ds: ds, f: f, row: -1, group: []int{}})
+		}
+		if s.having != nil {
+			kept := contexts[:0]
+			for _, c := range contexts {
+				v, err := s.having.eval(c)
+				if err != nil {
+					return nil, err
+				}
+				if sqlTruth(v) {
+					kept = append(kept, c)
+				}
+			}
+			contexts = kept
+		}
+	} else {
+		for _, i := range matched {
+			contexts = append(contexts, &sqlContext{ds: ds, f: f, row: i})
+		}
+	}
+
+	result := &sqlResult{}
+	for _, item := range s.items {
+		if item.expr == nil {
+			result.columns = append(result.columns, ds.header...)
+		} else {
+			result.columns = append(result.columns, item.name)
+		}
+	}
+	type resultRow struct {
+		values []sqlValue
+		keys   []sqlValue
+	}
+	var rows []resultRow
+	seen := make(map[string]bool)
+	for _, c := range contexts {
+		var row resultRow
+		for _, item := range s.items {
+			if item.expr == nil {
+				for _, name := range ds.header {
+					v, _ := sqlColumn{name}.eval(c)
+					row.values = append(row.values, v)
+				}
+				continue
+			}
+			v, err := item.expr.eval(c)
+			if err != nil {
+				return nil, err
+			}
+			row.values = append(row.values, v)
+		}
+		if s.distinct {
+			key := ""
+			for _, v := range row.values {
+				key += sqlKey(v, f) + "\x1f"
+			}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		for _, o := range s.orderBy {
+			if o.column >= 0 {
+				row.keys = append(row.keys, row.values[o.column])
+				continue
+			}
+			v, err := o.expr.eval(c)
+			if err != nil {
+				return nil, err
+			}
+			row.keys = append(row.keys, v)
+		}
+		rows = append(rows, row)
+	}
+
+	slices.SortStableFunc(rows, func(a, b resultRow) int {
+		for i, o := range s.orderBy {
+			cmp := sqlOrder(a.keys[i], b.keys[i], f)
+			if o.desc {
+				cmp = -cmp
+			}
+			if cmp != 0 {
+				return cmp
+			}
+		}
+		return 0
+	})
+
+	rows = rows[min(s.offset, len(rows)):]
+	if s.limit >= 0 && s.limit < len(rows) {
+		rows = rows[:s.limit]
+	}
+	for _, row := range rows {
+		result.rows = append(result.rows, row.values)
+	}
+	return result, nil
+}
+
+// write prints the result set as an aligned table, CSV or a JSON array of
+// objects.
+func (r *sqlResult) write(w io.Writer, format string, f *Formatter) error {
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write(r.columns)
+		for _, row := range r.rows {
+			record := make([]string, len(row))
+			for i, v := range row {
+				record[i] = sqlText(v, f)
+			}
+			cw.Write(record)
+		}
+		cw.Flush()
+		return cw.Error()
+	case "json":
+		objects := make([]map[string]interface{}, 0, len(r.rows))
+		for _, row := range r.rows {
+			object := make(map[string]interface{}, len(row))
+			for i, v := range row {
+				if t, ok := v.(time.Time); ok {
+					v = sqlText(t, f)
+				}
+				object[r.columns[i]] = v
+			}
+			objects = append(objects, object)
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(objects)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(r.columns, "\t"))
+	for _, row := range r.rows {
+		cells := make([]string, len(row))
+		for i, v := range row {
+			cells[i] = sqlText(v, f)
+			if v == nil {
+				cells[i] = "NULL"
+			}
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+	return tw.Flush()
+}
+
+// sqlFunctions are the scalar functions with their least and greatest
+// number of arguments; -1 is any number.
+var sqlFunctions = map[string][2]int{
+	"YEAR": {1, 1}, "MONTH": {1, 1}, "DAY": {1, 1}, "DATE": {1, 1},
+	"LOWER": {1, 1}, "UPPER": {1, 1}, "TRIM": {1, 1}, "LENGTH": {1, 1}, "SUBSTR": {2, 3},
+	"ABS": {1, 1}, "ROUND": {1, 2}, "COALESCE": {1, -1},
+}
+
+// sqlParser is a recursive-descent parser for the query subcommand. It
+// understands
+//
+//	SELECT [DISTINCT] * | expr [[AS] name], ...
+//	FROM extract
+//	[WHERE cond] [GROUP BY expr, ...] [HAVING cond]
+//	[ORDER BY expr|name|position [ASC|DESC], ...] [LIMIT n [OFFSET n]]
+//
+// with the operators of -alert conditions plus arithmetic, || and
+// BETWEEN, the aggregates COUNT, SUM, AVG, MIN and MAX, and the functions
+// in sqlFunctions. Field names match the extract's columns in any case,
+// and "double quotes" take a name that is not a plain word. The table name
+// is not checked: there is only the extract.
+type sqlParser struct {
+	tokenStream
+	src     string
+	header  []string
+	aliases map[string]sqlExpr // select items by name, for HAVING; nil before them
+}
+
+// parseSQL parses a SELECT statement over an extract with the given
+// columns.
+func parseSQL(text string, header []string) (*sqlSelect, error) {
+	tokens, err := sqlLexer.lex(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("empty statement")
+	}
+	p := &sqlParser{tokenStream: tokenStream{tokens: tokens, end: len(text)}, src: text, header: header}
+	s, err := p.statement()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return s, err
+}
+
+// sqlKeywords cannot be used as column names or aliases without quotes.
+var sqlKeywords = map[string]bool{
+	"SELECT": true, "DISTINCT": true, "FROM": true, "WHERE": true, "GROUP": true, "BY": true, "HAVING": true,
+	"ORDER": true, "ASC": true, "DESC": true, "LIMIT": true, "OFFSET": true, "AS": true, "AND": true, "OR": true,
+	"NOT": true, "IN": true, "LIKE": true, "IS": true, "NULL": true, "BETWEEN": true, "TRUE": true, "FALSE": true,
+}
+
+func (p *sqlParser) statement() (*sqlSelect, error) {
+	if !p.keyword("SELECT") {
+		return nil, errors.New("expected SELECT")
+	}
+	s := &sqlSelect{distinct: p.keyword("DISTINCT"), limit: -1}
+	for {
+		item, err := p.item()
+		if err != nil {
+			return nil, err
+		}
+		s.items = append(s.items, item)
+		if !p.punct(",") {
+			break
+		}
+	}
+	if !p.keyword("FROM") {
+		return nil, errors.New("expected FROM after the select list")
+	}
+	if t := p.peek(); t.kind != 'i' && t.kind != 'q' || sqlKeywords[strings.ToUpper(t.text)] && t.kind == 'i' {
+		return nil, errors.New("expected a table name after FROM")
+	}
+	p.pos++
+
+	var err error
+	if p.keyword("WHERE") {
+		if s.where, err = p.or(); err != nil {
+			return nil, err
+		}
+		if sqlHasAggregate(s.where) {
+			return nil, errors.New("aggregates are not allowed in WHERE; use HAVING")
+		}
+	}
+	// The clauses after WHERE may name the select items.
+	p.aliases = make(map[string]sqlExpr)
+	for _, item := range s.items {
+		if item.expr != nil {
+			p.aliases[strings.ToLower(item.name)] = item.expr
+		}
+	}
+	if p.keyword("GROUP") {
+		if !p.keyword("BY") {
+			return nil, errors.New("expected BY after GROUP")
+		}
+		for {
+			var e sqlExpr
+			if t := p.peek(); t.kind == 'n' {
+				// A position groups by that select item.
+				n, err := strconv.Atoi(t.text)
+				if err != nil || n < 1 || n > len(s.items) || s.items[n-1].expr == nil {
+					return nil, fmt.Errorf("GROUP BY %s: expected the position of a select item", t.text)
+				}
+				p.pos++
+				e = s.items[n-1].expr
+			} else if e, err = p.or(); err != nil {
+				return nil, err
+			}
+			if sqlHasAggregate(e) {
+				return nil, errors.New("aggregates are not allowed in GROUP BY")
+			}
+			s.groupBy = append(s.groupBy, e)
+			if !p.punct(",") {
+				break
+			}
+		}
+	}
+
+	if p.keyword("HAVING") {
+		if s.having, err = p.or(); err != nil {
+			return nil, err
+		}
+	}
+	if p.keyword("ORDER") {
+		if !p.keyword("BY") {
+			return nil, errors.New("expected BY after ORDER")
+		}
+		for {
+			o, err := p.ordering(s)
+			if err != nil {
+				return nil, err
+			}
+			s.orderBy = append(s.orderBy, o)
+			if !p.punct(",") {
+				break
+			}
+		}
+	}
+	if p.keyword("LIMIT") {
+		if s.limit, err = p.count("LIMIT"); err != nil {
+			return nil, err
+		}
+		if p.keyword("OFFSET") {
+			if s.offset, err = p.count("OFFSET"); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	s.grouped = len(s.groupBy) > 0 || s.having != nil
+	for _, item := range s.items {
+		s.grouped = s.grouped || item.expr != nil && sqlHasAggregate(item.expr)
+	}
+	for _, o := range s.orderBy {
+		s.grouped = s.grouped || o.expr != nil && sqlHasAggregate(o.expr)
+	}
+	if s.grouped {
+		for _, item := range s.items {
+			if item.expr == nil {
+				return nil, errors.New("SELECT * cannot be used with GROUP BY or aggregates")
+			}
+		}
+	}
+	return s, nil
+}
+
+// item parses one entry of the select list.
+func (p *sqlParser) item() (sqlItem, error) {
+	if p.punct("*") {
+		return sqlItem{}, nil
+	}
+	start := p.peek().at
+	e, err := p.or()
+	if err != nil {
+		return sqlItem{}, err
+	}
+	name := strings.TrimSpace(p.src[start:p.peek().at])
+	if c, ok := e.(sqlColumn); ok {
+		name = c.name
+	}
+	explicit := p.keyword("AS")
+	if t := p.peek(); t.kind == 'q' || t.kind == 'i' && !sqlKeywords[strings.ToUpper(t.text)] {
+		name = t.text
+		p.pos++
+	} else if explicit {
+		return sqlItem{}, errors.New("expected a name after AS")
+	}
+	return sqlItem{expr: e, name: name}, nil
+}
+
+// ordering parses one ORDER BY entry. The name of a select item or a
+// position (1 for the first column) sorts by that result column.
+func (p *sqlParser) ordering(s *sqlSelect) (sqlOrdering, error) {
+	// columns are the result columns, with * expanded; items maps the
+	// names of the select items to their column.
+	var columns int
+	items := make(map[string]int)
+	for _, item := range s.items {
+		if item.expr == nil {
+			columns += len(p.header)
+			continue
+		}
+		if _, ok := items[strings.ToLower(item.name)]; !ok {
+			items[strings.ToLower(item.name)] = columns
+		}
+		columns++
+	}
+
+	o := sqlOrdering{column: -1}
+	t := p.peek()
+	// A name or position stands alone, not as part of an expression.
+	alone := true
+	if p.pos+1 < len(p.tokens) {
+		after := p.tokens[p.pos+1]
+		alone = after.kind == 'o' && after.text == "," ||
+			after.kind == 'i' && slices.Contains([]string{"ASC", "DESC", "LIMIT"}, strings.ToUpper(after.text))
+	}
+	switch column, named := items[strings.ToLower(t.text)]; {
+	case t.kind == 'n' && alone:
+		p.pos++
+		n, err := strconv.Atoi(t.text)
+		if err != nil || n < 1 || n > columns {
+			return o, fmt.Errorf("ORDER BY %s: expected a column position from 1 to %d", t.text, columns)
+		}
+		o.column = n - 1
+	case (t.kind == 'i' || t.kind == 'q') && named && alone:
+		p.pos++
+		o.column = column
+	default:
+		var err error
+		if o.expr, err = p.or(); err != nil {
+			return o, err
+		}
+	}
+	if !p.keyword("ASC") {
+		o.desc = p.keyword("DESC")
+	}
+	return o, nil
+}
+
+// count parses the number after LIMIT or OFFSET.
+func (p *sqlParser) count(clause string) (int, error) {
+	t := p.peek()
+	n, err := strconv.Atoi(t.text)
+	if t.kind != 'n' || err != nil || n < 0 {
+		return 0, fmt.Errorf("expected a number of rows after %s", clause)
+	}
+	p.pos++
+	return n, nil
+}
+
+func (p *sqlParser) or() (sqlExpr, error) {
+	left, err := p.and()
+	for err == nil && p.keyword("OR") {
+		var right sqlExpr
+		if right, err = p.and(); err == nil {
+			left = sqlBinary{"OR", left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *sqlParser) and() (sqlExpr, error) {
+	left, err := p.not()
+	for err == nil && p.keyword("AND") {
+		var right sqlExpr
+		if right, err = p.not(); err == nil {
+			left = sqlBinary{"AND", left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *sqlParser) not() (sqlExpr, error) {
+	if p.keyword("NOT") {
+		e, err := p.not()
+		return sqlUnary{"NOT", e}, err
+	}
+	return p.predicate()
+}
+
+// predicate parses a value followed by a comparison, IN, LIKE, BETWEEN or
+// IS NULL, if there is one.
+func (p *sqlParser) predicate() (sqlExpr, error) {
+	x, err := p.concat()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.keyword("IS") {
+		not := p.keyword("NOT")
+		if !p.keyword("NULL") {
+			return nil, errors.New("expected NULL after IS")
+		}
+		return sqlIsNull{x, not}, nil
+	}
+
+	not := p.keyword("NOT")
+	switch {
+	case p.keyword("IN"):
+		if !p.punct("(") {
+			return nil, errors.New("expected ( after IN")
+		}
+		var list []sqlExpr
+		for {
+			item, err := p.concat()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+			if p.punct(")") {
+				break
+			}
+			if !p.punct(",") {
+				return nil, errors.New("expected , or ) in IN list")
+			}
+		}
+		return sqlIn{x, list, not}, nil
+	case p.keyword("LIKE"):
+		t := p.peek()
+		if t.kind != 's' {
+			return nil, errors.New("expected a 'pattern' after LIKE")
+		}
+		p.pos++
+		return sqlLike{x, t.text, not}, nil
+	case p.keyword("BETWEEN"):
+		lo, err := p.concat()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword("AND") {
+			return nil, errors.New("expected AND in BETWEEN")
+		}
+		hi, err := p.concat()
+		if err != nil {
+			return nil, err
+		}
+		return sqlBetween{x, lo, hi, not}, nil
+	case not:
+		return nil, errors.New("expected IN, LIKE or BETWEEN after NOT")
+	}
+
+	if op := p.peek(); op.kind == 'o' && alertOperators[op.text] {
+		p.pos++
+		y, err := p.concat()
+		if err != nil {
+			return nil, err
+		}
+		return sqlBinary{op.text, x, y}, nil
+	}
+	return x, nil
+}
+
+func (p *sqlParser) concat() (sqlExpr, error) {
+	left, err := p.sum()
+	for err == nil && p.punct("||") {
+		var right sqlExpr
+		if right, err = p.sum(); err == nil {
+			left = sqlBinary{"||", left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *sqlParser) sum() (sqlExpr, error) {
+	left, err := p.product()
+	for err == nil {
+		op := p.peek().text
+		if !p.punct("+") && !p.punct("-") {
+			break
+		}
+		var right sqlExpr
+		if right, err = p.product(); err == nil {
+			left = sqlBinary{op, left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *sqlParser) product() (sqlExpr, error) {
+	left, err := p.unary()
+	for err == nil {
+		op := p.peek().text
+		if !p.punct("*") && !p.punct("/") && !p.punct("%") {
+			break
+		}
+		var right sqlExpr
+		if right, err = p.unary(); err == nil {
+			left = sqlBinary{op, left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *sqlParser) unary() (sqlExpr, error) {
+	if p.punct("-") {
+		e, err := p.unary()
+		return sqlUnary{"-", e}, err
+	}
+	if p.punct("+") {
+		return p.unary()
+	}
+	return p.primary()
+}
+
+// primary parses a literal, a column, a function call or an expression in
+// parentheses.
+func (p *sqlParser) primary() (sqlExpr, error) {
+	t := p.peek()
+	switch t.kind {
+	case 0:
+		return nil, errors.New("statement ends early")
+	case 's':
+		p.pos++
+		return sqlLiteral{t.text}, nil
+	case 'n':
+		p.pos++
+		n, _ := strconv.ParseFloat(t.text, 64)
+		return sqlLiteral{n}, nil
+	case 'q':
+		p.pos++
+		return p.column(t.text)
+	case 'o':
+		if !p.punct("(") {
+			return nil, fmt.Errorf("unexpected %q", t.text)
+		}
+		e, err := p.or()
+		if err == nil && !p.punct(")") {
+			err = errors.New("missing )")
+		}
+		return e, err
+	}
+
+	p.pos++
+	switch strings.ToUpper(t.text) {
+	case "NULL":
+		return sqlLiteral{nil}, nil
+	case "TRUE":
+		return sqlLiteral{true}, nil
+	case "FALSE":
+		return sqlLiteral{false}, nil
+	}
+	if !p.punct("(") {
+		if sqlKeywords[strings.ToUpper(t.text)] {
+			return nil, fmt.Errorf("unexpected %s", t.text)
+		}
+		return p.column(t.text)
+	}
+	return p.call(strings.ToUpper(t.text))
+}
+
+// call parses the arguments of a function after its (.
+func (p *sqlParser) call(name string) (sqlExpr, error) {
+	arity, scalar := sqlFunctions[name]
+	if !scalar && !sqlAggregates[name] {
+		return nil, fmt.Errorf("unknown function %s", strings.ToLower(name))
+	}
+	e := sqlCall{name: name}
+	if sqlAggregates[name] {
+		arity = [2]int{1, 1}
+		if name == "COUNT" && p.punct("*") {
+			e.star = true
+			arity = [2]int{0, 0}
+		} else {
+			e.distinct = p.keyword("DISTINCT")
+		}
+	}
+	if !e.star && !p.punct(")") {
+		for {
+			arg, err := p.or()
+			if err != nil {
+				return nil, err
+			}
+			if sqlAggregates[name] && sqlHasAggregate(arg) {
+				return nil, fmt.Errorf("%s: aggregates cannot be nested", strings.ToLower(name))
+			}
+			e.args = append(e.args, arg)
+			if p.punct(")") {
+				break
+			}
+			if !p.punct(",") {
+				return nil, fmt.Errorf("%s: expected , or )", strings.ToLower(name))
+			}
+		}
+	} else if e.star && !p.punct(")") {
+		return nil, errors.New("count: expected ) after *")
+	}
+	if len(e.args) < arity[0] || arity[1] >= 0 && len(e.args) > arity[1] {
+		return nil, fmt.Errorf("%s: wrong number of arguments", strings.ToLower(name))
+	}
+	return e, nil
+}
+
+// column resolves a name against the extract's columns, then in HAVING
+// and ORDER BY against the names of the select items.
+func (p *sqlParser) column(name string) (sqlExpr, error) {
+	for _, h := range p.header {
+		if strings.EqualFold(h, name) {
+			return sqlColumn{h}, nil
+		}
+	}
+	if e, ok := p.aliases[strings.ToLower(name)]; ok {
+		return e, nil
+	}
+	return nil, fmt.Errorf("unknown field %q", name)
+}
+
+// sqlHasAggregate reports whether an expression uses an aggregate.
+func sqlHasAggregate(e sqlExpr) bool {
+	switch e := e.(type) {
+	case sqlCall:
+		if sqlAggregates[e.name] {
+			return true
+		}
+		return slices.ContainsFunc(e.args, sqlHasAggregate)
+	case sqlUnary:
+		return sqlHasAggregate(e.x)
+	case sqlBinary:
+		return sqlHasAggregate(e.l) || sqlHasAggregate(e.r)
+	case sqlIn:
+		return sqlHasAggregate(e.x) || slices.ContainsFunc(e.list, sqlHasAggregate)
+	case sqlLike:
+		return sqlHasAggregate(e.x)
+	case sqlIsNull:
+		return sqlHasAggregate(e.x)
+	case sqlBetween:
+		return sqlHasAggregate(e.x) || sqlHasAggregate(e.lo) || sqlHasAggregate(e.hi)
+	}
+	return false
+}
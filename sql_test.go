@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadTestExtract loads the output of the golden default run, ten records
+// with the layer's columns, the way query and serve load an extract.
+func loadTestExtract(t *testing.T) (*dataset, *Formatter) {
+	t.Helper()
+	f, err := newFormatter(&Options{DateFormat: "default"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &extractStore{comma: ',', dateField: "Sale_Date", formatter: f}
+	ds, err := store.load([]string{filepath.Join("testdata", "golden", "default", "out.csv")}, make([]time.Time, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ds, f
+}
+
+func TestParseSQL(t *testing.T) {
+	ds, f := loadTestExtract(t)
+	tests := []struct {
+		query string
+		want  string // the result as CSV
+	}{
+		{`SELECT COUNT(*) FROM extract`, "COUNT(*)\n10\n"},
+		{`select objectid, zip from extract where neighborhood = 'Portland'`, "ObjectId,Zip\n1002,40203\n"},
+		{`SELECT Zip, COUNT(*) AS n FROM extract GROUP BY Zip HAVING n > 1 ORDER BY n DESC`, "Zip,n\n40203,6\n"},
+		{`SELECT Neighborhood, COUNT(*) FROM extract GROUP BY 1 ORDER BY 2 DESC, 1 LIMIT 2`, "Neighborhood,COUNT(*)\nRussell,6\nClifton,1\n"},
+		{`SELECT SUM(Sale_Price), MAX(Sale_Price), MIN(Sale_Price) FROM extract WHERE Sale_Price IS NOT NULL`, "SUM(Sale_Price),MAX(Sale_Price),MIN(Sale_Price)\n1276167.49,1234567.5,0\n"},
+		{`SELECT ObjectId FROM extract WHERE Sale_Price BETWEEN 1 AND 50000 ORDER BY ObjectId`, "ObjectId\n1001\n1401\n"},
+		{`SELECT DISTINCT UPPER(Purchaser) FROM extract WHERE Purchaser LIKE 'metro' ORDER BY 1`, "UPPER(Purchaser)\nMETRO\n"},
+		{`SELECT ObjectId FROM extract WHERE year(Sale_Date) = 2021 AND Zip IN (40203, 40211) ORDER BY Sale_Date DESC`, "ObjectId\n634\n1002\n"},
+		{`SELECT ObjectId FROM extract WHERE Sale_Date IS NULL`, "ObjectId\n1004\n"},
+		{`SELECT "House_Nr" || ' ' || Street_Name AS address FROM extract WHERE ObjectId = 234;`, "address\n428 28th\n"},
+		{`SELECT ObjectId, Sale_Price * 2 + 1 FROM extract WHERE ObjectId = 1011`, "ObjectId,Sale_Price * 2 + 1\n1011,2469136\n"},
+		{`SELECT COALESCE(Purchaser, 'none') AS p, LENGTH(Neighborhood) FROM extract WHERE ObjectId = 1201`, "p,LENGTH(Neighborhood)\nnone,9\n"},
+		{`SELECT ObjectId FROM extract WHERE NOT (Zip = 40203 OR Zip = 40212) ORDER BY ObjectId LIMIT 2 OFFSET 1`, "ObjectId\n1201\n1401\n"},
+	}
+	for _, tt := range tests {
+		stmt, err := parseSQL(tt.query, ds.header)
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		result, err := stmt.run(ds, f)
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		var got bytes.Buffer
+		if err := result.write(&got, "csv", f); err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != tt.want {
+			t.Errorf("%s:\ngot\n%s\nwant\n%s", tt.query, got.String(), tt.want)
+		}
+	}
+
+	errs := []struct {
+		query string
+		want  string
+	}{
+		{``, "empty statement"},
+		{`DELETE FROM extract`, "expected SELECT"},
+		{`SELECT Zip`, "expected FROM"},
+		{`SELECT Zip FROM`, "expected a table name"},
+		{`SELECT Owner FROM extract`, "Owner"},
+		{`SELECT Zip FROM extract WHERE COUNT(*) > 1`, "aggregates are not allowed in WHERE"},
+		{`SELECT Zip FROM extract GROUP Zip`, "expected BY after GROUP"},
+		{`SELECT Zip FROM extract GROUP BY 3`, "expected the position of a select item"},
+		{`SELECT Zip FROM extract; SELECT Zip FROM extract`, "expected one statement"},
+		{`SELECT 'open FROM extract`, "unterminated string"},
+		{`SELECT Zip FROM extract LIMIT`, "LIMIT"},
+		{`SELECT Zip FROM extract extra`, `unexpected "extra"`},
+	}
+	for _, tt := range errs {
+		_, err := parseSQL(tt.query, ds.header)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want %q", tt.query, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// defaultStateFile is where information about previous runs is kept,
+// relative to the output directory.
+const defaultStateFile = ".fetch_state.json"
+
+// State is persisted between runs. Entries are keyed by the query (service
+// URL plus parameters) so different extracts do not interfere.
+type State struct {
+	Runs map[string]*RunState `json:"runs"`
+}
+
+// RunState records the outcome of the last successful run of a query.
+type RunState struct {
+	LastEditDate int64     `json:"lastEditDate,omitempty"` // layer editingInfo.lastEditDate (epoch ms)
+	Outputs      []string  `json:"outputs"`
+	Records      int       `json:"records"`
+	FetchedAt    time.Time `json:"fetchedAt"`
+
+	Replica *ReplicaState `json:"replica,omitempty"` // -sync replica of the query
+}
+
+// loadState reads the state file. A missing file is an empty state.
+func loadState(path string) (*State, error) {
+	state := &State{Runs: make(map[string]*RunState)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Runs == nil {
+		state.Runs = make(map[string]*RunState)
+	}
+	return state, nil
+}
+
+// save writes the state file via a temporary file so an interrupted write
+// cannot leave it truncated.
+func (s *State) save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// outputsExist reports whether every output of a previous run is still on disk.
+func (r *RunState) outputsExist() bool {
+	if len(r.Outputs) == 0 {
+		return false
+	}
+	for _, path := range r.Outputs {
+		if _, err := os.Stat(path); err != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// statisticTypes are the outStatistics types supported by ArcGIS.
+var statisticTypes = map[string]bool{
+	"count": true, "sum": true, "min": true, "max": true,
+	"avg": true, "stddev": true, "var": true,
+}
+
+// Statistic is one entry of the outStatistics parameter.
+type Statistic struct {
+	Type  string `json:"statisticType"`
+	Field string `json:"onStatisticField"`
+	Name  string `json:"outStatisticFieldName"`
+}
+
+// parseStatistic parses a -stat value of the form type:field, e.g.
+// avg:Sale_Price. The output column is named type_field.
+func parseStatistic(spec string) (Statistic, error) {
+	typ, field, ok := strings.Cut(spec, ":")
+	typ = strings.ToLower(strings.TrimSpace(typ))
+	field = strings.TrimSpace(field)
+	if !ok || field == "" {
+		return Statistic{}, fmt.Errorf("statistic %q must be type:field, e.g. avg:Sale_Price", spec)
+	}
+	if !statisticTypes[typ] {
+		return Statistic{}, fmt.Errorf("unknown statistic type %q", typ)
+	}
+	return Statistic{Type: typ, Field: field, Name: typ + "_" + field}, nil
+}
+
+// groupByExpr converts a group-by column into the SQL the server expects.
+// year(Field) and month(Field) use the same syntax as -split-by.
+func groupByExpr(p *Partitioner) string {
+	switch p.Func {
+	case "year":
+		return "EXTRACT(YEAR FROM " + p.Field + ")"
+	case "month":
+		return "EXTRACT(MONTH FROM " + p.Field + ")"
+	}
+	return p.Field
+}
+
+// runStats implements the stats subcommand, which asks the server for
+// grouped aggregates instead of downloading every row:
+//
+//	go run . stats -group-by Neighborhood -stat count:ObjectId -stat avg:Sale_Price
+//	go run . stats -group-by "year(Action_Filed)" -out data/filings_by_year.csv
+func runStats(args []string) int {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	var opts Options
+	opts.registerClient(fs)
+	opts.registerQuery(fs)
+	opts.registerLogging(fs)
+	groupBy := fs.String("group-by", "", "comma-separated group-by columns: field names or year(Field)/month(Field)")
+	var statSpecs listFlag
+	fs.Var(&statSpecs, "stat", "statistic as type:field (count, sum, min, max, avg, stddev, var); repeatable, default count:ObjectId")
+	out := fs.String("out", "", "write the result to this CSV file instead of printing it")
+	fs.Parse(args)
+	if err := setupLogging(&opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFatal
+	}
+
+	if len(statSpecs) == 0 {
+		statSpecs = listFlag{"count:ObjectId"}
+	}
+	var stats []Statistic
+	for _, spec := range statSpecs {
+		st, err := parseStatistic(spec)
+		if err != nil {
+			slog.Error("invalid -stat", "err", err)
+			return exitFatal
+		}
+		stats = append(stats, st)
+	}
+
+	var groups []*Partitioner
+	var exprs []string
+	for _, spec := range splitList(*groupBy) {
+		p, err := parsePartitioner(spec)
+		if err != nil {
+			slog.Error("invalid -group-by", "err", err)
+			return exitFatal
+		}
+		groups = append(groups, p)
+		exprs = append(exprs, groupByExpr(p))
+	}
+
+	query, err := newQuery(&opts)
+	if err != nil {
+		slog.Error("invalid query options", "err", err)
+		return exitFatal
+	}
+
+	params := query.params()
+	params.Del("orderByFields")
+	statsJSON, _ := json.Marshal(stats)
+	params.Set("outStatistics", string(statsJSON))
+	if len(exprs) > 0 {
+		params.Set("groupByFieldsForStatistics", strings.Join(exprs, ","))
+	}
+
+	client, err := newClient(&opts)
+	if err != nil {
+		slog.Error("invalid connection options", "err", err)
+		return exitFatal
+	}
+
+	var result QueryResult
+	if err := client.getJSON(context.Background(), query.URL, params, &result); err != nil {
+		slog.Error("cannot query statistics", "err", err)
+		return exitFatal
+	}
+
+	header := append(make([]string, 0, len(groups)+len(stats)), splitList(*groupBy)...)
+	for _, st := range stats {
+		header = append(header, st.Name)
+	}
+
+	formatter := defaultFormatter()
+	rows := make([][]string, 0, len(result.Features))
+	for _, feature := range result.Features {
+		rows = append(rows, statsRow(feature.Attributes, groups, stats, formatter))
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		for k := range groups {
+			if rows[i][k] != rows[j][k] {
+				return rows[i][k] < rows[j][k]
+			}
+		}
+		return false
+	})
+
+	if *out != "" {
+		return writeStatsCSV(*out, header, rows)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+
+	if result.ExceededTransferLimit {
+		slog.Warn("the server truncated the result; narrow the query with -where")
+	}
+	return exitOK
+}
+
+// statsRow lays out one statistics feature in header order. Plain group-by
+// fields come back under their own name; expression columns come back
+// under server-chosen names, so they are matched to the remaining
+// attributes in sorted key order.
+func statsRow(attrs map[string]interface{}, groups []*Partitioner, stats []Statistic, formatter *Formatter) []string {
+	known := make(map[string]bool)
+	for _, st := range stats {
+		known[st.Name] = true
+	}
+	for _, g := range groups {
+		if g.Func == "" {
+			known[g.Field] = true
+		}
+	}
+	var extra []string
+	for key := range attrs {
+		if !known[key] && !strings.EqualFold(key, "ObjectId") {
+			extra = append(extra, key)
+		}
+	}
+	sort.Strings(extra)
+
+	row := make([]string, 0, len(groups)+len(stats))
+	for _, g := range groups {
+		var value interface{}
+		key := g.Field
+		if g.Func != "" {
+			// year()/month() come back as plain numbers, not timestamps.
+			key = ""
+			if len(extra) > 0 {
+				value, extra = attrs[extra[0]], extra[1:]
+			}
+		} else {
+			value = attrs[g.Field]
+		}
+		if value == nil {
+			row = append(row, "(null)")
+			continue
+		}
+		row = append(row, formatter.formatValue(key, value))
+	}
+	for _, st := range stats {
+		if n, ok := attrs[st.Name].(float64); ok {
+			row = append(row, strconv.FormatFloat(n, 'f', -1, 64))
+		} else {
+			row = append(row, "")
+		}
+	}
+	return row
+}
+
+func writeStatsCSV(path string, header []string, rows [][]string) int {
+	file, err := os.Create(path)
+	if err != nil {
+		slog.Error("cannot create output", "path", path, "err", err)
+		return exitFatal
+	}
+	defer file.Close()
+
+	w := newCSVWriter(file, CSVDialect{Comma: ','})
+	if err := w.Write(header, nil); err != nil {
+		slog.Error("cannot write output", "path", path, "err", err)
+		return exitFatal
+	}
+	for _, row := range rows {
+		if err := w.Write(row, nil); err != nil {
+			slog.Error("cannot write output", "path", path, "err", err)
+			return exitFatal
+		}
+	}
+	if err := w.Flush(); err != nil {
+		slog.Error("cannot write output", "path", path, "err", err)
+		return exitFatal
+	}
+
+	slog.Info("statistics saved", "path", path)
+	return exitOK
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// RunSummary is the end-of-run report operators use to sanity check an
+// extract at a glance.
+type RunSummary struct {
+	Records      int
+	NewRecords   int // records not in the previous output, -1 if there was none to compare with
+	Pages        int // pages fetched in this run
+	FailedPages  int
+	RetriedPages int
+	Bytes        int64 // response bytes downloaded
+	WallTime     time.Duration
+	Outputs      []OutputFile
+	Dates        *dateRange
+	Alerts       []AlertMatch
+	Quarantined  int // records -coerce kept out of the output
+}
+
+// OutputFile is a written file and its size on disk.
+type OutputFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// statOutputs looks up the size of each output file.
+func statOutputs(paths []string) []OutputFile {
+	files := make([]OutputFile, 0, len(paths))
+	for _, path := range paths {
+		file := OutputFile{Path: path}
+		if info, err := os.Stat(path); err == nil {
+			file.Size = info.Size()
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+// dateRange tracks the earliest and latest value of a date field across
+// the records written.
+type dateRange struct {
+	Field    string
+	min, max float64 // epoch milliseconds
+	seen     bool
+}
+
+// observe folds a record's date into the range. Null and zero dates are
+// ignored.
+func (d *dateRange) observe(record map[string]interface{}) {
+	ms, ok := record[d.Field].(float64)
+	if !ok || ms == 0 {
+		return
+	}
+	if !d.seen || ms < d.min {
+		d.min = ms
+	}
+	if !d.seen || ms > d.max {
+		d.max = ms
+	}
+	d.seen = true
+}
+
+// Bounds returns the earliest and latest date seen, and false if there were none.
+func (d *dateRange) Bounds() (first, last time.Time, ok bool) {
+	if d == nil || !d.seen {
+		return time.Time{}, time.Time{}, false
+	}
+	return time.UnixMilli(int64(d.min)), time.UnixMilli(int64(d.max)), true
+}
+
+// print writes the summary as aligned label/value lines, like the dry run.
+func (s *RunSummary) print(w io.Writer, loc *time.Location) {
+	fmt.Fprintln(w, "Run summary:")
+	fmt.Fprintf(w, "  Records:       %d\n", s.Records)
+	if s.NewRecords >= 0 {
+		fmt.Fprintf(w, "  New records:   %d\n", s.NewRecords)
+	}
+	if s.Quarantined > 0 {
+		fmt.Fprintf(w, "  Quarantined:   %d\n", s.Quarantined)
+	}
+	for _, m := range s.Alerts {
+		fmt.Fprintf(w, "  Alert:         %d new matching %s\n", m.Count, m.Rule)
+	}
+	fmt.Fprintf(w, "  Pages:         %d fetched, %d failed, %d retried as smaller pages\n", s.Pages, s.FailedPages, s.RetriedPages)
+	fmt.Fprintf(w, "  Downloaded:    %s\n", formatBytes(s.Bytes))
+	fmt.Fprintf(w, "  Wall time:     %s\n", s.WallTime.Round(time.Millisecond))
+	for _, out := range s.Outputs {
+		fmt.Fprintf(w, "  Output:        %s (%s)\n", out.Path, formatBytes(out.Size))
+	}
+	if first, last, ok := s.Dates.Bounds(); ok {
+		fmt.Fprintf(w, "  %-14s %s to %s\n", s.Dates.Field+":", first.In(loc).Format("2006-01-02"), last.In(loc).Format("2006-01-02"))
+	}
+}
+
+// formatBytes formats a byte count with a binary unit, e.g. 12.3 MiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatInt(n, 10) + " B"
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ReplicaState is the sync replica of a query, recorded in the state file
+// so the next -sync run only asks for the edits since this one.
+type ReplicaState struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Cache string `json:"cache"` // local copy of the replica's features
+}
+
+// replicaCache is the local copy of the features in a replica, as of the
+// server generation it was synchronized to. The generation is kept with
+// the features rather than in the state file, so the two never disagree.
+type replicaCache struct {
+	ServerGen int64                    `json:"serverGen"`
+	Features  []map[string]interface{} `json:"features"`
+}
+
+// replicaSync fetches a layer through the feature service sync API for
+// -sync: the first run creates a replica and downloads every feature,
+// later runs download only the adds, updates and deletes since the
+// previous one and apply them to a local copy.
+type replicaSync struct {
+	client   *Client
+	service  string // FeatureServer endpoint
+	layerID  int
+	query    *Query
+	idField  string // the layer's ObjectId field
+	cacheDir string
+}
+
+// newReplicaSync checks that the -url layer is part of a feature service.
+func newReplicaSync(client *Client, query *Query) (*replicaSync, error) {
+	layer := layerURL(query.URL)
+	i := strings.LastIndexByte(layer, '/')
+	id, err := strconv.Atoi(layer[i+1:])
+	if err != nil || !strings.HasSuffix(strings.ToLower(layer[:i]), "/featureserver") {
+		return nil, fmt.Errorf("%s is not a FeatureServer layer", layer)
+	}
+	return &replicaSync{client: client, service: layer[:i], layerID: id, query: query, idField: idField, cacheDir: outputDir}, nil
+}
+
+// features returns every feature of the layer that matches the query,
+// synchronizing prev if there is one and it is still registered, or
+// creating a new replica otherwise. The replica to record in the state
+// is returned with them.
+func (r *replicaSync) features(ctx context.Context, prev *ReplicaState) ([]map[string]interface{}, *ReplicaState, error) {
+	var service struct {
+		SyncEnabled bool `json:"syncEnabled"`
+	}
+	if err := r.client.getJSON(ctx, r.service, url.Values{"f": {"json"}}, &service); err != nil {
+		return nil, nil, err
+	}
+	if !service.SyncEnabled {
+		return nil, nil, errors.New("the feature service does not have sync enabled")
+	}
+	if info, err := fetchLayerInfo(ctx, r.client, r.query.URL); err == nil && info.ObjectIDField != "" {
+		r.idField = info.ObjectIDField
+	}
+
+	if prev != nil {
+		records, err := r.synchronize(ctx, prev)
+		if err == nil {
+			return records, prev, nil
+		}
+		slog.Warn("cannot synchronize replica; creating a new one", "replica", prev.ID, "err", err)
+		os.Remove(prev.Cache)
+		// Otherwise the service keeps a replica per fallback, and the
+		// edit tracking of each, until someone removes them.
+		if err := r.unregister(ctx, prev); err != nil {
+			slog.Warn("cannot unregister the old replica", "replica", prev.ID, "err", err)
+		}
+	}
+	return r.create(ctx)
+}
+
+// unregister removes a replica from the service. A replica that is no
+// longer registered is not an error.
+func (r *replicaSync) unregister(ctx context.Context, st *ReplicaState) error {
+	params := url.Values{"f": {"json"}, "replicaID": {st.ID}}
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := r.client.postJSON(ctx, r.service+"/unRegisterReplica", params, &result); err != nil {
+		var apiErr *ArcGISError
+		if errors.As(err, &apiErr) && apiErr.Code == 404 {
+			return nil
+		}
+		return fmt.Errorf("unRegisterReplica: %w", err)
+	}
+	if !result.Success {
+		return errors.New("unRegisterReplica: the service did not report success")
+	}
+	slog.Info("replica unregistered", "replica", st.ID)
+	return nil
+}
+
+// create registers a replica of the layer, filtered by the query, and
+// downloads its features.
+func (r *replicaSync) create(ctx context.Context) ([]map[string]interface{}, *ReplicaState, error) {
+	layerQuery := map[string]interface{}{"queryOption": "useFilter", "where": r.query.Where, "useGeometry": r.query.Spatial != nil}
+	layerQueries, _ := json.Marshal(map[string]interface{}{strconv.Itoa(r.layerID): layerQuery})
+	name := "fetch_" + randomToken()
+	params := url.Values{
+		"f":                 {"json"},
+		"replicaName":       {name},
+		"layers":            {strconv.Itoa(r.layerID)},
+		"layerQueries":      {string(layerQueries)},
+		"syncModel":         {"perLayer"},
+		"syncDirection":     {"download"},
+		"transportType":     {"esriTransportTypeEmbedded"},
+		"dataFormat":        {"json"},
+		"async":             {"false"},
+		"returnAttachments": {"false"},
+	}
+	if r.query.Spatial != nil {
+		r.query.Spatial.params(params)
+	}
+	if r.query.ReturnGeometry && r.query.OutSR != "" {
+		params.Set("replicaSR", r.query.OutSR)
+	}
+
+	var result struct {
+		ReplicaID string `json:"replicaID"`
+		Layers    []struct {
+			ID       int              `json:"id"`
+			Features []replicaFeature `json:"features"`
+		} `json:"layers"`
+		replicaGens
+	}
+	if err := r.client.postJSON(ctx, r.service+"/createReplica", params, &result); err != nil {
+		return nil, nil, fmt.Errorf("createReplica: %w", err)
+	}
+	if result.ReplicaID == "" {
+		return nil, nil, errors.New("createReplica: the response has no replicaID")
+	}
+	cache := &replicaCache{ServerGen: result.serverGen(r.layerID)}
+	for _, layer := range result.Layers {
+		if layer.ID == r.layerID {
+			for _, f := range layer.Features {
+				cache.Features = append(cache.Features, f.record(r.query.ReturnGeometry))
+			}
+		}
+	}
+
+	slices.SortFunc(cache.Features, func(a, b map[string]interface{}) int {
+		ia, _ := r.id(a)
+		ib, _ := r.id(b)
+		return cmp.Compare(ia, ib)
+	})
+
+	state := &ReplicaState{
+		ID:    result.ReplicaID,
+		Name:  name,
+		Cache: filepath.Join(r.cacheDir, ".fetch_replica_"+strings.Trim(result.ReplicaID, "{}")+".json"),
+	}
+	slog.Info("replica created", "replica", state.ID, "features", len(cache.Features), "serverGen", cache.ServerGen)
+	if err := r.save(state.Cache, cache); err != nil {
+		return nil, nil, err
+	}
+	return cache.Features, state, nil
+}
+
+// synchronize downloads the edits since the cached generation and applies
+// them to the cache.
+func (r *replicaSync) synchronize(ctx context.Context, st *ReplicaState) ([]map[string]interface{}, error) {
+	raw, err := os.ReadFile(st.Cache)
+	if err != nil {
+		return nil, err
+	}
+	var cache replicaCache
+	if err := json.Unmarshal(raw, &cache); err != nil {
+		return nil, fmt.Errorf("%s: %w", st.Cache, err)
+	}
+
+	syncLayers, _ := json.Marshal([]map[string]interface{}{{"id": r.layerID, "syncDirection": "download", "serverGen": cache.ServerGen}})
+	params := url.Values{
+		"f":                {"json"},
+		"replicaID":        {st.ID},
+		"syncLayers":       {string(syncLayers)},
+		"syncDirection":    {"download"},
+		"transportType":    {"esriTransportTypeEmbedded"},
+		"dataFormat":       {"json"},
+		"async":            {"false"},
+		"closeReplica":     {"false"},
+		"returnIdsForAdds": {"false"},
+	}
+	var result struct {
+		Edits []struct {
+			ID       int `json:"id"`
+			Features struct {
+				Adds      []replicaFeature `json:"adds"`
+				Updates   []replicaFeature `json:"updates"`
+				DeleteIDs []int64          `json:"deleteIds"`
+			} `json:"features"`
+		} `json:"edits"`
+		replicaGens
+	}
+	if err := r.client.postJSON(ctx, r.service+"/synchronizeReplica", params, &result); err != nil {
+		return nil, fmt.Errorf("synchronizeReplica: %w", err)
+	}
+
+	byID := make(map[int64]map[string]interface{}, len(cache.Features))
+	for _, record := range cache.Features {
+		if id, ok := r.id(record); ok {
+			byID[id] = record
+		}
+	}
+	adds, updates, deletes := 0, 0, 0
+	for _, edits := range result.Edits {
+		if edits.ID != r.layerID {
+			continue
+		}
+		for _, f := range edits.Features.Adds {
+			record := f.record(r.query.ReturnGeometry)
+			if id, ok := r.id(record); ok {
+				byID[id] = record
+				adds++
+			}
+		}
+		for _, f := range edits.Features.Updates {
+			record := f.record(r.query.ReturnGeometry)
+			if id, ok := r.id(record); ok {
+				byID[id] = record
+				updates++
+			}
+		}
+		for _, id := range edits.Features.DeleteIDs {
+			if _, ok := byID[id]; ok {
+				delete(byID, id)
+				deletes++
+			}
+		}
+	}
+
+	// Records are kept in ObjectId order, like the default -order-by.
+	ids := make([]int64, 0, len(byID))
+	for id := range byID {
+		ids = append(ids, id)
+	}
+	slices.SortFunc(ids, cmp.Compare)
+	cache.Features = cache.Features[:0]
+	for _, id := range ids {
+		cache.Features = append(cache.Features, byID[id])
+	}
+	if gen := result.serverGen(r.layerID); gen != 0 {
+		cache.ServerGen = gen
+	}
+	slog.Info("replica synchronized", "replica", st.ID, "adds", adds, "updates", updates, "deletes", deletes,
+		"features", len(cache.Features), "serverGen", cache.ServerGen)
+	if err := r.save(st.Cache, &cache); err != nil {
+		return nil, err
+	}
+	return cache.Features, nil
+}
+
+// id returns the ObjectId of a record.
+func (r *replicaSync) id(record map[string]interface{}) (int64, bool) {
+	n, ok := record[r.idField].(float64)
+	return int64(n), ok
+}
+
+// save writes the cache via a temporary file, like State.save.
+func (r *replicaSync) save(path string, cache *replicaCache) error {
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// replicaFeature is a feature in a createReplica or synchronizeReplica
+// response.
+type replicaFeature struct {
+	Attributes map[string]interface{} `json:"attributes"`
+	Geometry   *Geometry              `json:"geometry"`
+}
+
+// record converts the feature like fetchBatch does, with point geometry
+// as X and Y.
+func (f replicaFeature) record(geometry bool) map[string]interface{} {
+	attrs := f.Attributes
+	if attrs == nil {
+		attrs = make(map[string]interface{})
+	}
+	if g := f.Geometry; geometry && g != nil && g.X != nil && g.Y != nil {
+		attrs[geometryFields[0]] = *g.X
+		attrs[geometryFields[1]] = *g.Y
+	}
+	return attrs
+}
+
+// replicaGens is the server generation a response brings a replica to:
+// per layer, or for the whole replica on services that sync it as one.
+type replicaGens struct {
+	LayerServerGens []struct {
+		ID        int   `json:"id"`
+		ServerGen int64 `json:"serverGen"`
+	} `json:"layerServerGens"`
+	ReplicaServerGen int64 `json:"replicaServerGen"`
+}
+
+func (g *replicaGens) serverGen(layerID int) int64 {
+	for _, gen := range g.LayerServerGens {
+		if gen.ID == layerID {
+			return gen.ServerGen
+		}
+	}
+	return g.ReplicaServerGen
+}
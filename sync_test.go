@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// A replica that can no longer be synchronized is unregistered before a
+// new one is created, and the replica operations are POSTs with the
+// token in the body.
+func TestReplicaFallbackUnregisters(t *testing.T) {
+	const token = "s3cr3t-t0ken"
+	var calls []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op := r.URL.Path[strings.LastIndexByte(r.URL.Path, '/')+1:]
+		r.ParseForm()
+		calls = append(calls, r.Method+" "+op)
+		if r.Form.Get("token") != token {
+			t.Errorf("%s %s without the token", r.Method, op)
+		}
+		if r.Method == http.MethodPost && r.URL.Query().Has("token") {
+			t.Errorf("%s sent the token in the URL", op)
+		}
+		switch op {
+		case "FeatureServer":
+			w.Write([]byte(`{"syncEnabled": true}`))
+		case "0":
+			w.Write([]byte(`{"objectIdField": "ObjectId"}`))
+		case "synchronizeReplica":
+			w.Write([]byte(`{"error": {"code": 400, "message": "Replica does not exist."}}`))
+		case "unRegisterReplica":
+			if id := r.PostForm.Get("replicaID"); id != "{old}" {
+				t.Errorf("unregistered replica %q, want {old}", id)
+			}
+			w.Write([]byte(`{"success": true}`))
+		case "createReplica":
+			w.Write([]byte(`{"replicaID": "{new}", "replicaServerGen": 7, "layers": [{"id": 0, "features": [{"attributes": {"ObjectId": 1}}]}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	client := &Client{HTTP: server.Client(), Tokens: staticToken(token)}
+	query := &Query{URL: server.URL + "/arcgis/rest/services/x/FeatureServer/0/query", Where: "1=1"}
+	r, err := newReplicaSync(client, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.cacheDir = t.TempDir()
+	prev := &ReplicaState{ID: "{old}", Cache: r.cacheDir + "/old.json"}
+	if err := r.save(prev.Cache, &replicaCache{ServerGen: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	records, st, err := r.features(context.Background(), prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ID != "{new}" || len(records) != 1 {
+		t.Errorf("got replica %s with %d records, want {new} with 1", st.ID, len(records))
+	}
+	want := []string{"GET FeatureServer", "GET 0", "POST synchronizeReplica", "POST unRegisterReplica", "POST createReplica"}
+	if !slices.Equal(calls, want) {
+		t.Errorf("requests %q, want %q", calls, want)
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A sink is a -tee destination. It receives every record the output does,
+// from the same pages, so one download feeds several destinations.
+type sink interface {
+	Write(record map[string]interface{}) error
+	Close() error
+}
+
+// aborter is a sink that can throw away what it was given, for a run that
+// did not finish: the Postgres table keeps its previous contents.
+type aborter interface {
+	Abort() error
+}
+
+// teeSink is an open -tee destination.
+type teeSink struct {
+	dest    string // as given
+	path    string // the file written; "" for a database
+	records int
+	err     error // the first write that failed; nothing more is sent
+	sink
+}
+
+// String names the destination in logs, without a database password.
+func (t *teeSink) String() string {
+	if u, err := url.Parse(t.dest); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return t.dest
+}
+
+// write passes a record on. After a failure the destination is given up,
+// and the output and the other destinations carry on.
+func (t *teeSink) write(record map[string]interface{}) {
+	if t.err != nil {
+		return
+	}
+	if err := t.Write(record); err != nil {
+		t.err = err
+		slog.Error("cannot write to -tee; no more records are sent there", "dest", t, "err", err)
+		return
+	}
+	t.records++
+}
+
+// closeTees finishes the -tee destinations and returns the files written.
+// A run that did not complete rolls a database load back; the files are
+// only renamed into place if commit is set, like the output.
+func closeTees(tees []*teeSink, complete, commit bool) []string {
+	var files []string
+	for _, t := range tees {
+		if a, ok := t.sink.(aborter); ok && (!complete || t.err != nil) {
+			if err := a.Abort(); err != nil {
+				slog.Error("cannot roll back -tee", "dest", t, "err", err)
+			} else {
+				slog.Warn("-tee load rolled back", "dest", t)
+			}
+			continue
+		}
+		if err := t.Close(); err != nil {
+			slog.Error("cannot write -tee", "dest", t, "err", err)
+			continue
+		}
+		if t.err != nil {
+			continue
+		}
+		if t.path == "" {
+			slog.Info("records loaded", "dest", t, "records", t.records)
+			continue
+		}
+		if !commit {
+			continue
+		}
+		if err := commitPartials([]string{t.path}); err != nil {
+			slog.Error("cannot write -tee", "dest", t, "err", err)
+			continue
+		}
+		slog.Info("data saved", "path", t.path, "records", t.records)
+		files = append(files, t.path)
+	}
+	return files
+}
+
+// checkTee validates the -tee destinations before the run.
+func checkTee(dests []string, resume bool) error {
+	for _, dest := range dests {
+		kind, err := teeKind(dest)
+		if err != nil {
+			return err
+		}
+		// A resumed run only writes the pages that are missing, which a
+		// file can be appended with but a Parquet file or a reloaded
+		// table cannot.
+		if resume && (kind == "parquet" || kind == "postgres") {
+			return fmt.Errorf("%s: a %s destination cannot be resumed; run again without -resume", dest, kind)
+		}
+	}
+	return nil
+}
+
+// teeKind tells the format of a destination from its URL scheme or file
+// extension.
+func teeKind(dest string) (string, error) {
+	if strings.HasPrefix(dest, "postgres://") || strings.HasPrefix(dest, "postgresql://") {
+		return "postgres", nil
+	}
+	switch strings.ToLower(filepath.Ext(dest)) {
+	case ".csv":
+		return "csv", nil
+	case ".tsv":
+		return "tsv", nil
+	case ".ndjson", ".jsonl":
+		return "ndjson", nil
+	case ".parquet":
+		return "parquet", nil
+	}
+	return "", fmt.Errorf("%q: want a .csv, .tsv, .ndjson, .jsonl or .parquet file, or a postgres:// URL", dest)
+}
+
+// openTee opens a -tee destination for records with the given headers,
+// written under columns (nil for the header names). Files in a resumed run
+// are appended to.
+func openTee(dest string, headers, columns []string, f *Formatter, dialect CSVDialect, resume bool) (*teeSink, error) {
+	if columns == nil {
+		columns = headers
+	}
+	kind, err := teeKind(dest)
+	if err != nil {
+		return nil, err
+	}
+	t := &teeSink{dest: dest}
+	if kind == "postgres" {
+		if t.sink, err = openPostgresSink(dest, headers, columns, f); err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+
+	t.path = dest
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return nil, err
+	}
+	switch kind {
+	case "csv", "tsv":
+		if kind == "tsv" {
+			dialect.Comma = '\t'
+		}
+		out := newCSVOutput(dest, headers, nil, f, dialect)
+		out.columns = columns
+		out.append = resume
+		// The header is written even if no record follows.
+		if _, err := out.writer(""); err != nil {
+			return nil, err
+		}
+		t.sink = out
+	case "ndjson":
+		file, err := openPartial(dest, resume)
+		if err != nil {
+			return nil, err
+		}
+		t.sink = &ndjsonOutput{file: file, w: bufio.NewWriter(file), headers: headers, columns: columns, formatter: f}
+	case "parquet":
+		if t.sink, err = createParquet(dest, headers, columns, f); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// ndjsonOutput writes one JSON object per line, for jq and log pipelines:
+// the keys in column order, the values as the CSV has them, and numbers,
+// booleans and nulls as JSON ones rather than strings.
+type ndjsonOutput struct {
+	file      *os.File // nil for stdout
+	w         *bufio.Writer
+	headers   []string
+	columns   []string
+	formatter *Formatter
+	line      []byte // reused for each record
+}
+
+func (o *ndjsonOutput) Write(record map[string]interface{}) error {
+	o.line = append(o.line[:0], '{')
+	for i, field := range o.headers {
+		if i > 0 {
+			o.line = append(o.line, ',')
+		}
+		key, err := json.Marshal(o.columns[i])
+		if err != nil {
+			return err
+		}
+		o.line = append(o.line, key...)
+		o.line = append(o.line, ':')
+		value, err := o.formatter.jsonValue(field, record[field])
+		if err != nil {
+			return err
+		}
+		o.line = append(o.line, value...)
+	}
+	o.line = append(o.line, '}', '\n')
+	_, err := o.w.Write(o.line)
+	return err
+}
+
+// jsonValue formats a value for NDJSON. The values of numeric fields, as
+// the service sends them or as -number-fields, -coerce and -raw-dates make
+// them, are numbers in the formatting of the CSV (-decimals); dates are
+// strings in the -date-format, like hashed and redacted fields, and
+// booleans and nulls keep their JSON types.
+func (f *Formatter) jsonValue(field string, value interface{}) ([]byte, error) {
+	if value == nil {
+		return []byte("null"), nil
+	}
+	_, coerced := f.Coerce[field]
+	plain := !coerced && !f.HashFields[field] && !f.RedactFields[field]
+	if b, ok := value.(bool); ok && plain {
+		return json.Marshal(b)
+	}
+	s := f.formatValue(field, value)
+	numeric := false
+	switch f.columnKind(field) {
+	case kindNumber, kindInt:
+		numeric = true
+	case kindText:
+		_, isNumber := value.(float64)
+		numeric = isNumber && plain && !dateFields[field]
+	}
+	if numeric && s != "" && s != f.NullToken && json.Valid([]byte(s)) {
+		return []byte(s), nil
+	}
+	return json.Marshal(s)
+}
+
+func (o *ndjsonOutput) Close() error {
+	err := o.w.Flush()
+	if o.file == nil {
+		return err
+	}
+	if cerr := o.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// newStreamOutput writes the records to w for -out -, as CSV with a header
+// line or as NDJSON. Closing it flushes w but leaves it open.
+func newStreamOutput(w io.Writer, format string, headers, columns []string, f *Formatter, dialect CSVDialect) (sink, error) {
+	if columns == nil {
+		columns = headers
+	}
+	if format == "ndjson" {
+		return &ndjsonOutput{w: bufio.NewWriter(w), headers: headers, columns: columns, formatter: f}, nil
+	}
+	s := &csvStream{w: newCSVWriter(w, dialect), headers: headers, formatter: f}
+	if dialect.BOM {
+		s.w.w.WriteString(utf8BOM)
+	}
+	if err := s.w.Write(columns, nil); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// csvStream is the CSV of -out -.
+type csvStream struct {
+	w         *csvWriter
+	headers   []string
+	formatter *Formatter
+}
+
+func (s *csvStream) Write(record map[string]interface{}) error {
+	return s.w.Write(s.formatter.formatRow(s.headers, record))
+}
+
+func (s *csvStream) Close() error { return s.w.Flush() }
+
+// Column kinds of the typed destinations, Parquet and Postgres.
+const (
+	kindText   = 's' // the text written to the CSV
+	kindNumber = 'n' // a float64
+	kindInt    = 'i' // an int64
+	kindTime   = 'd' // a time.Time
+)
+
+// columnKind decides how a typed destination stores a field: date fields
+// as timestamps, -number-fields and numeric -coerce rules as numbers, and
+// everything else, including hashed and redacted fields, as text.
+func (f *Formatter) columnKind(field string) byte {
+	if f.HashFields[field] || f.RedactFields[field] {
+		return kindText
+	}
+	if c, ok := f.Coerce[field]; ok {
+		switch c.Type {
+		case "int":
+			return kindInt
+		case "float":
+			return kindNumber
+		case "date":
+			return kindTime
+		}
+		return kindText
+	}
+	switch {
+	case f.RawDates["*"] || f.RawDates[field]:
+		return kindInt
+	case dateFields[field]:
+		return kindTime
+	case f.NumberFields[field]:
+		return kindNumber
+	}
+	return kindText
+}
+
+// typedValue converts a value for a column of the given kind. It reports
+// false for a null, or a value that does not convert.
+func (f *Formatter) typedValue(field string, kind byte, value interface{}) (interface{}, bool) {
+	if value == nil {
+		return nil, false
+	}
+	switch kind {
+	case kindNumber:
+		return f.parseNumber(value)
+	case kindInt:
+		n, ok := f.parseNumber(value)
+		return int64(n), ok
+	case kindTime:
+		switch v := value.(type) {
+		case float64:
+			return time.UnixMilli(int64(v)).UTC(), v != 0
+		case string:
+			for _, layout := range []string{time.RFC3339, time.DateTime, time.DateOnly} {
+				if t, err := time.Parse(layout, strings.TrimSpace(v)); err == nil {
+					return t.UTC(), true
+				}
+			}
+		}
+		return nil, false
+	}
+	return f.formatValue(field, value), true
+}
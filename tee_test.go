@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestNDJSONOutput(t *testing.T) {
+	f, err := newFormatter(&Options{DateFormat: "date-only", NumberFields: "Sale_Price", Decimals: 2, NullToken: `\N`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	o := &ndjsonOutput{
+		w:         bufio.NewWriter(&b),
+		headers:   []string{"ObjectId", "Zip", "Sale_Date", "Sale_Price", "Vacant", "Purchaser"},
+		columns:   []string{"id", "zip", "sold", "price", "vacant", "purchaser"},
+		formatter: f,
+	}
+	o.Write(map[string]interface{}{
+		"ObjectId": 234.0, "Zip": "40212", "Sale_Date": 1503633600000.0,
+		"Sale_Price": 41500.0, "Vacant": true, "Purchaser": nil,
+	})
+	o.Write(map[string]interface{}{"ObjectId": 235.0, "Sale_Price": "n/a"})
+	o.Close()
+	want := `{"id":234,"zip":"40212","sold":"2017-08-25","price":41500.00,"vacant":true,"purchaser":null}
+{"id":235,"zip":null,"sold":null,"price":"n/a","vacant":null,"purchaser":null}
+`
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// periodCount is the filings and sales of one month.
+type periodCount struct {
+	Filings int `json:"filings"`
+	Sales   int `json:"sales"`
+}
+
+// timeSeries counts the filings and sales per month as records are
+// written, for -timeseries. A filing is counted in the month of its
+// -date-field date and a sale in the month of its Sale_Date, in the -tz
+// zone.
+type timeSeries struct {
+	filed     string
+	formatter *Formatter
+	months    map[string]*periodCount // by "2006-01"
+}
+
+// newTimeSeries starts the counts, or carries on from those of the
+// checkpoint of a resumed run.
+func newTimeSeries(filed string, f *Formatter, resumed map[string]*periodCount) *timeSeries {
+	if resumed == nil {
+		resumed = make(map[string]*periodCount)
+	}
+	return &timeSeries{filed: filed, formatter: f, months: resumed}
+}
+
+func (t *timeSeries) observe(record map[string]interface{}) {
+	if t == nil || record == nil {
+		return
+	}
+	if month, ok := t.month(t.filed, record); ok {
+		t.count(month).Filings++
+	}
+	if month, ok := t.month(saleDateField, record); ok {
+		t.count(month).Sales++
+	}
+}
+
+// month returns the month of a date field, and false for a null or a
+// value that is not a date.
+func (t *timeSeries) month(field string, record map[string]interface{}) (string, bool) {
+	v, ok := t.formatter.typedValue(field, kindTime, record[field])
+	if !ok {
+		return "", false
+	}
+	return v.(time.Time).In(t.formatter.Location).Format("2006-01"), true
+}
+
+func (t *timeSeries) count(month string) *periodCount {
+	c := t.months[month]
+	if c == nil {
+		c = &periodCount{}
+		t.months[month] = c
+	}
+	return c
+}
+
+// write saves the counts as CSV: a row per month from the first to the
+// last with any, the months without filings or sales included so a chart
+// shows the gaps, followed by a row per year.
+func (t *timeSeries) write(path string, dialect CSVDialect) error {
+	var first, last time.Time
+	for month := range t.months {
+		m, _ := time.Parse("2006-01", month)
+		if first.IsZero() || m.Before(first) {
+			first = m
+		}
+		if m.After(last) {
+			last = m
+		}
+	}
+
+	rows := [][]string{{"level", "period", "filings", "sales"}}
+	years := make(map[int]*periodCount)
+	for m := first; !first.IsZero() && !m.After(last); m = m.AddDate(0, 1, 0) {
+		c := t.months[m.Format("2006-01")]
+		if c == nil {
+			c = &periodCount{}
+		}
+		rows = append(rows, []string{"month", m.Format("2006-01"), strconv.Itoa(c.Filings), strconv.Itoa(c.Sales)})
+		y := years[m.Year()]
+		if y == nil {
+			y = &periodCount{}
+			years[m.Year()] = y
+		}
+		y.Filings += c.Filings
+		y.Sales += c.Sales
+	}
+	for year := first.Year(); !first.IsZero() && year <= last.Year(); year++ {
+		rows = append(rows, []string{"year", strconv.Itoa(year), strconv.Itoa(years[year].Filings), strconv.Itoa(years[year].Sales)})
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	file, err := openPartial(path, false)
+	if err != nil {
+		return err
+	}
+	w := newCSVWriter(file, dialect)
+	for _, row := range rows {
+		w.Write(row, nil)
+	}
+	err = w.Flush()
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return commitPartials([]string{path})
+}
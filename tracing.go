@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tracer records spans and exports them to an OpenTelemetry collector with
+// OTLP over HTTP, using the JSON encoding so no protobuf or SDK dependency
+// is needed. Spans are buffered and sent in batches; shutdown sends the
+// rest.
+type tracer struct {
+	endpoint string // full URL of the collector's /v1/traces
+	service  string
+	headers  http.Header
+	client   *http.Client
+
+	mu      sync.Mutex
+	pending []*span
+	sending sync.WaitGroup
+}
+
+// spanBatch is how many finished spans are buffered before an export.
+const spanBatch = 256
+
+// newTracer configures tracing from -otlp-endpoint or the standard
+// OTEL_EXPORTER_OTLP_* environment variables. It returns nil, which
+// disables tracing, when no endpoint is set.
+//
+// The flag, given on the command line, wins over the environment. As the
+// OpenTelemetry spec has it, OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is the
+// traces URL as it stands and wins over OTEL_EXPORTER_OTLP_ENDPOINT, a
+// base URL that /v1/traces is appended to; -otlp-endpoint is a base URL
+// too.
+func newTracer(opts *Options) *tracer {
+	var endpoint string
+	switch traces := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); {
+	case opts.OTLPEndpoint != "":
+		endpoint = strings.TrimRight(opts.OTLPEndpoint, "/") + "/v1/traces"
+	case traces != "":
+		endpoint = traces
+	case os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "":
+		endpoint = strings.TrimRight(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "/") + "/v1/traces"
+	default:
+		return nil
+	}
+
+	headers := make(http.Header)
+	for _, pair := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if name, value, ok := strings.Cut(pair, "="); ok {
+			headers.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+	}
+
+	return &tracer{
+		endpoint: endpoint,
+		service:  firstNonEmpty(os.Getenv("OTEL_SERVICE_NAME"), "louisville-foreclosures-fetch"),
+		headers:  headers,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// span is one timed operation. Methods on a nil *span do nothing, so code
+// can be instrumented unconditionally.
+type span struct {
+	tracer  *tracer
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	name    string
+	kind    int // OTLP SpanKind: 1 internal, 3 client
+	start   time.Time
+	end     time.Time
+
+	mu    sync.Mutex
+	attrs []otlpAttribute
+	err   error
+}
+
+type tracerKey struct{}
+type spanKey struct{}
+
+// withTracer returns a context whose spans are recorded by t.
+func withTracer(ctx context.Context, t *tracer) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, tracerKey{}, t)
+}
+
+// startSpan starts a span as a child of the span in ctx, if any. Without
+// a tracer in ctx it returns ctx unchanged and a nil span.
+func startSpan(ctx context.Context, name string, attrs ...any) (context.Context, *span) {
+	t, _ := ctx.Value(tracerKey{}).(*tracer)
+	if t == nil {
+		return ctx, nil
+	}
+
+	s := &span{tracer: t, name: name, kind: 1, start: time.Now()}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		s.traceID = parent.traceID
+		s.parent = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	s.set(attrs...)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// spanFromContext returns the current span, or nil.
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// set adds attributes given as alternating keys and values.
+func (s *span) set(kv ...any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i+1 < len(kv); i += 2 {
+		key, _ := kv[i].(string)
+		s.attrs = append(s.attrs, otlpAttribute{Key: key, Value: otlpValue(kv[i+1])})
+	}
+}
+
+// fail marks the span as failed with err; a nil err is ignored.
+func (s *span) fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+// finish ends the span and queues it for export.
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.tracer.add(s)
+}
+
+// traceparent returns the W3C trace context header value for the span.
+func (s *span) traceparent() string {
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-01"
+}
+
+func (t *tracer) add(s *span) {
+	t.mu.Lock()
+	t.pending = append(t.pending, s)
+	var batch []*span
+	if len(t.pending) >= spanBatch {
+		batch, t.pending = t.pending, nil
+	}
+	t.mu.Unlock()
+
+	if batch != nil {
+		t.sending.Add(1)
+		go func() {
+			defer t.sending.Done()
+			t.export(batch)
+		}()
+	}
+}
+
+// shutdown exports the remaining spans and waits for batches in flight.
+// The tracer stays usable, so -watch calls it after every run.
+func (t *tracer) shutdown() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	batch := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+
+	if len(batch) > 0 {
+		t.export(batch)
+	}
+	t.sending.Wait()
+}
+
+// export sends spans to the collector. Tracing problems are logged and
+// never fail the run.
+func (t *tracer) export(spans []*span) {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		out = append(out, s.otlp())
+	}
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			{Key: "service.name", Value: otlpValue(t.service)},
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "fetchData"},
+			Spans: out,
+		}},
+	}}})
+	if err != nil {
+		slog.Warn("could not encode trace spans", "err", err)
+		return
+	}
+
+	req, err := http.NewRequest("POST", t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		slog.Warn("could not export trace spans", "err", err)
+		return
+	}
+	req.Header = t.headers.Clone()
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		slog.Warn("could not export trace spans", "endpoint", t.endpoint, "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		slog.Warn("could not export trace spans", "endpoint", t.endpoint, "status", resp.StatusCode)
+	}
+}
+
+// The types below are the subset of the OTLP/JSON trace encoding used here.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 0 unset, 1 ok, 2 error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+// otlpValue wraps a Go value in the OTLP AnyValue encoding. 64-bit
+// integers are sent as strings, as the JSON mapping requires.
+func otlpValue(v any) map[string]any {
+	switch v := v.(type) {
+	case string:
+		return map[string]any{"stringValue": v}
+	case bool:
+		return map[string]any{"boolValue": v}
+	case int:
+		return map[string]any{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]any{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]any{"doubleValue": v}
+	case time.Duration:
+		return map[string]any{"doubleValue": v.Seconds()}
+	default:
+		return map[string]any{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+func (s *span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := otlpSpan{
+		TraceID:    hex.EncodeToString(s.traceID[:]),
+		SpanID:     hex.EncodeToString(s.spanID[:]),
+		Name:       s.name,
+		Kind:       s.kind,
+		Start:      strconv.FormatInt(s.start.UnixNano(), 10),
+		End:        strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes: s.attrs,
+		Status:     otlpStatus{Code: 1},
+	}
+	if s.parent != ([8]byte{}) {
+		out.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	if s.err != nil {
+		out.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+	}
+	return out
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestTracerEndpoint(t *testing.T) {
+	tests := []struct {
+		name         string
+		flag         string
+		traces, base string
+		want         string
+	}{
+		{name: "none"},
+		{name: "base", base: "http://collector:4318/", want: "http://collector:4318/v1/traces"},
+		{name: "traces", traces: "http://collector:4318/custom/traces", want: "http://collector:4318/custom/traces"},
+		{name: "traces over base", traces: "http://a:4318/traces", base: "http://b:4318", want: "http://a:4318/traces"},
+		{name: "flag over environment", flag: "http://c:4318", traces: "http://a:4318/traces", base: "http://b:4318", want: "http://c:4318/v1/traces"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", tt.traces)
+			t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", tt.base)
+			got := ""
+			if tr := newTracer(&Options{OTLPEndpoint: tt.flag}); tr != nil {
+				got = tr.endpoint
+			}
+			if got != tt.want {
+				t.Errorf("endpoint %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
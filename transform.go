@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// A Transformer changes each record after the enrichments and before it
+// is written, for cleanups the formatting flags do not cover. It returns
+// the record to write, which may be the one it was given, or nil to leave
+// the record out. A record it returns an error for is quarantined. Only
+// the output columns of the records are written.
+type Transformer interface {
+	Transform(record map[string]interface{}) (map[string]interface{}, error)
+}
+
+// TransformFunc adapts a function to the Transformer interface.
+type TransformFunc func(record map[string]interface{}) (map[string]interface{}, error)
+
+func (f TransformFunc) Transform(record map[string]interface{}) (map[string]interface{}, error) {
+	return f(record)
+}
+
+// transformers builds the -transform steps by name from the text after
+// the colon, e.g. "upper:Street_Name,Purchaser". Custom transforms are
+// added with registerTransformer from an init function in a file of their
+// own.
+var transformers = map[string]func(arg string) (Transformer, error){
+	"trim":      newTrimTransform,
+	"upper":     func(arg string) (Transformer, error) { return newCaseTransform(arg, strings.ToUpper) },
+	"lower":     func(arg string) (Transformer, error) { return newCaseTransform(arg, strings.ToLower) },
+	"default":   newDefaultTransform,
+	"drop-null": newDropNullTransform,
+}
+
+// registerTransformer makes a transform available to -transform.
+func registerTransformer(name string, build func(arg string) (Transformer, error)) {
+	if _, ok := transformers[name]; ok {
+		panic("transformer " + name + " registered twice")
+	}
+	transformers[name] = build
+}
+
+// namedTransformer is a -transform step, named for logs and quarantine
+// reasons.
+type namedTransformer struct {
+	name string
+	Transformer
+}
+
+// parseTransforms builds the -transform steps, in the order given.
+func parseTransforms(specs []string) ([]namedTransformer, error) {
+	var steps []namedTransformer
+	for _, spec := range specs {
+		name, arg, _ := strings.Cut(spec, ":")
+		name = strings.TrimSpace(name)
+		build, ok := transformers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown transform %q (have %s)", name, strings.Join(slices.Sorted(maps.Keys(transformers)), ", "))
+		}
+		t, err := build(strings.TrimSpace(arg))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		steps = append(steps, namedTransformer{name: name, Transformer: t})
+	}
+	return steps, nil
+}
+
+// transformRecord runs a record through the steps. A nil record means a
+// step left it out.
+func transformRecord(steps []namedTransformer, record map[string]interface{}) (map[string]interface{}, error) {
+	for _, step := range steps {
+		var err error
+		if record, err = step.Transform(record); err != nil {
+			return nil, fmt.Errorf("transform %s: %w", step.name, err)
+		}
+		if record == nil {
+			return nil, nil
+		}
+	}
+	return record, nil
+}
+
+// newTrimTransform trims the spaces around the text values of the listed
+// fields, or of every field without a list.
+func newTrimTransform(arg string) (Transformer, error) {
+	fields := splitList(arg)
+	return TransformFunc(func(record map[string]interface{}) (map[string]interface{}, error) {
+		for field, value := range record {
+			if s, ok := value.(string); ok && (len(fields) == 0 || slices.Contains(fields, field)) {
+				record[field] = strings.TrimSpace(s)
+			}
+		}
+		return record, nil
+	}), nil
+}
+
+// newCaseTransform changes the case of the text values of the listed
+// fields.
+func newCaseTransform(arg string, change func(string) string) (Transformer, error) {
+	fields := splitList(arg)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("want the fields to change, e.g. Street_Name,Purchaser")
+	}
+	return TransformFunc(func(record map[string]interface{}) (map[string]interface{}, error) {
+		for _, field := range fields {
+			if s, ok := record[field].(string); ok {
+				record[field] = change(s)
+			}
+		}
+		return record, nil
+	}), nil
+}
+
+// newDefaultTransform fills null or empty values of a field, given as
+// field=value.
+func newDefaultTransform(arg string) (Transformer, error) {
+	field, value, ok := strings.Cut(arg, "=")
+	field = strings.TrimSpace(field)
+	if !ok || field == "" {
+		return nil, fmt.Errorf("want field=value")
+	}
+	return TransformFunc(func(record map[string]interface{}) (map[string]interface{}, error) {
+		if v := record[field]; v == nil || v == "" {
+			record[field] = value
+		}
+		return record, nil
+	}), nil
+}
+
+// newDropNullTransform leaves out the records with a null or empty value
+// in any of the listed fields.
+func newDropNullTransform(arg string) (Transformer, error) {
+	fields := splitList(arg)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("want the fields that must have a value")
+	}
+	return TransformFunc(func(record map[string]interface{}) (map[string]interface{}, error) {
+		for _, field := range fields {
+			if v := record[field]; v == nil || v == "" {
+				return nil, nil
+			}
+		}
+		return record, nil
+	}), nil
+}
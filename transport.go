@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// projectURL is where the publishers of the data can find out about the
+// program and its maintainers; it is part of the default User-Agent.
+const projectURL = "https://github.com/sduane20/CY_project"
+
+// newTransport builds the HTTP transport from the connection flags. Like
+// http.DefaultTransport it honors HTTP_PROXY, HTTPS_PROXY and NO_PROXY;
+// -proxy overrides them with an explicit proxy for every request. Every
+// request identifies the program with -user-agent.
+func newTransport(opts *Options) (http.RoundTripper, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+
+	// Keep one warm connection per worker (plus headroom for token and
+	// metadata requests) instead of the default two per host, so pages
+	// don't pay for a new TLS handshake.
+	maxWorkers := max(opts.Workers, 1)
+	if opts.Adaptive {
+		maxWorkers = max(maxWorkers, opts.MaxWorkers)
+	}
+	transport.MaxIdleConns = 4 * maxWorkers
+	transport.MaxIdleConnsPerHost = 2 * maxWorkers
+	transport.IdleConnTimeout = 90 * time.Second
+
+	// The transport sends "Accept-Encoding: gzip" and decompresses
+	// responses transparently as long as requests don't set that header
+	// themselves. JSON pages typically shrink by 80-90%.
+	transport.DisableCompression = false
+
+	// HTTP/2 is negotiated via ALPN when the server supports it. Setting
+	// TLSClientConfig below would otherwise turn it off.
+	transport.ForceAttemptHTTP2 = true
+
+	if opts.Proxy != "" {
+		proxyURL, err := url.Parse(opts.Proxy)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid -proxy %q: want a URL such as http://proxy.example.com:8080", opts.Proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig, err := newTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	agent := opts.UserAgent
+	if agent == "" {
+		agent = defaultUserAgent()
+	}
+	return &userAgentTransport{base: transport, agent: agent}, nil
+}
+
+// userAgentTransport sets the User-Agent of requests that have none, so a
+// -header "User-Agent: ..." still takes precedence.
+type userAgentTransport struct {
+	base  http.RoundTripper
+	agent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") != "" {
+		return t.base.RoundTrip(req)
+	}
+	// RoundTrippers must not modify the caller's request.
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.agent)
+	return t.base.RoundTrip(req)
+}
+
+// defaultUserAgent names the program, its version and projectURL, as in
+// "CY_project/v1.2.0 (+https://github.com/sduane20/CY_project)". The
+// version is the one the go command stamped into the binary, which for a
+// build from a checkout is a pseudo-version with the commit, or else the
+// commit itself.
+func defaultUserAgent() string {
+	version := "dev"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		var revision, modified string
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				revision = setting.Value
+			case "vcs.modified":
+				modified = setting.Value
+			}
+		}
+		switch {
+		case info.Main.Version != "" && info.Main.Version != "(devel)":
+			version = info.Main.Version
+		case revision != "":
+			version = revision[:min(len(revision), 12)]
+			if modified == "true" {
+				version += "-dirty"
+			}
+		}
+	}
+	return "CY_project/" + version + " (+" + projectURL + ")"
+}
+
+// newTLSConfig returns the TLS settings for -ca-file, -insecure and the
+// client certificate flags, or nil when the system defaults apply.
+func newTLSConfig(opts *Options) (*tls.Config, error) {
+	if opts.CAFile == "" && !opts.Insecure && opts.ClientCert == "" && opts.ClientKey == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+
+	if opts.ClientCert != "" || opts.ClientKey != "" {
+		if opts.ClientCert == "" || opts.ClientKey == "" {
+			return nil, fmt.Errorf("-client-cert and -client-key must be used together")
+		}
+		cert, err := tls.LoadX509KeyPair(opts.ClientCert, opts.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading -ca-file: %w", err)
+		}
+		// Trust the internal CA in addition to the system roots, so public
+		// endpoints keep working when the proxy does not intercept them.
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("-ca-file %s contains no PEM certificates", opts.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if opts.Insecure {
+		// For lab environments only: accept any certificate.
+		slog.Warn("TLS certificate verification is disabled (-insecure)")
+		config.InsecureSkipVerify = true
+	}
+
+	return config, nil
+}
+
+// headerTransport adds fixed headers to every outgoing request, including
+// token requests, for services behind API gateways.
+type headerTransport struct {
+	base    http.RoundTripper
+	headers http.Header
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the caller's request.
+	req = req.Clone(req.Context())
+	for key, values := range t.headers {
+		req.Header[key] = append([]string(nil), values...)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// parseHeaders parses repeated -header "Name: value" flags.
+func parseHeaders(specs []string) (http.Header, error) {
+	headers := make(http.Header)
+	for _, spec := range specs {
+		name, value, ok := strings.Cut(spec, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("header %q must be \"Name: value\"", spec)
+		}
+		headers.Add(name, strings.TrimSpace(value))
+	}
+	return headers, nil
+}
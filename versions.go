@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// versionLayout is the timestamp -versioned adds to the output name, e.g.
+// data/Louisville_Metro_KY_-_Property_Foreclosures_2025-06-01T06.csv. An
+// hour is as fine as a scheduled extract needs; a second run in the same
+// hour replaces the first.
+const versionLayout = "2006-01-02T15"
+
+// versionedPath returns the output path for a run started at t.
+func versionedPath(path string, t time.Time) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "_" + t.Format(versionLayout) + ext
+}
+
+// updateLatest points the unversioned names at this run's outputs, so the
+// plain output path always holds the latest extract: versioned is the
+// path the run wrote, and each output, one per partition, gets the
+// matching name under path.
+func updateLatest(path, versioned string, outputs []string) error {
+	ext := filepath.Ext(path)
+	base, versionedBase := strings.TrimSuffix(path, ext), strings.TrimSuffix(versioned, ext)
+	var errs []error
+	for _, out := range outputs {
+		rest, ok := strings.CutPrefix(out, versionedBase)
+		if !ok {
+			continue
+		}
+		if err := linkLatest(out, base+rest); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// linkLatest replaces link with a relative symlink to target, or with a
+// copy of it where symlinks are not permitted (Windows without developer
+// mode). Either way the swap is a rename, so readers never see the name
+// missing.
+func linkLatest(target, link string) error {
+	tmp := link + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(filepath.Base(target), tmp); err == nil {
+		return os.Rename(tmp, link)
+	}
+
+	src, err := os.Open(target)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, link)
+}
+
+// pruneVersions removes the versions of path whose timestamp, read in
+// loc, is older than the retention window, together with their sidecars
+// and encrypted copies, which share the versioned name as a prefix. The
+// unversioned names that pointed at them are removed too rather than left
+// dangling. It returns the removed files.
+func pruneVersions(path string, retention time.Duration, now time.Time, loc *time.Location) ([]string, error) {
+	dir := filepath.Dir(path)
+	prefix := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)) + "_"
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := now.Add(-retention)
+	var removed []string
+	var errs []error
+	for _, entry := range entries {
+		rest, ok := strings.CutPrefix(entry.Name(), prefix)
+		if !ok || len(rest) < len(versionLayout) || entry.Type()&os.ModeSymlink != 0 {
+			continue
+		}
+		t, err := time.ParseInLocation(versionLayout, rest[:len(versionLayout)], loc)
+		if err != nil || !t.Before(cutoff) {
+			continue
+		}
+		name := filepath.Join(dir, entry.Name())
+		if err := os.Remove(name); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed = append(removed, name)
+	}
+
+	// Only symlinks are checked: a copy made in place of one has no
+	// target to lose.
+	for _, entry := range entries {
+		if entry.Type()&os.ModeSymlink == 0 || !strings.HasPrefix(entry.Name(), prefix[:len(prefix)-1]) {
+			continue
+		}
+		name := filepath.Join(dir, entry.Name())
+		if _, err := os.Stat(name); errors.Is(err, os.ErrNotExist) {
+			if err := os.Remove(name); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			removed = append(removed, name)
+		}
+	}
+	return removed, errors.Join(errs...)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// watch keeps the process running and fetches every -watch interval, or
+// at each time matched by -schedule, until SIGINT or SIGTERM. It returns
+// the exit code of the last run. A signal during a run stops it as usual
+// and then ends the watch; one between runs ends it at once. When a run
+// stops short and leaves a checkpoint, the next one resumes from it
+// instead of starting over.
+func (j *fetchJob) watch() int {
+	// Registered for the whole watch, alongside the channel each run
+	// registers for its pages, so a signal at any point ends the watch.
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(quit)
+
+	// -watch fetches straight away; -schedule waits for its first time.
+	next := time.Now()
+	if j.schedule != nil {
+		next = j.schedule.next(next)
+		slog.Info("waiting for the first scheduled run", "schedule", j.schedule.String(), "next", next.Format(time.RFC3339))
+	}
+
+	resume := j.opts.Resume
+	code := exitOK
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-quit:
+			timer.Stop()
+			slog.Info("watch stopped")
+			return code
+		case <-timer.C:
+		}
+
+		started := time.Now()
+		var status string
+		status, code = j.run(resume)
+		resume = status == statusPartial || status == statusCancelled || status == statusFailed
+
+		// A run that overran its slot skips the times it missed.
+		if j.schedule != nil {
+			next = j.schedule.next(time.Now())
+		} else {
+			next = started.Add(j.opts.Watch)
+		}
+		if status != statusInterrupted {
+			slog.Info("waiting for the next run", "status", status, "next", next.Format(time.RFC3339))
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// webhookAttempts is how many times a webhook is tried before giving up.
+const webhookAttempts = 3
+
+// webhook POSTs the run report as JSON, so an orchestration system can
+// start its downstream jobs when fresh data is available. Network errors,
+// 429 and 5xx responses are retried.
+type webhook struct {
+	url    string
+	client *http.Client
+}
+
+// name identifies the webhook in logs by host only, since the URL may
+// carry a secret.
+func (h *webhook) name() string {
+	if u, err := url.Parse(h.url); err == nil && u.Host != "" {
+		return "webhook " + u.Host
+	}
+	return "webhook"
+}
+
+func (h *webhook) notify(ctx context.Context, report *RunReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	return postWithRetry(ctx, h.client, h.url, "application/json", body)
+}
+
+// postWithRetry POSTs body, retrying with a growing delay.
+func postWithRetry(ctx context.Context, client *http.Client, target, contentType string, body []byte) error {
+	var lastErr error
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-ctx.Done():
+				return lastErr
+			case <-time.After(time.Duration(attempt-1) * 2 * time.Second):
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", contentType)
+		resp, err := client.Do(req)
+		if err != nil {
+			// The *url.Error would repeat the URL, which may hold a secret.
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				err = urlErr.Err
+			}
+			lastErr = err
+			continue
+		}
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			return nil
+		}
+		lastErr = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(snippet))
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+			return lastErr
+		}
+	}
+	return lastErr
+}